@@ -0,0 +1,26 @@
+package localcommand
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Secret reports whether the terminal reads a secret such as a password,
+// that is, it reads whole lines without echoing them back.
+// Line editors like readline and zle turn off the echo as well at a prompt,
+// but they read input character by character.
+func (lcmd *LocalCommand) Secret() bool {
+	termios, ok := lcmd.termios()
+	return ok && termios.Lflag&syscall.ECHO == 0 && termios.Lflag&syscall.ICANON != 0
+}
+
+func (lcmd *LocalCommand) termios() (syscall.Termios, bool) {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		lcmd.pty.Fd(),
+		ioctlGetTermios,
+		uintptr(unsafe.Pointer(&termios)),
+	)
+	return termios, errno == 0
+}
@@ -0,0 +1,9 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package localcommand
+
+import (
+	"syscall"
+)
+
+const ioctlGetTermios = syscall.TIOCGETA
@@ -0,0 +1,7 @@
+package localcommand
+
+import (
+	"syscall"
+)
+
+const ioctlGetTermios = syscall.TCGETS
@@ -0,0 +1,80 @@
+package localcommand
+
+import (
+	"bytes"
+	"os/exec"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// output collects what a command writes to its terminal.
+type output struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (o *output) count(s string) int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return bytes.Count(o.buffer.Bytes(), []byte(s))
+}
+
+// waitFor fails the test when condition doesn't hold within a few seconds.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSecretAtShellPrompt(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+	lcmd, err := New("env", []string{"PS1=prompt> ", "INPUTRC=/dev/null", bash, "--norc", "--noprofile", "-i"}, WithCloseSignal(syscall.SIGKILL))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+	defer lcmd.Close()
+
+	var out output
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, err := lcmd.Read(buffer)
+			if err != nil {
+				return
+			}
+			out.mutex.Lock()
+			out.buffer.Write(buffer[:n])
+			out.mutex.Unlock()
+		}
+	}()
+
+	// readline turns off the echo at the prompt, but reads key by key
+	waitFor(t, "the prompt", func() bool { return out.count("prompt> ") == 1 })
+	waitFor(t, "readline to turn off the echo", func() bool {
+		termios, ok := lcmd.termios()
+		return ok && termios.Lflag&syscall.ECHO == 0
+	})
+	if lcmd.Secret() {
+		t.Fatalf("The shell prompt is taken for a secret")
+	}
+
+	// the prompt is split so that the echoed command doesn't contain it
+	lcmd.Write([]byte("read -s -p 'pass''word> ' password\r"))
+	waitFor(t, "the password prompt", func() bool { return out.count("password> ") == 1 })
+	waitFor(t, "the password to be read as a secret", lcmd.Secret)
+
+	lcmd.Write([]byte("secret\r"))
+	waitFor(t, "the next prompt", func() bool { return out.count("prompt> ") == 2 })
+	if lcmd.Secret() {
+		t.Fatalf("The shell prompt after a password is taken for a secret")
+	}
+}
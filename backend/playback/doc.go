@@ -0,0 +1,3 @@
+// Package playback provides an implementation of webtty.Slave
+// that replays an asciicast recording.
+package playback
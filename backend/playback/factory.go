@@ -0,0 +1,81 @@
+package playback
+
+import (
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/pkg/homedir"
+	"github.com/yudai/gotty/server"
+)
+
+type Options struct {
+	PlaybackDir     string `hcl:"playback_dir" flagName:"playback" flagSName:"" flagDescribe:"Replay asciicast files in this directory instead of running a command (select one with ?file=NAME)" default:""`
+	PlaybackMaxIdle int    `hcl:"playback_max_idle" flagName:"playback-max-idle" flagSName:"" flagDescribe:"Maximum seconds to wait between events in playback (0 to use the recording's limit)" default:"0"`
+}
+
+type Factory struct {
+	dir     string
+	options *Options
+}
+
+func NewFactory(options *Options) (*Factory, error) {
+	if options.PlaybackDir == "" {
+		return nil, errors.New("playback directory is not specified")
+	}
+
+	return &Factory{
+		dir:     homedir.Expand(options.PlaybackDir),
+		options: options,
+	}, nil
+}
+
+func (factory *Factory) Name() string {
+	return "playback"
+}
+
+// New replays the file given by the `file` parameter.
+// `speed` multiplies the recorded timing and `idle` limits waits in seconds.
+func (factory *Factory) New(params map[string][]string) (server.Slave, error) {
+	name := firstParam(params, "file")
+	if name == "" {
+		return nil, errors.New("recording file is not specified")
+	}
+	// never leave the playback directory
+	path := filepath.Join(factory.dir, filepath.Base(filepath.Clean("/"+name)))
+
+	opts := []Option{}
+	if factory.options.PlaybackMaxIdle > 0 {
+		opts = append(opts, WithMaxIdle(time.Duration(factory.options.PlaybackMaxIdle)*time.Second))
+	}
+	if speed := firstParam(params, "speed"); speed != "" {
+		value, err := strconv.ParseFloat(speed, 64)
+		if err != nil || value <= 0 {
+			return nil, errors.Errorf("invalid playback speed `%s`", speed)
+		}
+		opts = append(opts, WithSpeed(value))
+	}
+	if idle := firstParam(params, "idle"); idle != "" {
+		value, err := strconv.ParseFloat(idle, 64)
+		if err != nil || value < 0 {
+			return nil, errors.Errorf("invalid playback idle limit `%s`", idle)
+		}
+		opts = append(opts, WithMaxIdle(time.Duration(value*float64(time.Second))))
+	}
+
+	// a nil *Playback would make a non-nil Slave
+	pb, err := New(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return pb, nil
+}
+
+func firstParam(params map[string][]string, name string) string {
+	if len(params[name]) == 0 {
+		return ""
+	}
+	return params[name][0]
+}
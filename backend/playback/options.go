@@ -0,0 +1,22 @@
+package playback
+
+import (
+	"time"
+)
+
+type Option func(*Playback)
+
+// WithSpeed sets the multiplier applied to the recorded timing.
+func WithSpeed(speed float64) Option {
+	return func(pb *Playback) {
+		pb.speed = speed
+	}
+}
+
+// WithMaxIdle limits the wait between two events.
+// Zero or a negative value keeps the recorded timing.
+func WithMaxIdle(maxIdle time.Duration) Option {
+	return func(pb *Playback) {
+		pb.maxIdle = maxIdle
+	}
+}
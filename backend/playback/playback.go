@@ -0,0 +1,162 @@
+package playback
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/pkg/asciicast"
+)
+
+const (
+	DefaultSpeed = 1.0
+)
+
+// Playback replays the output events of an asciicast file with the recorded timing.
+// Input from the master is discarded.
+// Resize events are skipped, the size of the terminal is chosen by the master.
+type Playback struct {
+	path   string
+	file   *os.File
+	reader *asciicast.Reader
+
+	speed   float64
+	maxIdle time.Duration
+
+	pipeReader *io.PipeReader
+	pipeWriter *io.PipeWriter
+	closed     chan struct{}
+}
+
+func New(path string, options ...Option) (*Playback, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open recording `%s`", path)
+	}
+
+	reader, err := asciicast.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to read recording `%s`", path)
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	pb := &Playback{
+		path:   path,
+		file:   file,
+		reader: reader,
+
+		speed:   DefaultSpeed,
+		maxIdle: time.Duration(reader.Header.IdleTimeLimit * float64(time.Second)),
+
+		pipeReader: pipeReader,
+		pipeWriter: pipeWriter,
+		closed:     make(chan struct{}),
+	}
+
+	for _, option := range options {
+		option(pb)
+	}
+	if pb.speed <= 0 {
+		pb.speed = DefaultSpeed
+	}
+
+	go pb.play()
+
+	return pb, nil
+}
+
+func (pb *Playback) Read(p []byte) (n int, err error) {
+	return pb.pipeReader.Read(p)
+}
+
+// Write discards input, a recording cannot be controlled.
+func (pb *Playback) Write(p []byte) (n int, err error) {
+	return len(p), nil
+}
+
+func (pb *Playback) Close() error {
+	select {
+	case <-pb.closed:
+		return nil
+	default:
+	}
+	close(pb.closed)
+	pb.pipeReader.Close()
+	return pb.file.Close()
+}
+
+func (pb *Playback) WindowTitleVariables() map[string]interface{} {
+	return map[string]interface{}{
+		"command": pb.reader.Header.Command,
+		"title":   pb.reader.Header.Title,
+		"file":    pb.path,
+	}
+}
+
+// ResizeTerminal does nothing, the recording has its own size.
+func (pb *Playback) ResizeTerminal(width int, height int) error {
+	return nil
+}
+
+// play writes output events into the pipe until the end of the recording,
+// which makes Read() return io.EOF.
+func (pb *Playback) play() {
+	var err error
+	defer func() {
+		pb.pipeWriter.CloseWithError(err)
+	}()
+
+	var last float64
+	for {
+		var event asciicast.Event
+		event, err = pb.reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		if !pb.wait(event.Time - last) {
+			return
+		}
+		last = event.Time
+
+		// input, markers and resizes are not shown
+		if event.Type != asciicast.EventOutput {
+			continue
+		}
+		if _, err = pb.pipeWriter.Write([]byte(event.Data)); err != nil {
+			return
+		}
+	}
+}
+
+// wait sleeps for the given seconds of the recording, adjusted by the speed
+// and clamped to the maximum idle time. Returns false when closed while waiting.
+func (pb *Playback) wait(seconds float64) bool {
+	if seconds <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(pb.delay(seconds))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-pb.closed:
+		return false
+	}
+}
+
+// delay returns how long to wait for the given seconds of the recording.
+func (pb *Playback) delay(seconds float64) time.Duration {
+	delay := time.Duration(seconds * float64(time.Second))
+	if pb.maxIdle > 0 && delay > pb.maxIdle {
+		delay = pb.maxIdle
+	}
+	return time.Duration(float64(delay) / pb.speed)
+}
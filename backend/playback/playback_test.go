@@ -0,0 +1,132 @@
+package playback
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const recording = `{"version":2,"width":80,"height":24,"idle_time_limit":2}
+[0.5,"o","hello "]
+[1.0,"r","100x30"]
+[1.5,"i","x"]
+[1.5,"o","world"]
+`
+
+func writeRecording(t *testing.T, dir string, name string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(recording), 0600); err != nil {
+		t.Fatalf("Unexpected error from WriteFile(): %s", err)
+	}
+	return path
+}
+
+func TestPlaybackOutput(t *testing.T) {
+	path := writeRecording(t, t.TempDir(), "test.cast")
+	pb, err := New(path, WithSpeed(100))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+	defer pb.Close()
+
+	// only output events are replayed
+	output, err := ioutil.ReadAll(pb)
+	if err != nil {
+		t.Fatalf("Unexpected error from ReadAll(): %s", err)
+	}
+	if string(output) != "hello world" {
+		t.Fatalf("Unexpected output: %q", output)
+	}
+}
+
+func TestPlaybackDelay(t *testing.T) {
+	path := writeRecording(t, t.TempDir(), "test.cast")
+	for _, c := range []struct {
+		name     string
+		options  []Option
+		seconds  float64
+		expected time.Duration
+	}{
+		{"recorded timing", nil, 1, time.Second},
+		{"speed", []Option{WithSpeed(2)}, 1, 500 * time.Millisecond},
+		{"slow speed", []Option{WithSpeed(0.5)}, 1, 2 * time.Second},
+		{"idle limit of the recording", nil, 10, 2 * time.Second},
+		{"idle limit", []Option{WithMaxIdle(time.Second)}, 10, time.Second},
+		{"no idle limit", []Option{WithMaxIdle(0)}, 10, 10 * time.Second},
+		{"idle limit before speed", []Option{WithMaxIdle(time.Second), WithSpeed(4)}, 10, 250 * time.Millisecond},
+		{"invalid speed", []Option{WithSpeed(0)}, 1, time.Second},
+	} {
+		pb, err := New(path, c.options...)
+		if err != nil {
+			t.Fatalf("Unexpected error from New(): %s", err)
+		}
+		if delay := pb.delay(c.seconds); delay != c.expected {
+			t.Errorf("%s: unexpected delay: %s", c.name, delay)
+		}
+		pb.Close()
+	}
+}
+
+func TestFactoryStaysInDirectory(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "recordings")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("Unexpected error from Mkdir(): %s", err)
+	}
+	writeRecording(t, dir, "inside.cast")
+	writeRecording(t, root, "outside.cast")
+
+	factory, err := NewFactory(&Options{PlaybackDir: dir})
+	if err != nil {
+		t.Fatalf("Unexpected error from NewFactory(): %s", err)
+	}
+
+	for _, c := range []struct {
+		file string
+		ok   bool
+	}{
+		{"inside.cast", true},
+		{"/inside.cast", true},
+		{"../recordings/inside.cast", true},
+		{"../outside.cast", false},
+		{filepath.Join(root, "outside.cast"), false},
+		{"", false},
+	} {
+		slave, err := factory.New(map[string][]string{"file": {c.file}})
+		if (err == nil) != c.ok {
+			t.Errorf("Unexpected result of file `%s`: %v", c.file, err)
+		}
+		if slave != nil {
+			if path := slave.WindowTitleVariables()["file"]; path != filepath.Join(dir, "inside.cast") {
+				t.Errorf("Unexpected path of file `%s`: %s", c.file, path)
+			}
+			slave.Close()
+		}
+	}
+}
+
+func TestFactoryParameters(t *testing.T) {
+	dir := t.TempDir()
+	writeRecording(t, dir, "test.cast")
+	factory, err := NewFactory(&Options{PlaybackDir: dir, PlaybackMaxIdle: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error from NewFactory(): %s", err)
+	}
+
+	for _, speed := range []string{"0", "-1", "fast"} {
+		if _, err := factory.New(map[string][]string{"file": {"test.cast"}, "speed": {speed}}); err == nil {
+			t.Errorf("Invalid speed `%s` was accepted", speed)
+		}
+	}
+
+	slave, err := factory.New(map[string][]string{"file": {"test.cast"}, "speed": {"2"}})
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+	defer slave.Close()
+	if delay := slave.(*Playback).delay(10); delay != 500*time.Millisecond {
+		t.Fatalf("Unexpected delay: %s", delay)
+	}
+}
@@ -0,0 +1,352 @@
+// Package client attaches to a GoTTY server as a master of the webtty protocol,
+// the way the browser front end does.
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/webtty"
+)
+
+// features are the features of the protocol this package supports.
+// Compression is left out as the WebSocket connection doesn't negotiate it.
+var features = []string{webtty.FeatureBinary, webtty.FeatureNotice, webtty.FeatureSession}
+
+// DefaultPingInterval is the interval of pings, the same as the browser front end.
+const DefaultPingInterval = 30 * time.Second
+
+// Client is a connection to a terminal of a GoTTY server.
+// Read returns the output of the terminal and Write sends input to it.
+type Client struct {
+	conn   *websocket.Conn
+	binary bool
+
+	output       *io.PipeReader
+	outputWriter *io.PipeWriter
+	writeMutex   sync.Mutex
+
+	titleHandler  func(title string)
+	noticeHandler func(notice webtty.NoticeMessage)
+
+	stateMutex   sync.Mutex // guards title, session and capabilities
+	title        string
+	session      webtty.SessionMessage
+	capabilities webtty.CapabilitiesMessage
+
+	rtt  atomic.Int64 // in nanoseconds
+	done chan struct{}
+	once sync.Once
+}
+
+// Dial connects to the terminal served at rawurl, which is the URL opened
+// with a browser, such as http://localhost:8080/?arg=foo. The query of the URL
+// is sent as the arguments of the terminal like the browser does.
+func Dial(ctx context.Context, rawurl string, options ...Option) (*Client, error) {
+	opts := &dialOptions{pingInterval: DefaultPingInterval}
+	for _, option := range options {
+		if err := option(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	wsURL, arguments, credential, err := websocketURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if opts.arguments != nil {
+		arguments = *opts.arguments
+	}
+	if opts.credential != "" {
+		credential = opts.credential
+	}
+
+	header := http.Header{}
+	if credential != "" {
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credential)))
+	}
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		Subprotocols:     webtty.Protocols,
+		TLSClientConfig:  opts.tlsConfig,
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		if resp != nil {
+			return nil, errors.Wrapf(err, "failed to connect to %s (%s)", wsURL, resp.Status)
+		}
+		return nil, errors.Wrapf(err, "failed to connect to %s", wsURL)
+	}
+
+	init, _ := json.Marshal(struct {
+		Arguments    string   `json:"Arguments,omitempty"`
+		ResumeToken  string   `json:"ResumeToken,omitempty"`
+		Version      int      `json:"Version"`
+		Capabilities []string `json:"Capabilities"`
+	}{arguments, opts.resumeToken, webtty.ProtocolVersion, features})
+	err = conn.WriteMessage(websocket.TextMessage, init)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to send init message")
+	}
+
+	output, outputWriter := io.Pipe()
+	client := &Client{
+		conn:          conn,
+		binary:        conn.Subprotocol() == webtty.ProtocolBinary,
+		output:        output,
+		outputWriter:  outputWriter,
+		titleHandler:  opts.titleHandler,
+		noticeHandler: opts.noticeHandler,
+		done:          make(chan struct{}),
+	}
+	go client.readLoop()
+	if opts.pingInterval > 0 {
+		go client.pingLoop(opts.pingInterval)
+	}
+
+	return client, nil
+}
+
+// Read reads the output of the terminal.
+// It returns io.EOF once the server has closed the connection.
+func (c *Client) Read(p []byte) (int, error) {
+	return c.output.Read(p)
+}
+
+// Write sends p to the terminal as input.
+func (c *Client) Write(p []byte) (int, error) {
+	err := c.send(append([]byte{webtty.Input}, p...))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Resize tells the size of the local terminal to the server.
+func (c *Client) Resize(columns int, rows int) error {
+	payload, _ := json.Marshal(map[string]int{"columns": columns, "rows": rows})
+	return c.send(append([]byte{webtty.ResizeTerminal}, payload...))
+}
+
+// Title returns the last window title sent by the server.
+func (c *Client) Title() string {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.title
+}
+
+// Session returns the last session sent by the server, whose token
+// resumes the process after the connection drops when the server keeps it.
+func (c *Client) Session() webtty.SessionMessage {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.session
+}
+
+// Capabilities returns the protocol version and the features chosen by the server,
+// or zero values if the server predates protocol versions.
+func (c *Client) Capabilities() webtty.CapabilitiesMessage {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.capabilities
+}
+
+// RTT returns the last round trip time measured with a ping, 0 if unknown.
+func (c *Client) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+// Done is closed when the connection has been closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	c.writeMutex.Lock()
+	c.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second),
+	)
+	c.writeMutex.Unlock()
+
+	c.finish(io.EOF)
+	return nil
+}
+
+func (c *Client) send(message []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	messageType := websocket.TextMessage
+	if c.binary {
+		messageType = websocket.BinaryMessage
+	}
+	err := c.conn.WriteMessage(messageType, message)
+	if err != nil {
+		return errors.Wrapf(err, "failed to send message to server")
+	}
+	return nil
+}
+
+func (c *Client) readLoop() {
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			// the server closes the connection without a close message when the terminal exits
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				err = io.EOF
+			}
+			c.finish(err)
+			return
+		}
+
+		err = c.handleMessage(message)
+		if err != nil {
+			c.finish(err)
+			return
+		}
+	}
+}
+
+func (c *Client) handleMessage(message []byte) error {
+	if len(message) == 0 {
+		return errors.New("unexpected zero length message from server")
+	}
+	payload := message[1:]
+
+	switch message[0] {
+	case webtty.Output:
+		data := payload
+		if !c.binary {
+			decoded, err := base64.StdEncoding.DecodeString(string(payload))
+			if err != nil {
+				return errors.Wrapf(err, "received malformed output")
+			}
+			data = decoded
+		}
+		_, err := c.outputWriter.Write(data)
+		if err != nil {
+			// the reader has gone
+			return err
+		}
+
+	case webtty.SetWindowTitle:
+		c.stateMutex.Lock()
+		c.title = string(payload)
+		c.stateMutex.Unlock()
+		if c.titleHandler != nil {
+			c.titleHandler(string(payload))
+		}
+
+	case webtty.Pong:
+		var pong webtty.PongMessage
+		if json.Unmarshal(payload, &pong) == nil && pong.Timestamp > 0 {
+			c.rtt.Store(int64(time.Since(time.UnixMilli(pong.Timestamp))))
+		}
+
+	case webtty.Capabilities:
+		var capabilities webtty.CapabilitiesMessage
+		if json.Unmarshal(payload, &capabilities) == nil {
+			c.stateMutex.Lock()
+			c.capabilities = capabilities
+			c.stateMutex.Unlock()
+		}
+
+	case webtty.Session:
+		var session webtty.SessionMessage
+		if json.Unmarshal(payload, &session) == nil {
+			c.stateMutex.Lock()
+			c.session = session
+			c.stateMutex.Unlock()
+		}
+
+	case webtty.Notice:
+		var notice webtty.NoticeMessage
+		if json.Unmarshal(payload, &notice) == nil && c.noticeHandler != nil {
+			c.noticeHandler(notice)
+		}
+	}
+	// preferences, write control and other messages are for browsers,
+	// the server sends no messages of the features left out above
+
+	return nil
+}
+
+func (c *Client) pingLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ping, _ := json.Marshal(webtty.PingMessage{
+				Timestamp: time.Now().UnixMilli(),
+			})
+			if c.send(append([]byte{webtty.Ping}, ping...)) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) finish(err error) {
+	c.once.Do(func() {
+		c.outputWriter.CloseWithError(err)
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+// websocketURL returns the WebSocket endpoint of the terminal at rawurl,
+// the arguments given by its query and the credential given by its user information.
+func websocketURL(rawurl string) (wsURL string, arguments string, credential string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", "", "", errors.Wrapf(err, "failed to parse URL")
+	}
+
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", "", "", errors.Errorf("unsupported scheme `%s`, must be http or https", u.Scheme)
+	}
+
+	if u.User != nil {
+		credential = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			credential += ":" + password
+		}
+		u.User = nil
+	}
+	if u.RawQuery != "" {
+		arguments = "?" + u.RawQuery
+	}
+	u.RawQuery, u.Fragment = "", ""
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.Path += "ws"
+
+	return u.String(), arguments, credential, nil
+}
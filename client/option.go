@@ -0,0 +1,83 @@
+package client
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/yudai/gotty/webtty"
+)
+
+// Option is an option for Dial.
+type Option func(*dialOptions) error
+
+type dialOptions struct {
+	credential    string
+	resumeToken   string
+	arguments     *string
+	tlsConfig     *tls.Config
+	pingInterval  time.Duration
+	titleHandler  func(title string)
+	noticeHandler func(notice webtty.NoticeMessage)
+}
+
+// WithCredential sets the credential of the server in the form of user:pass,
+// which is used for Basic Authentication of the WebSocket request.
+// The user information of the URL is used by default.
+func WithCredential(credential string) Option {
+	return func(opts *dialOptions) error {
+		opts.credential = credential
+		return nil
+	}
+}
+
+// WithResumeToken resumes the process left by an earlier connection,
+// whose token is given by Client.Session. A new process is started
+// when the token is no longer valid.
+func WithResumeToken(token string) Option {
+	return func(opts *dialOptions) error {
+		opts.resumeToken = token
+		return nil
+	}
+}
+
+// WithArguments sets the arguments of the terminal, such as "?arg=foo&arg=bar",
+// instead of the query of the URL.
+func WithArguments(arguments string) Option {
+	return func(opts *dialOptions) error {
+		opts.arguments = &arguments
+		return nil
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used for https URLs.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(opts *dialOptions) error {
+		opts.tlsConfig = config
+		return nil
+	}
+}
+
+// WithPingInterval sets the interval of pings, 0 to disable them.
+func WithPingInterval(interval time.Duration) Option {
+	return func(opts *dialOptions) error {
+		opts.pingInterval = interval
+		return nil
+	}
+}
+
+// WithTitleHandler sets a function called with the window titles sent by the server.
+func WithTitleHandler(handler func(title string)) Option {
+	return func(opts *dialOptions) error {
+		opts.titleHandler = handler
+		return nil
+	}
+}
+
+// WithNoticeHandler sets a function called with the notices sent by the server,
+// such as the reason of a disconnection.
+func WithNoticeHandler(handler func(notice webtty.NoticeMessage)) Option {
+	return func(opts *dialOptions) error {
+		opts.noticeHandler = handler
+		return nil
+	}
+}
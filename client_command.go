@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/urfave/cli"
+	"golang.org/x/term"
+
+	"github.com/yudai/gotty/client"
+	"github.com/yudai/gotty/webtty"
+)
+
+func clientCommand() cli.Command {
+	return cli.Command{
+		Name:      "client",
+		Usage:     "Attach to a terminal served by GoTTY",
+		ArgsUsage: "<url>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "credential, c",
+				Usage:  "Credential for Basic Authentication (ex: user:pass)",
+				EnvVar: "GOTTY_CLIENT_CREDENTIAL",
+			},
+			cli.BoolFlag{
+				Name:  "insecure, k",
+				Usage: "Accept any TLS certificate of the server",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if len(c.Args()) != 1 {
+				cli.ShowCommandHelp(c, "client")
+				exit(fmt.Errorf("Error: No URL given."), 1)
+			}
+			err := runClient(c.Args()[0], c.String("credential"), c.Bool("insecure"))
+			if err != nil {
+				exit(err, 8)
+			}
+		},
+	}
+}
+
+// runClient attaches the standard input and output to the terminal at url.
+// When the standard input is a terminal, it's put in raw mode and its size follows the local one.
+func runClient(url string, credential string, insecure bool) error {
+	options := []client.Option{
+		client.WithNoticeHandler(func(notice webtty.NoticeMessage) {
+			fmt.Fprintf(os.Stderr, "\r\n%s\r\n", notice.Message)
+		}),
+	}
+	if credential != "" {
+		options = append(options, client.WithCredential(credential))
+	}
+	if insecure {
+		options = append(options, client.WithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	}
+
+	conn, err := client.Dial(context.Background(), url, options...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+
+		resize := func() {
+			if columns, rows, err := term.GetSize(fd); err == nil {
+				conn.Resize(columns, rows)
+			}
+		}
+		resize()
+
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		defer signal.Stop(winch)
+		go func() {
+			for {
+				select {
+				case <-winch:
+					resize()
+				case <-conn.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// input ending does not close the connection, the terminal may still have output
+	go io.Copy(conn, os.Stdin)
+
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
@@ -5,6 +5,7 @@ var helpTemplate = `NAME:
 
 USAGE:
    {{.Name}} [options] <command> [<arguments...>]
+   {{.Name}} client [options] <url>
 
 VERSION:
    {{.Version}}{{if or .Author .Email}}
@@ -66,6 +66,10 @@ export class Hterm {
         };
     };
 
+    letterbox(columns: number, rows: number): void {
+        // hterm has no way to shade a part of the screen
+    };
+
     onResize(callback: (colmuns: number, rows: number) => void) {
         this.io.onTerminalResize = (columns: number, rows: number) => {
             this.columns = columns;
@@ -4,7 +4,6 @@ import { Terminal, WebTTY, protocols } from "./webtty";
 import { ConnectionFactory } from "./websocket";
 
 // @TODO remove these
-declare var gotty_auth_token: string;
 declare var gotty_term: string;
 
 const elem = document.getElementById("terminal")
@@ -20,9 +19,61 @@ if (elem !== null) {
     const url = (httpsEnabled ? 'wss://' : 'ws://') + window.location.host + window.location.pathname + 'ws';
     const args = window.location.search;
     const factory = new ConnectionFactory(url, protocols);
-    const wt = new WebTTY(term, factory, args, gotty_auth_token);
+    const wt = new WebTTY(term, factory, args, window.location.pathname + 'auth_token.json');
     const closer = wt.open();
 
+    // drop files onto the terminal to upload them into its working directory
+    elem.addEventListener("dragover", (event: DragEvent) => {
+        event.preventDefault();
+    });
+    elem.addEventListener("drop", (event: DragEvent) => {
+        event.preventDefault();
+        if (event.dataTransfer == null) {
+            return;
+        }
+        const files = event.dataTransfer.files;
+        for (let i = 0; i < files.length; i++) {
+            wt.upload(files[i]);
+        }
+    });
+
+    // Ctrl+Shift+U picks files to upload
+    const picker = document.createElement("input");
+    picker.type = "file";
+    picker.multiple = true;
+    picker.addEventListener("change", () => {
+        const files = picker.files;
+        if (files != null) {
+            for (let i = 0; i < files.length; i++) {
+                wt.upload(files[i]);
+            }
+        }
+        picker.value = "";
+    });
+
+    // Ctrl+Shift+S downloads a file, Ctrl+Shift+X cancels running transfers
+    window.addEventListener("keydown", (event: KeyboardEvent) => {
+        if (!event.ctrlKey || !event.shiftKey) {
+            return;
+        }
+        if (event.code == "KeyS") {
+            event.preventDefault();
+            event.stopPropagation();
+            const name = window.prompt("File to download, relative to the working directory:");
+            if (name) {
+                wt.download(name);
+            }
+        } else if (event.code == "KeyU") {
+            event.preventDefault();
+            event.stopPropagation();
+            picker.click();
+        } else if (event.code == "KeyX") {
+            event.preventDefault();
+            event.stopPropagation();
+            wt.cancelTransfers();
+        }
+    }, true);
+
     // Show help bubble if session parameter is present
     const urlParams = new URLSearchParams(window.location.search);
     if (urlParams.has('session')) {
@@ -0,0 +1,256 @@
+import { Terminal } from "./webtty";
+
+// chunkSize must not exceed webtty.FileTransferChunkSize of the server
+const chunkSize = 32 * 1024;
+// number of upload chunks sent ahead of the progress reported by the server
+const uploadWindow = 4;
+
+export interface FileTransferEvent {
+    id: string;
+    action: string;
+    name?: string;
+    size?: number;
+    transferred?: number;
+    data?: string; // base64
+    error?: string;
+}
+
+interface Upload {
+    file: File;
+    sent: number;
+    acked: number;
+    reading: boolean;
+    ended: boolean;
+}
+
+interface Download {
+    name: string;
+    chunks: Uint8Array[];
+}
+
+// FileTransfers runs uploads and downloads over a connection,
+// sending requests with send and showing progress on term.
+export class FileTransfers {
+    term: Terminal;
+    send: (request: object) => void;
+    uploads: { [id: string]: Upload };
+    downloads: { [id: string]: Download };
+    lastID: number;
+    // a request of rz or trz waiting for a file, the files dropped while it receives another one,
+    // and whether it has got files, so that it can finish once the queue is empty
+    zmodemRequest: string | null;
+    zmodemQueue: File[];
+    zmodemSent: boolean;
+
+    constructor(term: Terminal, send: (request: object) => void) {
+        this.term = term;
+        this.send = send;
+        this.uploads = {};
+        this.downloads = {};
+        this.lastID = 0;
+        this.zmodemRequest = null;
+        this.zmodemQueue = [];
+        this.zmodemSent = false;
+    };
+
+    upload(file: File) {
+        if (this.zmodemRequest != null) {
+            const id = this.zmodemRequest;
+            this.zmodemRequest = null;
+            this.zmodemSent = true;
+            this.startUpload(id, file);
+            return;
+        }
+        for (const id of Object.keys(this.uploads)) {
+            if (isZmodem(id)) {
+                this.zmodemQueue.push(file);
+                return;
+            }
+        }
+        this.startUpload(this.nextID(), file);
+    };
+
+    startUpload(id: string, file: File) {
+        this.uploads[id] = { file: file, sent: 0, acked: 0, reading: false, ended: false };
+        this.send({ id: id, action: "upload_start", name: file.name, size: file.size });
+        this.term.showMessage("Uploading " + file.name, 2000);
+    };
+
+    download(name: string) {
+        const id = this.nextID();
+        this.downloads[id] = { name: name, chunks: [] };
+        this.send({ id: id, action: "download", name: name });
+        this.term.showMessage("Downloading " + name, 2000);
+    };
+
+    // cancelAll aborts the running transfers, the server confirms each of them
+    cancelAll() {
+        if (this.zmodemRequest != null) {
+            this.send({ id: this.zmodemRequest, action: "cancel" });
+        }
+        this.resetZmodem();
+        for (const id of Object.keys(this.uploads).concat(Object.keys(this.downloads))) {
+            this.send({ id: id, action: "cancel" });
+        }
+    };
+
+    // close forgets the transfers when the connection is gone
+    close() {
+        const running = Object.keys(this.uploads).length + Object.keys(this.downloads).length;
+        this.uploads = {};
+        this.downloads = {};
+        this.resetZmodem();
+        if (running > 0) {
+            console.log("File transfers interrupted: " + running);
+        }
+    };
+
+    handle(event: FileTransferEvent) {
+        const upload = this.uploads[event.id];
+        const download = this.downloads[event.id];
+        const name = event.name || (download ? download.name : "");
+
+        switch (event.action) {
+            case "upload_request":
+                this.requestUpload(event.id);
+                break;
+            case "download_start":
+                this.downloads[event.id] = { name: name, chunks: [] };
+                this.term.showMessage("Downloading " + name, 2000);
+                break;
+            case "progress":
+                if (upload) {
+                    upload.acked = event.transferred || 0;
+                    this.showProgress("Uploading", name, upload.acked, upload.file.size);
+                    this.pump(event.id, upload);
+                }
+                break;
+            case "data":
+                if (download) {
+                    download.chunks.push(base64ToBytes(event.data || ""));
+                    this.showProgress("Downloading", name, event.transferred || 0, event.size || 0);
+                }
+                break;
+            case "complete":
+                delete this.uploads[event.id];
+                delete this.downloads[event.id];
+                if (download) {
+                    saveFile(download.name, download.chunks);
+                }
+                this.term.showMessage((upload ? "Uploaded " : "Downloaded ") + name, 2000);
+                break;
+            case "canceled":
+                delete this.uploads[event.id];
+                delete this.downloads[event.id];
+                if (isZmodem(event.id)) {
+                    this.resetZmodem();
+                }
+                this.term.showMessage("Transfer of " + name + " canceled", 2000);
+                break;
+            case "error":
+                delete this.uploads[event.id];
+                delete this.downloads[event.id];
+                console.log("File transfer of " + name + " failed: " + event.error);
+                this.term.showMessage("Transfer of " + name + " failed: " + event.error, 5000);
+                break;
+        }
+    };
+
+    // requestUpload answers rz or trz waiting for a file with the next dropped file,
+    // or lets it finish once the dropped files have been sent
+    requestUpload(id: string) {
+        const file = this.zmodemQueue.shift();
+        if (file) {
+            this.startUpload(id, file);
+        } else if (this.zmodemSent) {
+            this.zmodemSent = false;
+            this.send({ id: id, action: "cancel" });
+        } else {
+            this.zmodemRequest = id;
+            this.term.showMessage("Waiting for files: drop files or press Ctrl+Shift+U, Ctrl+Shift+X to cancel", 10000);
+        }
+    };
+
+    resetZmodem() {
+        this.zmodemRequest = null;
+        this.zmodemQueue = [];
+        this.zmodemSent = false;
+    };
+
+    // pump sends the next chunks of an upload, a few ahead of the server
+    pump(id: string, upload: Upload) {
+        if (upload.reading || upload.ended || this.uploads[id] !== upload) {
+            return;
+        }
+        if (upload.sent >= upload.file.size) {
+            upload.ended = true;
+            this.send({ id: id, action: "upload_end" });
+            return;
+        }
+        if (upload.sent - upload.acked >= uploadWindow * chunkSize) {
+            return;
+        }
+
+        upload.reading = true;
+        const reader = new FileReader();
+        reader.onload = () => {
+            upload.reading = false;
+            if (this.uploads[id] !== upload) {
+                return;
+            }
+            const chunk = new Uint8Array(reader.result as ArrayBuffer);
+            upload.sent += chunk.length;
+            this.send({ id: id, action: "upload_chunk", data: bytesToBase64(chunk) });
+            this.pump(id, upload);
+        };
+        reader.onerror = () => {
+            upload.reading = false;
+            this.send({ id: id, action: "cancel" });
+        };
+        reader.readAsArrayBuffer(upload.file.slice(upload.sent, upload.sent + chunkSize));
+    };
+
+    showProgress(verb: string, name: string, transferred: number, size: number) {
+        const percent = size > 0 ? Math.floor(transferred * 100 / size) : 100;
+        this.term.showMessage(verb + " " + name + ": " + percent + "%", 2000);
+    };
+
+    nextID(): string {
+        this.lastID++;
+        return "" + this.lastID;
+    };
+};
+
+// isZmodem tells whether a transfer belongs to rz, sz, trz or tsz running in the terminal
+function isZmodem(id: string): boolean {
+    return id.indexOf("zmodem-") == 0;
+}
+
+// saveFile offers the downloaded chunks to the user as a file
+function saveFile(name: string, chunks: Uint8Array[]) {
+    const url = URL.createObjectURL(new Blob(chunks));
+    const link = document.createElement("a");
+    link.href = url;
+    link.download = name.slice(name.lastIndexOf("/") + 1);
+    document.body.appendChild(link);
+    link.click();
+    document.body.removeChild(link);
+    setTimeout(() => URL.revokeObjectURL(url), 1000);
+}
+
+function base64ToBytes(data: string): Uint8Array {
+    const binary = atob(data);
+    const bytes = new Uint8Array(binary.length);
+    for (let i = 0; i < binary.length; i++) {
+        bytes[i] = binary.charCodeAt(i);
+    }
+    return bytes;
+}
+
+function bytesToBase64(bytes: Uint8Array): string {
+    let binary = "";
+    for (let i = 0; i < bytes.length; i += 0x8000) {
+        binary += String.fromCharCode.apply(null, bytes.subarray(i, i + 0x8000));
+    }
+    return btoa(binary);
+}
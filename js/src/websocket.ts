@@ -18,6 +18,7 @@ export class Connection {
 
     constructor(url: string, protocols: string[]) {
         this.bare = new WebSocket(url, protocols);
+        this.bare.binaryType = "arraybuffer";
     }
 
     open() {
@@ -28,10 +29,18 @@ export class Connection {
         this.bare.close();
     };
 
+    protocol(): string {
+        return this.bare.protocol;
+    };
+
     send(data: string) {
         this.bare.send(data);
     };
 
+    sendBinary(data: Uint8Array) {
+        this.bare.send(data);
+    };
+
     isOpen(): boolean {
         if (this.bare.readyState == WebSocket.CONNECTING ||
             this.bare.readyState == WebSocket.OPEN) {
@@ -46,7 +55,7 @@ export class Connection {
         }
     };
 
-    onReceive(callback: (data: string) => void) {
+    onReceive(callback: (data: string | ArrayBuffer) => void) {
         this.bare.onmessage = (event) => {
             callback(event.data);
         }
@@ -1,9 +1,18 @@
-export const protocols = ["webtty"];
+import { FileTransfers } from "./transfer";
+
+export const protocolBinary = "webtty.binary";
+export const protocolText = "webtty";
+export const protocols = [protocolBinary, protocolText];
 
 export const msgInputUnknown = '0';
 export const msgInput = '1';
 export const msgPing = '2';
 export const msgResizeTerminal = '3';
+export const msgPauseOutput = '4';
+export const msgResumeOutput = '5';
+export const msgRequestWriteControl = '6';
+export const msgReleaseWriteControl = '7';
+export const msgRequestFileTransfer = '8';
 
 export const msgUnknownOutput = '0';
 export const msgOutput = '1';
@@ -11,7 +20,20 @@ export const msgPong = '2';
 export const msgSetWindowTitle = '3';
 export const msgSetPreferences = '4';
 export const msgSetReconnect = '5';
+export const msgResyncTerminal = '6';
+export const msgWriteControl = '7';
+export const msgNotice = '8';
+export const msgFileTransfer = '9';
+export const msgTerminalSize = 'A';
+export const msgSession = 'B';
+export const msgCapabilities = 'C';
+
 
+// the version of the protocol and the features this client supports
+export const protocolVersion = 1;
+export const features = [
+    "binary", "compression", "notice", "write_control", "terminal_size", "file_transfer", "zmodem", "session",
+];
 
 export interface Terminal {
     info(): { columns: number, rows: number };
@@ -20,6 +42,7 @@ export interface Terminal {
     removeMessage(): void;
     setWindowTitle(title: string): void;
     setPreferences(value: object): void;
+    letterbox(columns: number, rows: number): void;
     onInput(callback: (input: string) => void): void;
     onResize(callback: (colmuns: number, rows: number) => void): void;
     reset(): void;
@@ -30,10 +53,12 @@ export interface Terminal {
 export interface Connection {
     open(): void;
     close(): void;
+    protocol(): string;
     send(data: string): void;
+    sendBinary(data: Uint8Array): void;
     isOpen(): boolean;
     onOpen(callback: () => void): void;
-    onReceive(callback: (data: string) => void): void;
+    onReceive(callback: (data: string | ArrayBuffer) => void): void;
     onClose(callback: () => void): void;
 }
 
@@ -47,22 +72,65 @@ export class WebTTY {
     connectionFactory: ConnectionFactory;
     args: string;
     authToken: string;
+    // tokens are single-use, a new one is fetched from here for each connection
+    authTokenURL: string;
     reconnect: number;
+    writeControl: { writable: boolean, holder?: string, requests?: string[] } | null;
+    transfers: FileTransfers | null;
+    // resumes the process on the server after the connection drops
+    resumeToken: string;
 
-    constructor(term: Terminal, connectionFactory: ConnectionFactory, args: string, authToken: string) {
+    constructor(term: Terminal, connectionFactory: ConnectionFactory, args: string, authTokenURL: string = "") {
         this.term = term;
         this.connectionFactory = connectionFactory;
         this.args = args;
-        this.authToken = authToken;
+        this.authToken = "";
+        this.authTokenURL = authTokenURL;
         this.reconnect = -1;
+        this.writeControl = null;
+        this.transfers = null;
+        this.resumeToken = sessionStorage.getItem(this.resumeTokenKey()) || "";
+    };
+
+    // a reloaded page resumes its process too
+    resumeTokenKey(): string {
+        return "gotty-resume-token:" + window.location.pathname + this.args;
+    };
+
+    setResumeToken(token: string) {
+        this.resumeToken = token;
+        if (token) {
+            sessionStorage.setItem(this.resumeTokenKey(), token);
+        } else {
+            sessionStorage.removeItem(this.resumeTokenKey());
+        }
     };
 
     open() {
-        let connection = this.connectionFactory.create();
+        let connection: Connection = null;
+        let closed = false;
         let pingTimer: number;
         let reconnectTimeout: number;
+        let writeControlRequested = false;
+        let visibilityHandler: () => void;
+        // the last notice from the server, which explains why the connection is closed
+        let notice: { kind: string, message: string, reconnect: boolean } = null;
 
         const setup = () => {
+            // send a message using the framing negotiated with the server,
+            // the init message is always sent as text
+            const send = (data: string) => {
+                if (connection.protocol() == protocolBinary) {
+                    connection.sendBinary(binaryStringToBytes(unescape(encodeURIComponent(data))));
+                } else {
+                    connection.send(data);
+                }
+            };
+            const transfers = new FileTransfers(this.term, (request: object) => {
+                send(msgRequestFileTransfer + JSON.stringify(request));
+            });
+            this.transfers = transfers;
+
             connection.onOpen(() => {
                 const termInfo = this.term.info();
 
@@ -70,12 +138,15 @@ export class WebTTY {
                     {
                         Arguments: this.args,
                         AuthToken: this.authToken,
+                        ResumeToken: this.resumeToken,
+                        Version: protocolVersion,
+                        Capabilities: features,
                     }
                 ));
 
 
                 const resizeHandler = (colmuns: number, rows: number) => {
-                    connection.send(
+                    send(
                         msgResizeTerminal + JSON.stringify(
                             {
                                 columns: colmuns,
@@ -93,23 +164,58 @@ export class WebTTY {
 
                 this.term.onInput(
                     (input: string) => {
-                        connection.send(msgInput + input);
+                        const control = this.writeControl;
+                        if (control != null && !control.writable && control.holder) {
+                            // someone else is typing, ask for the turn instead
+                            if (!writeControlRequested) {
+                                writeControlRequested = true;
+                                send(msgRequestWriteControl);
+                                this.term.showMessage("Write control requested", 2000);
+                            }
+                            return;
+                        }
+                        send(msgInput + input);
                     }
                 );
 
-                pingTimer = setInterval(() => {
-                    connection.send(msgPing)
-                }, 30 * 1000);
+                // hand the keyboard over when leaving the tab while others are waiting
+                visibilityHandler = () => {
+                    const control = this.writeControl;
+                    if (document.hidden && control != null && control.writable &&
+                        control.requests && control.requests.length > 0) {
+                        send(msgReleaseWriteControl);
+                    }
+                };
+                document.addEventListener("visibilitychange", visibilityHandler);
+
+                // pings carry a timestamp echoed back by the server
+                const ping = () => {
+                    send(msgPing + JSON.stringify({ timestamp: Date.now() }));
+                };
+                ping();
+                pingTimer = setInterval(ping, 30 * 1000);
 
             });
 
-            connection.onReceive((data) => {
+            connection.onReceive((received) => {
+                let data: string;
+                let output: string;
+                if (typeof received === "string") {
+                    data = received;
+                    output = data[0] == msgOutput ? atob(data.slice(1)) : "";
+                } else {
+                    const binary = bytesToBinaryString(new Uint8Array(received));
+                    output = binary.slice(1);
+                    data = binary[0] == msgOutput ? binary : decodeURIComponent(escape(binary));
+                }
+
                 const payload = data.slice(1);
                 switch (data[0]) {
                     case msgOutput:
-                        this.term.output(atob(payload));
+                        this.term.output(output);
                         break;
                     case msgPong:
+                        // pings only keep the connection alive
                         break;
                     case msgSetWindowTitle:
                         this.term.setWindowTitle(payload);
@@ -123,29 +229,151 @@ export class WebTTY {
                         console.log("Enabling reconnect: " + autoReconnect + " seconds")
                         this.reconnect = autoReconnect;
                         break;
+                    case msgResyncTerminal:
+                        // the server discarded output for us, start over with a clean screen
+                        console.log("Output discarded by server: " + payload + " bytes")
+                        this.term.reset();
+                        break;
+                    case msgWriteControl:
+                        const control = JSON.parse(payload);
+                        if (control.writable && (this.writeControl == null || !this.writeControl.writable)) {
+                            this.term.showMessage("You have write control", 2000);
+                        } else if (!control.writable && this.writeControl != null && this.writeControl.writable) {
+                            this.term.showMessage("Write control passed to another viewer", 2000);
+                        }
+                        if (control.writable || !control.holder) {
+                            writeControlRequested = false;
+                        }
+                        this.writeControl = control;
+                        break;
+                    case msgNotice:
+                        notice = JSON.parse(payload);
+                        console.log("Notice from server (" + notice.kind + "): " + notice.message)
+                        this.term.showMessage(notice.message, 5000);
+                        break;
+                    case msgFileTransfer:
+                        transfers.handle(JSON.parse(payload));
+                        break;
+                    case msgCapabilities:
+                        const capabilities = JSON.parse(payload);
+                        console.log("Protocol version " + capabilities.version + ", features: " + capabilities.features.join(", "));
+                        break;
+                    case msgSession:
+                        const session = JSON.parse(payload);
+                        if (session.resumed) {
+                            console.log("Resumed the process left by the last connection");
+                        }
+                        this.setResumeToken(session.token || "");
+                        break;
+                    case msgTerminalSize:
+                        // the terminal is shared, shade what is outside of the size chosen by the server
+                        const size = JSON.parse(payload);
+                        this.term.letterbox(size.columns, size.rows);
+                        break;
                 }
             });
 
             connection.onClose(() => {
                 clearInterval(pingTimer);
+                document.removeEventListener("visibilitychange", visibilityHandler);
+                this.writeControl = null;
+                writeControlRequested = false;
+                transfers.close();
                 this.term.deactivate();
-                this.term.showMessage("Connection Closed", 0);
-                if (this.reconnect > 0) {
+                this.term.showMessage(notice != null ? notice.message : "Connection Closed", 0);
+                // the server keeps the process for a while when it has given a resume token
+                const delay = this.reconnect > 0 ? this.reconnect : (this.resumeToken ? 1 : 0);
+                if (delay > 0 && (notice == null || notice.reconnect)) {
                     reconnectTimeout = setTimeout(() => {
-                        connection = this.connectionFactory.create();
-                        this.term.reset();
-                        setup();
-                    }, this.reconnect * 1000);
+                        this.refreshAuthToken(() => {
+                            notice = null;
+                            this.term.reset();
+                            connect();
+                        });
+                    }, delay * 1000);
                 }
             });
 
             connection.open();
         }
 
-        setup();
+        // the token is fetched before the connection is created,
+        // which starts connecting right away
+        const connect = () => {
+            if (closed) {
+                return;
+            }
+            connection = this.connectionFactory.create();
+            setup();
+        };
+
+        this.refreshAuthToken(connect);
         return () => {
+            closed = true;
             clearTimeout(reconnectTimeout);
-            connection.close();
+            if (connection != null) {
+                connection.close();
+            }
+        }
+    };
+
+    // refreshAuthToken fetches a new token and calls done,
+    // keeping the current one when the server gives none
+    refreshAuthToken(done: () => void) {
+        if (!this.authTokenURL) {
+            done();
+            return;
+        }
+        const request = new XMLHttpRequest();
+        request.open("GET", this.authTokenURL);
+        request.onload = () => {
+            if (request.status == 200) {
+                this.authToken = JSON.parse(request.responseText).token;
+            }
+            done();
+        };
+        request.onerror = () => {
+            done();
+        };
+        request.send();
+    };
+
+    // upload sends a file into the working directory of the terminal
+    upload(file: File) {
+        if (this.transfers != null) {
+            this.transfers.upload(file);
+        }
+    };
+
+    // download saves a file of the terminal, relative to its working directory
+    download(name: string) {
+        if (this.transfers != null) {
+            this.transfers.download(name);
+        }
+    };
+
+    cancelTransfers() {
+        if (this.transfers != null) {
+            this.transfers.cancelAll();
         }
     };
 };
+
+// bytesToBinaryString converts bytes into a string that has one character per byte.
+function bytesToBinaryString(bytes: Uint8Array): string {
+    let result = "";
+    const chunkSize = 0x8000;
+    for (let i = 0; i < bytes.length; i += chunkSize) {
+        result += String.fromCharCode.apply(null, bytes.subarray(i, i + chunkSize));
+    }
+    return result;
+}
+
+// binaryStringToBytes converts a string that has one character per byte into bytes.
+function binaryStringToBytes(binary: string): Uint8Array {
+    const bytes = new Uint8Array(binary.length);
+    for (let i = 0; i < binary.length; i++) {
+        bytes[i] = binary.charCodeAt(i);
+    }
+    return bytes;
+}
@@ -14,6 +14,11 @@ export class Xterm {
     messageTimeout: number;
     messageTimer: number;
 
+    letterboxRight: HTMLElement;
+    letterboxBottom: HTMLElement;
+    letterboxColumns: number;
+    letterboxRows: number;
+
 
     constructor(elem: HTMLElement) {
         this.elem = elem;
@@ -23,9 +28,17 @@ export class Xterm {
         this.message.className = "xterm-overlay";
         this.messageTimeout = 2000;
 
+        this.letterboxRight = elem.ownerDocument.createElement("div");
+        this.letterboxRight.className = "xterm-letterbox";
+        this.letterboxBottom = elem.ownerDocument.createElement("div");
+        this.letterboxBottom.className = "xterm-letterbox";
+        this.letterboxColumns = 0;
+        this.letterboxRows = 0;
+
         this.resizeListener = () => {
             this.term.fit();
             this.term.scrollToBottom();
+            this.updateLetterbox();
             this.showMessage(String(this.term.cols) + "x" + String(this.term.rows), this.messageTimeout);
         };
 
@@ -89,6 +102,37 @@ export class Xterm {
     setPreferences(value: object) {
     };
 
+    letterbox(columns: number, rows: number): void {
+        this.letterboxColumns = columns;
+        this.letterboxRows = rows;
+        this.updateLetterbox();
+    };
+
+    updateLetterbox(): void {
+        const right = Math.max(this.term.cols - this.letterboxColumns, 0) / this.term.cols;
+        const bottom = Math.max(this.term.rows - this.letterboxRows, 0) / this.term.rows;
+
+        if (this.letterboxColumns > 0 && right > 0) {
+            this.letterboxRight.style.top = "0";
+            this.letterboxRight.style.right = "0";
+            this.letterboxRight.style.width = String(right * 100) + "%";
+            this.letterboxRight.style.height = "100%";
+            this.elem.appendChild(this.letterboxRight);
+        } else if (this.letterboxRight.parentNode) {
+            this.elem.removeChild(this.letterboxRight);
+        }
+
+        if (this.letterboxRows > 0 && bottom > 0) {
+            this.letterboxBottom.style.left = "0";
+            this.letterboxBottom.style.bottom = "0";
+            this.letterboxBottom.style.width = String((1 - right) * 100) + "%";
+            this.letterboxBottom.style.height = String(bottom * 100) + "%";
+            this.elem.appendChild(this.letterboxBottom);
+        } else if (this.letterboxBottom.parentNode) {
+            this.elem.removeChild(this.letterboxBottom);
+        }
+    };
+
     onInput(callback: (input: string) => void) {
         this.term.on("data", (data) => {
             callback(data);
@@ -12,6 +12,7 @@ import (
 	"github.com/urfave/cli"
 
 	"github.com/yudai/gotty/backend/localcommand"
+	"github.com/yudai/gotty/backend/playback"
 	"github.com/yudai/gotty/pkg/homedir"
 	"github.com/yudai/gotty/server"
 	"github.com/yudai/gotty/utils"
@@ -33,8 +34,12 @@ func main() {
 	if err := utils.ApplyDefaultValues(backendOptions); err != nil {
 		exit(err, 1)
 	}
+	playbackOptions := &playback.Options{}
+	if err := utils.ApplyDefaultValues(playbackOptions); err != nil {
+		exit(err, 1)
+	}
 
-	cliFlags, flagMappings, err := utils.GenerateFlags(appOptions, backendOptions)
+	cliFlags, flagMappings, err := utils.GenerateFlags(appOptions, backendOptions, playbackOptions)
 	if err != nil {
 		exit(err, 3)
 	}
@@ -49,24 +54,26 @@ func main() {
 		},
 	)
 
-	app.Action = func(c *cli.Context) {
-		if len(c.Args()) == 0 {
-			msg := "Error: No command given."
-			cli.ShowAppHelp(c)
-			exit(fmt.Errorf(msg), 1)
-		}
+	app.Commands = []cli.Command{clientCommand()}
 
+	app.Action = func(c *cli.Context) {
 		configFile := c.String("config")
 		_, err := os.Stat(homedir.Expand(configFile))
 		if configFile != "~/.gotty" || !os.IsNotExist(err) {
-			if err := utils.ApplyConfigFile(configFile, appOptions, backendOptions); err != nil {
+			if err := utils.ApplyConfigFile(configFile, appOptions, backendOptions, playbackOptions); err != nil {
 				exit(err, 2)
 			}
 		}
 
-		utils.ApplyFlags(cliFlags, flagMappings, c, appOptions, backendOptions)
+		utils.ApplyFlags(cliFlags, flagMappings, c, appOptions, backendOptions, playbackOptions)
 
-		appOptions.EnableBasicAuth = c.IsSet("credential")
+		if len(c.Args()) == 0 && playbackOptions.PlaybackDir == "" {
+			msg := "Error: No command given."
+			cli.ShowAppHelp(c)
+			exit(fmt.Errorf(msg), 1)
+		}
+
+		appOptions.EnableBasicAuth = c.IsSet("credential") || appOptions.CredentialFile != ""
 		appOptions.EnableTLSClientAuth = c.IsSet("tls-ca-crt")
 
 		err = appOptions.Validate()
@@ -74,8 +81,14 @@ func main() {
 			exit(err, 6)
 		}
 
+		var factory server.Factory
 		args := c.Args()
-		factory, err := localcommand.NewFactory(args[0], args[1:], backendOptions)
+		if playbackOptions.PlaybackDir != "" {
+			factory, err = playback.NewFactory(playbackOptions)
+			args = []string{"playback", playbackOptions.PlaybackDir}
+		} else {
+			factory, err = localcommand.NewFactory(args[0], args[1:], backendOptions)
+		}
 		if err != nil {
 			exit(err, 3)
 		}
@@ -0,0 +1,93 @@
+// Package asciicast reads and writes terminal recordings
+// in the asciicast v2 format used by asciinema.
+package asciicast
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Version is the version of the asciicast format supported by this package.
+const Version = 2
+
+// Event types of asciicast v2.
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventMarker = "m"
+	EventResize = "r"
+)
+
+// Header is the first line of an asciicast file.
+// RemoteAddr, SessionName and ConnectionID are GoTTY specific and ignored by other players.
+type Header struct {
+	Version       int               `json:"version"`
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	Timestamp     int64             `json:"timestamp,omitempty"`
+	Duration      float64           `json:"duration,omitempty"`
+	IdleTimeLimit float64           `json:"idle_time_limit,omitempty"`
+	Command       string            `json:"command,omitempty"`
+	Title         string            `json:"title,omitempty"`
+	Env           map[string]string `json:"env,omitempty"`
+
+	RemoteAddr   string `json:"remote_addr,omitempty"`
+	SessionName  string `json:"session_name,omitempty"`
+	ConnectionID string `json:"connection_id,omitempty"`
+}
+
+// Event is a line following the header, encoded as `[time, type, data]`.
+type Event struct {
+	// Time is the number of seconds since the beginning of the recording.
+	Time float64
+	Type string
+	Data string
+}
+
+// MarshalJSON encodes the event as a JSON array.
+func (event Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{event.Time, event.Type, event.Data})
+}
+
+// UnmarshalJSON decodes the event from a JSON array.
+func (event *Event) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return errors.Errorf("malformed event with %d fields", len(fields))
+	}
+	if err := json.Unmarshal(fields[0], &event.Time); err != nil {
+		return errors.Wrapf(err, "malformed event time")
+	}
+	if err := json.Unmarshal(fields[1], &event.Type); err != nil {
+		return errors.Wrapf(err, "malformed event type")
+	}
+	if err := json.Unmarshal(fields[2], &event.Data); err != nil {
+		return errors.Wrapf(err, "malformed event data")
+	}
+	return nil
+}
+
+// splitIncompleteUTF8 splits data before a trailing UTF-8 sequence
+// which is cut in the middle, so that it can be completed by the next chunk.
+func splitIncompleteUTF8(data []byte) (complete []byte, rest []byte) {
+	// a UTF-8 sequence is at most utf8.UTFMax bytes long
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		b := data[len(data)-i]
+		if b < utf8.RuneSelf {
+			break // ASCII, nothing pending
+		}
+		if !utf8.RuneStart(b) {
+			continue // continuation byte, look further back
+		}
+		if !utf8.FullRune(data[len(data)-i:]) {
+			return data[:len(data)-i], data[len(data)-i:]
+		}
+		break
+	}
+	return data, nil
+}
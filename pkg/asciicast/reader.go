@@ -0,0 +1,64 @@
+package asciicast
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// maxLineSize limits the length of a line in an asciicast file.
+const maxLineSize = 16 * 1024 * 1024
+
+// Reader reads events from an asciicast stream.
+type Reader struct {
+	Header Header
+
+	scanner *bufio.Scanner
+}
+
+// NewReader reads the header from src and returns a Reader for the following events.
+func NewReader(src io.Reader) (*Reader, error) {
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrapf(err, "failed to read asciicast header")
+		}
+		return nil, errors.New("failed to read asciicast header: empty input")
+	}
+
+	reader := &Reader{scanner: scanner}
+	if err := json.Unmarshal(scanner.Bytes(), &reader.Header); err != nil {
+		return nil, errors.Wrapf(err, "malformed asciicast header")
+	}
+	if reader.Header.Version != Version {
+		return nil, errors.Errorf("unsupported asciicast version %d", reader.Header.Version)
+	}
+
+	return reader, nil
+}
+
+// Next returns the next event, or io.EOF at the end of the stream.
+// Empty lines are skipped.
+func (reader *Reader) Next() (Event, error) {
+	for reader.scanner.Scan() {
+		line := reader.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return Event{}, errors.Wrapf(err, "malformed asciicast event")
+		}
+		return event, nil
+	}
+
+	if err := reader.scanner.Err(); err != nil {
+		return Event{}, errors.Wrapf(err, "failed to read asciicast event")
+	}
+	return Event{}, io.EOF
+}
@@ -0,0 +1,143 @@
+package asciicast
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Writer records events into an asciicast stream.
+// Events are encoded and written in a background goroutine,
+// so a slow destination never blocks the caller.
+// When the internal queue is full, events are discarded and counted.
+type Writer struct {
+	dest  io.WriteCloser
+	start time.Time
+
+	events  chan Event
+	done    chan struct{}
+	err     error
+	pending []byte // incomplete UTF-8 sequence at the end of the last output
+
+	mutex   sync.Mutex
+	closed  bool
+	dropped int
+}
+
+// NewWriter writes the header to dest and returns a Writer that
+// queues up to queueSize events. The header timestamp is set when empty.
+func NewWriter(dest io.WriteCloser, header Header, queueSize int) (*Writer, error) {
+	start := time.Now()
+	header.Version = Version
+	if header.Timestamp == 0 {
+		header.Timestamp = start.Unix()
+	}
+
+	headerLine, err := json.Marshal(header)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal asciicast header")
+	}
+	if _, err := dest.Write(append(headerLine, '\n')); err != nil {
+		return nil, errors.Wrapf(err, "failed to write asciicast header")
+	}
+
+	writer := &Writer{
+		dest:   dest,
+		start:  start,
+		events: make(chan Event, queueSize),
+		done:   make(chan struct{}),
+	}
+	go writer.run()
+
+	return writer, nil
+}
+
+// WriteOutput records data sent to the terminal.
+func (writer *Writer) WriteOutput(data []byte) {
+	writer.enqueue(Event{Type: EventOutput, Data: string(data)})
+}
+
+// WriteResize records a change of the terminal size.
+func (writer *Writer) WriteResize(columns int, rows int) {
+	writer.enqueue(Event{Type: EventResize, Data: fmt.Sprintf("%dx%d", columns, rows)})
+}
+
+// Dropped returns the number of events discarded because the queue was full.
+func (writer *Writer) Dropped() int {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	return writer.dropped
+}
+
+// Close flushes queued events and closes the destination.
+func (writer *Writer) Close() error {
+	writer.mutex.Lock()
+	if writer.closed {
+		writer.mutex.Unlock()
+		return nil
+	}
+	writer.closed = true
+	close(writer.events)
+	writer.mutex.Unlock()
+
+	<-writer.done
+	closeErr := writer.dest.Close()
+	if writer.err != nil {
+		return writer.err
+	}
+	return closeErr
+}
+
+func (writer *Writer) enqueue(event Event) {
+	event.Time = time.Since(writer.start).Seconds()
+
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	if writer.closed {
+		return
+	}
+	select {
+	case writer.events <- event:
+	default:
+		writer.dropped++
+	}
+}
+
+func (writer *Writer) run() {
+	defer close(writer.done)
+
+	buffered := bufio.NewWriter(writer.dest)
+	encoder := json.NewEncoder(buffered)
+	encoder.SetEscapeHTML(false)
+	for event := range writer.events {
+		if writer.err != nil {
+			continue // drain the queue
+		}
+
+		if event.Type == EventOutput {
+			data := append(writer.pending, event.Data...)
+			var complete []byte
+			complete, writer.pending = splitIncompleteUTF8(data)
+			writer.pending = append([]byte(nil), writer.pending...)
+			if len(complete) == 0 {
+				continue
+			}
+			event.Data = string(complete)
+		}
+
+		writer.err = encoder.Encode(event)
+		if writer.err == nil && len(writer.events) == 0 {
+			writer.err = buffered.Flush()
+		}
+	}
+	if writer.err == nil {
+		writer.err = buffered.Flush()
+	}
+}
@@ -0,0 +1,100 @@
+package asciicast
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestWriterSplitsUTF8(t *testing.T) {
+	buf := nopCloser{new(bytes.Buffer)}
+	writer, err := NewWriter(buf, Header{Width: 80, Height: 24}, 16)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewWriter(): %s", err)
+	}
+
+	// "あ" is e3 81 82, split across two chunks
+	writer.WriteOutput([]byte("a\xe3\x81"))
+	writer.WriteOutput([]byte("\x82b"))
+	writer.WriteResize(100, 30)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Unexpected error from Close(): %s", err)
+	}
+
+	scanner := bufio.NewScanner(buf)
+	scanner.Scan()
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+	}
+	if header.Version != Version || header.Width != 80 {
+		t.Fatalf("Unexpected header: %+v", header)
+	}
+
+	var events []Event
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+		}
+		events = append(events, event)
+	}
+
+	expected := []Event{
+		{Type: EventOutput, Data: "a"},
+		{Type: EventOutput, Data: "あb"},
+		{Type: EventResize, Data: "100x30"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Unexpected events: %+v", events)
+	}
+	for i := range expected {
+		if events[i].Type != expected[i].Type || events[i].Data != expected[i].Data {
+			t.Fatalf("Unexpected event %d: %+v", i, events[i])
+		}
+	}
+}
+
+// blockingCloser blocks writes after the header until released.
+type blockingCloser struct {
+	nopCloser
+	header  bool
+	release chan struct{}
+}
+
+func (b *blockingCloser) Write(p []byte) (int, error) {
+	if b.header {
+		<-b.release
+	}
+	b.header = true
+	return b.nopCloser.Write(p)
+}
+
+func TestWriterCountsDropped(t *testing.T) {
+	dest := &blockingCloser{nopCloser: nopCloser{new(bytes.Buffer)}, release: make(chan struct{})}
+	writer, err := NewWriter(dest, Header{Width: 80, Height: 24}, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewWriter(): %s", err)
+	}
+
+	// the slow destination doesn't block the caller
+	for i := 0; i < 10; i++ {
+		writer.WriteOutput([]byte("a"))
+	}
+	close(dest.release)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Unexpected error from Close(): %s", err)
+	}
+
+	written := bytes.Count(dest.Bytes(), []byte("\n")) - 1
+	if dropped := writer.Dropped(); dropped == 0 || written+dropped != 10 {
+		t.Fatalf("Unexpected events written and dropped: %d, %d", written, dropped)
+	}
+}
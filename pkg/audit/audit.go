@@ -0,0 +1,110 @@
+// Package audit logs what clients type into terminals,
+// both as raw input and as reconstructed command lines.
+package audit
+
+import (
+	"sync"
+	"time"
+)
+
+// Kinds of audit entries.
+const (
+	// KindInput is raw input written to the terminal.
+	KindInput = "input"
+	// KindLine is a command line reconstructed from input.
+	KindLine = "line"
+)
+
+// Entry is a record of the audit log.
+type Entry struct {
+	Time         time.Time `json:"time"`
+	Kind         string    `json:"kind"`
+	ConnectionID string    `json:"connection_id"`
+	RemoteAddr   string    `json:"remote_addr"`
+	SessionName  string    `json:"session_name,omitempty"`
+	Username     string    `json:"username,omitempty"`
+	Data         string    `json:"data"`
+	// Redacted is set when Data has been removed because the terminal read a secret.
+	Redacted bool `json:"redacted,omitempty"`
+	// Approximate is set on lines edited with history recall or completion,
+	// whose result is only known to the shell.
+	Approximate bool `json:"approximate,omitempty"`
+}
+
+// Sink stores audit entries. Write is called from multiple goroutines.
+type Sink interface {
+	Write(entry *Entry) error
+	Close() error
+}
+
+// Identity tells whose input is audited.
+type Identity struct {
+	ConnectionID string
+	RemoteAddr   string
+	SessionName  string
+	// Username is the authenticated user, if any.
+	Username string
+}
+
+// Auditor logs the input of a connection into a Sink.
+// It satisfies webtty.Auditor.
+type Auditor struct {
+	sink          Sink
+	identity      Identity
+	redactSecrets bool
+
+	mutex  sync.Mutex
+	editor LineEditor
+}
+
+// NewAuditor creates an Auditor for the connection of identity.
+// When redactSecrets is true, input typed while the terminal reads a secret,
+// such as a password, is left out of the log.
+func NewAuditor(sink Sink, identity Identity, redactSecrets bool) *Auditor {
+	return &Auditor{
+		sink:          sink,
+		identity:      identity,
+		redactSecrets: redactSecrets,
+	}
+}
+
+// AuditInput logs data and any command lines completed by it.
+// Errors of the sink are ignored, and a sink which can block,
+// such as RotatingFile, should be wrapped in a Queue.
+func (auditor *Auditor) AuditInput(data []byte, secret bool) {
+	auditor.mutex.Lock()
+	defer auditor.mutex.Unlock()
+
+	now := time.Now()
+	redacted := auditor.redactSecrets && secret
+
+	input := auditor.entry(now, KindInput)
+	if redacted {
+		input.Redacted = true
+	} else {
+		input.Data = string(data)
+	}
+	auditor.sink.Write(input)
+
+	for _, line := range auditor.editor.Feed(data, redacted) {
+		entry := auditor.entry(now, KindLine)
+		if line.Redacted {
+			entry.Redacted = true
+		} else {
+			entry.Data = line.Text
+		}
+		entry.Approximate = line.Approximate
+		auditor.sink.Write(entry)
+	}
+}
+
+func (auditor *Auditor) entry(now time.Time, kind string) *Entry {
+	return &Entry{
+		Time:         now,
+		Kind:         kind,
+		ConnectionID: auditor.identity.ConnectionID,
+		RemoteAddr:   auditor.identity.RemoteAddr,
+		SessionName:  auditor.identity.SessionName,
+		Username:     auditor.identity.Username,
+	}
+}
@@ -0,0 +1,129 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLineEditor(t *testing.T) {
+	cases := []struct {
+		input string
+		lines []Line
+	}{
+		{"ls -l\r", []Line{{Text: "ls -l"}}},
+		{"lss\x7f -l\r\n\r", []Line{{Text: "ls -l"}}},
+		{"echo wrld\x1b[D\x1b[D\x1b[Do\r", []Line{{Text: "echo world"}}},
+		{"cat file\x01\x1b[3~\x1b[3~\x1b[3~less\x05 | head\r", []Line{{Text: "less file | head"}}},
+		{"rm -rf /\x03echo ok\x17\x17pwd\r", []Line{{Text: "pwd"}}},
+		{"\x1b[Atop\rcd \xe3\x81\x82\x7fsrc\r", []Line{{Text: "top", Approximate: true}, {Text: "cd src"}}},
+	}
+
+	for _, c := range cases {
+		var editor LineEditor
+		var lines []Line
+		// feed byte by byte to cover sequences split across reads
+		for i := 0; i < len(c.input); i++ {
+			lines = append(lines, editor.Feed([]byte{c.input[i]}, false)...)
+		}
+		if len(lines) != len(c.lines) {
+			t.Fatalf("Unexpected lines for %q: %+v", c.input, lines)
+		}
+		for i := range lines {
+			if lines[i] != c.lines[i] {
+				t.Errorf("Unexpected line for %q: %+v, expected %+v", c.input, lines[i], c.lines[i])
+			}
+		}
+	}
+}
+
+func TestLineEditorRedacts(t *testing.T) {
+	var editor LineEditor
+	editor.Feed([]byte("sudo ls\r"), false)
+	lines := editor.Feed([]byte("secret\r"), true)
+	if len(lines) != 1 || !lines[0].Redacted {
+		t.Fatalf("Unexpected lines: %+v", lines)
+	}
+	lines = editor.Feed([]byte("exit\r"), false)
+	if len(lines) != 1 || lines[0].Redacted || lines[0].Text != "exit" {
+		t.Fatalf("Unexpected lines: %+v", lines)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("Unexpected error from TempDir(): %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	sink, err := NewRotatingFile(path, 200, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewRotatingFile(): %s", err)
+	}
+	auditor := NewAuditor(sink, Identity{ConnectionID: "c1", RemoteAddr: "127.0.0.1"}, true)
+	for i := 0; i < 10; i++ {
+		auditor.AuditInput([]byte("ls\r"), false)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Unexpected error from Close(): %s", err)
+	}
+
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Unexpected error from Stat(): %s", err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("Unexpected size of %s: %d", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit.log.3")); !os.IsNotExist(err) {
+		t.Errorf("Unexpected backup audit.log.3: %v", err)
+	}
+}
+
+// blockingSink is a Sink whose writes block until it's released.
+type blockingSink struct {
+	release chan struct{}
+	entries []*Entry
+	closed  bool
+}
+
+func (sink *blockingSink) Write(entry *Entry) error {
+	<-sink.release
+	sink.entries = append(sink.entries, entry)
+	return nil
+}
+
+func (sink *blockingSink) Close() error {
+	sink.closed = true
+	return nil
+}
+
+func TestQueue(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	queue := NewQueue(sink, 1)
+	auditor := NewAuditor(queue, Identity{ConnectionID: "c1"}, false)
+
+	// the slow sink doesn't block the terminal
+	for i := 0; i < 10; i++ {
+		auditor.AuditInput([]byte("a"), false)
+	}
+	close(sink.release)
+	if err := queue.Close(); err != nil {
+		t.Fatalf("Unexpected error from Close(): %s", err)
+	}
+
+	if !sink.closed {
+		t.Fatalf("The sink is not closed with the queue")
+	}
+	if dropped := queue.Dropped(); dropped == 0 || len(sink.entries)+dropped != 10 {
+		t.Fatalf("Unexpected entries written and dropped: %d, %d", len(sink.entries), dropped)
+	}
+	if err := queue.Write(&Entry{}); err == nil {
+		t.Fatalf("An entry was queued after Close()")
+	}
+}
@@ -0,0 +1,124 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RotatingFile is a Sink writing entries as JSON lines into a file.
+// When the file grows over maxSize bytes, it is renamed to path.1,
+// the former path.1 to path.2 and so on, keeping maxBackups files.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// NewRotatingFile opens path for appending audit entries.
+// A maxSize of 0 disables the rotation.
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// Write appends entry to the file, rotating it beforehand if necessary.
+func (rf *RotatingFile) Write(entry *Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal audit entry")
+	}
+	line = append(line, '\n')
+
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.file == nil {
+		return errors.New("audit log is closed")
+	}
+
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(line)) > rf.maxSize {
+		// entries are still written when only the renaming has failed
+		if err := rf.rotate(); err != nil && rf.file == nil {
+			return err
+		}
+	}
+
+	n, err := rf.file.Write(line)
+	rf.size += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write audit log `%s`", rf.path)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (rf *RotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open audit log `%s`", rf.path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "failed to stat audit log `%s`", rf.path)
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) rotate() error {
+	rf.file.Close()
+	rf.file = nil
+
+	var err error
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			os.Rename(rf.backup(i), rf.backup(i+1))
+		}
+		err = os.Rename(rf.path, rf.backup(1))
+	} else {
+		err = os.Remove(rf.path)
+	}
+
+	// keep writing into the current file even if it could not be rotated
+	if openErr := rf.open(); openErr != nil {
+		return openErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to rotate audit log `%s`", rf.path)
+	}
+	return nil
+}
+
+func (rf *RotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", rf.path, i)
+}
@@ -0,0 +1,194 @@
+package audit
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Line is a command line reconstructed by LineEditor.
+type Line struct {
+	Text string
+	// Redacted is set when any part of the line was typed with redaction.
+	Redacted bool
+	// Approximate is set when the line was edited with history recall or completion.
+	Approximate bool
+}
+
+// LineEditor reconstructs command lines from keystrokes by emulating
+// the basic editing keys of readline: cursor movement with arrows,
+// Home, End and their Ctrl shortcuts, Backspace, Delete, Ctrl-U, Ctrl-K and Ctrl-W.
+// It is best-effort, as the terminal may be in a program with other key bindings.
+// The zero value is ready to use.
+type LineEditor struct {
+	buffer      []rune
+	cursor      int
+	redacted    bool
+	approximate bool
+
+	escape  []byte // unfinished escape sequence
+	partial []byte // unfinished UTF-8 sequence
+	lastCR  bool   // the last byte was CR, so that CRLF makes one line
+}
+
+// Feed processes keystrokes and returns the lines completed by Enter.
+// Empty lines are returned only when redacted.
+func (editor *LineEditor) Feed(data []byte, redacted bool) []Line {
+	var lines []Line
+
+	for _, b := range data {
+		if redacted {
+			editor.redacted = true
+		}
+		lastCR := editor.lastCR
+		editor.lastCR = false
+
+		if len(editor.escape) > 0 {
+			editor.escape = append(editor.escape, b)
+			if escapeComplete(editor.escape) {
+				editor.handleEscape(string(editor.escape))
+				editor.escape = editor.escape[:0]
+			}
+			continue
+		}
+
+		if len(editor.partial) > 0 || b >= utf8.RuneSelf {
+			editor.partial = append(editor.partial, b)
+			if utf8.FullRune(editor.partial) {
+				r, _ := utf8.DecodeRune(editor.partial)
+				editor.partial = editor.partial[:0]
+				if r != utf8.RuneError {
+					editor.insert(r)
+				}
+			}
+			continue
+		}
+
+		switch b {
+		case '\r', '\n':
+			if b == '\n' && lastCR {
+				break
+			}
+			editor.lastCR = b == '\r'
+			if line, ok := editor.finish(); ok {
+				lines = append(lines, line)
+			}
+		case 0x1b: // ESC
+			editor.escape = append(editor.escape, b)
+		case 0x7f, 0x08: // Backspace, Ctrl-H
+			if editor.cursor > 0 {
+				editor.delete(editor.cursor-1, editor.cursor)
+			}
+		case 0x01: // Ctrl-A
+			editor.cursor = 0
+		case 0x05: // Ctrl-E
+			editor.cursor = len(editor.buffer)
+		case 0x02: // Ctrl-B
+			editor.left()
+		case 0x06: // Ctrl-F
+			editor.right()
+		case 0x04: // Ctrl-D
+			if editor.cursor < len(editor.buffer) {
+				editor.delete(editor.cursor, editor.cursor+1)
+			}
+		case 0x15: // Ctrl-U
+			editor.delete(0, editor.cursor)
+		case 0x0b: // Ctrl-K
+			editor.delete(editor.cursor, len(editor.buffer))
+		case 0x17: // Ctrl-W
+			start := editor.cursor
+			for start > 0 && unicode.IsSpace(editor.buffer[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(editor.buffer[start-1]) {
+				start--
+			}
+			editor.delete(start, editor.cursor)
+		case 0x03: // Ctrl-C abandons the line
+			editor.reset()
+		case 0x09, 0x10, 0x0e, 0x12: // Tab, Ctrl-P, Ctrl-N, Ctrl-R
+			editor.approximate = true
+		default:
+			if b >= 0x20 {
+				editor.insert(rune(b))
+			}
+		}
+	}
+
+	return lines
+}
+
+// escapeComplete reports whether seq, starting with ESC, is a complete sequence.
+func escapeComplete(seq []byte) bool {
+	if len(seq) < 2 {
+		return false
+	}
+	switch seq[1] {
+	case '[': // CSI ends with a byte in 0x40-0x7e
+		last := seq[len(seq)-1]
+		return len(seq) > 2 && last >= 0x40 && last <= 0x7e
+	case 'O': // SS3 has one more byte
+		return len(seq) > 2
+	default: // Alt with a key
+		return true
+	}
+}
+
+func (editor *LineEditor) handleEscape(seq string) {
+	switch seq {
+	case "\x1b[D", "\x1bOD":
+		editor.left()
+	case "\x1b[C", "\x1bOC":
+		editor.right()
+	case "\x1b[H", "\x1bOH", "\x1b[1~", "\x1b[7~":
+		editor.cursor = 0
+	case "\x1b[F", "\x1bOF", "\x1b[4~", "\x1b[8~":
+		editor.cursor = len(editor.buffer)
+	case "\x1b[3~":
+		if editor.cursor < len(editor.buffer) {
+			editor.delete(editor.cursor, editor.cursor+1)
+		}
+	case "\x1b[A", "\x1bOA", "\x1b[B", "\x1bOB":
+		editor.approximate = true
+	}
+}
+
+func (editor *LineEditor) insert(r rune) {
+	editor.buffer = append(editor.buffer, 0)
+	copy(editor.buffer[editor.cursor+1:], editor.buffer[editor.cursor:])
+	editor.buffer[editor.cursor] = r
+	editor.cursor++
+}
+
+func (editor *LineEditor) delete(start, end int) {
+	editor.buffer = append(editor.buffer[:start], editor.buffer[end:]...)
+	editor.cursor = start
+}
+
+func (editor *LineEditor) left() {
+	if editor.cursor > 0 {
+		editor.cursor--
+	}
+}
+
+func (editor *LineEditor) right() {
+	if editor.cursor < len(editor.buffer) {
+		editor.cursor++
+	}
+}
+
+func (editor *LineEditor) finish() (Line, bool) {
+	line := Line{
+		Text:        string(editor.buffer),
+		Redacted:    editor.redacted,
+		Approximate: editor.approximate,
+	}
+	editor.reset()
+	return line, line.Text != "" || line.Redacted
+}
+
+func (editor *LineEditor) reset() {
+	editor.buffer = editor.buffer[:0]
+	editor.cursor = 0
+	editor.redacted = false
+	editor.approximate = false
+}
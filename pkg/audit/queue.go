@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Queue is a Sink passing entries to another Sink in a background goroutine,
+// so that a slow sink, such as a file on a busy disk, never blocks the terminal.
+// When the queue is full, entries are discarded and counted.
+type Queue struct {
+	sink    Sink
+	entries chan *Entry
+	done    chan struct{}
+	err     error // the first error of the sink
+
+	mutex   sync.Mutex
+	closed  bool
+	dropped int
+}
+
+// NewQueue returns a Queue holding up to size entries for sink.
+func NewQueue(sink Sink, size int) *Queue {
+	queue := &Queue{
+		sink:    sink,
+		entries: make(chan *Entry, size),
+		done:    make(chan struct{}),
+	}
+	go queue.run()
+
+	return queue
+}
+
+// Write queues entry for the sink.
+func (queue *Queue) Write(entry *Entry) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.closed {
+		return errors.New("audit log is closed")
+	}
+	select {
+	case queue.entries <- entry:
+		return nil
+	default:
+		queue.dropped++
+		return errors.New("audit queue is full")
+	}
+}
+
+// Dropped returns the number of entries discarded because the queue was full.
+func (queue *Queue) Dropped() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return queue.dropped
+}
+
+// Close writes the queued entries and closes the sink.
+// It returns the first error of the sink, if any.
+func (queue *Queue) Close() error {
+	queue.mutex.Lock()
+	if queue.closed {
+		queue.mutex.Unlock()
+		return nil
+	}
+	queue.closed = true
+	close(queue.entries)
+	queue.mutex.Unlock()
+
+	<-queue.done
+	closeErr := queue.sink.Close()
+	if queue.err != nil {
+		return queue.err
+	}
+	return closeErr
+}
+
+func (queue *Queue) run() {
+	defer close(queue.done)
+
+	for entry := range queue.entries {
+		if err := queue.sink.Write(entry); err != nil && queue.err == nil {
+			queue.err = err
+		}
+	}
+}
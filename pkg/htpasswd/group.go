@@ -0,0 +1,108 @@
+package htpasswd
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Groups is a loaded group file in the htgroup format, one "group: user1 user2" line per group,
+// which can be reloaded when it changes.
+type Groups struct {
+	path string
+
+	mutex   sync.RWMutex
+	groups  map[string][]string // by username
+	modTime time.Time
+	size    int64
+}
+
+// LoadGroups reads the group file at path.
+func LoadGroups(path string) (*Groups, error) {
+	groups := &Groups{path: path}
+	if err := groups.Reload(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// Path returns the path of the file.
+func (groups *Groups) Path() string {
+	return groups.path
+}
+
+// Reload reads the file again. The groups loaded before are kept on errors.
+func (groups *Groups) Reload() error {
+	info, err := os.Stat(groups.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read group file")
+	}
+	data, err := os.ReadFile(groups.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read group file")
+	}
+	members, err := parseGroups(data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse group file `%s`", groups.path)
+	}
+
+	groups.mutex.Lock()
+	defer groups.mutex.Unlock()
+	groups.groups = members
+	groups.modTime = info.ModTime()
+	groups.size = info.Size()
+	return nil
+}
+
+// ReloadIfModified reloads the file when its modification time or size has changed,
+// and reports whether it has.
+func (groups *Groups) ReloadIfModified() (bool, error) {
+	info, err := os.Stat(groups.path)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read group file")
+	}
+
+	groups.mutex.RLock()
+	modified := !info.ModTime().Equal(groups.modTime) || info.Size() != groups.size
+	groups.mutex.RUnlock()
+	if !modified {
+		return false, nil
+	}
+	return true, groups.Reload()
+}
+
+// Of returns the groups user belongs to.
+func (groups *Groups) Of(user string) []string {
+	groups.mutex.RLock()
+	defer groups.mutex.RUnlock()
+	return groups.groups[user]
+}
+
+func parseGroups(data []byte) (map[string][]string, error) {
+	members := make(map[string][]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		group, users, ok := strings.Cut(line, ":")
+		group = strings.TrimSpace(group)
+		if !ok || group == "" {
+			return nil, errors.Errorf("line %d is not in the form of group: user1 user2", number)
+		}
+		for _, user := range strings.Fields(users) {
+			members[user] = append(members[user], group)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
@@ -0,0 +1,105 @@
+package htpasswd
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// checkHash returns an error when hash is in none of the supported forms.
+func checkHash(hash string) error {
+	switch {
+	case isBcrypt(hash):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	case strings.HasPrefix(hash, "$5$"):
+		_, _, _, err := parseSHA256Crypt(hash)
+		return err
+	case strings.HasPrefix(hash, "$argon2"):
+		_, err := parseArgon2(hash)
+		return err
+	default:
+		return errors.New("unsupported hash, must be bcrypt, SHA-256 crypt or argon2")
+	}
+}
+
+// verify reports whether password matches hash, which has been checked by checkHash.
+func verify(hash string, password string) bool {
+	switch {
+	case isBcrypt(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$5$"):
+		salt, rounds, explicit, err := parseSHA256Crypt(hash)
+		if err != nil {
+			return false
+		}
+		computed := sha256Crypt([]byte(password), salt, rounds, explicit)
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "$argon2"):
+		params, err := parseArgon2(hash)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare(params.key([]byte(password)), params.hash) == 1
+	}
+	return false
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2y$") || strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$")
+}
+
+// argon2Params are the parameters of an argon2 hash in the PHC string format,
+// such as $argon2id$v=19$m=65536,t=3,p=4$salt$hash.
+type argon2Params struct {
+	variant     string
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	hash        []byte
+}
+
+func parseArgon2(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return nil, errors.New("malformed argon2 hash")
+	}
+
+	params := &argon2Params{variant: parts[1]}
+	if params.variant != "argon2id" && params.variant != "argon2i" {
+		return nil, errors.Errorf("unsupported argon2 variant `%s`", params.variant)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.Errorf("unsupported argon2 version `%s`", parts[2])
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism)
+	if err != nil || params.iterations == 0 || params.parallelism == 0 {
+		return nil, errors.Errorf("malformed argon2 parameters `%s`", parts[3])
+	}
+
+	params.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, errors.Wrapf(err, "malformed argon2 salt")
+	}
+	params.hash, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(params.hash) == 0 {
+		return nil, errors.New("malformed argon2 hash")
+	}
+	return params, nil
+}
+
+func (params *argon2Params) key(password []byte) []byte {
+	length := uint32(len(params.hash))
+	if params.variant == "argon2i" {
+		return argon2.Key(password, params.salt, params.iterations, params.memory, params.parallelism, length)
+	}
+	return argon2.IDKey(password, params.salt, params.iterations, params.memory, params.parallelism, length)
+}
@@ -0,0 +1,172 @@
+// Package htpasswd authenticates users with a credential file
+// in the htpasswd format, one "user:hash" line per user.
+// Hashes can be bcrypt ($2y$), SHA-256 crypt ($5$) or argon2 ($argon2id$, $argon2i$).
+// Users can be put into groups with a group file in the htgroup format.
+package htpasswd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dummyHash is verified for unknown users, so that they take as long as known ones
+// and usernames can't be told by timing.
+const dummyHash = "$2a$10$u4EufI/ZdYxnJYdFngryxugxwKZw15pxWrh.zc5gWF9l3X/7GrxN."
+
+// File is a loaded credential file, which can be reloaded when it changes.
+type File struct {
+	path string
+
+	mutex   sync.RWMutex
+	hashes  map[string]string // by username
+	modTime time.Time
+	size    int64
+
+	// passwords verified since the last load, to skip slow hashes next time,
+	// kept as HMACs under a random key so that they can't be cracked from memory
+	verifiedMutex sync.Mutex
+	verified      map[string][sha256.Size]byte
+	verifiedKey   []byte
+}
+
+// Load reads the credential file at path.
+func Load(path string) (*File, error) {
+	file := &File{path: path, verifiedKey: make([]byte, 32)}
+	if _, err := rand.Read(file.verifiedKey); err != nil {
+		return nil, errors.Wrapf(err, "failed to generate key")
+	}
+	if err := file.Reload(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Path returns the path of the file.
+func (file *File) Path() string {
+	return file.path
+}
+
+// Len returns the number of users.
+func (file *File) Len() int {
+	file.mutex.RLock()
+	defer file.mutex.RUnlock()
+	return len(file.hashes)
+}
+
+// Reload reads the file again. The users loaded before are kept on errors.
+func (file *File) Reload() error {
+	info, err := os.Stat(file.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read credential file")
+	}
+	data, err := os.ReadFile(file.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read credential file")
+	}
+	hashes, err := parse(data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse credential file `%s`", file.path)
+	}
+
+	file.mutex.Lock()
+	file.hashes = hashes
+	file.modTime = info.ModTime()
+	file.size = info.Size()
+	file.mutex.Unlock()
+
+	file.verifiedMutex.Lock()
+	file.verified = make(map[string][sha256.Size]byte)
+	file.verifiedMutex.Unlock()
+	return nil
+}
+
+// ReloadIfModified reloads the file when its modification time or size has changed,
+// and reports whether it has.
+func (file *File) ReloadIfModified() (bool, error) {
+	info, err := os.Stat(file.path)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read credential file")
+	}
+
+	file.mutex.RLock()
+	modified := !info.ModTime().Equal(file.modTime) || info.Size() != file.size
+	file.mutex.RUnlock()
+	if !modified {
+		return false, nil
+	}
+	return true, file.Reload()
+}
+
+// Authenticate reports whether password is the one of user.
+func (file *File) Authenticate(user string, password string) bool {
+	file.mutex.RLock()
+	hash, ok := file.hashes[user]
+	file.mutex.RUnlock()
+	if !ok {
+		verify(dummyHash, password)
+		return false
+	}
+
+	digest := file.digest(user, password)
+	file.verifiedMutex.Lock()
+	verified, ok := file.verified[user]
+	file.verifiedMutex.Unlock()
+	if ok && subtle.ConstantTimeCompare(verified[:], digest[:]) == 1 {
+		return true
+	}
+
+	if !verify(hash, password) {
+		return false
+	}
+
+	file.verifiedMutex.Lock()
+	file.verified[user] = digest
+	file.verifiedMutex.Unlock()
+	return true
+}
+
+// digest returns the HMAC of a verified password of user.
+func (file *File) digest(user string, password string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, file.verifiedKey)
+	mac.Write([]byte(user))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+
+	var digest [sha256.Size]byte
+	copy(digest[:], mac.Sum(nil))
+	return digest
+}
+
+func parse(data []byte) (map[string]string, error) {
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, errors.Errorf("line %d is not in the form of user:hash", number)
+		}
+		if err := checkHash(hash); err != nil {
+			return nil, errors.Wrapf(err, "invalid hash of `%s` at line %d", user, number)
+		}
+		hashes[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
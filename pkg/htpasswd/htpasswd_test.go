@@ -0,0 +1,130 @@
+package htpasswd
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerify(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Unexpected error from GenerateFromPassword(): %s", err)
+	}
+
+	cases := []struct {
+		hash     string
+		password string
+	}{
+		{string(bcryptHash), "secret"},
+		// from the specification of SHA-crypt
+		{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+		{"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"},
+		// from the reference implementation of argon2
+		{"$argon2i$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG", "password"},
+	}
+
+	for _, c := range cases {
+		if err := checkHash(c.hash); err != nil {
+			t.Fatalf("Unexpected error from checkHash(%s): %s", c.hash, err)
+		}
+		if !verify(c.hash, c.password) {
+			t.Fatalf("Password not verified with %s", c.hash)
+		}
+		if verify(c.hash, c.password+"x") {
+			t.Fatalf("Wrong password verified with %s", c.hash)
+		}
+	}
+
+	if err := checkHash("$apr1$salt$hash"); err == nil {
+		t.Fatalf("Expected an error for an unsupported hash")
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatalf("Unexpected error from TempDir(): %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "htpasswd")
+	content := "# users\nalice:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Unexpected error from WriteFile(): %s", err)
+	}
+
+	file, err := Load(path)
+	if err != nil {
+		t.Fatalf("Unexpected error from Load(): %s", err)
+	}
+	if file.Len() != 1 || !file.Authenticate("alice", "Hello world!") || file.Authenticate("bob", "Hello world!") {
+		t.Fatalf("Unexpected authentication results")
+	}
+	// verified once, then remembered
+	if !file.Authenticate("alice", "Hello world!") || file.Authenticate("alice", "hello") {
+		t.Fatalf("Unexpected authentication results")
+	}
+	// remembered without the plain SHA-256 of the password
+	if digest, plain := file.verified["alice"], sha256.Sum256([]byte("Hello world!")); digest == plain || digest != file.digest("alice", "Hello world!") {
+		t.Fatalf("Unexpected digest of a verified password")
+	}
+	// unknown users are checked against a real hash
+	if err := checkHash(dummyHash); err != nil {
+		t.Fatalf("Unexpected error from checkHash() of the dummy hash: %s", err)
+	}
+
+	content += "bob:$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Unexpected error from WriteFile(): %s", err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	reloaded, err := file.ReloadIfModified()
+	if err != nil || !reloaded {
+		t.Fatalf("Unexpected results from ReloadIfModified(): %v %v", reloaded, err)
+	}
+	if file.Len() != 2 || !file.Authenticate("bob", "Hello world!") {
+		t.Fatalf("Unexpected authentication results after reloading")
+	}
+
+	// a broken file keeps the users
+	if err := ioutil.WriteFile(path, []byte("broken\n"), 0600); err != nil {
+		t.Fatalf("Unexpected error from WriteFile(): %s", err)
+	}
+	if err := file.Reload(); err == nil {
+		t.Fatalf("Expected an error for a broken file")
+	}
+	if file.Len() != 2 {
+		t.Fatalf("Users lost after a failed reload")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htgroup")
+	if err != nil {
+		t.Fatalf("Unexpected error from TempDir(): %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "htgroup")
+	content := "# groups\nops: alice bob\nadmins:alice\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Unexpected error from WriteFile(): %s", err)
+	}
+
+	groups, err := LoadGroups(path)
+	if err != nil {
+		t.Fatalf("Unexpected error from LoadGroups(): %s", err)
+	}
+	if of := groups.Of("alice"); len(of) != 2 || of[0] != "ops" || of[1] != "admins" {
+		t.Fatalf("Unexpected groups of alice: %v", of)
+	}
+	if of := groups.Of("carol"); len(of) != 0 {
+		t.Fatalf("Unexpected groups of carol: %v", of)
+	}
+}
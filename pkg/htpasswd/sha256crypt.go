@@ -0,0 +1,141 @@
+package htpasswd
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SHA-256 crypt as specified in https://www.akkadia.org/drepper/SHA-crypt.txt,
+// which is written by `htpasswd -2` and `mkpasswd -m sha-256`.
+const (
+	sha256CryptDefaultRounds = 5000
+	sha256CryptMinRounds     = 1000
+	sha256CryptMaxRounds     = 999999999
+	sha256CryptMaxSalt       = 16
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// parseSHA256Crypt returns the salt and the rounds of a hash in the form of
+// $5$rounds=N$salt$hash, where the rounds are optional. explicit tells
+// whether the rounds are given.
+func parseSHA256Crypt(hash string) (salt []byte, rounds int, explicit bool, err error) {
+	rest := strings.TrimPrefix(hash, "$5$")
+	rounds = sha256CryptDefaultRounds
+	if strings.HasPrefix(rest, "rounds=") {
+		value, remaining, ok := strings.Cut(strings.TrimPrefix(rest, "rounds="), "$")
+		if !ok {
+			return nil, 0, false, errors.New("malformed SHA-256 crypt hash")
+		}
+		rounds, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, 0, false, errors.New("malformed rounds of SHA-256 crypt hash")
+		}
+		rounds = max(sha256CryptMinRounds, min(rounds, sha256CryptMaxRounds))
+		explicit = true
+		rest = remaining
+	}
+
+	saltString, encoded, ok := strings.Cut(rest, "$")
+	if !ok || len(saltString) > sha256CryptMaxSalt || len(encoded) != 43 {
+		return nil, 0, false, errors.New("malformed SHA-256 crypt hash")
+	}
+	return []byte(saltString), rounds, explicit, nil
+}
+
+// sha256Crypt returns the hash of password in the form parsed by parseSHA256Crypt.
+func sha256Crypt(password []byte, salt []byte, rounds int, explicit bool) string {
+	// digest B
+	b := sha256.New()
+	b.Write(password)
+	b.Write(salt)
+	b.Write(password)
+	digestB := b.Sum(nil)
+
+	// digest A
+	a := sha256.New()
+	a.Write(password)
+	a.Write(salt)
+	a.Write(repeat(digestB, len(password)))
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(password)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	// sequences P and S
+	dp := sha256.New()
+	for i := 0; i < len(password); i++ {
+		dp.Write(password)
+	}
+	sequenceP := repeat(dp.Sum(nil), len(password))
+
+	ds := sha256.New()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(salt)
+	}
+	sequenceS := repeat(ds.Sum(nil), len(salt))
+
+	digest := digestA
+	for i := 0; i < rounds; i++ {
+		c := sha256.New()
+		if i&1 != 0 {
+			c.Write(sequenceP)
+		} else {
+			c.Write(digest)
+		}
+		if i%3 != 0 {
+			c.Write(sequenceS)
+		}
+		if i%7 != 0 {
+			c.Write(sequenceP)
+		}
+		if i&1 != 0 {
+			c.Write(digest)
+		} else {
+			c.Write(sequenceP)
+		}
+		digest = c.Sum(nil)
+	}
+
+	var result strings.Builder
+	result.WriteString("$5$")
+	if explicit {
+		result.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	result.Write(salt)
+	result.WriteString("$")
+
+	order := [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	for _, o := range order {
+		encode24(&result, digest[o[0]], digest[o[1]], digest[o[2]], 4)
+	}
+	encode24(&result, 0, digest[31], digest[30], 3)
+	return result.String()
+}
+
+// repeat returns data repeated up to length bytes.
+func repeat(data []byte, length int) []byte {
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		result = append(result, data[:min(len(data), length-len(result))]...)
+	}
+	return result
+}
+
+func encode24(result *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for i := 0; i < n; i++ {
+		result.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
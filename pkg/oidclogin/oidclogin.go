@@ -0,0 +1,415 @@
+// Package oidclogin logs users in with the authorization code flow of OpenID Connect
+// and keeps them logged in with encrypted session cookies.
+//
+// One endpoint starts the flow and receives the callback from the provider,
+// so the redirect URL registered at the provider is the URL of the login endpoint.
+// Cookies are scoped to the directory of the login endpoint.
+package oidclogin
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// SessionCookie is the name of the cookie of logged in users.
+	SessionCookie = "gotty_session"
+	// stateCookie keeps the state of a login in progress.
+	stateCookie = "gotty_oidc_state"
+
+	stateLifetime = 10 * time.Minute
+)
+
+// Config configures Login.
+type Config struct {
+	// Issuer is the URL of the provider, where its discovery document is found.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the URL of the login endpoint registered at the provider.
+	// It's derived from the request when empty, which does not work behind proxies.
+	// Users logged out of the provider are sent back to the site of RedirectURL,
+	// or left at the provider when it's empty.
+	RedirectURL string
+	// Scopes are requested in addition to openid.
+	Scopes []string
+
+	// UserClaim is the claim naming the user, falling back to sub when it's missing.
+	UserClaim string
+	// GroupsClaim is the claim listing the groups of the user.
+	GroupsClaim string
+	// AllowedGroups lets in only the users of one of them, or anybody when it's empty.
+	AllowedGroups []string
+	// AllowedClaims lets in only the users who have all of these claims,
+	// such as email_verified=true. Claims that are lists need to contain the value.
+	AllowedClaims map[string]string
+
+	// Secret encrypts the cookies. A random one is generated when it's empty,
+	// which logs users out when the server restarts.
+	Secret string
+	// SessionLifetime is how long users stay logged in.
+	SessionLifetime time.Duration
+	// SecureCookies marks the cookies Secure even for requests without TLS,
+	// such as behind a proxy terminating TLS. Cookies of requests over TLS are always Secure.
+	SecureCookies bool
+}
+
+// Identity is a logged in user.
+type Identity struct {
+	User    string   `json:"u"`
+	Groups  []string `json:"g,omitempty"`
+	Expires int64    `json:"e"` // Unix seconds
+}
+
+// loginState is kept in a cookie between the redirect to the provider and its callback.
+type loginState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Next     string `json:"x"`
+	Expires  int64  `json:"e"`
+}
+
+// Login serves the login and logout endpoints and identifies logged in users.
+type Login struct {
+	config   Config
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	// endSession is the logout endpoint of the provider, if it has one.
+	endSession string
+	aead       cipher.AEAD
+}
+
+// New creates a Login, fetching the discovery document of the provider.
+func New(ctx context.Context, config Config) (*Login, error) {
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to discover OpenID Connect provider `%s`", config.Issuer)
+	}
+	var metadata struct {
+		EndSession string `json:"end_session_endpoint"`
+	}
+	provider.Claims(&metadata)
+
+	key := sha256.Sum256([]byte(config.Secret))
+	if config.Secret == "" {
+		if _, err := rand.Read(key[:]); err != nil {
+			return nil, errors.Wrapf(err, "failed to generate session secret")
+		}
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Login{
+		config: config,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, config.Scopes...),
+		},
+		verifier:   provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		endSession: metadata.EndSession,
+		aead:       aead,
+	}, nil
+}
+
+// Identity returns the user logged in with the session cookie of r.
+func (login *Login) Identity(r *http.Request) (*Identity, bool) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	var identity Identity
+	if err := login.open(SessionCookie, cookie.Value, &identity); err != nil {
+		return nil, false
+	}
+	if time.Now().Unix() >= identity.Expires {
+		return nil, false
+	}
+	return &identity, true
+}
+
+// HandleLogin redirects users to the provider, and back to the page given with
+// the next parameter once the provider calls it back with a code.
+func (login *Login) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("code") != "" || query.Get("error") != "" {
+		login.handleCallback(w, r)
+		return
+	}
+
+	state := loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: oauth2.GenerateVerifier(),
+		Next:     safeNext(query.Get("next"), cookiePath(r)),
+		Expires:  time.Now().Add(stateLifetime).Unix(),
+	}
+	login.setCookie(w, r, stateCookie, login.seal(stateCookie, state), stateLifetime)
+
+	config := login.oauth2
+	config.RedirectURL = login.redirectURL(r)
+	http.Redirect(w, r, config.AuthCodeURL(
+		state.State,
+		oidc.Nonce(state.Nonce),
+		oauth2.S256ChallengeOption(state.Verifier),
+	), http.StatusFound)
+}
+
+func (login *Login) handleCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var state loginState
+	cookie, err := r.Cookie(stateCookie)
+	if err == nil {
+		err = login.open(stateCookie, cookie.Value, &state)
+	}
+	if err != nil || time.Now().Unix() >= state.Expires || query.Get("state") != state.State {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	login.setCookie(w, r, stateCookie, "", -1)
+
+	if reason := query.Get("error"); reason != "" {
+		log.Printf("OpenID Connect login failed: %s %s", reason, query.Get("error_description"))
+		http.Error(w, "Login failed: "+reason, http.StatusForbidden)
+		return
+	}
+
+	config := login.oauth2
+	config.RedirectURL = login.redirectURL(r)
+	token, err := config.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		log.Printf("OpenID Connect code exchange failed: %s", err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "Login failed: no ID token", http.StatusBadGateway)
+		return
+	}
+	idToken, err := login.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != state.Nonce {
+		log.Printf("OpenID Connect ID token rejected: %v", err)
+		http.Error(w, "Login failed: invalid ID token", http.StatusForbidden)
+		return
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "Login failed: invalid claims", http.StatusForbidden)
+		return
+	}
+	identity, err := login.authorize(claims)
+	if err != nil {
+		log.Printf("OpenID Connect login denied: %s", err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	identity.Expires = time.Now().Add(login.config.SessionLifetime).Unix()
+	login.setCookie(w, r, SessionCookie, login.seal(SessionCookie, identity), login.config.SessionLifetime)
+	log.Printf("OpenID Connect login succeeded: %s", identity.User)
+	http.Redirect(w, r, state.Next, http.StatusFound)
+}
+
+// HandleLogout removes the session cookie on a POST from the same site, and logs users
+// out of the provider too when it supports RP-initiated logout.
+func (login *Login) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !SameOrigin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	login.setCookie(w, r, SessionCookie, "", -1)
+	next := safeNext(r.URL.Query().Get("next"), cookiePath(r))
+	if login.endSession == "" {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	params := url.Values{}
+	params.Set("client_id", login.config.ClientID)
+	if redirect, err := url.Parse(login.config.RedirectURL); err == nil && redirect.Host != "" {
+		params.Set("post_logout_redirect_uri", redirect.Scheme+"://"+redirect.Host+next)
+	}
+	separator := "?"
+	if strings.Contains(login.endSession, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, login.endSession+separator+params.Encode(), http.StatusSeeOther)
+}
+
+// authorize returns the identity of the claims, unless they aren't allowed in.
+func (login *Login) authorize(claims map[string]interface{}) (*Identity, error) {
+	identity := &Identity{}
+	identity.User, _ = claims[login.config.UserClaim].(string)
+	if identity.User == "" {
+		identity.User, _ = claims["sub"].(string)
+	}
+	if identity.User == "" {
+		return nil, errors.New("no user in claims")
+	}
+	identity.Groups = claimStrings(claims[login.config.GroupsClaim])
+
+	if len(login.config.AllowedGroups) > 0 && !containsAny(identity.Groups, login.config.AllowedGroups) {
+		return nil, errors.Errorf("user `%s` is in none of the allowed groups", identity.User)
+	}
+	for name, value := range login.config.AllowedClaims {
+		if !containsAny(claimStrings(claims[name]), []string{value}) {
+			return nil, errors.Errorf("user `%s` does not have claim %s=%s", identity.User, name, value)
+		}
+	}
+	return identity, nil
+}
+
+// redirectURL returns the URL the provider calls back, which is the login endpoint.
+func (login *Login) redirectURL(r *http.Request) string {
+	if login.config.RedirectURL != "" {
+		return login.config.RedirectURL
+	}
+	return baseURL(r) + r.URL.Path
+}
+
+func (login *Login) setCookie(w http.ResponseWriter, r *http.Request, name string, value string, lifetime time.Duration) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     cookiePath(r),
+		Secure:   r.TLS != nil || login.config.SecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if lifetime < 0 {
+		cookie.MaxAge = -1
+	} else {
+		cookie.MaxAge = int(lifetime / time.Second)
+	}
+	http.SetCookie(w, cookie)
+}
+
+// seal encrypts value into a cookie called name, which is authenticated
+// so that a cookie can't be used as another.
+func (login *Login) seal(name string, value interface{}) string {
+	plaintext, _ := json.Marshal(value)
+	nonce := make([]byte, login.aead.NonceSize())
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(login.aead.Seal(nonce, nonce, plaintext, []byte(name)))
+}
+
+func (login *Login) open(name string, sealed string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < login.aead.NonceSize() {
+		return errors.New("malformed cookie")
+	}
+	size := login.aead.NonceSize()
+	plaintext, err := login.aead.Open(nil, data[:size], data[size:], []byte(name))
+	if err != nil {
+		return errors.New("invalid cookie")
+	}
+	return json.Unmarshal(plaintext, value)
+}
+
+// cookiePath returns the directory of the login and logout endpoints,
+// under which GoTTY is served.
+func cookiePath(r *http.Request) string {
+	dir := path.Dir(r.URL.Path)
+	if dir == "/" {
+		return dir
+	}
+	return dir + "/"
+}
+
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// SameOrigin tells whether r comes from a page of this server,
+// or from a program other than browsers, so that other sites can't
+// log users out or have requests made with their sessions.
+func SameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// safeNext returns next when it's a path on this server, otherwise fallback.
+func safeNext(next string, fallback string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return fallback
+	}
+	return next
+}
+
+// claimStrings returns a claim, which is a string or a list, as strings.
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		result := make([]string, 0, len(value))
+		for _, item := range value {
+			result = append(result, fmt.Sprint(item))
+		}
+		return result
+	default:
+		return []string{fmt.Sprint(value)}
+	}
+}
+
+func containsAny(values []string, targets []string) bool {
+	for _, value := range values {
+		for _, target := range targets {
+			if value == target {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func randomString() string {
+	data := make([]byte, 16)
+	rand.Read(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
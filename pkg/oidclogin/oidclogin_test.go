@@ -0,0 +1,296 @@
+package oidclogin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+// mockProvider is an OpenID Connect provider logging in whoever comes with the claims.
+type mockProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+
+	nonce     string
+	challenge string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unexpected error from GenerateKey(): %s", err)
+	}
+	provider := &mockProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := provider.server.URL
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer,
+			"authorization_endpoint":                issuer + "/authorize",
+			"token_endpoint":                        issuer + "/token",
+			"jwks_uri":                              issuer + "/jwks",
+			"end_session_endpoint":                  issuer + "/logout",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "key", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		provider.nonce = query.Get("nonce")
+		provider.challenge = query.Get("code_challenge")
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code=code&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "code" || base64.RawURLEncoding.EncodeToString(challenge[:]) != provider.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     provider.idToken(t),
+		})
+	})
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("logged out"))
+	})
+	provider.server = httptest.NewServer(mux)
+	return provider
+}
+
+func (provider *mockProvider) idToken(t *testing.T) string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: provider.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "key"),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewSigner(): %s", err)
+	}
+	claims := map[string]interface{}{
+		"iss":   provider.server.URL,
+		"aud":   "gotty",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": provider.nonce,
+	}
+	for name, value := range provider.claims {
+		claims[name] = value
+	}
+	payload, _ := json.Marshal(claims)
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatalf("Unexpected error from Sign(): %s", err)
+	}
+	token, _ := signed.CompactSerialize()
+	return token
+}
+
+func newApp(t *testing.T, config Config) (*httptest.Server, *http.Client) {
+	login, err := New(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gotty/login", login.HandleLogin)
+	mux.HandleFunc("/gotty/logout", login.HandleLogout)
+	mux.HandleFunc("/gotty/", func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := login.Identity(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(identity.Groups)
+		w.Write([]byte(identity.User))
+	})
+	app := httptest.NewServer(mux)
+
+	jar, _ := cookiejar.New(nil)
+	return app, &http.Client{Jar: jar}
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get(): %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestLogin(t *testing.T) {
+	provider := newMockProvider(t)
+	defer provider.server.Close()
+	provider.claims = map[string]interface{}{
+		"sub":                "1234",
+		"preferred_username": "alice",
+		"groups":             []string{"ops", "dev"},
+		"email_verified":     true,
+	}
+
+	app, client := newApp(t, Config{
+		Issuer:          provider.server.URL,
+		ClientID:        "gotty",
+		ClientSecret:    "secret",
+		UserClaim:       "preferred_username",
+		GroupsClaim:     "groups",
+		AllowedGroups:   []string{"ops"},
+		AllowedClaims:   map[string]string{"email_verified": "true"},
+		SessionLifetime: time.Hour,
+	})
+	defer app.Close()
+
+	if status, _ := get(t, client, app.URL+"/gotty/"); status != http.StatusUnauthorized {
+		t.Fatalf("Unexpected status before login: %d", status)
+	}
+
+	status, body := get(t, client, app.URL+"/gotty/login?next=/gotty/")
+	if status != http.StatusOK || body != "[\"ops\",\"dev\"]\nalice" {
+		t.Fatalf("Unexpected response after login: %d %q", status, body)
+	}
+
+	// logging out needs a POST
+	if status, _ := get(t, client, app.URL+"/gotty/logout"); status != http.StatusMethodNotAllowed {
+		t.Fatalf("Unexpected status of logout with GET: %d", status)
+	}
+	if status, _ := get(t, client, app.URL+"/gotty/"); status != http.StatusOK {
+		t.Fatalf("Unexpected status after logout with GET: %d", status)
+	}
+
+	// logged out of the provider too
+	resp, err := client.Post(app.URL+"/gotty/logout", "", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Post(): %s", err)
+	}
+	logoutBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(logoutBody) != "logged out" {
+		t.Fatalf("Unexpected response of logout: %d %q", resp.StatusCode, logoutBody)
+	}
+	if status, _ := get(t, client, app.URL+"/gotty/"); status != http.StatusUnauthorized {
+		t.Fatalf("Unexpected status after logout: %d", status)
+	}
+}
+
+func TestLoginDenied(t *testing.T) {
+	provider := newMockProvider(t)
+	defer provider.server.Close()
+	provider.claims = map[string]interface{}{
+		"sub":    "1234",
+		"groups": []string{"dev"},
+	}
+
+	app, client := newApp(t, Config{
+		Issuer:          provider.server.URL,
+		ClientID:        "gotty",
+		GroupsClaim:     "groups",
+		AllowedGroups:   []string{"ops"},
+		SessionLifetime: time.Hour,
+	})
+	defer app.Close()
+
+	if status, _ := get(t, client, app.URL+"/gotty/login?next=/gotty/"); status != http.StatusForbidden {
+		t.Fatalf("Unexpected status of login: %d", status)
+	}
+	if status, _ := get(t, client, app.URL+"/gotty/"); status != http.StatusUnauthorized {
+		t.Fatalf("Unexpected status after denied login: %d", status)
+	}
+
+	// a redirect to another site is not followed after login
+	if next := safeNext("//evil.example.com/", "/gotty/"); next != "/gotty/" {
+		t.Fatalf("Unexpected next: %s", next)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	provider := newMockProvider(t)
+	defer provider.server.Close()
+
+	login, err := New(context.Background(), Config{
+		Issuer:          provider.server.URL,
+		ClientID:        "gotty",
+		RedirectURL:     "https://gotty.example.com/gotty/login",
+		SessionLifetime: time.Hour,
+		SecureCookies:   true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	for _, c := range []struct {
+		name, header, value string
+		status              int
+	}{
+		{"other origin", "Origin", "http://evil.example.com", http.StatusForbidden},
+		{"cross site", "Sec-Fetch-Site", "cross-site", http.StatusForbidden},
+		{"same site", "Sec-Fetch-Site", "same-site", http.StatusForbidden},
+		{"same origin", "Sec-Fetch-Site", "same-origin", http.StatusSeeOther},
+		{"own origin", "Origin", "http://attacker.example.com", http.StatusSeeOther},
+	} {
+		// the Host header doesn't change where users are sent back to
+		r := httptest.NewRequest("POST", "http://attacker.example.com/gotty/logout?next=/gotty/", nil)
+		r.Header.Set(c.header, c.value)
+		w := httptest.NewRecorder()
+		login.HandleLogout(w, r)
+		if w.Code != c.status {
+			t.Fatalf("%s: unexpected status of logout: %d", c.name, w.Code)
+		}
+		if c.status != http.StatusSeeOther {
+			continue
+		}
+
+		location, _ := url.Parse(w.Header().Get("Location"))
+		if redirect := location.Query().Get("post_logout_redirect_uri"); redirect != "https://gotty.example.com/gotty/" {
+			t.Fatalf("%s: unexpected redirect after logout: %s", c.name, redirect)
+		}
+		cookie := w.Result().Cookies()[0]
+		if cookie.Name != SessionCookie || cookie.MaxAge >= 0 || !cookie.Secure {
+			t.Fatalf("%s: unexpected cookie of logout: %+v", c.name, cookie)
+		}
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	for _, c := range []struct {
+		header, value string
+		expected      bool
+	}{
+		{"", "", true},
+		{"Sec-Fetch-Site", "same-origin", true},
+		{"Sec-Fetch-Site", "none", true},
+		{"Sec-Fetch-Site", "same-site", false},
+		{"Sec-Fetch-Site", "cross-site", false},
+		{"Origin", "http://example.com", true},
+		{"Origin", "http://evil.example.com", false},
+		{"Origin", "null", false},
+	} {
+		r := httptest.NewRequest("GET", "http://example.com/auth_token.json", nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		if SameOrigin(r) != c.expected {
+			t.Errorf("Unexpected result of SameOrigin() with %s: %s", c.header, c.value)
+		}
+	}
+}
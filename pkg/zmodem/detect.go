@@ -0,0 +1,78 @@
+package zmodem
+
+import (
+	"bytes"
+)
+
+// Kind is a kind of transfer started by a program.
+type Kind int
+
+const (
+	// KindNone means no transfer has started.
+	KindNone Kind = iota
+	// KindReceive means a program such as sz has started sending files,
+	// to be taken with Receive.
+	KindReceive
+	// KindSend means a program such as rz is waiting for files,
+	// to be given with Send.
+	KindSend
+	// KindTrzsz means trz or tsz has started a transfer,
+	// to be run with StartTrzsz.
+	KindTrzsz
+)
+
+var signatures = []struct {
+	kind      Kind
+	signature []byte
+}{
+	{KindReceive, []byte("**\x18B00")}, // ZRQINIT
+	{KindSend, []byte("**\x18B01")},    // ZRINIT
+	{KindTrzsz, []byte("::TRZSZ:TRANSFER:")},
+}
+
+// Detector finds the start of a transfer in the output of a terminal.
+type Detector struct {
+	// the end of the previous data, which may hold the beginning of a signature
+	tail []byte
+}
+
+// Scan looks for the start of a transfer in the next chunk of output.
+// When a transfer has started, the session begins with start followed by
+// data[offset:]. start holds the beginning of the signature found in
+// earlier chunks, if any.
+func (d *Detector) Scan(data []byte) (kind Kind, offset int, start []byte) {
+	buffer := append(d.tail, data...)
+
+	found := -1
+	for _, s := range signatures {
+		i := bytes.Index(buffer, s.signature)
+		if i >= 0 && (found < 0 || i < found) {
+			found, kind = i, s.kind
+		}
+	}
+
+	if found < 0 {
+		keep := min(len(buffer), maxSignatureSize-1)
+		d.tail = append(d.tail[:0], buffer[len(buffer)-keep:]...)
+		return KindNone, 0, nil
+	}
+
+	d.tail = d.tail[:0]
+	if found < len(buffer)-len(data) {
+		return kind, 0, append([]byte{}, buffer[found:len(buffer)-len(data)]...)
+	}
+	return kind, found - (len(buffer) - len(data)), nil
+}
+
+// Reset forgets the output scanned so far.
+func (d *Detector) Reset() {
+	d.tail = d.tail[:0]
+}
+
+var maxSignatureSize = func() int {
+	size := 0
+	for _, s := range signatures {
+		size = max(size, len(s.signature))
+	}
+	return size
+}()
@@ -0,0 +1,398 @@
+package zmodem
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	zpad   = '*'
+	zdle   = 0x18 // also CAN
+	zbin   = 'A'
+	zhex   = 'B'
+	zbin32 = 'C'
+
+	xon  = 0x11
+	xoff = 0x13
+)
+
+// frame types
+const (
+	zrqinit = iota
+	zrinit
+	zsinit
+	zack
+	zfile
+	zskip
+	znak
+	zabort
+	zfin
+	zrpos
+	zdata
+	zeof
+	zferr
+	zcrc
+	zchallenge
+	zcompl
+	zcan
+	zfreecnt
+	zcommand
+	zstderr
+)
+
+// ends of data subpackets
+const (
+	zcrce = 'h' // end of frame, a header follows
+	zcrcg = 'i' // frame continues without a response
+	zcrcq = 'j' // frame continues, ZACK expected
+	zcrcw = 'k' // end of frame, ZACK expected
+	zrub0 = 'l' // escaped 0x7f
+	zrub1 = 'm' // escaped 0xff
+)
+
+// capabilities of receivers in ZF0 of ZRINIT
+const (
+	canfdx  = 0x01 // full duplex
+	canovio = 0x02 // can receive data while writing to disk
+	canfc32 = 0x20 // 32 bit CRC
+)
+
+// zcbin in ZF0 of ZFILE asks for a binary transfer
+const zcbin = 1
+
+const (
+	// maxSubpacketSize is the largest subpacket accepted
+	maxSubpacketSize = 8192
+	// subpacketSize is the size of subpackets sent
+	subpacketSize = 1024
+	// trailerTimeout is how long to wait for the line ending a hex header
+	trailerTimeout = 100 * time.Millisecond
+)
+
+var (
+	errBadHeader    = errors.New("malformed header")
+	errBadSubpacket = errors.New("malformed data subpacket")
+)
+
+// header is a frame header. data holds the position
+// in little endian, or the flags with ZF0 in data[3].
+type header struct {
+	typ      byte
+	data     [4]byte
+	encoding byte // zhex, zbin or zbin32 when received
+}
+
+func positionHeader(typ byte, position int64) header {
+	h := header{typ: typ}
+	binary.LittleEndian.PutUint32(h.data[:], uint32(position))
+	return h
+}
+
+func flagsHeader(typ byte, f0 byte) header {
+	h := header{typ: typ}
+	h.data[3] = f0
+	return h
+}
+
+func (h header) position() int64 {
+	return int64(binary.LittleEndian.Uint32(h.data[:]))
+}
+
+// hex encodes the header in the hex form used by receivers.
+func (h header) hex() []byte {
+	raw := append([]byte{h.typ}, h.data[:]...)
+	crc := crc16(raw)
+	raw = append(raw, byte(crc>>8), byte(crc))
+
+	frame := []byte{zpad, zpad, zdle, zhex}
+	frame = append(frame, hex.EncodeToString(raw)...)
+	frame = append(frame, '\r', '\n'|0x80)
+	if h.typ != zfin && h.typ != zack {
+		frame = append(frame, xon)
+	}
+	return frame
+}
+
+// binary encodes the header in the binary form used by senders.
+func (h header) binary(use32 bool) []byte {
+	raw := append([]byte{h.typ}, h.data[:]...)
+
+	var frame []byte
+	if use32 {
+		frame = []byte{zpad, zdle, zbin32}
+		raw = binary.LittleEndian.AppendUint32(raw, crc32.ChecksumIEEE(raw))
+	} else {
+		frame = []byte{zpad, zdle, zbin}
+		crc := crc16(raw)
+		raw = append(raw, byte(crc>>8), byte(crc))
+	}
+	for _, b := range raw {
+		frame = escape(frame, b)
+	}
+	return frame
+}
+
+// subpacket encodes data followed by end and the CRC of both.
+func subpacket(data []byte, end byte, use32 bool) []byte {
+	frame := make([]byte, 0, len(data)+len(data)/8+16)
+	for _, b := range data {
+		frame = escape(frame, b)
+	}
+	frame = append(frame, zdle, end)
+
+	var crc []byte
+	if use32 {
+		crc = binary.LittleEndian.AppendUint32(nil, crc32.Update(crc32.ChecksumIEEE(data), crc32.IEEETable, []byte{end}))
+	} else {
+		sum := crc16(append(append([]byte{}, data...), end))
+		crc = []byte{byte(sum >> 8), byte(sum)}
+	}
+	for _, b := range crc {
+		frame = escape(frame, b)
+	}
+	if end == zcrcw {
+		frame = append(frame, xon)
+	}
+	return frame
+}
+
+// escape appends b to dst, escaping bytes which may not pass a terminal.
+func escape(dst []byte, b byte) []byte {
+	switch b {
+	case zdle, 0x10, 0x90, xon, xon | 0x80, xoff, xoff | 0x80, '\r', '\r' | 0x80:
+		return append(dst, zdle, b^0x40)
+	default:
+		return append(dst, b)
+	}
+}
+
+// reader reads frames from a Port.
+type reader struct {
+	port    Port
+	timeout time.Duration
+}
+
+func (r *reader) readByte() (byte, error) {
+	return r.port.ReadByteTimeout(r.timeout)
+}
+
+// readHeader skips anything until a header and returns it.
+func (r *reader) readHeader() (header, error) {
+	cans := 0
+	for {
+		c, err := r.readByte()
+		if err != nil {
+			return header{}, err
+		}
+		switch c {
+		case zpad:
+			cans = 0
+		case zdle:
+			cans++
+			if cans >= 5 {
+				return header{}, ErrCanceled
+			}
+			continue
+		default:
+			cans = 0
+			continue
+		}
+
+		for c == zpad {
+			c, err = r.readByte()
+			if err != nil {
+				return header{}, err
+			}
+		}
+		if c != zdle {
+			continue
+		}
+		cans = 1
+
+		encoding, err := r.readByte()
+		if err != nil {
+			return header{}, err
+		}
+		switch encoding {
+		case zhex:
+			return r.readHexHeader()
+		case zbin, zbin32:
+			return r.readBinaryHeader(encoding)
+		case zdle:
+			cans++
+		}
+	}
+}
+
+func (r *reader) readHexHeader() (header, error) {
+	digits := make([]byte, 14)
+	for i := range digits {
+		c, err := r.readByte()
+		if err != nil {
+			return header{}, err
+		}
+		digits[i] = c
+	}
+	raw, err := hex.DecodeString(string(digits))
+	if err != nil {
+		return header{}, errBadHeader
+	}
+	if crc16(raw[:5]) != uint16(raw[5])<<8|uint16(raw[6]) {
+		return header{}, errBadHeader
+	}
+
+	// consume the line ending and XON following the header
+	for i := 0; i < 3; i++ {
+		c, err := r.port.ReadByteTimeout(trailerTimeout)
+		if err != nil {
+			break
+		}
+		if c != '\r' && c != '\n' && c != '\n'|0x80 && c != xon {
+			r.port.UnreadByte()
+			break
+		}
+	}
+
+	h := header{typ: raw[0], encoding: zhex}
+	copy(h.data[:], raw[1:5])
+	return h, nil
+}
+
+func (r *reader) readBinaryHeader(encoding byte) (header, error) {
+	size := 7
+	if encoding == zbin32 {
+		size = 9
+	}
+	raw := make([]byte, size)
+	for i := range raw {
+		b, end, err := r.readEscaped()
+		if err != nil {
+			return header{}, err
+		}
+		if end != 0 {
+			return header{}, errBadHeader
+		}
+		raw[i] = b
+	}
+
+	if encoding == zbin32 {
+		if crc32.ChecksumIEEE(raw[:5]) != binary.LittleEndian.Uint32(raw[5:]) {
+			return header{}, errBadHeader
+		}
+	} else if crc16(raw[:5]) != uint16(raw[5])<<8|uint16(raw[6]) {
+		return header{}, errBadHeader
+	}
+
+	h := header{typ: raw[0], encoding: encoding}
+	copy(h.data[:], raw[1:5])
+	return h, nil
+}
+
+// readSubpacket reads a data subpacket and returns its content and end.
+func (r *reader) readSubpacket(use32 bool) (data []byte, end byte, err error) {
+	for {
+		b, e, err := r.readEscaped()
+		if err != nil {
+			return nil, 0, err
+		}
+		if e != 0 {
+			end = e
+			break
+		}
+		if len(data) >= maxSubpacketSize {
+			return nil, 0, errBadSubpacket
+		}
+		data = append(data, b)
+	}
+
+	size := 2
+	if use32 {
+		size = 4
+	}
+	crc := make([]byte, size)
+	for i := range crc {
+		b, e, err := r.readEscaped()
+		if err != nil {
+			return nil, 0, err
+		}
+		if e != 0 {
+			return nil, 0, errBadSubpacket
+		}
+		crc[i] = b
+	}
+
+	if use32 {
+		if crc32.Update(crc32.ChecksumIEEE(data), crc32.IEEETable, []byte{end}) != binary.LittleEndian.Uint32(crc) {
+			return nil, 0, errBadSubpacket
+		}
+	} else if crc16(append(append([]byte{}, data...), end)) != uint16(crc[0])<<8|uint16(crc[1]) {
+		return nil, 0, errBadSubpacket
+	}
+	return data, end, nil
+}
+
+// readEscaped returns the next byte of escaped data,
+// or the end of a subpacket in end.
+func (r *reader) readEscaped() (b byte, end byte, err error) {
+	for {
+		c, err := r.readByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		switch c {
+		case xon, xon | 0x80, xoff, xoff | 0x80:
+			continue
+		case zdle:
+		default:
+			return c, 0, nil
+		}
+
+		cans := 1
+		for {
+			c, err = r.readByte()
+			if err != nil {
+				return 0, 0, err
+			}
+			switch c {
+			case zdle:
+				cans++
+				if cans >= 5 {
+					return 0, 0, ErrCanceled
+				}
+				continue
+			case xon, xon | 0x80, xoff, xoff | 0x80:
+				continue
+			case zcrce, zcrcg, zcrcq, zcrcw:
+				return 0, c, nil
+			case zrub0:
+				return 0x7f, 0, nil
+			case zrub1:
+				return 0xff, 0, nil
+			}
+			if c&0x60 == 0x40 {
+				return c ^ 0x40, 0, nil
+			}
+			return 0, 0, errBadSubpacket
+		}
+	}
+}
+
+// crc16 is the CRC-16/XMODEM of data.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
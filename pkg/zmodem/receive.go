@@ -0,0 +1,239 @@
+package zmodem
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReceiveHandler takes the files sent by the program.
+type ReceiveHandler interface {
+	// Offer is called for each file offered by the sender.
+	// It returns where to write the content, or an error to skip the file.
+	Offer(info FileInfo) (io.Writer, error)
+	// Done is called when an accepted file has been received,
+	// or with the error which has interrupted it.
+	Done(info FileInfo, err error)
+}
+
+// Receive receives files from a program which has started sending them,
+// typically sz, until the program finishes.
+// The session has to start with the ZRQINIT header reported by Detector.
+func Receive(port Port, handler ReceiveHandler) error {
+	receiver := &receiver{
+		reader:  reader{port: port, timeout: readTimeout},
+		handler: handler,
+	}
+	return receiver.run()
+}
+
+type receiver struct {
+	reader
+	handler ReceiveHandler
+
+	// the file being received, if any
+	file     *FileInfo
+	writer   io.Writer
+	position int64
+}
+
+func (rc *receiver) run() (err error) {
+	defer func() {
+		if err != nil && rc.file != nil {
+			rc.handler.Done(*rc.file, err)
+		}
+	}()
+
+	ready := flagsHeader(zrinit, canfdx|canovio|canfc32).hex()
+	last := ready // resent when the sender does not respond
+	retries := 0
+	for {
+		h, err := rc.readHeader()
+		switch {
+		case err == ErrTimeout || err == errBadHeader:
+			retries++
+			if retries > maxRetries {
+				return errors.New("sender is not responding")
+			}
+			if err := rc.send(last); err != nil {
+				return err
+			}
+			continue
+		case err != nil:
+			return err
+		}
+
+		switch h.typ {
+		case zrqinit:
+			last = ready
+
+		case zsinit:
+			_, _, err := rc.readSubpacket(h.encoding == zbin32)
+			if err != nil {
+				if err != errBadSubpacket && err != ErrTimeout {
+					return err
+				}
+				last = flagsHeader(znak, 0).hex()
+				break
+			}
+			last = positionHeader(zack, 0).hex()
+
+		case zfile:
+			data, _, err := rc.readSubpacket(h.encoding == zbin32)
+			if err != nil {
+				if err != errBadSubpacket && err != ErrTimeout {
+					return err
+				}
+				last = flagsHeader(znak, 0).hex()
+				break
+			}
+			if rc.file != nil {
+				// the sender has missed our ZRPOS
+				break
+			}
+			info := parseFileInfo(data)
+			writer, err := rc.handler.Offer(info)
+			if err != nil {
+				last = flagsHeader(zskip, 0).hex()
+				break
+			}
+			rc.file, rc.writer, rc.position = &info, writer, 0
+			last = positionHeader(zrpos, 0).hex()
+
+		case zdata:
+			if rc.file == nil {
+				last = flagsHeader(zskip, 0).hex()
+				break
+			}
+			if h.position() != rc.position {
+				last = positionHeader(zrpos, rc.position).hex()
+				break
+			}
+			err := rc.receiveData(h.encoding == zbin32)
+			if err == nil {
+				retries = 0
+				continue
+			}
+			if err != errBadSubpacket && err != ErrTimeout {
+				return err
+			}
+			retries++
+			if retries > maxRetries {
+				return errors.New("too many errors in data")
+			}
+			last = positionHeader(zrpos, rc.position).hex()
+
+		case zeof:
+			if rc.file == nil || h.position() != rc.position {
+				// a stale ZEOF, the sender is going to send more data
+				continue
+			}
+			rc.handler.Done(*rc.file, nil)
+			rc.file, rc.writer = nil, nil
+			last = ready
+
+		case zfin:
+			rc.send(positionHeader(zfin, 0).hex())
+			rc.readOverAndOut()
+			return nil
+
+		case zcan, zabort:
+			return ErrCanceled
+
+		case zferr:
+			return errors.New("sender failed to read the file")
+
+		default:
+			continue
+		}
+
+		if err := rc.send(last); err != nil {
+			return err
+		}
+	}
+}
+
+// receiveData reads the data subpackets following a ZDATA header.
+func (rc *receiver) receiveData(use32 bool) error {
+	for {
+		data, end, err := rc.readSubpacket(use32)
+		if err != nil {
+			return err
+		}
+		if rc.file.Size >= 0 && rc.position+int64(len(data)) > rc.file.Size {
+			return errors.New("received more data than the file size")
+		}
+		_, err = rc.writer.Write(data)
+		if err != nil {
+			return errors.Wrapf(err, "failed to write file")
+		}
+		rc.position += int64(len(data))
+
+		switch end {
+		case zcrcw:
+			return rc.send(positionHeader(zack, rc.position).hex())
+		case zcrcq:
+			err := rc.send(positionHeader(zack, rc.position).hex())
+			if err != nil {
+				return err
+			}
+		case zcrce:
+			return nil
+		}
+	}
+}
+
+// readOverAndOut consumes the "OO" sent by the sender after ZFIN.
+func (rc *receiver) readOverAndOut() {
+	for i := 0; i < len(overAndOut); i++ {
+		c, err := rc.port.ReadByteTimeout(finTimeout)
+		if err != nil {
+			return
+		}
+		if c != overAndOut[i] {
+			rc.port.UnreadByte()
+			return
+		}
+	}
+}
+
+func (rc *receiver) send(frame []byte) error {
+	_, err := rc.port.Write(frame)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write to sender")
+	}
+	return nil
+}
+
+// parseFileInfo parses the data subpacket of ZFILE: the file name,
+// and the size, modification time and mode separated by spaces.
+func parseFileInfo(data []byte) FileInfo {
+	info := FileInfo{Size: -1}
+
+	name, rest, _ := bytes.Cut(data, []byte{0})
+	info.Name = string(name)
+	attributes, _, _ := bytes.Cut(rest, []byte{0})
+	fields := strings.Fields(string(attributes))
+
+	if len(fields) > 0 {
+		if size, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			info.Size = size
+		}
+	}
+	if len(fields) > 1 {
+		if mtime, err := strconv.ParseInt(fields[1], 8, 64); err == nil && mtime > 0 {
+			info.ModTime = time.Unix(mtime, 0)
+		}
+	}
+	if len(fields) > 2 {
+		if mode, err := strconv.ParseUint(fields[2], 8, 32); err == nil {
+			info.Mode = os.FileMode(mode).Perm()
+		}
+	}
+	return info
+}
@@ -0,0 +1,345 @@
+package zmodem
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSkipped is given to SendHandler.Done when the receiver has refused a file.
+var ErrSkipped = errors.New("file skipped by the receiver")
+
+// retransmitSize is the number of bytes kept to resend data the receiver has missed.
+const retransmitSize = 1024 * 1024
+
+// SendHandler provides the files for the program.
+type SendHandler interface {
+	// Next returns the next file to send,
+	// or io.EOF when there are no more files.
+	Next() (FileInfo, io.Reader, error)
+	// Done is called when the receiver has got a file, with ErrSkipped
+	// when it has refused the file, or with the error which has interrupted it.
+	Done(info FileInfo, err error)
+}
+
+// Send sends files to a program waiting for them, typically rz,
+// and then finishes the session.
+// The session has to start with the ZRINIT header reported by Detector.
+func Send(port Port, handler SendHandler) error {
+	sender := &sender{
+		reader:  reader{port: port, timeout: readTimeout},
+		handler: handler,
+	}
+	return sender.run()
+}
+
+type sender struct {
+	reader
+	handler SendHandler
+	use32   bool
+
+	// the last bytes sent, starting at position retransmitStart
+	retransmit      []byte
+	retransmitStart int64
+}
+
+func (s *sender) run() error {
+	h, err := s.waitReceiver()
+	if err != nil {
+		return err
+	}
+	s.use32 = h.data[3]&canfc32 != 0
+
+	for {
+		info, content, err := s.handler.Next()
+		if err == io.EOF {
+			return s.finish()
+		}
+		if err != nil {
+			return err
+		}
+
+		err = s.sendFile(info, content)
+		s.handler.Done(info, err)
+		if err != nil && err != ErrSkipped {
+			return err
+		}
+	}
+}
+
+// waitReceiver reads the ZRINIT of the receiver.
+func (s *sender) waitReceiver() (header, error) {
+	for retries := 0; retries <= maxRetries; retries++ {
+		h, err := s.readHeader()
+		if err == ErrTimeout || err == errBadHeader {
+			if err := s.send(positionHeader(zrqinit, 0).hex()); err != nil {
+				return header{}, err
+			}
+			continue
+		}
+		if err != nil {
+			return header{}, err
+		}
+
+		switch h.typ {
+		case zrinit:
+			return h, nil
+		case zcan, zabort:
+			return header{}, ErrCanceled
+		}
+	}
+	return header{}, errors.New("receiver is not responding")
+}
+
+func (s *sender) sendFile(info FileInfo, content io.Reader) error {
+	attributes := fmt.Sprintf("%d %o %o 0 1 %d", info.Size, info.ModTime.Unix(), 0100000|info.Mode.Perm(), info.Size)
+	if info.ModTime.IsZero() {
+		attributes = fmt.Sprintf("%d 0 %o 0 1 %d", info.Size, 0100000|info.Mode.Perm(), info.Size)
+	}
+	offer := append(append([]byte(info.Name), 0), attributes...)
+	offer = append(offer, 0)
+
+	// drop the ZRINITs repeated by the receiver while it was waiting for the file
+	for {
+		h, ok, err := s.poll()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if h.typ == zcan || h.typ == zabort {
+			return ErrCanceled
+		}
+	}
+
+	for retries := 0; ; retries++ {
+		if retries > maxRetries {
+			return errors.New("receiver is not responding")
+		}
+		err := s.send(flagsHeader(zfile, zcbin).binary(s.use32), subpacket(offer, zcrcw, s.use32))
+		if err != nil {
+			return err
+		}
+
+		h, err := s.readHeader()
+		if err == ErrTimeout || err == errBadHeader {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		switch h.typ {
+		case zrpos:
+			return s.sendData(content, h.position())
+		case zskip:
+			return ErrSkipped
+		case zcan, zabort, zfin:
+			return ErrCanceled
+		}
+	}
+}
+
+// sendData streams content from position, resending what the receiver asks for again.
+func (s *sender) sendData(content io.Reader, position int64) error {
+	if position > 0 {
+		_, err := io.CopyN(io.Discard, content, position)
+		if err != nil {
+			return errors.Wrapf(err, "failed to skip to position %d", position)
+		}
+	}
+	s.retransmit = s.retransmit[:0]
+	s.retransmitStart = position
+
+	err := s.send(positionHeader(zdata, position).binary(s.use32))
+	if err != nil {
+		return err
+	}
+
+	buffer := make([]byte, subpacketSize)
+	eof := false
+	for {
+		h, ok, err := s.poll()
+		if err != nil {
+			return err
+		}
+		if ok {
+			switch h.typ {
+			case zrpos:
+				position, err = s.rewind(h.position())
+				if err != nil {
+					return err
+				}
+			case zskip:
+				return ErrSkipped
+			case zcan, zabort, zfin:
+				return ErrCanceled
+			}
+		}
+
+		// resend what has been asked for again
+		if end := s.retransmitStart + int64(len(s.retransmit)); position < end {
+			chunk := s.retransmit[position-s.retransmitStart : min(position+subpacketSize, end)-s.retransmitStart]
+			err := s.send(subpacket(chunk, zcrcg, s.use32))
+			if err != nil {
+				return err
+			}
+			position += int64(len(chunk))
+			continue
+		}
+
+		if !eof {
+			n, err := io.ReadFull(content, buffer)
+			switch err {
+			case nil:
+			case io.EOF, io.ErrUnexpectedEOF:
+				eof = true
+			default:
+				return errors.Wrapf(err, "failed to read file")
+			}
+			if n > 0 {
+				s.keep(buffer[:n])
+				err = s.send(subpacket(buffer[:n], zcrcg, s.use32))
+				if err != nil {
+					return err
+				}
+				position += int64(n)
+			}
+			continue
+		}
+
+		h, err = s.sendEOF(position)
+		if err != nil {
+			return err
+		}
+		if h.typ == zrinit {
+			return nil
+		}
+		position, err = s.rewind(h.position())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendEOF ends the data at position and waits until the receiver
+// confirms it with ZRINIT, or asks for data again with ZRPOS.
+func (s *sender) sendEOF(position int64) (header, error) {
+	err := s.send(subpacket(nil, zcrce, s.use32))
+	if err != nil {
+		return header{}, err
+	}
+
+	for retries := 0; retries <= maxRetries; retries++ {
+		err := s.send(positionHeader(zeof, position).binary(s.use32))
+		if err != nil {
+			return header{}, err
+		}
+
+		for {
+			h, err := s.readHeader()
+			if err == ErrTimeout || err == errBadHeader {
+				break
+			}
+			if err != nil {
+				return header{}, err
+			}
+
+			switch h.typ {
+			case zrinit, zrpos:
+				return h, nil
+			case zskip:
+				return header{}, ErrSkipped
+			case zcan, zabort, zfin:
+				return header{}, ErrCanceled
+			}
+		}
+	}
+	return header{}, errors.New("receiver is not responding")
+}
+
+// rewind restarts the data from position, which the receiver has asked for.
+func (s *sender) rewind(position int64) (int64, error) {
+	end := s.retransmitStart + int64(len(s.retransmit))
+	if position < s.retransmitStart || position > end {
+		return 0, errors.Errorf("cannot resend data from position %d", position)
+	}
+	return position, s.send(positionHeader(zdata, position).binary(s.use32))
+}
+
+// keep stores data sent for retransmission.
+func (s *sender) keep(data []byte) {
+	s.retransmit = append(s.retransmit, data...)
+	if len(s.retransmit) > 2*retransmitSize {
+		cut := len(s.retransmit) - retransmitSize
+		s.retransmit = append(s.retransmit[:0], s.retransmit[cut:]...)
+		s.retransmitStart += int64(cut)
+	}
+}
+
+// poll reads a header sent by the receiver, if any, without waiting for one.
+func (s *sender) poll() (header, bool, error) {
+	cans := 0
+	for {
+		c, err := s.port.ReadByteTimeout(0)
+		if err == ErrTimeout {
+			return header{}, false, nil
+		}
+		if err != nil {
+			return header{}, false, err
+		}
+		if c == zdle {
+			cans++
+			if cans >= 5 {
+				return header{}, false, ErrCanceled
+			}
+			continue
+		}
+		cans = 0
+		if c != zpad {
+			continue
+		}
+
+		s.port.UnreadByte()
+		h, err := s.readHeader()
+		if err == ErrTimeout || err == errBadHeader {
+			return header{}, false, nil
+		}
+		return h, err == nil, err
+	}
+}
+
+// finish ends the session with ZFIN, which the receiver answers with ZFIN.
+func (s *sender) finish() error {
+	for retries := 0; retries < 3; retries++ {
+		err := s.send(positionHeader(zfin, 0).hex())
+		if err != nil {
+			return err
+		}
+
+		h, err := s.readHeader()
+		if err == ErrTimeout || err == errBadHeader {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if h.typ == zfin {
+			return s.send([]byte(overAndOut))
+		}
+	}
+	// the receiver has gone already
+	return nil
+}
+
+func (s *sender) send(frames ...[]byte) error {
+	for _, frame := range frames {
+		_, err := s.port.Write(frame)
+		if err != nil {
+			return errors.Wrapf(err, "failed to write to receiver")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,498 @@
+package zmodem
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TrzszMode is the direction of a trzsz transfer.
+type TrzszMode byte
+
+const (
+	// TrzszReceive means tsz has started sending files, to be taken with Trzsz.Receive.
+	TrzszReceive TrzszMode = 'S'
+	// TrzszSend means trz is waiting for files, to be given with Trzsz.Send.
+	TrzszSend TrzszMode = 'R'
+	// TrzszDirectory means trz -d is waiting for directories, which are not supported.
+	TrzszDirectory TrzszMode = 'D'
+)
+
+// trzszVersion is the version of trzsz reported to trz and tsz.
+const trzszVersion = "1.1.6"
+
+const (
+	// trzszTimeout is how long the client waits for a line of trz or tsz.
+	trzszTimeout = 20 * time.Second
+	// trzszMaxLine limits the length of the lines read from trz and tsz, and of their data.
+	trzszMaxLine = 64 * 1024 * 1024
+	// trzszChunkSize is the largest data sent to trz at once, unless it asks for less.
+	trzszChunkSize = 32 * 1024
+)
+
+// Trzsz is the client end of a transfer started by trz or tsz,
+// which exchange lines of base64 with the client in the form of #TYPE:data.
+// Files are sent in the base64 mode of the original protocol,
+// which every version of trz and tsz supports.
+type Trzsz struct {
+	Mode    TrzszMode
+	Version string // of trz or tsz
+
+	reader
+	config trzszConfig
+}
+
+type trzszAction struct {
+	Lang       string `json:"lang"`
+	Version    string `json:"version"`
+	Confirm    bool   `json:"confirm"`
+	Newline    string `json:"newline"`
+	Binary     bool   `json:"binary"`
+	SupportDir bool   `json:"support_dir"`
+}
+
+type trzszConfig struct {
+	BufSize   int64 `json:"bufsize"`
+	Directory bool  `json:"directory"`
+}
+
+// StartTrzsz reads the beginning of a transfer from port, which has to start with
+// the signature reported by Detector as KindTrzsz, such as ::TRZSZ:TRANSFER:R:1.1.6:1234.
+func StartTrzsz(port Port) (*Trzsz, error) {
+	t := &Trzsz{reader: reader{port: port, timeout: readTimeout}}
+	for _, expected := range []byte("::TRZSZ:TRANSFER:") {
+		c, err := t.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if c != expected {
+			return nil, errors.New("invalid trzsz signature")
+		}
+	}
+
+	c, err := t.readByte()
+	if err != nil {
+		return nil, err
+	}
+	t.Mode = TrzszMode(c)
+	if c, err = t.readByte(); err != nil {
+		return nil, err
+	}
+	if c != ':' {
+		return nil, errors.New("invalid trzsz signature")
+	}
+
+	// the version may be followed by an ID, the line ending is left as junk before the config
+	var version []byte
+	for {
+		c, err := t.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if (c < '0' || c > '9') && c != '.' {
+			t.port.UnreadByte()
+			break
+		}
+		version = append(version, c)
+	}
+	t.Version = string(version)
+
+	switch t.Mode {
+	case TrzszReceive, TrzszSend, TrzszDirectory:
+		return t, nil
+	default:
+		return nil, errors.Errorf("unknown trzsz mode `%c`", t.Mode)
+	}
+}
+
+// Decline tells trz or tsz that the transfer has been declined, so that it ends.
+func (t *Trzsz) Decline() error {
+	return t.sendAction(false)
+}
+
+// Receive takes the files sent by tsz, and then lets it finish.
+func (t *Trzsz) Receive(handler ReceiveHandler) (err error) {
+	defer t.fail(&err)
+	if err := t.confirm(); err != nil {
+		return err
+	}
+
+	num, err := t.recvInteger("NUM")
+	if err != nil {
+		return err
+	}
+	if err := t.sendInteger("SUCC", num); err != nil {
+		return err
+	}
+
+	var names []string
+	for i := int64(0); i < num; i++ {
+		name, err := t.recvFile(handler)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	return t.sendString("EXIT", "Received "+strings.Join(names, ", "))
+}
+
+// recvFile takes the next file sent by tsz.
+func (t *Trzsz) recvFile(handler ReceiveHandler) (string, error) {
+	name, err := t.recvString("NAME")
+	if err != nil {
+		return "", err
+	}
+	if err := t.sendString("SUCC", name); err != nil {
+		return "", err
+	}
+	size, err := t.recvInteger("SIZE")
+	if err != nil {
+		return "", err
+	}
+	if err := t.sendInteger("SUCC", size); err != nil {
+		return "", err
+	}
+
+	info := FileInfo{Name: name, Size: size, ModTime: time.Now(), Mode: 0644}
+	writer, err := handler.Offer(info)
+	if err != nil {
+		return "", err
+	}
+	err = t.recvData(writer, size)
+	handler.Done(info, err)
+	return name, err
+}
+
+func (t *Trzsz) recvData(writer io.Writer, size int64) error {
+	digest := md5.New()
+	for received := int64(0); received < size; {
+		data, err := t.recvBinary("DATA")
+		if err != nil {
+			return err
+		}
+		received += int64(len(data))
+		if received > size {
+			return errors.New("received more data than the file size")
+		}
+		digest.Write(data)
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+		if err := t.sendInteger("SUCC", int64(len(data))); err != nil {
+			return err
+		}
+	}
+
+	expected, err := t.recvBinary("MD5")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(expected, digest.Sum(nil)) {
+		return errors.New("check MD5 failed")
+	}
+	return t.sendBinary("SUCC", expected)
+}
+
+// Send gives trz the files of handler, and then lets it finish.
+// trz needs to know the number of files first, so all of them are taken
+// from handler before any of their content is read.
+// The transfer is declined when handler has no files.
+func (t *Trzsz) Send(handler SendHandler) (err error) {
+	var infos []FileInfo
+	var contents []io.Reader
+	for {
+		info, content, err := handler.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Decline()
+			return err
+		}
+		infos, contents = append(infos, info), append(contents, content)
+	}
+	if len(infos) == 0 {
+		return t.Decline()
+	}
+
+	defer t.fail(&err)
+	if err := t.confirm(); err != nil {
+		return err
+	}
+
+	if err := t.sendInteger("NUM", int64(len(infos))); err != nil {
+		return err
+	}
+	if err := t.checkInteger(int64(len(infos))); err != nil {
+		return err
+	}
+
+	var names []string
+	for i, info := range infos {
+		name, err := t.sendFile(info, contents[i])
+		handler.Done(info, err)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	return t.sendString("EXIT", "Saved "+strings.Join(names, ", "))
+}
+
+// sendFile gives trz a file and returns the name it has been saved with.
+func (t *Trzsz) sendFile(info FileInfo, content io.Reader) (string, error) {
+	if err := t.sendString("NAME", info.Name); err != nil {
+		return "", err
+	}
+	name, err := t.recvString("SUCC")
+	if err != nil {
+		return "", err
+	}
+	if err := t.sendInteger("SIZE", info.Size); err != nil {
+		return "", err
+	}
+	if err := t.checkInteger(info.Size); err != nil {
+		return "", err
+	}
+
+	chunkSize := int64(trzszChunkSize)
+	if t.config.BufSize > 0 {
+		chunkSize = min(chunkSize, t.config.BufSize)
+	}
+	buffer := make([]byte, chunkSize)
+	digest := md5.New()
+	for sent := int64(0); sent < info.Size; {
+		n, err := content.Read(buffer[:min(chunkSize, info.Size-sent)])
+		if n > 0 {
+			digest.Write(buffer[:n])
+			if err := t.sendBinary("DATA", buffer[:n]); err != nil {
+				return "", err
+			}
+			if err := t.checkInteger(int64(n)); err != nil {
+				return "", err
+			}
+			sent += int64(n)
+		}
+		if err == io.EOF && sent < info.Size {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+	}
+
+	sum := digest.Sum(nil)
+	if err := t.sendBinary("MD5", sum); err != nil {
+		return "", err
+	}
+	confirmed, err := t.recvBinary("SUCC")
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(confirmed, sum) {
+		return "", errors.New("check MD5 failed")
+	}
+	return name, nil
+}
+
+// confirm accepts the transfer and takes the config of trz or tsz.
+func (t *Trzsz) confirm() error {
+	if err := t.sendAction(true); err != nil {
+		return err
+	}
+	config, err := t.recvString("CFG")
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(config), &t.config); err != nil {
+		return errors.Wrapf(err, "invalid trzsz config")
+	}
+	if t.config.Directory {
+		return errors.New("directories are not supported")
+	}
+	t.timeout = trzszTimeout
+	return nil
+}
+
+func (t *Trzsz) sendAction(confirm bool) error {
+	action, _ := json.Marshal(trzszAction{
+		Lang:    "go",
+		Version: trzszVersion,
+		Confirm: confirm,
+		Newline: "\n",
+	})
+	return t.sendString("ACT", string(action))
+}
+
+// fail tells trz or tsz the error which has interrupted the transfer, unless it has failed itself.
+func (t *Trzsz) fail(err *error) {
+	if *err == nil {
+		return
+	}
+	if _, remote := (*err).(*trzszError); remote {
+		return
+	}
+	t.sendString("fail", (*err).Error())
+}
+
+// trzszError is an error reported by trz or tsz.
+type trzszError struct {
+	message string
+}
+
+func (e *trzszError) Error() string {
+	return e.message
+}
+
+func (t *Trzsz) sendLine(typ string, data string) error {
+	_, err := t.port.Write([]byte("#" + typ + ":" + data + "\n"))
+	return err
+}
+
+func (t *Trzsz) sendString(typ string, s string) error {
+	return t.sendBinary(typ, []byte(s))
+}
+
+func (t *Trzsz) sendBinary(typ string, data []byte) error {
+	return t.sendLine(typ, trzszEncode(data))
+}
+
+func (t *Trzsz) sendInteger(typ string, n int64) error {
+	return t.sendLine(typ, strconv.FormatInt(n, 10))
+}
+
+// recvLine returns the data of the next line of typ. Anything which isn't
+// a line of trzsz is skipped, such as the end of the line of the signature.
+func (t *Trzsz) recvLine(typ string) (string, error) {
+	for {
+		line, err := t.readLine()
+		if err != nil {
+			return "", err
+		}
+		start := bytes.LastIndex(line, []byte("#"+typ+":"))
+		if start < 0 {
+			start = bytes.LastIndexByte(line, '#')
+		}
+		if start < 0 {
+			continue
+		}
+		got, data, ok := strings.Cut(string(line[start+1:]), ":")
+		if !ok {
+			continue
+		}
+		return checkTrzszLine(typ, got, data)
+	}
+}
+
+func (t *Trzsz) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		c, err := t.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == '\n' {
+			return bytes.TrimRight(line, "\r"), nil
+		}
+		if len(line) >= trzszMaxLine {
+			return nil, errors.New("too long line from trzsz")
+		}
+		line = append(line, c)
+	}
+}
+
+// checkTrzszLine returns the data of a line of typ, or the failure reported instead.
+func checkTrzszLine(typ string, got string, data string) (string, error) {
+	if got != typ {
+		switch got {
+		case "fail", "FAIL", "EXIT":
+			message, err := trzszDecode(data)
+			if err != nil {
+				return "", &trzszError{message: data}
+			}
+			return "", &trzszError{message: string(message)}
+		default:
+			return "", errors.Errorf("unexpected #%s from trzsz, expected #%s", got, typ)
+		}
+	}
+	return data, nil
+}
+
+func (t *Trzsz) recvString(typ string) (string, error) {
+	data, err := t.recvBinary(typ)
+	return string(data), err
+}
+
+func (t *Trzsz) recvBinary(typ string) ([]byte, error) {
+	line, err := t.recvLine(typ)
+	if err != nil {
+		return nil, err
+	}
+	data, err := trzszDecode(line)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid #%s from trzsz", typ)
+	}
+	return data, nil
+}
+
+func (t *Trzsz) recvInteger(typ string) (int64, error) {
+	line, err := t.recvLine(typ)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(line, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid #%s from trzsz", typ)
+	}
+	return n, nil
+}
+
+// checkInteger reads the #SUCC of trz or tsz, which has to be expected.
+func (t *Trzsz) checkInteger(expected int64) error {
+	n, err := t.recvInteger("SUCC")
+	if err != nil {
+		return err
+	}
+	if n != expected {
+		return errors.Errorf("trzsz has confirmed %d, expected %d", n, expected)
+	}
+	return nil
+}
+
+// trzszEncode compresses data with zlib and encodes it with base64.
+func trzszEncode(data []byte) string {
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	writer.Write(data)
+	writer.Close()
+	return base64.StdEncoding.EncodeToString(compressed.Bytes())
+}
+
+func trzszDecode(s string) ([]byte, error) {
+	compressed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(reader, trzszMaxLine+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress")
+	}
+	if len(data) > trzszMaxLine {
+		return nil, errors.New("too large data from trzsz")
+	}
+	return data, nil
+}
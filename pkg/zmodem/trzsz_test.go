@@ -0,0 +1,303 @@
+package zmodem
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fakeTrzsz plays trz or tsz at the other end of a pipe.
+type fakeTrzsz struct {
+	port *pipePort
+}
+
+func (f *fakeTrzsz) send(typ string, data string) {
+	f.port.Write([]byte("#" + typ + ":" + data + "\r\n"))
+}
+
+func (f *fakeTrzsz) recv(typ string) (string, error) {
+	var line []byte
+	for {
+		c, err := f.port.ReadByteTimeout(time.Second)
+		if err != nil {
+			return "", err
+		}
+		if c == '\n' {
+			break
+		}
+		line = append(line, c)
+	}
+	data, ok := strings.CutPrefix(string(line), "#"+typ+":")
+	if !ok {
+		return "", errors.Errorf("unexpected line: %q, expected #%s", line, typ)
+	}
+	return data, nil
+}
+
+func (f *fakeTrzsz) recvBinary(typ string) ([]byte, error) {
+	data, err := f.recv(typ)
+	if err != nil {
+		return nil, err
+	}
+	return trzszDecode(data)
+}
+
+func (f *fakeTrzsz) expect(typ string, expected string) error {
+	data, err := f.recv(typ)
+	if err != nil {
+		return err
+	}
+	if data != expected {
+		return errors.Errorf("unexpected #%s: %s, expected %s", typ, data, expected)
+	}
+	return nil
+}
+
+// start sends the signature and returns whether the client has confirmed the transfer.
+func (f *fakeTrzsz) start(mode TrzszMode) (bool, error) {
+	f.port.Write([]byte("::TRZSZ:TRANSFER:" + string(mode) + ":1.1.6:1234\r\n"))
+	action, err := f.recvBinary("ACT")
+	if err != nil {
+		return false, err
+	}
+	var decoded trzszAction
+	if err := json.Unmarshal(action, &decoded); err != nil {
+		return false, err
+	}
+	if decoded.Confirm {
+		f.send("CFG", trzszEncode([]byte(`{"timeout":20,"bufsize":1000,"binary":false,"overwrite":false}`)))
+	}
+	return decoded.Confirm, nil
+}
+
+// tsz sends files to the client.
+func (f *fakeTrzsz) tsz(files []memoryFile) error {
+	if _, err := f.start(TrzszReceive); err != nil {
+		return err
+	}
+	f.send("NUM", strconv.Itoa(len(files)))
+	if err := f.expect("SUCC", strconv.Itoa(len(files))); err != nil {
+		return err
+	}
+	for _, file := range files {
+		f.send("NAME", trzszEncode([]byte(file.info.Name)))
+		if _, err := f.recvBinary("SUCC"); err != nil {
+			return err
+		}
+		f.send("SIZE", strconv.Itoa(len(file.content)))
+		if err := f.expect("SUCC", strconv.Itoa(len(file.content))); err != nil {
+			return err
+		}
+		for content := file.content; len(content) > 0; {
+			n := min(len(content), 1000)
+			f.send("DATA", trzszEncode(content[:n]))
+			if err := f.expect("SUCC", strconv.Itoa(n)); err != nil {
+				return err
+			}
+			content = content[n:]
+		}
+		sum := md5.Sum(file.content)
+		f.send("MD5", trzszEncode(sum[:]))
+		if _, err := f.recvBinary("SUCC"); err != nil {
+			return err
+		}
+	}
+	_, err := f.recvBinary("EXIT")
+	return err
+}
+
+// trz receives files from the client.
+func (f *fakeTrzsz) trz() ([]memoryFile, error) {
+	confirmed, err := f.start(TrzszSend)
+	if err != nil || !confirmed {
+		return nil, err
+	}
+	num, err := f.recv("NUM")
+	if err != nil {
+		return nil, err
+	}
+	f.send("SUCC", num)
+	n, _ := strconv.Atoi(num)
+
+	var files []memoryFile
+	for i := 0; i < n; i++ {
+		name, err := f.recvBinary("NAME")
+		if err != nil {
+			return nil, err
+		}
+		f.send("SUCC", trzszEncode(append(name, ".1"...)))
+		size, err := f.recv("SIZE")
+		if err != nil {
+			return nil, err
+		}
+		f.send("SUCC", size)
+		length, _ := strconv.Atoi(size)
+
+		var content []byte
+		for len(content) < length {
+			data, err := f.recvBinary("DATA")
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > 1000 {
+				return nil, errors.Errorf("too large data: %d bytes", len(data))
+			}
+			content = append(content, data...)
+			f.send("SUCC", strconv.Itoa(len(data)))
+		}
+		sum, err := f.recvBinary("MD5")
+		if err != nil {
+			return nil, err
+		}
+		if expected := md5.Sum(content); !bytes.Equal(sum, expected[:]) {
+			return nil, errors.New("check MD5 failed")
+		}
+		f.send("SUCC", trzszEncode(sum))
+		files = append(files, memoryFile{FileInfo{Name: string(name), Size: int64(length)}, content})
+	}
+	_, err = f.recvBinary("EXIT")
+	return files, err
+}
+
+// startTrzsz starts the client end, as the bridge does once the signature is detected.
+func startTrzsz(t *testing.T, port *pipePort) *Trzsz {
+	trzsz, err := StartTrzsz(port)
+	if err != nil {
+		t.Fatalf("Unexpected error from StartTrzsz(): %s", err)
+	}
+	return trzsz
+}
+
+func TestTrzszReceive(t *testing.T) {
+	content := make([]byte, 10*1024+123)
+	rand.New(rand.NewSource(1)).Read(content)
+	files := []memoryFile{
+		{FileInfo{Name: "first.bin"}, content},
+		{FileInfo{Name: "empty"}, nil},
+	}
+
+	clientPort, serverPort := newPipePorts()
+	fake := &fakeTrzsz{port: serverPort}
+	result := make(chan error, 1)
+	go func() { result <- fake.tsz(files) }()
+
+	trzsz := startTrzsz(t, clientPort)
+	if trzsz.Mode != TrzszReceive || trzsz.Version != "1.1.6" {
+		t.Fatalf("Unexpected start of trzsz: %c %s", trzsz.Mode, trzsz.Version)
+	}
+	receiver := &testReceiver{}
+	if err := trzsz.Receive(receiver); err != nil {
+		t.Fatalf("Unexpected error from Receive(): %s", err)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("Unexpected error from tsz: %s", err)
+	}
+
+	if len(receiver.done) != 2 || receiver.done[0] != nil || receiver.done[1] != nil {
+		t.Fatalf("Unexpected results of received files: %v", receiver.done)
+	}
+	if info := receiver.offered[0]; info.Name != "first.bin" || info.Size != int64(len(content)) {
+		t.Fatalf("Unexpected file offered: %+v", info)
+	}
+	if !bytes.Equal(receiver.files[0].Bytes(), content) {
+		t.Fatalf("Unexpected content received: %d bytes", receiver.files[0].Len())
+	}
+	if receiver.offered[1].Name != "empty" || receiver.files[1].Len() != 0 {
+		t.Fatalf("Unexpected second file: %+v", receiver.offered[1])
+	}
+}
+
+func TestTrzszSend(t *testing.T) {
+	content := make([]byte, 10*1024+123)
+	rand.New(rand.NewSource(1)).Read(content)
+	files := []memoryFile{
+		{FileInfo{Name: "first.bin", Size: int64(len(content))}, content},
+		{FileInfo{Name: "empty", Size: 0}, nil},
+	}
+
+	clientPort, serverPort := newPipePorts()
+	fake := &fakeTrzsz{port: serverPort}
+	type result struct {
+		files []memoryFile
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		files, err := fake.trz()
+		results <- result{files, err}
+	}()
+
+	trzsz := startTrzsz(t, clientPort)
+	if trzsz.Mode != TrzszSend {
+		t.Fatalf("Unexpected mode of trzsz: %c", trzsz.Mode)
+	}
+	sender := &testSender{files: files}
+	if err := trzsz.Send(sender); err != nil {
+		t.Fatalf("Unexpected error from Send(): %s", err)
+	}
+	received := <-results
+	if received.err != nil {
+		t.Fatalf("Unexpected error from trz: %s", received.err)
+	}
+
+	if len(sender.done) != 2 || sender.done[0] != nil || sender.done[1] != nil {
+		t.Fatalf("Unexpected results of sent files: %v", sender.done)
+	}
+	if len(received.files) != 2 || received.files[0].info.Name != "first.bin" || !bytes.Equal(received.files[0].content, content) {
+		t.Fatalf("Unexpected files received by trz")
+	}
+	if received.files[1].info.Name != "empty" || len(received.files[1].content) != 0 {
+		t.Fatalf("Unexpected second file received by trz: %+v", received.files[1].info)
+	}
+}
+
+func TestTrzszDecline(t *testing.T) {
+	clientPort, serverPort := newPipePorts()
+	fake := &fakeTrzsz{port: serverPort}
+	results := make(chan error, 1)
+	go func() {
+		files, err := fake.trz()
+		if err == nil && files != nil {
+			err = errors.New("files received")
+		}
+		results <- err
+	}()
+
+	// no files are given to trz
+	trzsz := startTrzsz(t, clientPort)
+	if err := trzsz.Send(&testSender{}); err != nil {
+		t.Fatalf("Unexpected error from Send(): %s", err)
+	}
+	if err := <-results; err != nil {
+		t.Fatalf("Unexpected result of trz: %s", err)
+	}
+}
+
+func TestTrzszFailure(t *testing.T) {
+	clientPort, serverPort := newPipePorts()
+	fake := &fakeTrzsz{port: serverPort}
+	go func() {
+		fake.start(TrzszReceive)
+		fake.send("fail", trzszEncode([]byte("disk full")))
+	}()
+
+	trzsz := startTrzsz(t, clientPort)
+	err := trzsz.Receive(&testReceiver{})
+	if err == nil || err.Error() != "disk full" {
+		t.Fatalf("Unexpected error from Receive(): %v", err)
+	}
+	if _, ok := err.(*trzszError); !ok {
+		t.Fatalf("Unexpected type of the error: %T", err)
+	}
+	// the failure of tsz is not reported back
+	if _, err := serverPort.ReadByteTimeout(100 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("Unexpected output after the failure: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+// Package zmodem implements both ends of the ZMODEM file transfer protocol,
+// so that files can be exchanged with rz and sz running in a terminal,
+// and the client end of trzsz for trz and tsz.
+package zmodem
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrTimeout is returned by Port.ReadByteTimeout when no byte arrives in time.
+	ErrTimeout = errors.New("timeout")
+	// ErrCanceled is returned when the other end has aborted the session.
+	ErrCanceled = errors.New("transfer canceled by the other end")
+)
+
+// Port connects a session to the program in the terminal.
+type Port interface {
+	// ReadByteTimeout returns the next byte written by the program.
+	// It returns ErrTimeout when nothing arrives for timeout,
+	// and another error when the session has to stop.
+	ReadByteTimeout(timeout time.Duration) (byte, error)
+	// UnreadByte returns the last byte read to the port,
+	// so that it is left to the terminal after the session.
+	UnreadByte() error
+	// Write sends data to the input of the program.
+	Write(p []byte) (int, error)
+}
+
+// FileInfo describes a transferred file.
+type FileInfo struct {
+	Name    string
+	Size    int64 // -1 when unknown
+	ModTime time.Time
+	Mode    os.FileMode
+}
+
+// Abort makes the other end give up the session.
+// w is the Port of the session, or the input of the program.
+func Abort(w io.Writer) error {
+	_, err := w.Write(abortSequence)
+	return err
+}
+
+// timeouts and retries while waiting for the other end
+const (
+	readTimeout = 10 * time.Second
+	maxRetries  = 10
+	// finTimeout is how long the receiver waits for the "OO" closing a session.
+	finTimeout = 500 * time.Millisecond
+)
+
+// abortSequence is 8 CANs to abort, and backspaces to erase them from a screen.
+var abortSequence = []byte("\x18\x18\x18\x18\x18\x18\x18\x18\x08\x08\x08\x08\x08\x08\x08\x08")
+
+// overAndOut ends a session after ZFIN.
+const overAndOut = "OO"
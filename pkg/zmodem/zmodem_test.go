@@ -0,0 +1,225 @@
+package zmodem
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipePort reads what the other end of a pipe has written.
+type pipePort struct {
+	in      chan byte
+	out     chan byte
+	last    byte
+	unread  bool
+	corrupt func(written int, b byte) byte
+	written int
+}
+
+func newPipePorts() (*pipePort, *pipePort) {
+	a, b := make(chan byte, 1<<20), make(chan byte, 1<<20)
+	return &pipePort{in: a, out: b}, &pipePort{in: b, out: a}
+}
+
+func (p *pipePort) ReadByteTimeout(timeout time.Duration) (byte, error) {
+	if p.unread {
+		p.unread = false
+		return p.last, nil
+	}
+	select {
+	case p.last = <-p.in:
+		return p.last, nil
+	case <-time.After(timeout):
+		return 0, ErrTimeout
+	}
+}
+
+func (p *pipePort) UnreadByte() error {
+	p.unread = true
+	return nil
+}
+
+func (p *pipePort) Write(data []byte) (int, error) {
+	for _, b := range data {
+		if p.corrupt != nil {
+			b = p.corrupt(p.written, b)
+		}
+		p.written++
+		p.out <- b
+	}
+	return len(data), nil
+}
+
+type memoryFile struct {
+	info    FileInfo
+	content []byte
+}
+
+type testReceiver struct {
+	files   []*bytes.Buffer
+	offered []FileInfo
+	done    []error
+}
+
+func (r *testReceiver) Offer(info FileInfo) (io.Writer, error) {
+	r.offered = append(r.offered, info)
+	buffer := new(bytes.Buffer)
+	r.files = append(r.files, buffer)
+	return buffer, nil
+}
+
+func (r *testReceiver) Done(info FileInfo, err error) {
+	r.done = append(r.done, err)
+}
+
+type testSender struct {
+	files []memoryFile
+	next  int
+	done  []error
+}
+
+func (s *testSender) Next() (FileInfo, io.Reader, error) {
+	if s.next == len(s.files) {
+		return FileInfo{}, nil, io.EOF
+	}
+	file := s.files[s.next]
+	s.next++
+	return file.info, bytes.NewReader(file.content), nil
+}
+
+func (s *testSender) Done(info FileInfo, err error) {
+	s.done = append(s.done, err)
+}
+
+func TestHeaders(t *testing.T) {
+	ready := string(flagsHeader(zrinit, canfdx|canovio|canfc32).hex())
+	if expected := "**\x18B0100000023be50\r\x8a\x11"; ready != expected {
+		t.Fatalf("Unexpected ZRINIT: %q, expected %q", ready, expected)
+	}
+
+	request := string(positionHeader(zrqinit, 0).hex())
+	if expected := "**\x18B00000000000000\r\x8a\x11"; request != expected {
+		t.Fatalf("Unexpected ZRQINIT: %q, expected %q", request, expected)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	content := make([]byte, 100*1024+123)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	for _, corrupt := range []bool{false, true} {
+		senderPort, receiverPort := newPipePorts()
+		if corrupt {
+			damaged := false
+			senderPort.corrupt = func(written int, b byte) byte {
+				if written == 50000 && !damaged {
+					damaged = true
+					return b ^ 0x01
+				}
+				return b
+			}
+		}
+
+		files := []memoryFile{
+			{FileInfo{Name: "first.bin", Size: int64(len(content)), ModTime: time.Unix(1700000000, 0), Mode: 0640}, content},
+			{FileInfo{Name: "empty", Size: 0}, nil},
+		}
+		sender := &testSender{files: files}
+		receiver := &testReceiver{}
+
+		// sz starts with ZRQINIT
+		senderPort.Write(positionHeader(zrqinit, 0).hex())
+
+		var wg sync.WaitGroup
+		var sendErr, receiveErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			sendErr = Send(senderPort, sender)
+			senderPort.Write([]byte("$ "))
+		}()
+		go func() {
+			defer wg.Done()
+			receiveErr = Receive(receiverPort, receiver)
+		}()
+		wg.Wait()
+
+		if sendErr != nil || receiveErr != nil {
+			t.Fatalf("Unexpected errors from Send() and Receive(): %v, %v", sendErr, receiveErr)
+		}
+		if len(sender.done) != 2 || sender.done[0] != nil || sender.done[1] != nil {
+			t.Fatalf("Unexpected results of sent files: %v", sender.done)
+		}
+		if len(receiver.done) != 2 || receiver.done[0] != nil || receiver.done[1] != nil {
+			t.Fatalf("Unexpected results of received files: %v", receiver.done)
+		}
+
+		info := receiver.offered[0]
+		if info.Name != "first.bin" || info.Size != int64(len(content)) || info.Mode != 0640 || info.ModTime.Unix() != 1700000000 {
+			t.Fatalf("Unexpected file offered: %+v", info)
+		}
+		if !bytes.Equal(receiver.files[0].Bytes(), content) {
+			t.Fatalf("Unexpected content received: %d bytes", receiver.files[0].Len())
+		}
+		if receiver.offered[1].Name != "empty" || receiver.files[1].Len() != 0 {
+			t.Fatalf("Unexpected second file: %+v", receiver.offered[1])
+		}
+
+		// the output following the session is left to the terminal
+		var rest []byte
+		for {
+			c, err := receiverPort.ReadByteTimeout(100 * time.Millisecond)
+			if err != nil {
+				break
+			}
+			rest = append(rest, c)
+		}
+		if string(rest) != "$ " {
+			t.Fatalf("Unexpected output after the session: %q", rest)
+		}
+	}
+}
+
+func TestCanceled(t *testing.T) {
+	senderPort, receiverPort := newPipePorts()
+	senderPort.Write(positionHeader(zrqinit, 0).hex())
+	Abort(senderPort)
+
+	err := Receive(receiverPort, &testReceiver{})
+	if err != ErrCanceled {
+		t.Fatalf("Unexpected error from Receive(): %v", err)
+	}
+}
+
+func TestDetector(t *testing.T) {
+	var detector Detector
+
+	kind, _, _ := detector.Scan([]byte("$ ls\r\n"))
+	if kind != KindNone {
+		t.Fatalf("Unexpected kind detected: %d", kind)
+	}
+
+	// the signature of sz split across chunks
+	kind, _, _ = detector.Scan([]byte("$ sz foo\r\nrz\r**\x18"))
+	if kind != KindNone {
+		t.Fatalf("Unexpected kind detected: %d", kind)
+	}
+	kind, offset, start := detector.Scan([]byte("B00000000000000\r\x8a\x11"))
+	if kind != KindReceive || offset != 0 || string(start) != "**\x18" {
+		t.Fatalf("Unexpected detection: %d %d %q", kind, offset, start)
+	}
+
+	detector.Reset()
+	kind, offset, start = detector.Scan([]byte("rz waiting to receive.**\x18B0100000023be50\r\x8a\x11"))
+	if kind != KindSend || offset != 22 || start != nil {
+		t.Fatalf("Unexpected detection: %d %d %q", kind, offset, start)
+	}
+
+	kind, _, _ = detector.Scan([]byte("\x1b7\x07::TRZSZ:TRANSFER:S:1.1.6:1234\r\n"))
+	if kind != KindTrzsz {
+		t.Fatalf("Unexpected kind detected: %d", kind)
+	}
+}
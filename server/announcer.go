@@ -0,0 +1,50 @@
+package server
+
+import (
+	"sync"
+)
+
+// announcer delivers the announcements of a group, such as its write control,
+// in order without blocking the other groups on a slow client.
+// Announcements are queued with push while the lock of the group's registry
+// is held, which keeps them in the order of the changes, and sent by flush
+// after releasing it. Only one caller flushes a group at a time,
+// sending the announcements the others have queued meanwhile as well.
+type announcer struct {
+	mutex   sync.Mutex
+	queue   []func()
+	sending bool
+}
+
+// push queues announcements and reports whether the caller has to flush them,
+// because nobody is sending the announcements of the group.
+func (a *announcer) push(announcements ...func()) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.queue = append(a.queue, announcements...)
+	if a.sending || len(a.queue) == 0 {
+		return false
+	}
+	a.sending = true
+	return true
+}
+
+// flush sends the queued announcements until none is left.
+// It must be called only when push has returned true.
+func (a *announcer) flush() {
+	a.mutex.Lock()
+	for len(a.queue) > 0 {
+		announcements := a.queue
+		a.queue = nil
+		a.mutex.Unlock()
+
+		for _, announce := range announcements {
+			announce()
+		}
+
+		a.mutex.Lock()
+	}
+	a.sending = false
+	a.mutex.Unlock()
+}
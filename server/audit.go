@@ -0,0 +1,21 @@
+package server
+
+import (
+	"log"
+
+	"github.com/yudai/gotty/pkg/audit"
+)
+
+// auditQueueSize is the number of entries buffered for the audit file
+// before entries are discarded to keep the terminals responsive.
+const auditQueueSize = 4096
+
+// closeAudit writes the queued entries of the audit file and closes it.
+func closeAudit(queue *audit.Queue, path string) {
+	if err := queue.Close(); err != nil {
+		log.Printf("Failed to write audit log %s: %s", path, err)
+	}
+	if dropped := queue.Dropped(); dropped > 0 {
+		log.Printf("Audit log %s is missing %d entries, writing it could not keep up", path, dropped)
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// authTokens mints and verifies the tokens browsers send in the init message of
+// WebSocket connections instead of the credential. A token is signed with HMAC-SHA256,
+// is bound to a user and an expiry, and is accepted only once by this server.
+type authTokens struct {
+	secret   []byte
+	lifetime time.Duration
+
+	mutex sync.Mutex
+	used  map[string]time.Time // expiries of used tokens, by nonce
+}
+
+type authTokenClaims struct {
+	User    string   `json:"u"`
+	Groups  []string `json:"g,omitempty"` // given by the login of the user
+	Expires int64    `json:"e"`           // Unix seconds
+	Nonce   string   `json:"n"`
+}
+
+// newAuthTokens creates authTokens signing with secret, or with a random secret when it's empty.
+func newAuthTokens(secret string, lifetime time.Duration) (*authTokens, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, errors.Wrapf(err, "failed to generate auth token secret")
+		}
+	}
+	return &authTokens{
+		secret:   key,
+		lifetime: lifetime,
+		used:     make(map[string]time.Time),
+	}, nil
+}
+
+// mint returns a new token of user in groups.
+func (tokens *authTokens) mint(user string, groups []string) string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	claims, _ := json.Marshal(authTokenClaims{
+		User:    user,
+		Groups:  groups,
+		Expires: time.Now().Add(tokens.lifetime).Unix(),
+		Nonce:   base64.RawURLEncoding.EncodeToString(nonce),
+	})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokens.sign(payload))
+}
+
+// verify returns the user of token and its groups, and uses the token up.
+func (tokens *authTokens) verify(token string) (string, []string, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", nil, errors.New("malformed auth token")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, tokens.sign(payload)) {
+		return "", nil, errors.New("invalid signature of auth token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, errors.New("malformed auth token")
+	}
+	var claims authTokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return "", nil, errors.New("malformed auth token")
+	}
+
+	now := time.Now()
+	expires := time.Unix(claims.Expires, 0)
+	if !now.Before(expires) {
+		return "", nil, errors.New("auth token expired")
+	}
+
+	tokens.mutex.Lock()
+	defer tokens.mutex.Unlock()
+	for nonce, expiry := range tokens.used {
+		if !now.Before(expiry) {
+			delete(tokens.used, nonce)
+		}
+	}
+	if _, ok := tokens.used[claims.Nonce]; ok {
+		return "", nil, errors.New("auth token already used")
+	}
+	tokens.used[claims.Nonce] = expires
+	return claims.User, claims.Groups, nil
+}
+
+func (tokens *authTokens) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, tokens.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// requestUser authenticates the credential of Basic Authentication sent with a WebSocket
+// request, or the user given by a trusted proxy, which only clients other than browsers
+// can use. Browsers, which always send Origin and would send the credential on behalf
+// of any page, have to present a token.
+func (server *Server) requestUser(r *http.Request) (string, bool) {
+	if r.Header.Get("Origin") != "" {
+		return "", false
+	}
+	if user, ok := server.proxyUser(r); ok {
+		return user, true
+	}
+	if !server.options.EnableBasicAuth {
+		return "", false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	return server.authenticate(user + ":" + password)
+}
+
+// authenticateConnection returns the user of a WebSocket connection and its groups,
+// whose request has been authenticated by requestUser or whose init message has token.
+func (server *Server) authenticateConnection(ctx context.Context, token string) (string, []string, error) {
+	if !server.authEnabled() {
+		return "", nil, nil
+	}
+	if user, ok := ctx.Value(userContextKey).(string); ok {
+		return user, nil, nil
+	}
+	return server.authTokens.verify(token)
+}
+
+// mintAuthToken returns a token for the user of a request, empty without authentication.
+func (server *Server) mintAuthToken(r *http.Request) string {
+	if !server.authEnabled() {
+		return ""
+	}
+	return server.authTokens.mint(userFromContext(r.Context()), groupsFromContext(r.Context()))
+}
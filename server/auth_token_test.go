@@ -0,0 +1,65 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthTokens(t *testing.T) {
+	tokens, err := newAuthTokens("secret", time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error from newAuthTokens(): %s", err)
+	}
+
+	token := tokens.mint("alice", []string{"ops"})
+	user, groups, err := tokens.verify(token)
+	if err != nil {
+		t.Fatalf("Unexpected error from verify(): %s", err)
+	}
+	if user != "alice" || len(groups) != 1 || groups[0] != "ops" {
+		t.Fatalf("Unexpected results of verify(): %s %v", user, groups)
+	}
+
+	// replayed
+	if _, _, err := tokens.verify(token); err == nil {
+		t.Fatalf("Expected an error from verify() of a used token")
+	}
+
+	// signed with another key
+	others, _ := newAuthTokens("other", time.Minute)
+	if _, _, err := tokens.verify(others.mint("alice", nil)); err == nil {
+		t.Fatalf("Expected an error from verify() of a token signed with another key")
+	}
+
+	// tampered
+	payload, signature, _ := strings.Cut(tokens.mint("alice", nil), ".")
+	forged, _, _ := strings.Cut(tokens.mint("mallory", nil), ".")
+	for _, token := range []string{forged + "." + signature, payload + ".", payload, payload + "." + signature + "x"} {
+		if _, _, err := tokens.verify(token); err == nil {
+			t.Fatalf("Expected an error from verify() of `%s`", token)
+		}
+	}
+
+	// expired
+	expired, _ := newAuthTokens("secret", -time.Second)
+	if _, _, err := tokens.verify(expired.mint("alice", nil)); err == nil {
+		t.Fatalf("Expected an error from verify() of an expired token")
+	}
+}
+
+func TestAuthTokensPruning(t *testing.T) {
+	tokens, _ := newAuthTokens("", time.Minute)
+	tokens.used["old"] = time.Now().Add(-time.Second)
+	tokens.used["recent"] = time.Now().Add(time.Minute)
+
+	if _, _, err := tokens.verify(tokens.mint("alice", nil)); err != nil {
+		t.Fatalf("Unexpected error from verify(): %s", err)
+	}
+	if _, ok := tokens.used["old"]; ok {
+		t.Fatalf("Expected the expired nonce to be pruned")
+	}
+	if _, ok := tokens.used["recent"]; !ok || len(tokens.used) != 2 {
+		t.Fatalf("Unexpected used nonces: %v", tokens.used)
+	}
+}
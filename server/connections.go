@@ -1,30 +1,61 @@
 package server
 
 import (
+	"context"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/yudai/gotty/webtty"
 )
 
 // ConnectionInfo represents information about a connected client
 type ConnectionInfo struct {
-	ID          string          `json:"id"`
-	RemoteAddr  string          `json:"remote_addr"`
-	ConnectedAt time.Time       `json:"connected_at"`
-	SessionName string          `json:"session_name,omitempty"`
-	Arguments   string          `json:"arguments,omitempty"`
-	conn        *websocket.Conn // unexported field to store the actual connection
+	ID          string     `json:"id"`
+	RemoteAddr  string     `json:"remote_addr"`
+	Username    string     `json:"username,omitempty"` // authenticated user, if any
+	Role        string     `json:"role"`               // role of the user, one of viewer, operator or admin
+	ConnectedAt time.Time  `json:"connected_at"`
+	SessionName string     `json:"session_name,omitempty"`
+	Arguments   string     `json:"arguments,omitempty"`
+	ShareKey    string     `json:"share_key,omitempty"` // connections with the same key share a process
+	Writable    bool       `json:"writable"`            // holds the write control of its terminal
+	RTT         float64    `json:"rtt_ms,omitempty"`    // last round trip time of a heartbeat
+	BytesIn     int64      `json:"bytes_in"`
+	BytesOut    int64      `json:"bytes_out"`
+	MessagesIn  int64      `json:"messages_in"`
+	MessagesOut int64      `json:"messages_out"`
+	LastInputAt *time.Time `json:"last_input_at,omitempty"`
+	Compressed  bool       `json:"compressed"`                  // permessage-deflate has been negotiated
+	WireIn      int64      `json:"wire_bytes_in"`               // bytes received on the wire, including WebSocket framing
+	WireOut     int64      `json:"wire_bytes_out"`              // bytes sent on the wire, including WebSocket framing
+	Compression float64    `json:"compression_ratio,omitempty"` // bytes of output messages per byte sent on the wire
+	Version     int        `json:"protocol_version"`            // 0 for clients older than protocol versions
+	Features    []string   `json:"features"`                    // features chosen for the connection
+	Unknown     int64      `json:"unknown_messages,omitempty"`  // messages of unknown types, which are ignored
+	conn        *wsWrapper // unexported field to store the actual connection
+	role        role
+	tty         *webtty.WebTTY
+	cancel      context.CancelCauseFunc
+	transfers   []FileTransferRecord
 }
 
 // ConnectionHistoryEntry represents a historical connection record
 type ConnectionHistoryEntry struct {
 	RemoteAddr     string    `json:"remote_addr"`
+	Username       string    `json:"username,omitempty"`
 	ConnectedAt    time.Time `json:"connected_at"`
 	DisconnectedAt time.Time `json:"disconnected_at"`
 	Duration       string    `json:"duration"`
 	SessionName    string    `json:"session_name,omitempty"`
 	Arguments      string    `json:"arguments,omitempty"`
+	ShareKey       string    `json:"share_key,omitempty"`
+	CloseReason    string    `json:"close_reason,omitempty"`
+	BytesIn        int64     `json:"bytes_in"`
+	BytesOut       int64     `json:"bytes_out"`
+	MessagesIn     int64     `json:"messages_in"`
+	MessagesOut    int64     `json:"messages_out"`
+
+	Transfers []FileTransferRecord `json:"transfers,omitempty"`
 }
 
 // ConnectionTracker tracks active WebSocket connections and maintains history
@@ -45,13 +76,14 @@ func NewConnectionTracker() *ConnectionTracker {
 }
 
 // Add adds a new connection to the tracker
-func (ct *ConnectionTracker) Add(id, remoteAddr, sessionName, arguments string) {
+func (ct *ConnectionTracker) Add(id, remoteAddr, username, sessionName, arguments string) {
 	ct.mu.Lock()
 	defer ct.mu.Unlock()
 
 	ct.connections[id] = &ConnectionInfo{
 		ID:          id,
 		RemoteAddr:  remoteAddr,
+		Username:    username,
 		ConnectedAt: time.Now(),
 		SessionName: sessionName,
 		Arguments:   arguments,
@@ -60,7 +92,7 @@ func (ct *ConnectionTracker) Add(id, remoteAddr, sessionName, arguments string)
 }
 
 // SetConn sets the WebSocket connection for a tracked connection
-func (ct *ConnectionTracker) SetConn(id string, conn *websocket.Conn) {
+func (ct *ConnectionTracker) SetConn(id string, conn *wsWrapper) {
 	ct.mu.Lock()
 	defer ct.mu.Unlock()
 
@@ -69,26 +101,146 @@ func (ct *ConnectionTracker) SetConn(id string, conn *websocket.Conn) {
 	}
 }
 
+// SetShareKey records the key of the process shared by a tracked connection
+func (ct *ConnectionTracker) SetShareKey(id string, shareKey string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if connInfo, exists := ct.connections[id]; exists {
+		connInfo.ShareKey = shareKey
+	}
+}
+
+// SetCapabilities records the protocol version and features chosen for a tracked connection
+func (ct *ConnectionTracker) SetCapabilities(id string, capabilities webtty.CapabilitiesMessage) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if connInfo, exists := ct.connections[id]; exists {
+		connInfo.Version = capabilities.Version
+		connInfo.Features = capabilities.Features
+	}
+}
+
+// SetRole records the role of the user of a tracked connection
+func (ct *ConnectionTracker) SetRole(id string, r role) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if connInfo, exists := ct.connections[id]; exists {
+		connInfo.role = r
+		connInfo.Role = r.String()
+	}
+}
+
+// roleOf returns the role of the user of a tracked connection
+func (ct *ConnectionTracker) roleOf(id string) (role, bool) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+
+	connInfo, exists := ct.connections[id]
+	if !exists {
+		return roleViewer, false
+	}
+	return connInfo.role, true
+}
+
+// SetWritable records whether a tracked connection holds the write control
+func (ct *ConnectionTracker) SetWritable(id string, writable bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if connInfo, exists := ct.connections[id]; exists {
+		connInfo.Writable = writable
+	}
+}
+
+// SetTTY sets the running WebTTY of a tracked connection, which is used to send notices
+func (ct *ConnectionTracker) SetTTY(id string, tty *webtty.WebTTY, cancel context.CancelCauseFunc) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if connInfo, exists := ct.connections[id]; exists {
+		connInfo.tty = tty
+		connInfo.cancel = cancel
+	}
+}
+
+// AddFileTransfer records a finished file transfer of a connection
+func (ct *ConnectionTracker) AddFileTransfer(id string, record FileTransferRecord) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if connInfo, exists := ct.connections[id]; exists {
+		connInfo.transfers = append(connInfo.transfers, record)
+		if len(connInfo.transfers) > maxFileTransferRecords {
+			connInfo.transfers = connInfo.transfers[len(connInfo.transfers)-maxFileTransferRecords:]
+		}
+	}
+}
+
 // Kick closes a connection by ID
 func (ct *ConnectionTracker) Kick(id string) error {
+	ct.close(id, &connectionClosed{reason: "administrator", notice: kickedNotice})
+	return nil
+}
+
+// close cancels a connection by ID with the cause, which tells the client why
+func (ct *ConnectionTracker) close(id string, cause *connectionClosed) {
 	ct.mu.Lock()
 	defer ct.mu.Unlock()
 
 	connInfo, exists := ct.connections[id]
 	if !exists {
-		return nil // Connection not found, already disconnected
+		return // Connection not found, already disconnected
 	}
 
-	if connInfo.conn != nil {
+	if connInfo.cancel != nil {
+		// The connection sends the notice and closes itself
+		connInfo.cancel(cause)
+	} else if connInfo.conn != nil {
 		// Close the WebSocket connection
 		connInfo.conn.Close()
 	}
+}
 
-	return nil
+// Notify sends a notice to a connection by ID without closing it
+func (ct *ConnectionTracker) Notify(id string, notice webtty.NoticeMessage) bool {
+	ct.mu.RLock()
+	connInfo, exists := ct.connections[id]
+	var tty *webtty.WebTTY
+	if exists {
+		tty = connInfo.tty
+	}
+	ct.mu.RUnlock()
+
+	if tty == nil {
+		return false
+	}
+	tty.SendNotice(notice)
+	return true
+}
+
+// NotifyAll sends a notice to all active connections and returns the number of notified connections
+func (ct *ConnectionTracker) NotifyAll(notice webtty.NoticeMessage) int {
+	ct.mu.RLock()
+	ttys := make([]*webtty.WebTTY, 0, len(ct.connections))
+	for _, connInfo := range ct.connections {
+		if connInfo.tty != nil {
+			ttys = append(ttys, connInfo.tty)
+		}
+	}
+	ct.mu.RUnlock()
+
+	// a stalled client must not hold up the others
+	for _, tty := range ttys {
+		go tty.SendNotice(notice)
+	}
+	return len(ttys)
 }
 
-// Remove removes a connection from the tracker and adds it to history
-func (ct *ConnectionTracker) Remove(id string) {
+// Remove removes a connection from the tracker and adds it to history with the reason it was closed
+func (ct *ConnectionTracker) Remove(id string, closeReason string) {
 	ct.mu.Lock()
 	defer ct.mu.Unlock()
 
@@ -101,12 +253,17 @@ func (ct *ConnectionTracker) Remove(id string) {
 		// Create history entry
 		historyEntry := &ConnectionHistoryEntry{
 			RemoteAddr:     conn.RemoteAddr,
+			Username:       conn.Username,
 			ConnectedAt:    conn.ConnectedAt,
 			DisconnectedAt: disconnectedAt,
 			Duration:       formatDuration(duration),
 			SessionName:    conn.SessionName,
 			Arguments:      conn.Arguments,
+			ShareKey:       conn.ShareKey,
+			CloseReason:    closeReason,
+			Transfers:      conn.transfers,
 		}
+		historyEntry.setStats(conn.stats())
 
 		// Add to history (newest first)
 		ct.history = append([]*ConnectionHistoryEntry{historyEntry}, ct.history...)
@@ -126,9 +283,28 @@ func (ct *ConnectionTracker) List() []*ConnectionInfo {
 	ct.mu.RLock()
 	defer ct.mu.RUnlock()
 
+	// copies are returned, with live traffic counters
 	connections := make([]*ConnectionInfo, 0, len(ct.connections))
 	for _, conn := range ct.connections {
-		connections = append(connections, conn)
+		info := *conn
+		stats := conn.stats()
+		info.BytesIn = stats.BytesIn
+		info.BytesOut = stats.BytesOut
+		info.MessagesIn = stats.MessagesIn
+		info.MessagesOut = stats.MessagesOut
+		info.Unknown = stats.UnknownMessages
+		if !stats.LastInput.IsZero() {
+			info.LastInputAt = &stats.LastInput
+		}
+		if conn.conn != nil {
+			info.RTT = float64(conn.conn.roundTripTime()) / float64(time.Millisecond)
+			info.Compressed = conn.conn.compressed
+			info.WireIn, info.WireOut = conn.conn.wireBytes()
+			if info.WireOut > 0 {
+				info.Compression = float64(stats.BytesOut) / float64(info.WireOut)
+			}
+		}
+		connections = append(connections, &info)
 	}
 
 	return connections
@@ -154,12 +330,16 @@ func (ct *ConnectionTracker) GetHistory() []*ConnectionHistoryEntry {
 	for _, conn := range ct.connections {
 		entry := &ConnectionHistoryEntry{
 			RemoteAddr:     conn.RemoteAddr,
+			Username:       conn.Username,
 			ConnectedAt:    conn.ConnectedAt,
 			DisconnectedAt: time.Time{}, // Zero time indicates still connected
 			Duration:       formatDuration(time.Since(conn.ConnectedAt)),
 			SessionName:    conn.SessionName,
 			Arguments:      conn.Arguments,
+			ShareKey:       conn.ShareKey,
+			Transfers:      append([]FileTransferRecord(nil), conn.transfers...),
 		}
+		entry.setStats(conn.stats())
 		combined = append(combined, entry)
 	}
 
@@ -169,6 +349,21 @@ func (ct *ConnectionTracker) GetHistory() []*ConnectionHistoryEntry {
 	return combined
 }
 
+// stats returns the traffic counters of the connection, zero before its WebTTY is running.
+func (conn *ConnectionInfo) stats() webtty.Stats {
+	if conn.tty == nil {
+		return webtty.Stats{}
+	}
+	return conn.tty.Stats()
+}
+
+func (entry *ConnectionHistoryEntry) setStats(stats webtty.Stats) {
+	entry.BytesIn = stats.BytesIn
+	entry.BytesOut = stats.BytesOut
+	entry.MessagesIn = stats.MessagesIn
+	entry.MessagesOut = stats.MessagesOut
+}
+
 // formatDuration formats a duration into a human-readable string
 func formatDuration(d time.Duration) string {
 	if d < time.Second {
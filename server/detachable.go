@@ -0,0 +1,364 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/yudai/gotty/pkg/randomstring"
+	"github.com/yudai/gotty/webtty"
+)
+
+// detachableChunks is the number of output chunks buffered for the client.
+const detachableChunks = 64
+
+// resumeTokenLength is the length of resume tokens, which are as good as credentials.
+const resumeTokenLength = 32
+
+// DetachedSessionInfo represents a process kept after its client has dropped.
+type DetachedSessionInfo struct {
+	ID          string    `json:"id"` // ID of the connection which started the process
+	RemoteAddr  string    `json:"remote_addr"`
+	Username    string    `json:"username,omitempty"` // authenticated user, the only one who can resume the process
+	SessionName string    `json:"session_name,omitempty"`
+	Arguments   string    `json:"arguments,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	DetachedAt  time.Time `json:"detached_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Buffered    int       `json:"buffered_bytes"` // output replayed to the client resuming the process
+}
+
+// detachableSessions keeps the slaves of connections which have dropped
+// for a grace period, so that their clients can resume them with a token
+// instead of starting a new process.
+type detachableSessions struct {
+	mutex       sync.Mutex
+	sessions    map[string]*detachableSession // by resume token
+	gracePeriod time.Duration
+	maxDetached int
+	bufferSize  int
+}
+
+// detachableSession runs a slave for one connection at a time and keeps
+// its recent output, which is replayed to the connection resuming it.
+type detachableSession struct {
+	registry    *detachableSessions
+	id          string
+	token       string
+	slave       Slave
+	remoteAddr  string
+	username    string
+	sessionName string
+	arguments   string
+	startedAt   time.Time
+	buffer      *webtty.Scrollback
+
+	// client is changed with both the mutex of the registry and this mutex held
+	mutex      sync.Mutex
+	client     *detachableClient // nil while detached
+	detachedAt time.Time
+	timer      *time.Timer
+	ended      chan struct{} // closed when the slave output ends
+}
+
+// detachableClient is the Slave given to the connection attached to a detachableSession.
+type detachableClient struct {
+	session *detachableSession
+	chunks  chan []byte
+	pending []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newDetachableSessions(gracePeriod time.Duration, maxDetached int, bufferSize int) *detachableSessions {
+	return &detachableSessions{
+		sessions:    make(map[string]*detachableSession),
+		gracePeriod: gracePeriod,
+		maxDetached: maxDetached,
+		bufferSize:  bufferSize,
+	}
+}
+
+// start runs a new slave created by create and returns its client.
+// id, remoteAddr, username, sessionName and arguments describe the connection for the API,
+// and only username can resume the session.
+func (sds *detachableSessions) start(id, remoteAddr, username, sessionName, arguments string, create func() (Slave, error)) (*detachableClient, error) {
+	slave, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &detachableSession{
+		registry:    sds,
+		id:          id,
+		token:       randomstring.Generate(resumeTokenLength),
+		slave:       slave,
+		remoteAddr:  remoteAddr,
+		username:    username,
+		sessionName: sessionName,
+		arguments:   arguments,
+		startedAt:   time.Now(),
+		buffer:      webtty.NewScrollback(sds.bufferSize),
+		ended:       make(chan struct{}),
+	}
+	client := newDetachableClient(session)
+	session.client = client
+
+	sds.mutex.Lock()
+	sds.sessions[session.token] = session
+	sds.mutex.Unlock()
+
+	go session.run()
+	return client, nil
+}
+
+// resume attaches a new client to the detached session of token for username.
+// It returns false when there is no such session, it has been started by another user
+// or it's attached to another connection.
+// The client starts by reading the recent output of the slave.
+func (sds *detachableSessions) resume(token string, username string) (*detachableClient, bool) {
+	sds.mutex.Lock()
+	defer sds.mutex.Unlock()
+
+	session, ok := sds.sessions[token]
+	if !ok || session.username != username {
+		return nil, false
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.client != nil {
+		return nil, false
+	}
+
+	if session.timer != nil {
+		session.timer.Stop()
+		session.timer = nil
+	}
+	client := newDetachableClient(session)
+	client.pending = session.buffer.Bytes()
+	session.client = client
+	return client, true
+}
+
+// detach removes client from its session. The session is kept for the grace period
+// when keep is true, unless the slave has ended or too many sessions are detached already.
+// Otherwise the slave is closed.
+func (sds *detachableSessions) detach(client *detachableClient, keep bool) error {
+	session := client.session
+
+	sds.mutex.Lock()
+	session.mutex.Lock()
+	if session.client != client {
+		session.mutex.Unlock()
+		sds.mutex.Unlock()
+		return nil
+	}
+	session.client = nil
+
+	select {
+	case <-session.ended:
+		keep = false
+	default:
+	}
+	if keep && sds.detachedCount() <= sds.maxDetached {
+		detachedAt := time.Now()
+		session.detachedAt = detachedAt
+		session.timer = time.AfterFunc(sds.gracePeriod, func() {
+			sds.expire(session, detachedAt)
+		})
+		session.mutex.Unlock()
+		sds.mutex.Unlock()
+		return nil
+	}
+
+	session.mutex.Unlock()
+	if sds.sessions[session.token] == session {
+		delete(sds.sessions, session.token)
+	}
+	sds.mutex.Unlock()
+
+	// closing can take a while, don't block other connections meanwhile
+	return session.slave.Close()
+}
+
+// expire closes the session detached at detachedAt unless it has been resumed since.
+func (sds *detachableSessions) expire(session *detachableSession, detachedAt time.Time) {
+	sds.mutex.Lock()
+	if session.client != nil || !session.detachedAt.Equal(detachedAt) || sds.sessions[session.token] != session {
+		sds.mutex.Unlock()
+		return
+	}
+	delete(sds.sessions, session.token)
+	sds.mutex.Unlock()
+
+	session.slave.Close()
+}
+
+// detachedCount must be called with the lock held.
+func (sds *detachableSessions) detachedCount() int {
+	count := 0
+	for _, session := range sds.sessions {
+		if session.client == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// list returns the detached sessions.
+func (sds *detachableSessions) list() []DetachedSessionInfo {
+	sds.mutex.Lock()
+	defer sds.mutex.Unlock()
+
+	list := make([]DetachedSessionInfo, 0)
+	for _, session := range sds.sessions {
+		if session.client != nil {
+			continue
+		}
+		list = append(list, DetachedSessionInfo{
+			ID:          session.id,
+			RemoteAddr:  session.remoteAddr,
+			Username:    session.username,
+			SessionName: session.sessionName,
+			Arguments:   session.arguments,
+			StartedAt:   session.startedAt,
+			DetachedAt:  session.detachedAt,
+			ExpiresAt:   session.detachedAt.Add(sds.gracePeriod),
+			Buffered:    len(session.buffer.Bytes()),
+		})
+	}
+	return list
+}
+
+// closeAll closes the detached sessions, typically when the server stops.
+func (sds *detachableSessions) closeAll() {
+	sds.mutex.Lock()
+	var sessions []*detachableSession
+	for token, session := range sds.sessions {
+		if session.client == nil {
+			if session.timer != nil {
+				session.timer.Stop()
+			}
+			delete(sds.sessions, token)
+			sessions = append(sessions, session)
+		}
+	}
+	sds.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.slave.Close()
+	}
+}
+
+// run reads the slave, keeping its output and handing it to the client if any.
+func (session *detachableSession) run() {
+	defer func() {
+		close(session.ended)
+
+		// a detached session has no connection to close the slave
+		sds := session.registry
+		sds.mutex.Lock()
+		detached := session.client == nil && sds.sessions[session.token] == session
+		if sds.sessions[session.token] == session {
+			delete(sds.sessions, session.token)
+		}
+		if session.timer != nil {
+			session.timer.Stop()
+		}
+		sds.mutex.Unlock()
+		if detached {
+			session.slave.Close()
+		}
+	}()
+
+	buffer := make([]byte, 1024)
+	for {
+		n, err := session.slave.Read(buffer)
+		if err != nil {
+			return
+		}
+		chunk := make([]byte, n)
+		copy(chunk, buffer[:n])
+
+		session.mutex.Lock()
+		session.buffer.Append(session, chunk)
+		client := session.client
+		session.mutex.Unlock()
+
+		if client != nil {
+			select {
+			case client.chunks <- chunk:
+			case <-client.done:
+			}
+		}
+	}
+}
+
+func newDetachableClient(session *detachableSession) *detachableClient {
+	return &detachableClient{
+		session: session,
+		chunks:  make(chan []byte, detachableChunks),
+		done:    make(chan struct{}),
+	}
+}
+
+func (client *detachableClient) Read(p []byte) (n int, err error) {
+	for len(client.pending) == 0 {
+		select {
+		case client.pending = <-client.chunks:
+		case <-client.done:
+			return 0, io.EOF
+		case <-client.session.ended:
+			// deliver chunks sent before the end
+			select {
+			case client.pending = <-client.chunks:
+			default:
+				return 0, io.EOF
+			}
+		}
+	}
+
+	n = copy(p, client.pending)
+	client.pending = client.pending[n:]
+	return n, nil
+}
+
+func (client *detachableClient) Write(p []byte) (n int, err error) {
+	return client.session.slave.Write(p)
+}
+
+func (client *detachableClient) WindowTitleVariables() map[string]interface{} {
+	return client.session.slave.WindowTitleVariables()
+}
+
+func (client *detachableClient) ResizeTerminal(columns int, rows int) error {
+	return client.session.slave.ResizeTerminal(columns, rows)
+}
+
+func (client *detachableClient) Secret() bool {
+	if reporter, ok := client.session.slave.(webtty.SecretReporter); ok {
+		return reporter.Secret()
+	}
+	return false
+}
+
+// Close closes the client along with the slave.
+func (client *detachableClient) Close() error {
+	return client.close(false)
+}
+
+// Detach closes the client and keeps the slave running for the grace period,
+// so that the next connection can resume it.
+func (client *detachableClient) Detach() error {
+	return client.close(true)
+}
+
+func (client *detachableClient) close(keep bool) (err error) {
+	client.closeOnce.Do(func() {
+		close(client.done)
+		err = client.session.registry.detach(client, keep)
+	})
+	return err
+}
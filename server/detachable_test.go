@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closingSlave is a pipeSlave which reports when it's closed.
+type closingSlave struct {
+	pipeSlave
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newClosingSlave() (*closingSlave, *io.PipeWriter) {
+	reader, writer := io.Pipe()
+	return &closingSlave{pipeSlave: pipeSlave{reader}, closed: make(chan struct{})}, writer
+}
+
+func (slave *closingSlave) Close() error {
+	slave.closeOnce.Do(func() { close(slave.closed) })
+	return slave.pipeSlave.Close()
+}
+
+func (slave *closingSlave) isClosed() bool {
+	select {
+	case <-slave.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func startDetachable(t *testing.T, sds *detachableSessions, id string) (*detachableClient, *closingSlave, *io.PipeWriter) {
+	slave, writer := newClosingSlave()
+	client, err := sds.start(id, "192.0.2.1", "alice", "", "", func() (Slave, error) { return slave, nil })
+	if err != nil {
+		t.Fatalf("Unexpected error from start(): %s", err)
+	}
+	return client, slave, writer
+}
+
+// waitFor fails the test when condition doesn't hold within a second.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDetachableResumeReplaysOutput(t *testing.T) {
+	sds := newDetachableSessions(time.Minute, 4, 1024)
+	client, slave, writer := startDetachable(t, sds, "1")
+	token := client.session.token
+
+	writer.Write([]byte("hello"))
+	received := make([]byte, 5)
+	if _, err := io.ReadFull(client, received); err != nil || string(received) != "hello" {
+		t.Fatalf("Unexpected output of the client: %q, %v", received, err)
+	}
+
+	if err := client.Detach(); err != nil {
+		t.Fatalf("Unexpected error from Detach(): %s", err)
+	}
+	writer.Write([]byte(" world"))
+	waitFor(t, "the output of the detached session", func() bool {
+		list := sds.list()
+		return len(list) == 1 && list[0].Buffered == len("hello world")
+	})
+
+	resumed, ok := sds.resume(token, "alice")
+	if !ok {
+		t.Fatalf("Failed to resume the detached session")
+	}
+	if len(sds.list()) != 0 {
+		t.Fatalf("The resumed session is still listed as detached")
+	}
+	received = make([]byte, len("hello world"))
+	if _, err := io.ReadFull(resumed, received); err != nil || string(received) != "hello world" {
+		t.Fatalf("Unexpected output replayed to the resumed client: %q, %v", received, err)
+	}
+
+	// the resumed client receives the live output
+	writer.Write([]byte("!"))
+	if _, err := io.ReadFull(resumed, received[:1]); err != nil || received[0] != '!' {
+		t.Fatalf("Unexpected output of the resumed client: %q, %v", received[:1], err)
+	}
+
+	resumed.Close()
+	if !slave.isClosed() {
+		t.Fatalf("The slave is not closed with its client")
+	}
+}
+
+func TestDetachableExpires(t *testing.T) {
+	sds := newDetachableSessions(10*time.Millisecond, 4, 1024)
+	client, slave, _ := startDetachable(t, sds, "1")
+	token := client.session.token
+
+	client.Detach()
+	select {
+	case <-slave.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("The slave is not closed after the grace period")
+	}
+
+	if len(sds.list()) != 0 {
+		t.Fatalf("The expired session is still listed")
+	}
+	if _, ok := sds.resume(token, "alice"); ok {
+		t.Fatalf("The expired session was resumed")
+	}
+}
+
+func TestDetachableResumeAttached(t *testing.T) {
+	sds := newDetachableSessions(time.Minute, 4, 1024)
+	client, slave, _ := startDetachable(t, sds, "1")
+	token := client.session.token
+
+	if _, ok := sds.resume(token, "alice"); ok {
+		t.Fatalf("A session attached to a client was resumed")
+	}
+
+	client.Detach()
+	resumed, ok := sds.resume(token, "alice")
+	if !ok {
+		t.Fatalf("Failed to resume the detached session")
+	}
+	if _, ok := sds.resume(token, "alice"); ok {
+		t.Fatalf("A resumed session was resumed again")
+	}
+	if _, ok := sds.resume("unknown", "alice"); ok {
+		t.Fatalf("A session was resumed with an unknown token")
+	}
+
+	// closing the first client again doesn't affect the resumed one
+	client.Close()
+	if slave.isClosed() {
+		t.Fatalf("The slave was closed by a previous client")
+	}
+	resumed.Close()
+}
+
+func TestDetachableResumeOtherUser(t *testing.T) {
+	sds := newDetachableSessions(time.Minute, 4, 1024)
+	client, slave, _ := startDetachable(t, sds, "1")
+	token := client.session.token
+
+	client.Detach()
+	if _, ok := sds.resume(token, "mallory"); ok {
+		t.Fatalf("A session was resumed by another user")
+	}
+	if _, ok := sds.resume(token, ""); ok {
+		t.Fatalf("A session was resumed without authentication")
+	}
+	if slave.isClosed() {
+		t.Fatalf("The slave was closed by a refused resume")
+	}
+
+	resumed, ok := sds.resume(token, "alice")
+	if !ok {
+		t.Fatalf("Failed to resume the detached session by its user")
+	}
+	resumed.Close()
+}
+
+func TestDetachableLimit(t *testing.T) {
+	sds := newDetachableSessions(time.Minute, 1, 1024)
+	first, firstSlave, _ := startDetachable(t, sds, "1")
+	second, secondSlave, _ := startDetachable(t, sds, "2")
+
+	first.Detach()
+	second.Detach()
+
+	if !secondSlave.isClosed() {
+		t.Fatalf("The slave detached beyond the limit is not closed")
+	}
+	if firstSlave.isClosed() {
+		t.Fatalf("The slave detached within the limit is closed")
+	}
+	if list := sds.list(); len(list) != 1 || list[0].ID != "1" {
+		t.Fatalf("Unexpected detached sessions: %+v", list)
+	}
+	if _, ok := sds.resume(second.session.token, "alice"); ok {
+		t.Fatalf("The session detached beyond the limit was resumed")
+	}
+
+	sds.closeAll()
+	if !firstSlave.isClosed() {
+		t.Fatalf("The detached slave is not closed by closeAll()")
+	}
+}
+
+func TestDetachableExitWhileDetached(t *testing.T) {
+	sds := newDetachableSessions(time.Minute, 4, 1024)
+	client, slave, writer := startDetachable(t, sds, "1")
+	token := client.session.token
+
+	client.Detach()
+	if len(sds.list()) != 1 {
+		t.Fatalf("The session is not listed as detached")
+	}
+
+	// the process exits
+	writer.Close()
+	select {
+	case <-slave.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("The slave which has exited while detached is not closed")
+	}
+
+	waitFor(t, "the session to be removed", func() bool { return len(sds.list()) == 0 })
+	if _, ok := sds.resume(token, "alice"); ok {
+		t.Fatalf("The session which has exited was resumed")
+	}
+
+	// output of the slave before its end is still delivered to a client
+	other, _, otherWriter := startDetachable(t, sds, "2")
+	go func() {
+		otherWriter.Write([]byte("bye"))
+		otherWriter.Close()
+	}()
+	var received bytes.Buffer
+	if _, err := io.Copy(&received, other); err != nil || received.String() != "bye" {
+		t.Fatalf("Unexpected output of the client: %q, %v", received.String(), err)
+	}
+	other.Close()
+}
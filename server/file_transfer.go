@@ -0,0 +1,421 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/webtty"
+)
+
+// File transfers allowed by Options.FileTransfer
+const (
+	transferNone     = "none"
+	transferUpload   = "upload"
+	transferDownload = "download"
+	transferBoth     = "both"
+)
+
+// Statuses of FileTransferRecord
+const (
+	transferComplete = "complete"
+	transferFailed   = "error"
+	transferCanceled = "canceled"
+)
+
+// maxFileTransferRecords is the number of transfers kept for each connection.
+const maxFileTransferRecords = 100
+
+// FileTransferRecord represents a file transfer done by a connection
+type FileTransferRecord struct {
+	Direction   string    `json:"direction"` // upload or download
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Transferred int64     `json:"transferred"`
+	Status      string    `json:"status"` // complete, error or canceled
+	Error       string    `json:"error,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	EndedAt     time.Time `json:"ended_at"`
+}
+
+// fileTransfers handles the file transfers requested by a connection.
+type fileTransfers struct {
+	connID   string
+	tty      *webtty.WebTTY // set once the WebTTY is created
+	target   transferTarget
+	upload   bool
+	download bool
+	maxSize  int64 // 0 for no limit
+	record   func(FileTransferRecord)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // running downloads
+
+	mutex     sync.Mutex
+	transfers map[string]*fileTransfer // running transfers by ID
+}
+
+// fileTransfer is a running upload or download.
+type fileTransfer struct {
+	id     string
+	file   uploadFile // nil for downloads
+	cancel context.CancelFunc
+
+	// mutex serializes the writes of an upload with its abort when the connection closes
+	mutex  sync.Mutex
+	record FileTransferRecord
+}
+
+func newFileTransfers(connID string, policy string, maxSize int, target transferTarget, record func(FileTransferRecord)) *fileTransfers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &fileTransfers{
+		connID:    connID,
+		target:    target,
+		upload:    policy == transferUpload || policy == transferBoth,
+		download:  policy == transferDownload || policy == transferBoth,
+		maxSize:   int64(maxSize),
+		record:    record,
+		ctx:       ctx,
+		cancel:    cancel,
+		transfers: make(map[string]*fileTransfer),
+	}
+}
+
+// handle is the webtty.FileTransferHandler of the connection.
+func (transfers *fileTransfers) handle(request *webtty.FileTransferRequest) {
+	switch request.Action {
+	case webtty.TransferUploadStart:
+		transfers.startUpload(request)
+	case webtty.TransferUploadChunk:
+		transfers.writeUpload(request)
+	case webtty.TransferUploadEnd:
+		transfers.endUpload(request)
+	case webtty.TransferDownload:
+		transfers.startDownload(request)
+	case webtty.TransferCancel:
+		transfers.cancelTransfer(request)
+	default:
+		transfers.reject(request, errors.Errorf("unknown action `%s`", request.Action))
+	}
+}
+
+// close aborts the running transfers and waits for downloads to stop.
+func (transfers *fileTransfers) close() {
+	transfers.cancel()
+
+	transfers.mutex.Lock()
+	uploads := make([]*fileTransfer, 0, len(transfers.transfers))
+	for _, transfer := range transfers.transfers {
+		if transfer.file != nil {
+			uploads = append(uploads, transfer)
+		}
+	}
+	transfers.mutex.Unlock()
+
+	for _, transfer := range uploads {
+		transfer.mutex.Lock()
+		transfer.file.abort()
+		transfers.finish(transfer, transferCanceled, errors.New("connection closed"))
+		transfer.mutex.Unlock()
+	}
+	transfers.wg.Wait()
+}
+
+func (transfers *fileTransfers) startUpload(request *webtty.FileTransferRequest) {
+	if !transfers.upload {
+		transfers.reject(request, errors.New("uploads are not allowed"))
+		return
+	}
+	if err := transfers.check(request); err != nil {
+		transfers.reject(request, err)
+		return
+	}
+	if request.Name != filepath.Base(request.Name) || request.Name == "." || request.Name == ".." || strings.ContainsRune(request.Name, 0) {
+		transfers.reject(request, errors.Errorf("invalid file name `%s`", request.Name))
+		return
+	}
+	if request.Size < 0 || (transfers.maxSize > 0 && request.Size > transfers.maxSize) {
+		transfers.reject(request, errors.Errorf("file size exceeds the limit of %d bytes", transfers.maxSize))
+		return
+	}
+
+	if transfers.running(request.ID) {
+		transfers.reject(request, errors.Errorf("transfer `%s` is already running", request.ID))
+		return
+	}
+	file, err := transfers.target.create(transfers.ctx, request.Name)
+	if err != nil {
+		transfers.reject(request, err)
+		return
+	}
+	transfer := transfers.add(request, transferUpload, file)
+	if transfer == nil {
+		file.abort()
+		return
+	}
+	log.Printf("Connection %s started uploading %s (%d bytes)", transfers.connID, request.Name, request.Size)
+	transfers.progress(transfer)
+}
+
+func (transfers *fileTransfers) writeUpload(request *webtty.FileTransferRequest) {
+	transfer := transfers.get(request)
+	if transfer == nil {
+		return
+	}
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+	if transfer.record.Transferred+int64(len(request.Data)) > transfer.record.Size {
+		transfer.file.abort()
+		transfers.finish(transfer, transferFailed, errors.New("received more data than the file size"))
+		return
+	}
+
+	n, err := transfer.file.Write(request.Data)
+	transfer.record.Transferred += int64(n)
+	if err != nil {
+		transfer.file.abort()
+		transfers.finish(transfer, transferFailed, err)
+		return
+	}
+	transfers.progress(transfer)
+}
+
+func (transfers *fileTransfers) endUpload(request *webtty.FileTransferRequest) {
+	transfer := transfers.get(request)
+	if transfer == nil {
+		return
+	}
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+	if transfer.record.Transferred != transfer.record.Size {
+		transfer.file.abort()
+		transfers.finish(transfer, transferFailed, errors.Errorf("received %d of %d bytes", transfer.record.Transferred, transfer.record.Size))
+		return
+	}
+
+	err := transfer.file.commit()
+	if err != nil {
+		transfers.finish(transfer, transferFailed, err)
+		return
+	}
+	transfers.finish(transfer, transferComplete, nil)
+}
+
+func (transfers *fileTransfers) startDownload(request *webtty.FileTransferRequest) {
+	if !transfers.download {
+		transfers.reject(request, errors.New("downloads are not allowed"))
+		return
+	}
+	if err := transfers.check(request); err != nil {
+		transfers.reject(request, err)
+		return
+	}
+	if request.Name == "" {
+		transfers.reject(request, errors.New("file name is empty"))
+		return
+	}
+
+	transfer := transfers.add(request, transferDownload, nil)
+	if transfer == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(transfers.ctx)
+	transfer.cancel = cancel
+
+	transfers.wg.Add(1)
+	go func() {
+		defer transfers.wg.Done()
+		defer cancel()
+
+		status, err := transfers.send(ctx, transfer)
+		transfers.finish(transfer, status, err)
+	}()
+}
+
+// send streams a download to the client.
+func (transfers *fileTransfers) send(ctx context.Context, transfer *fileTransfer) (status string, err error) {
+	reader, size, err := transfers.target.open(ctx, transfer.record.Name)
+	if err != nil {
+		return transferFailed, err
+	}
+	defer reader.Close()
+
+	transfer.record.Size = size
+	if transfers.maxSize > 0 && size > transfers.maxSize {
+		return transferFailed, errors.Errorf("file size exceeds the limit of %d bytes", transfers.maxSize)
+	}
+	log.Printf("Connection %s started downloading %s (%d bytes)", transfers.connID, transfer.record.Name, size)
+
+	buffer := make([]byte, webtty.FileTransferChunkSize)
+	for {
+		n, err := io.ReadFull(reader, buffer)
+		if n > 0 {
+			if ctx.Err() != nil {
+				return transferCanceled, nil
+			}
+			transfer.record.Transferred += int64(n)
+			sendErr := transfers.tty.SendFileTransfer(&webtty.FileTransferEvent{
+				ID:          transfer.id,
+				Action:      webtty.TransferData,
+				Name:        transfer.record.Name,
+				Size:        size,
+				Transferred: transfer.record.Transferred,
+				Data:        buffer[:n],
+			})
+			if sendErr != nil {
+				return transferFailed, sendErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return transferComplete, nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return transferCanceled, nil
+			}
+			return transferFailed, errors.Wrapf(err, "failed to read %s", transfer.record.Name)
+		}
+	}
+}
+
+func (transfers *fileTransfers) cancelTransfer(request *webtty.FileTransferRequest) {
+	transfer := transfers.get(request)
+	if transfer == nil {
+		return
+	}
+
+	if transfer.file == nil {
+		// the download reports itself
+		transfer.cancel()
+		return
+	}
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+	transfer.file.abort()
+	transfers.finish(transfer, transferCanceled, nil)
+}
+
+// check rejects transfers of connections unable to write to the terminal.
+func (transfers *fileTransfers) check(request *webtty.FileTransferRequest) error {
+	if transfers.ctx.Err() != nil {
+		return errors.New("connection closed")
+	}
+	if !transfers.tty.PermitWrite() {
+		return errors.New("write permission is required")
+	}
+	return nil
+}
+
+// running reports whether a transfer with id is running.
+func (transfers *fileTransfers) running(id string) bool {
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
+
+	_, exists := transfers.transfers[id]
+	return exists
+}
+
+// add registers a new transfer, or rejects the request when its ID is in use.
+func (transfers *fileTransfers) add(request *webtty.FileTransferRequest, direction string, file uploadFile) *fileTransfer {
+	transfers.mutex.Lock()
+	_, exists := transfers.transfers[request.ID]
+	transfer := &fileTransfer{
+		id:   request.ID,
+		file: file,
+		record: FileTransferRecord{
+			Direction: direction,
+			Name:      request.Name,
+			Size:      request.Size,
+			StartedAt: time.Now(),
+		},
+	}
+	if !exists {
+		transfers.transfers[request.ID] = transfer
+	}
+	transfers.mutex.Unlock()
+
+	if exists {
+		transfers.reject(request, errors.Errorf("transfer `%s` is already running", request.ID))
+		return nil
+	}
+	return transfer
+}
+
+// get returns the running transfer of a request, which has to be an upload
+// unless the request cancels it.
+func (transfers *fileTransfers) get(request *webtty.FileTransferRequest) *fileTransfer {
+	transfers.mutex.Lock()
+	transfer := transfers.transfers[request.ID]
+	transfers.mutex.Unlock()
+
+	if transfer == nil || (transfer.file == nil && request.Action != webtty.TransferCancel) {
+		transfers.reject(request, errors.Errorf("no upload `%s` is running", request.ID))
+		return nil
+	}
+	return transfer
+}
+
+// finish removes a transfer, records it in the history and tells the client.
+func (transfers *fileTransfers) finish(transfer *fileTransfer, status string, err error) {
+	transfers.mutex.Lock()
+	if transfers.transfers[transfer.id] != transfer {
+		// already finished by close
+		transfers.mutex.Unlock()
+		return
+	}
+	delete(transfers.transfers, transfer.id)
+	transfers.mutex.Unlock()
+
+	record := transfer.record
+	record.Status = status
+	record.EndedAt = time.Now()
+	if err != nil {
+		record.Error = err.Error()
+	}
+	transfers.record(record)
+	log.Printf(
+		"Connection %s %s %s: %s, %d/%d bytes",
+		transfers.connID, record.Direction, record.Name, status, record.Transferred, record.Size,
+	)
+
+	action := map[string]string{
+		transferComplete: webtty.TransferComplete,
+		transferFailed:   webtty.TransferError,
+		transferCanceled: webtty.TransferCanceled,
+	}[status]
+	transfers.tty.SendFileTransfer(&webtty.FileTransferEvent{
+		ID:          transfer.id,
+		Action:      action,
+		Name:        record.Name,
+		Size:        record.Size,
+		Transferred: record.Transferred,
+		Error:       record.Error,
+	})
+}
+
+func (transfers *fileTransfers) progress(transfer *fileTransfer) {
+	transfers.tty.SendFileTransfer(&webtty.FileTransferEvent{
+		ID:          transfer.id,
+		Action:      webtty.TransferProgress,
+		Name:        transfer.record.Name,
+		Size:        transfer.record.Size,
+		Transferred: transfer.record.Transferred,
+	})
+}
+
+// reject refuses a request without recording it.
+func (transfers *fileTransfers) reject(request *webtty.FileTransferRequest, err error) {
+	transfers.tty.SendFileTransfer(&webtty.FileTransferEvent{
+		ID:     request.ID,
+		Action: webtty.TransferError,
+		Name:   request.Name,
+		Error:  err.Error(),
+	})
+}
@@ -14,6 +14,8 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 
+	"github.com/yudai/gotty/pkg/audit"
+	"github.com/yudai/gotty/pkg/oidclogin"
 	"github.com/yudai/gotty/webtty"
 )
 
@@ -39,7 +41,7 @@ func (server *Server) generateHandleWS(ctx context.Context, cancel context.Cance
 
 		num := counter.add(1)
 		closeReason := "unknown reason"
-		clientIP := getClientIP(r)
+		clientIP := server.clientIP(r)
 
 		defer func() {
 			num := counter.done()
@@ -67,49 +69,115 @@ func (server *Server) generateHandleWS(ctx context.Context, cancel context.Cance
 			return
 		}
 
-		conn, err := server.upgrader.Upgrade(w, r, nil)
+		wire := &countingResponseWriter{ResponseWriter: w}
+		conn, err := server.upgrader.Upgrade(wire, r, nil)
 		if err != nil {
 			closeReason = err.Error()
 			return
 		}
 		defer conn.Close()
 
-		err = server.processWSConn(ctx, conn, clientIP)
+		master := &wsWrapper{Conn: conn, wire: wire.conn}
+		if server.options.EnableCompression && offersDeflate(r) {
+			master.compressed = true
+			master.compressionMinSize = server.options.CompressionMinSize
+			conn.SetCompressionLevel(server.options.CompressionLevel)
+		}
 
-		switch err {
-		case ctx.Err():
-			closeReason = "cancelation"
-		case webtty.ErrSlaveClosed:
-			closeReason = server.factory.Name()
-		case webtty.ErrMasterClosed:
-			closeReason = "client"
-		default:
-			closeReason = fmt.Sprintf("an error: %s", err)
+		route := server.options.route(routeFromContext(r.Context()))
+		// clients other than browsers can authenticate the request instead of sending a token
+		userCtx := ctx
+		if user, ok := server.requestUser(r); ok {
+			userCtx = withIdentity(ctx, user, nil)
 		}
+		err = server.processWSConn(userCtx, master, clientIP, route)
+		closeReason = server.closeReason(ctx, err)
 	}
 }
 
-func (server *Server) processWSConn(ctx context.Context, conn *websocket.Conn, clientIP string) error {
-	typ, initLine, err := conn.ReadMessage()
+// features returns the features the server supports for a connection.
+func (server *Server) features(master *wsWrapper, shareKey string) []string {
+	features := []string{webtty.FeatureNotice, webtty.FeatureWriteControl, webtty.FeatureTerminalSize}
+	if master.binary() {
+		features = append(features, webtty.FeatureBinary)
+	}
+	if master.compressed {
+		features = append(features, webtty.FeatureCompression)
+	}
+	if server.options.FileTransfer != transferNone {
+		features = append(features, webtty.FeatureFileTransfer, webtty.FeatureZmodem)
+	}
+	// a shared process lives as long as its clients
+	if server.detachables != nil && shareKey == "" {
+		features = append(features, webtty.FeatureSession)
+	}
+	return features
+}
+
+// detaches reports whether the process of a connection closed by err is kept
+// for the client to resume it, which is when the connection has dropped
+// rather than being closed by the process or the server.
+func (server *Server) detaches(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if _, ok := err.(*connectionClosed); ok {
+		return false
+	}
+	return err != webtty.ErrSlaveClosed
+}
+
+// closeReason describes why processWSConn has returned err.
+func (server *Server) closeReason(ctx context.Context, err error) string {
+	if closed, ok := err.(*connectionClosed); ok {
+		return closed.reason
+	}
+
+	switch err {
+	case ctx.Err():
+		return "cancelation"
+	case webtty.ErrSlaveClosed:
+		return server.factory.Name()
+	case webtty.ErrMasterClosed:
+		return "client"
+	case webtty.ErrOutputQueueFull:
+		return "slow client"
+	case errHeartbeatTimeout:
+		return "heartbeat timeout"
+	default:
+		return fmt.Sprintf("an error: %s", err)
+	}
+}
+
+func (server *Server) processWSConn(ctx context.Context, master *wsWrapper, clientIP string, route *RouteOptions) (err error) {
+	if server.options.HeartbeatInterval > 0 {
+		stopHeartbeat := master.startHeartbeat(
+			time.Duration(server.options.HeartbeatInterval)*time.Second,
+			server.options.HeartbeatTolerance,
+		)
+		defer stopHeartbeat()
+	}
+
+	typ, initLine, err := master.ReadMessage()
 	if err != nil {
+		master.checkTimeout(err)
+		if master.heartbeatTimedOut() {
+			return errHeartbeatTimeout
+		}
 		return errors.Wrapf(err, "failed to authenticate websocket connection")
 	}
-	log.Printf("DEBUG: Received WebSocket message type: %d, length: %d bytes", typ, len(initLine))
 	if typ != websocket.TextMessage {
 		return errors.New("failed to authenticate websocket connection: invalid message type")
 	}
 
-	log.Printf("DEBUG: Raw init message: %q", string(initLine))
 	var init InitMessage
 	err = json.Unmarshal(initLine, &init)
 	if err != nil {
-		log.Printf("DEBUG: JSON unmarshal error: %v", err)
-		log.Printf("DEBUG: Failed to parse init message, raw bytes (hex): %x", initLine)
 		return errors.Wrapf(err, "failed to authenticate websocket connection")
 	}
-	log.Printf("DEBUG: Successfully parsed init message - AuthToken present: %v, Arguments: %q", init.AuthToken != "", init.Arguments)
-	if init.AuthToken != server.options.Credential {
-		return errors.New("failed to authenticate websocket connection")
+	username, groups, err := server.authenticateConnection(ctx, init.AuthToken)
+	if err != nil {
+		return errors.Wrapf(err, "failed to authenticate websocket connection")
 	}
 
 	queryPath := "?"
@@ -126,16 +194,73 @@ func (server *Server) processWSConn(ctx context.Context, conn *websocket.Conn, c
 	// Track this connection using the real client IP
 	connID := fmt.Sprintf("%s-%d", clientIP, time.Now().UnixNano())
 	sessionName := params.Get("session")
-	server.connections.Add(connID, clientIP, sessionName, init.Arguments)
-	server.connections.SetConn(connID, conn) // Store the WebSocket connection for kick functionality
-	defer server.connections.Remove(connID)
+	server.connections.Add(connID, clientIP, username, sessionName, init.Arguments)
+	server.connections.SetConn(connID, master) // Store the WebSocket connection for kick functionality
+	userRole := server.roles.of(username, groups)
+	server.connections.SetRole(connID, userRole)
+	defer func() {
+		if master.heartbeatTimedOut() {
+			err = errHeartbeatTimeout
+		}
+		server.connections.Remove(connID, server.closeReason(ctx, err))
+	}()
+
+	shareKey := ""
+	if server.options.EnableSharing {
+		shareKey = params.Get("share")
+	}
+
+	// clients older than versions get the features of that time
+	version, offered := 0, webtty.LegacyFeatures
+	if init.Version > 0 {
+		version, offered = init.Version, init.Capabilities
+	}
+	capabilities := webtty.Negotiate(version, offered, server.features(master, shareKey))
+	server.connections.SetCapabilities(connID, capabilities)
 
 	var slave Slave
-	slave, err = server.factory.New(params)
+	var detachable *detachableClient // the process can be resumed after the connection drops
+	resumed := false
+	permitWrite := server.options.PermitWrite && userRole >= roleOperator
+	if shareKey != "" {
+		var owner bool
+		slave, owner, err = server.sharedSlaves.attach(shareKey, func() (Slave, error) {
+			return server.factory.New(params)
+		})
+		if !owner && server.options.ShareWriters != "all" {
+			permitWrite = false
+		}
+		server.connections.SetShareKey(connID, shareKey)
+	} else if server.detachables != nil && capabilities.Has(webtty.FeatureSession) {
+		if init.ResumeToken != "" {
+			detachable, resumed = server.detachables.resume(init.ResumeToken, username)
+			if !resumed {
+				log.Printf("Connection %s could not resume a process, starting a new one", connID)
+			}
+		}
+		if !resumed {
+			detachable, err = server.detachables.start(connID, clientIP, username, sessionName, init.Arguments, func() (Slave, error) {
+				return server.factory.New(params)
+			})
+		}
+		if err == nil {
+			slave = detachable
+		}
+	} else {
+		slave, err = server.factory.New(params)
+	}
 	if err != nil {
 		return errors.Wrapf(err, "failed to create backend")
 	}
-	defer slave.Close()
+	running := false
+	defer func() {
+		if detachable != nil && running && server.detaches(ctx, err) {
+			detachable.Detach()
+			log.Printf("Keeping the process of connection %s for %d seconds", connID, server.options.DetachGracePeriod)
+			return
+		}
+		slave.Close()
+	}()
 
 	// Check if 'name' parameter is present - use it as title if so
 	var windowTitle []byte
@@ -151,9 +276,36 @@ func (server *Server) processWSConn(ctx context.Context, conn *websocket.Conn, c
 	opts := []webtty.Option{
 		webtty.WithWindowTitle(windowTitle),
 	}
-	if server.options.PermitWrite {
-		opts = append(opts, webtty.WithPermitWrite())
+	if master.binary() {
+		opts = append(opts, webtty.WithBinaryProtocol())
 	}
+	if init.Version > 0 {
+		opts = append(opts, webtty.WithCapabilities(capabilities))
+	}
+	// connections seeing the same terminal compete for the write control
+	controlGroup := "connection:" + connID
+	if shareKey != "" {
+		controlGroup = "share:" + shareKey
+	} else if sessionName != "" {
+		controlGroup = "session:" + sessionName
+	}
+	// the write control is given by server.writeControls
+	var control *writeControlMember
+	opts = append(opts, webtty.WithWriteControlHandler(func(request bool) {
+		server.writeControls.handle(control, request)
+	}))
+	// the size of the terminal is chosen by server.resizes
+	var resizer *resizeMember
+	opts = append(opts, webtty.WithResizeHandler(func(columns int, rows int) {
+		server.resizes.resize(resizer, columns, rows)
+	}))
+	// join the groups once the master has learned the capabilities,
+	// so that their announcements follow the initializing messages
+	var tty *webtty.WebTTY
+	opts = append(opts, webtty.WithStartHandler(func() {
+		control = server.writeControls.join(controlGroup, connID, tty, permitWrite)
+		resizer = server.resizes.join(controlGroup, connID, tty)
+	}))
 	if server.options.EnableReconnect {
 		opts = append(opts, webtty.WithReconnect(server.options.ReconnectTime))
 	}
@@ -166,13 +318,114 @@ func (server *Server) processWSConn(ctx context.Context, conn *websocket.Conn, c
 	if server.options.Preferences != nil {
 		opts = append(opts, webtty.WithMasterPreferences(server.options.Preferences))
 	}
+	if detachable != nil {
+		opts = append(opts, webtty.WithSession(webtty.SessionMessage{
+			Token:       detachable.session.token,
+			Resumed:     resumed,
+			GracePeriod: server.options.DetachGracePeriod,
+		}))
+	}
+	encoding, err := webtty.LookupEncoding(server.options.encoding(route, params.Get("encoding")))
+	if err != nil {
+		return err
+	}
+	opts = append(opts, webtty.WithEncoding(encoding))
+	outputQueuePolicy, _ := webtty.ParseOutputQueuePolicy(server.options.OutputQueuePolicy)
+	opts = append(opts, webtty.WithOutputQueue(server.options.OutputQueueSize, outputQueuePolicy))
+
+	// a shared slave replays its own scrollback when attached, and so does a resumed one
+	if server.options.ScrollbackSize > 0 && sessionName != "" && shareKey == "" && !resumed {
+		opts = append(opts, webtty.WithScrollback(server.scrollbacks.get(sessionName)))
+	}
+
+	if server.options.recording(route) {
+		recorder, path, err := server.startRecording(connID, clientIP, sessionName, slave)
+		if err != nil {
+			return errors.Wrapf(err, "failed to start recording")
+		}
+		defer server.stopRecording(connID, recorder, path)
+		log.Printf("Recording connection %s to %s", connID, path)
+		opts = append(opts, webtty.WithRecorder(recorder))
+	}
+
+	if server.auditSink != nil {
+		auditor := audit.NewAuditor(server.auditSink, audit.Identity{
+			ConnectionID: connID,
+			RemoteAddr:   clientIP,
+			SessionName:  sessionName,
+			Username:     username,
+		}, server.options.AuditRedact)
+		opts = append(opts, webtty.WithAuditor(auditor))
+	}
+
+	var transfers *fileTransfers
+	if capabilities.Has(webtty.FeatureFileTransfer) {
+		transfers = newFileTransfers(
+			connID, server.options.FileTransfer, server.options.FileTransferMaxSize,
+			newTransferTarget(server.options, sessionName, slave),
+			func(record FileTransferRecord) { server.connections.AddFileTransfer(connID, record) },
+		)
+		defer transfers.close()
+		opts = append(opts, webtty.WithFileTransferHandler(transfers.handle))
+
+		// rz and sz, and trz and tsz, started in the terminal follow the same policy
+		if capabilities.Has(webtty.FeatureZmodem) {
+			policy := server.options.FileTransfer
+			opts = append(opts, webtty.WithZmodem(
+				policy == transferUpload || policy == transferBoth,
+				policy == transferDownload || policy == transferBoth,
+				int64(server.options.FileTransferMaxSize),
+			))
+		}
+	}
 
-	tty, err := webtty.New(&wsWrapper{conn}, slave, opts...)
+	tty, err = webtty.New(master, slave, opts...)
 	if err != nil {
 		return errors.Wrapf(err, "failed to create webtty")
 	}
+	if transfers != nil {
+		transfers.tty = tty
+	}
+
+	defer func() {
+		if control != nil {
+			server.writeControls.leave(control)
+			server.resizes.leave(resizer)
+		}
+	}()
 
-	err = tty.Run(ctx)
+	// the server closes the connection through connCtx with a *connectionClosed as the cause
+	connCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	server.connections.SetTTY(connID, tty, cancel)
+
+	limits := &connectionLimits{
+		idleTimeout:    server.options.idleTimeout(route, userRole),
+		maxSessionTime: server.options.maxSessionTime(route, userRole),
+		warning:        time.Duration(server.options.TimeoutWarning) * time.Second,
+	}
+	go limits.watch(connCtx, tty, cancel)
+
+	running = true
+	err = tty.Run(connCtx)
+
+	switch {
+	case err == webtty.ErrSlaveClosed && detachable != nil:
+		// nothing to resume any more
+		tty.SendSession(webtty.SessionMessage{})
+	case ctx.Err() != nil && err == ctx.Err():
+		tty.SendNotice(shutdownNotice)
+	case err == connCtx.Err():
+		if closed, ok := context.Cause(connCtx).(*connectionClosed); ok {
+			tty.SendNotice(closed.notice)
+			master.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, closed.reason),
+				time.Now().Add(time.Second),
+			)
+			err = closed
+		}
+	}
 
 	return err
 }
@@ -205,10 +458,20 @@ func (server *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	w.Write(indexBuf.Bytes())
 }
 
+// handleAuthToken gives the page a token to connect with, fetched again to reconnect
+// as tokens are single-use. Pages of other sites can't get one.
 func (server *Server) handleAuthToken(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/javascript")
-	// @TODO hashing?
-	w.Write([]byte("var gotty_auth_token = '" + server.options.Credential + "';"))
+	if !oidclogin.SameOrigin(r) {
+		log.Printf("Request of %s for an auth token rejected, cross-origin", server.clientIP(r))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Token string `json:"token"`
+	}{server.mintAuthToken(r)})
 }
 
 func (server *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
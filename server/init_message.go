@@ -3,4 +3,10 @@ package server
 type InitMessage struct {
 	Arguments string `json:"Arguments,omitempty"`
 	AuthToken string `json:"AuthToken,omitempty"`
+	// ResumeToken resumes a detached process, see webtty.SessionMessage
+	ResumeToken string `json:"ResumeToken,omitempty"`
+	// Version is the protocol version of the client, 0 for clients older than versions
+	Version int `json:"Version,omitempty"`
+	// Capabilities are the features the client supports, see webtty.Negotiate
+	Capabilities []string `json:"Capabilities,omitempty"`
 }
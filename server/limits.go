@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/yudai/gotty/webtty"
+)
+
+// Kinds of notices about the time limits of connections
+const (
+	noticeIdleTimeout    = "idle_timeout"
+	noticeSessionTimeout = "session_timeout"
+)
+
+// connectionLimits closes a connection sending no input for idleTimeout
+// or lasting for maxSessionTime, and warns the client warning before.
+// Zero durations disable the limits. The warning is given at half
+// of a limit at the earliest.
+type connectionLimits struct {
+	idleTimeout    time.Duration
+	maxSessionTime time.Duration
+	warning        time.Duration
+}
+
+// watch blocks until ctx is canceled or a limit is reached,
+// in which case the connection is canceled by cancel with a *connectionClosed.
+func (limits *connectionLimits) watch(ctx context.Context, tty *webtty.WebTTY, cancel context.CancelCauseFunc) {
+	if limits.idleTimeout <= 0 && limits.maxSessionTime <= 0 {
+		return
+	}
+
+	startedAt := time.Now()
+	var idleWarned time.Time // the idle deadline the client has been warned of
+	sessionWarned := false
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+
+		now := time.Now()
+		next := time.Duration(-1)
+		wakeIn := func(d time.Duration) {
+			if next < 0 || d < next {
+				next = d
+			}
+		}
+
+		if limits.maxSessionTime > 0 {
+			left := startedAt.Add(limits.maxSessionTime).Sub(now)
+			warning := min(limits.warning, limits.maxSessionTime/2)
+			switch {
+			case left <= 0:
+				cancel(&connectionClosed{
+					reason: "session time limit",
+					notice: webtty.NoticeMessage{
+						Kind:    noticeSessionTimeout,
+						Message: "Session time limit reached",
+					},
+				})
+				return
+			case left > warning:
+				wakeIn(left - warning)
+			default:
+				if !sessionWarned {
+					sessionWarned = true
+					tty.SendNotice(webtty.NoticeMessage{
+						Kind:      noticeSessionTimeout,
+						Message:   fmt.Sprintf("Session time limit reached in %s", left.Round(time.Second)),
+						Reconnect: true,
+					})
+				}
+				wakeIn(left)
+			}
+		}
+
+		if limits.idleTimeout > 0 {
+			lastInput := tty.LastInput()
+			if lastInput.Before(startedAt) {
+				lastInput = startedAt
+			}
+			deadline := lastInput.Add(limits.idleTimeout)
+			left := deadline.Sub(now)
+			warning := min(limits.warning, limits.idleTimeout/2)
+			switch {
+			case left <= 0:
+				cancel(&connectionClosed{
+					reason: "idle timeout",
+					notice: webtty.NoticeMessage{
+						Kind:    noticeIdleTimeout,
+						Message: "Disconnected due to inactivity",
+					},
+				})
+				return
+			case left > warning:
+				wakeIn(left - warning)
+			default:
+				if !idleWarned.Equal(deadline) {
+					idleWarned = deadline
+					tty.SendNotice(webtty.NoticeMessage{
+						Kind:      noticeIdleTimeout,
+						Message:   fmt.Sprintf("Disconnecting in %s due to inactivity", left.Round(time.Second)),
+						Reconnect: true,
+					})
+				}
+				wakeIn(left)
+			}
+		}
+
+		timer.Reset(next)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/pkg/oidclogin"
+)
+
+// newLogin creates the OpenID Connect login of options, or returns nil when it's disabled.
+func newLogin(options *Options) (*oidclogin.Login, error) {
+	if options.OIDCIssuer == "" {
+		return nil, nil
+	}
+	claims, err := parseClaims(options.OIDCAllowedClaims)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return oidclogin.New(ctx, oidclogin.Config{
+		Issuer:          options.OIDCIssuer,
+		ClientID:        options.OIDCClientID,
+		ClientSecret:    options.OIDCClientSecret,
+		RedirectURL:     options.OIDCRedirectURL,
+		Scopes:          splitList(options.OIDCScopes),
+		UserClaim:       options.OIDCUserClaim,
+		GroupsClaim:     options.OIDCGroupsClaim,
+		AllowedGroups:   splitList(options.OIDCAllowedGroups),
+		AllowedClaims:   claims,
+		Secret:          options.SessionSecret,
+		SessionLifetime: time.Duration(options.SessionLifetime) * time.Second,
+		// the login endpoint is reached over https, even when a proxy terminates TLS
+		SecureCookies: options.SecureCookies || strings.HasPrefix(options.OIDCRedirectURL, "https://"),
+	})
+}
+
+// parseClaims parses a list of claims in the form of email_verified=true,hd=example.com.
+func parseClaims(spec string) (map[string]string, error) {
+	claims := make(map[string]string)
+	for _, item := range splitList(spec) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || name == "" {
+			return nil, errors.Errorf("invalid claim `%s`, must be in the form of name=value", item)
+		}
+		claims[name] = value
+	}
+	return claims, nil
+}
+
+// splitList splits a comma separated list, leaving out empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// wrapLogin requires users to be logged in with OpenID Connect.
+// Pages redirect users to the login endpoint, while other requests are rejected.
+// Requests with a credential of Basic Authentication are checked with it when it's enabled.
+func (server *Server) wrapLogin(handler http.Handler) http.Handler {
+	basicAuth := server.wrapBasicAuth(handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := server.login.Identity(r)
+		if ok {
+			handler.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), identity.User, identity.Groups)))
+			return
+		}
+
+		if _, _, ok := r.BasicAuth(); ok && server.options.EnableBasicAuth {
+			basicAuth.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, server.loginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		log.Printf("Request of %s to %s rejected, not logged in", server.clientIP(r), r.URL.Path)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -1,59 +1,77 @@
 package server
 
 import (
-	"encoding/base64"
+	"context"
+	"crypto/subtle"
 	"log"
-	"net"
 	"net/http"
 	"strings"
+	"time"
 )
 
-// getClientIP extracts the real client IP from the request, checking proxy headers
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (most common for proxies)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// X-Forwarded-For can contain multiple IPs: "client, proxy1, proxy2"
-		// We want the first (leftmost) IP which is the original client
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			clientIP := strings.TrimSpace(ips[0])
-			// Validate it's a proper IP
-			if net.ParseIP(clientIP) != nil {
-				return clientIP
-			}
-		}
-	}
+type contextKey int
 
-	// Check X-Real-IP header (used by nginx and others)
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		clientIP := strings.TrimSpace(xri)
-		if net.ParseIP(clientIP) != nil {
-			return clientIP
-		}
-	}
+const (
+	routeContextKey contextKey = iota
+	userContextKey
+	groupsContextKey
+	logEntryContextKey
+)
 
-	// Check CF-Connecting-IP (Cloudflare)
-	if cfIP := r.Header.Get("CF-Connecting-IP"); cfIP != "" {
-		clientIP := strings.TrimSpace(cfIP)
-		if net.ParseIP(clientIP) != nil {
-			return clientIP
-		}
-	}
+// logEntry collects what wrapLogger logs about a request
+// from the handlers it wraps, which get requests with new contexts.
+type logEntry struct {
+	user string
+}
 
-	// Fallback to RemoteAddr
-	// RemoteAddr is in format "IP:port", so we need to extract just the IP
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr // Return as-is if parsing fails
+// wrapRoute attaches the name of a route in Options.Routes to requests.
+func (server *Server) wrapRoute(handler http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), routeContextKey, name)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// routeFromContext returns the name of the route attached by wrapRoute,
+// or an empty string for the default route.
+func routeFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(routeContextKey).(string)
+	return name
+}
+
+// withIdentity attaches an authenticated user and the groups given by its login, if any.
+// The user is also logged by wrapLogger.
+func withIdentity(ctx context.Context, user string, groups []string) context.Context {
+	if entry, ok := ctx.Value(logEntryContextKey).(*logEntry); ok {
+		entry.user = user
 	}
-	return host
+	ctx = context.WithValue(ctx, userContextKey, user)
+	return context.WithValue(ctx, groupsContextKey, groups)
+}
+
+// userFromContext returns the user authenticated by wrapAuth,
+// or an empty string without authentication.
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userContextKey).(string)
+	return user
+}
+
+// groupsFromContext returns the groups of the user given by its OpenID Connect login.
+func groupsFromContext(ctx context.Context) []string {
+	groups, _ := ctx.Value(groupsContextKey).([]string)
+	return groups
 }
 
 func (server *Server) wrapLogger(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rw := &logResponseWriter{w, 200}
-		handler.ServeHTTP(rw, r)
-		log.Printf("%s %d %s %s", getClientIP(r), rw.status, r.Method, r.URL.Path)
+		entry := &logEntry{user: userFromContext(r.Context())}
+		handler.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), logEntryContextKey, entry)))
+		if entry.user != "" {
+			log.Printf("%s %s %d %s %s", server.clientIP(r), entry.user, rw.status, r.Method, r.URL.Path)
+			return
+		}
+		log.Printf("%s %d %s %s", server.clientIP(r), rw.status, r.Method, r.URL.Path)
 	})
 }
 
@@ -65,29 +83,96 @@ func (server *Server) wrapHeaders(handler http.Handler) http.Handler {
 	})
 }
 
-func (server *Server) wrapBasicAuth(handler http.Handler, credential string) http.Handler {
+// wrapRole rejects requests of users whose role is lower than minimum.
+// It must be wrapped by wrapAuth to know the user.
+func (server *Server) wrapRole(handler http.Handler, minimum role) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
-
-		if len(token) != 2 || strings.ToLower(token[0]) != "basic" {
-			w.Header().Set("WWW-Authenticate", `Basic realm="GoTTY"`)
-			http.Error(w, "Bad Request", http.StatusUnauthorized)
+		user := userFromContext(r.Context())
+		if server.roles.of(user, groupsFromContext(r.Context())) < minimum {
+			log.Printf("Request of %s %s to %s denied, requires role %s", server.clientIP(r), user, r.URL.Path, minimum)
+			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
+		handler.ServeHTTP(w, r)
+	})
+}
 
-		payload, err := base64.StdEncoding.DecodeString(token[1])
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+// wrapAuth requires the login with OpenID Connect or Basic Authentication
+// for handler when either is enabled, unless a trusted proxy has authenticated the user.
+func (server *Server) wrapAuth(handler http.Handler) http.Handler {
+	authenticated := handler
+	switch {
+	case server.login != nil:
+		authenticated = server.wrapLogin(handler)
+	case server.options.EnableBasicAuth:
+		authenticated = server.wrapBasicAuth(handler)
+	}
+	if server.options.TrustedUserHeader != "" {
+		authenticated = server.wrapProxyUser(handler, authenticated)
+	}
+	return authenticated
+}
+
+// authEnabled reports whether users are authenticated.
+func (server *Server) authEnabled() bool {
+	return server.options.EnableBasicAuth || server.login != nil || server.options.TrustedUserHeader != ""
+}
+
+func (server *Server) wrapBasicAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="GoTTY"`)
+			http.Error(w, "Bad Request", http.StatusUnauthorized)
 			return
 		}
 
-		if credential != string(payload) {
+		user, ok = server.authenticate(user + ":" + password)
+		if !ok {
+			log.Printf("Basic Authentication Failed: %s", server.clientIP(r))
 			w.Header().Set("WWW-Authenticate", `Basic realm="GoTTY"`)
 			http.Error(w, "authorization failed", http.StatusUnauthorized)
 			return
 		}
 
-		log.Printf("Basic Authentication Succeeded: %s", getClientIP(r))
-		handler.ServeHTTP(w, r)
+		log.Printf("Basic Authentication Succeeded: %s %s", server.clientIP(r), user)
+		handler.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), user, nil)))
 	})
 }
+
+// authenticate checks a credential in the form of user:password against the users
+// of the credential file and Options.Credential, and returns the user.
+// Without Basic Authentication, only an empty credential is accepted.
+func (server *Server) authenticate(credential string) (string, bool) {
+	user, password, _ := strings.Cut(credential, ":")
+	if server.credentials != nil {
+		server.reloadCredentials()
+		if server.credentials.Authenticate(user, password) {
+			return user, true
+		}
+		if server.options.Credential == "" {
+			return "", false
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(credential), []byte(server.options.Credential)) != 1 {
+		return "", false
+	}
+	return user, true
+}
+
+// reloadCredentials reloads the credential file when it has been modified,
+// checking it at most once a second.
+func (server *Server) reloadCredentials() {
+	if !due(&server.credentialsChecked, time.Second) {
+		return
+	}
+
+	reloaded, err := server.credentials.ReloadIfModified()
+	if err != nil {
+		log.Printf("Failed to reload credential file, keeping the users loaded before: %s", err)
+		return
+	}
+	if reloaded {
+		log.Printf("Reloaded %d users from credential file `%s`", server.credentials.Len(), server.credentials.Path())
+	}
+}
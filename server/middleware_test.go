@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yudai/gotty/utils"
+)
+
+func TestLogAuthentication(t *testing.T) {
+	options := &Options{}
+	if err := utils.ApplyDefaultValues(options); err != nil {
+		t.Fatalf("Unexpected error from ApplyDefaultValues(): %s", err)
+	}
+	options.EnableBasicAuth = true
+	options.Credential = "bob:secret"
+
+	server, err := New(&nullFactory{}, options)
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := server.setupHandlers(ctx, cancel, "/", newCounter(time.Duration(0)))
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	for _, c := range []struct {
+		path     string
+		user     string
+		password string
+		expected string
+	}{
+		// failed authentication is logged
+		{"/", "", "", "192.0.2.1 401 GET /\n"},
+		{"/", "bob", "wrong", "192.0.2.1 401 GET /\n"},
+		{"/api/sessions", "", "", "192.0.2.1 401 GET /api/sessions\n"},
+		// the authenticated user is logged
+		{"/api/sessions", "bob", "secret", "192.0.2.1 bob 200 GET /api/sessions\n"},
+	} {
+		logged.Reset()
+		r := httptest.NewRequest("GET", c.path, nil)
+		if c.user != "" {
+			r.SetBasicAuth(c.user, c.password)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		lines := strings.SplitAfter(logged.String(), "\n")
+		last := lines[len(lines)-2]
+		if !strings.HasSuffix(last, c.expected) {
+			t.Errorf("Unexpected log of %s by %q: %q", c.path, c.user, logged.String())
+		}
+	}
+}
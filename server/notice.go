@@ -0,0 +1,35 @@
+package server
+
+import (
+	"github.com/yudai/gotty/webtty"
+)
+
+// Kinds of notices shown to clients
+const (
+	noticeKicked   = "kicked"
+	noticeShutdown = "shutdown"
+	noticeMessage  = "message"
+)
+
+var (
+	kickedNotice = webtty.NoticeMessage{
+		Kind:    noticeKicked,
+		Message: "You were disconnected by an administrator",
+	}
+	shutdownNotice = webtty.NoticeMessage{
+		Kind:      noticeShutdown,
+		Message:   "Server is shutting down",
+		Reconnect: true,
+	}
+)
+
+// connectionClosed is the cause of canceling a connection closed by the server.
+// The notice is sent to the client before its socket is closed.
+type connectionClosed struct {
+	reason string
+	notice webtty.NoticeMessage
+}
+
+func (closed *connectionClosed) Error() string {
+	return closed.reason
+}
@@ -1,7 +1,12 @@
 package server
 
 import (
+	"strings"
+	"time"
+
 	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/webtty"
 )
 
 type Options struct {
@@ -10,6 +15,26 @@ type Options struct {
 	PermitWrite         bool             `hcl:"permit_write" flagName:"permit-write" flagSName:"w" flagDescribe:"Permit clients to write to the TTY (BE CAREFUL)" default:"false"`
 	EnableBasicAuth     bool             `hcl:"enable_basic_auth" default:"false"`
 	Credential          string           `hcl:"credential" flagName:"credential" flagSName:"c" flagDescribe:"Credential for Basic Authentication (ex: user:pass, default disabled)" default:""`
+	CredentialFile      string           `hcl:"credential_file" flagName:"credential-file" flagDescribe:"htpasswd file of users for Basic Authentication, with bcrypt, SHA-256 or argon2 hashes" default:""`
+	GroupFile           string           `hcl:"group_file" flagName:"group-file" flagDescribe:"htgroup file of groups of users, for giving roles to groups" default:""`
+	Roles               string           `hcl:"roles" flagName:"roles" flagDescribe:"Roles of users and @groups, one of viewer, operator or admin (ex: alice=admin,@ops=operator)" default:""`
+	DefaultRole         string           `hcl:"default_role" flagName:"default-role" flagDescribe:"Role of users given none by --roles (default: admin without --roles, viewer with them)" default:""`
+	AuthTokenSecret     string           `hcl:"auth_token_secret" flagName:"auth-token-secret" flagDescribe:"Secret signing the tokens browsers connect with, shared by servers behind a load balancer (default: generated at startup)" default:""`
+	AuthTokenLifetime   int              `hcl:"auth_token_lifetime" flagName:"auth-token-lifetime" flagDescribe:"Seconds the token of a page is valid for to connect with" default:"60"`
+	OIDCIssuer          string           `hcl:"oidc_issuer" flagName:"oidc-issuer" flagDescribe:"OpenID Connect provider URL to log users in with (default disabled)" default:""`
+	OIDCClientID        string           `hcl:"oidc_client_id" flagName:"oidc-client-id" flagDescribe:"Client ID registered at the OpenID Connect provider" default:""`
+	OIDCClientSecret    string           `hcl:"oidc_client_secret" flagName:"oidc-client-secret" flagDescribe:"Client secret registered at the OpenID Connect provider" default:""`
+	OIDCRedirectURL     string           `hcl:"oidc_redirect_url" flagName:"oidc-redirect-url" flagDescribe:"URL of the login endpoint registered at the OpenID Connect provider (ex: https://example.com/login, default: derived from requests)" default:""`
+	OIDCScopes          string           `hcl:"oidc_scopes" flagName:"oidc-scopes" flagDescribe:"Scopes requested in addition to openid" default:"profile,email"`
+	OIDCUserClaim       string           `hcl:"oidc_user_claim" flagName:"oidc-user-claim" flagDescribe:"Claim naming the user, sub when it's missing" default:"preferred_username"`
+	OIDCGroupsClaim     string           `hcl:"oidc_groups_claim" flagName:"oidc-groups-claim" flagDescribe:"Claim listing the groups of the user" default:"groups"`
+	OIDCAllowedGroups   string           `hcl:"oidc_allowed_groups" flagName:"oidc-allowed-groups" flagDescribe:"Groups whose users can log in (ex: ops,dev, default: anybody)" default:""`
+	OIDCAllowedClaims   string           `hcl:"oidc_allowed_claims" flagName:"oidc-allowed-claims" flagDescribe:"Claims users need to log in (ex: email_verified=true,hd=example.com)" default:""`
+	SessionSecret       string           `hcl:"session_secret" flagName:"session-secret" flagDescribe:"Secret encrypting login session cookies (default: generated at startup)" default:""`
+	SessionLifetime     int              `hcl:"session_lifetime" flagName:"session-lifetime" flagDescribe:"Seconds users stay logged in with OpenID Connect" default:"43200"`
+	SecureCookies       bool             `hcl:"secure_cookies" flagName:"secure-cookies" flagDescribe:"Mark login session cookies Secure without TLS, such as behind a proxy terminating TLS (default: when --oidc-redirect-url is https)" default:"false"`
+	TrustedProxies      string           `hcl:"trusted_proxies" flagName:"trusted-proxies" flagDescribe:"CIDRs and addresses of reverse proxies whose X-Forwarded-For, X-Real-IP and CF-Connecting-IP headers are honored (ex: 10.0.0.0/8,127.0.0.1)" default:""`
+	TrustedUserHeader   string           `hcl:"trusted_user_header" flagName:"trusted-user-header" flagDescribe:"Header naming the user authenticated by trusted proxies (ex: X-Forwarded-User, default disabled)" default:""`
 	EnableRandomUrl     bool             `hcl:"enable_random_url" flagName:"random-url" flagSName:"r" flagDescribe:"Add a random string to the URL" default:"false"`
 	RandomUrlLength     int              `hcl:"random_url_length" flagName:"random-url-length" flagDescribe:"Random URL length" default:"8"`
 	EnableTLS           bool             `hcl:"enable_tls" flagName:"tls" flagSName:"t" flagDescribe:"Enable TLS/SSL" default:"false"`
@@ -30,6 +55,39 @@ type Options struct {
 	Height              int              `hcl:"height" flagName:"height" flagDescribe:"Static height of the screen, 0(default) means dynamically resize" default:"0"`
 	WSOrigin            string           `hcl:"ws_origin" flagName:"ws-origin" flagDescribe:"A regular expression that matches origin URLs to be accepted by WebSocket. No cross origin requests are acceptable by default" default:""`
 	Term                string           `hcl:"term" flagName:"term" flagDescribe:"Terminal name to use on the browser, one of xterm or hterm." default:"xterm"`
+	OutputQueueSize     int              `hcl:"output_queue_size" flagName:"output-queue-size" flagDescribe:"Maximum bytes of output queued for each client" default:"1048576"`
+	OutputQueuePolicy   string           `hcl:"output_queue_policy" flagName:"output-queue-policy" flagDescribe:"What to do when a client is too slow, one of block, drop or disconnect" default:"block"`
+	EnableRecording     bool             `hcl:"enable_recording" flagName:"record" flagDescribe:"Record each connection into an asciicast v2 file" default:"false"`
+	RecordingDir        string           `hcl:"recording_dir" flagName:"record-dir" flagDescribe:"Directory to store recordings" default:"~/.gotty-recordings"`
+	EnableSharing       bool             `hcl:"enable_sharing" flagName:"share" flagDescribe:"Attach clients with the same ?share=KEY parameter to a single process" default:"false"`
+	ShareWriters        string           `hcl:"share_writers" flagName:"share-writers" flagDescribe:"Clients allowed to write to a shared process, one of owner or all" default:"owner"`
+	ScrollbackSize      int              `hcl:"scrollback_size" flagName:"scrollback-size" flagDescribe:"Bytes of recent output replayed to clients joining a session (0 to disable)" default:"65536"`
+	IdleTimeout         int              `hcl:"idle_timeout" flagName:"idle-timeout" flagDescribe:"Disconnect clients sending no input for seconds (0 to disable)" default:"0"`
+	MaxSessionTime      int              `hcl:"max_session_time" flagName:"max-session-time" flagDescribe:"Disconnect clients connected for seconds (0 to disable)" default:"0"`
+	TimeoutWarning      int              `hcl:"timeout_warning" flagName:"timeout-warning" flagDescribe:"Seconds to warn clients before idle-timeout or max-session-time disconnects them" default:"60"`
+	HeartbeatInterval   int              `hcl:"heartbeat_interval" flagName:"heartbeat-interval" flagDescribe:"Seconds between WebSocket pings to detect dead clients (0 to disable)" default:"30"`
+	HeartbeatTolerance  int              `hcl:"heartbeat_tolerance" flagName:"heartbeat-tolerance" flagDescribe:"Number of heartbeats a client can miss before being disconnected" default:"2"`
+	EnableCompression   bool             `hcl:"enable_compression" flagName:"compression" flagDescribe:"Negotiate permessage-deflate compression of WebSocket messages" default:"false"`
+	CompressionLevel    int              `hcl:"compression_level" flagName:"compression-level" flagDescribe:"Compression level from -2 (Huffman only) to 9 (best compression)" default:"1"`
+	CompressionMinSize  int              `hcl:"compression_min_size" flagName:"compression-min-size" flagDescribe:"Bytes of a message to start compressing it at" default:"128"`
+	WSReadBufferSize    int              `hcl:"ws_read_buffer_size" flagName:"ws-read-buffer-size" flagDescribe:"Bytes of the WebSocket read buffer" default:"1024"`
+	WSWriteBufferSize   int              `hcl:"ws_write_buffer_size" flagName:"ws-write-buffer-size" flagDescribe:"Bytes of the WebSocket write buffer" default:"1024"`
+	EnableAudit         bool             `hcl:"enable_audit" flagName:"audit" flagDescribe:"Log the input of clients and the command lines they type" default:"false"`
+	AuditFile           string           `hcl:"audit_file" flagName:"audit-file" flagDescribe:"Audit log file path" default:"~/.gotty-audit.log"`
+	AuditMaxSize        int              `hcl:"audit_max_size" flagName:"audit-max-size" flagDescribe:"Bytes of the audit log to rotate it at (0 to disable)" default:"10485760"`
+	AuditMaxBackups     int              `hcl:"audit_max_backups" flagName:"audit-max-backups" flagDescribe:"Number of rotated audit logs to keep" default:"5"`
+	AuditRedact         bool             `hcl:"audit_redact" flagName:"audit-redact" flagDescribe:"Leave out input typed while the terminal reads a password from the audit log" default:"false"`
+	FileTransfer        string           `hcl:"file_transfer" flagName:"file-transfer" flagDescribe:"File transfers allowed to clients with write permission, one of none, upload, download or both" default:"none"`
+	FileTransferMaxSize int              `hcl:"file_transfer_max_size" flagName:"file-transfer-max-size" flagDescribe:"Bytes of the largest file transferred (0 for no limit)" default:"104857600"`
+	FileTransferSSH     bool             `hcl:"file_transfer_ssh" flagName:"file-transfer-ssh" flagDescribe:"Transfer files of tmux sessions started by tmux-wrapper.sh (?session=) over SSH on the Docker host" default:"false"`
+	ResizePolicy        string           `hcl:"resize_policy" flagName:"resize-policy" flagDescribe:"Size of a terminal seen by several clients, one of smallest, largest, owner or writer" default:"smallest"`
+	DetachGracePeriod   int              `hcl:"detach_grace_period" flagName:"detach-grace-period" flagDescribe:"Seconds to keep the process of a dropped client for it to resume (0 to disable)" default:"0"`
+	MaxDetachedSessions int              `hcl:"max_detached_sessions" flagName:"max-detached-sessions" flagDescribe:"Maximum number of processes kept for dropped clients" default:"16"`
+	DetachBufferSize    int              `hcl:"detach_buffer_size" flagName:"detach-buffer-size" flagDescribe:"Bytes of output kept for each dropped client to replay when it resumes" default:"262144"`
+	Encoding            string           `hcl:"encoding" flagName:"encoding" flagDescribe:"Character encoding of the command, such as shift_jis or latin1, converted from and to UTF-8 for clients" default:"utf-8"`
+
+	Routes     map[string]*RouteOptions `hcl:"route"`
+	RoleLimits map[string]*RoleOptions  `hcl:"role"`
 
 	TitleVariables map[string]interface{}
 }
@@ -38,9 +96,164 @@ func (options *Options) Validate() error {
 	if options.EnableTLSClientAuth && !options.EnableTLS {
 		return errors.New("TLS client authentication is enabled, but TLS is not enabled")
 	}
+	if _, err := webtty.ParseOutputQueuePolicy(options.OutputQueuePolicy); err != nil {
+		return err
+	}
+	if options.OutputQueueSize <= 0 {
+		return errors.New("output queue size must be positive")
+	}
+	if options.ShareWriters != "owner" && options.ShareWriters != "all" {
+		return errors.Errorf("unknown share writers `%s`, must be one of owner or all", options.ShareWriters)
+	}
+	if options.ScrollbackSize < 0 {
+		return errors.New("scrollback size must not be negative")
+	}
+	if options.IdleTimeout < 0 || options.MaxSessionTime < 0 || options.TimeoutWarning < 0 {
+		return errors.New("idle timeout, max session time and timeout warning must not be negative")
+	}
+	if options.HeartbeatInterval < 0 || options.HeartbeatTolerance < 0 {
+		return errors.New("heartbeat interval and tolerance must not be negative")
+	}
+	if options.CompressionLevel < -2 || options.CompressionLevel > 9 {
+		return errors.Errorf("invalid compression level %d, must be between -2 and 9", options.CompressionLevel)
+	}
+	if options.WSReadBufferSize <= 0 || options.WSWriteBufferSize <= 0 {
+		return errors.New("WebSocket buffer sizes must be positive")
+	}
+	if options.AuditMaxSize < 0 || options.AuditMaxBackups < 0 {
+		return errors.New("audit max size and max backups must not be negative")
+	}
+	switch options.FileTransfer {
+	case transferNone, transferUpload, transferDownload, transferBoth:
+	default:
+		return errors.Errorf("unknown file transfer `%s`, must be one of none, upload, download or both", options.FileTransfer)
+	}
+	if options.FileTransferMaxSize < 0 {
+		return errors.New("file transfer max size must not be negative")
+	}
+	switch options.ResizePolicy {
+	case resizeSmallest, resizeLargest, resizeOwner, resizeWriter:
+	default:
+		return errors.Errorf("unknown resize policy `%s`, must be one of smallest, largest, owner or writer", options.ResizePolicy)
+	}
+	if options.DetachGracePeriod < 0 || options.MaxDetachedSessions < 0 || options.DetachBufferSize < 0 {
+		return errors.New("detach grace period, max detached sessions and detach buffer size must not be negative")
+	}
+	if _, err := webtty.LookupEncoding(options.Encoding); err != nil {
+		return err
+	}
+	if options.AuthTokenLifetime <= 0 {
+		return errors.New("auth token lifetime must be positive")
+	}
+	if _, err := parseTrustedProxies(options.TrustedProxies); err != nil {
+		return err
+	}
+	if options.TrustedUserHeader != "" && options.TrustedProxies == "" {
+		return errors.New("trusted user header is given, but trusted proxies are not")
+	}
+	if options.OIDCIssuer != "" && options.OIDCClientID == "" {
+		return errors.New("OpenID Connect issuer is given, but client ID is not")
+	}
+	if _, err := parseClaims(options.OIDCAllowedClaims); err != nil {
+		return err
+	}
+	if options.SessionLifetime <= 0 {
+		return errors.New("session lifetime must be positive")
+	}
+	if _, err := parseRoles(options.Roles, options.DefaultRole); err != nil {
+		return err
+	}
+	for name, route := range options.Routes {
+		if name == "" || strings.ContainsAny(name, "/?#") {
+			return errors.Errorf("invalid route name `%s`", name)
+		}
+		if route.Encoding != nil {
+			if _, err := webtty.LookupEncoding(*route.Encoding); err != nil {
+				return errors.Wrapf(err, "invalid encoding of route `%s`", name)
+			}
+		}
+		if (route.IdleTimeout != nil && *route.IdleTimeout < 0) || (route.MaxSessionTime != nil && *route.MaxSessionTime < 0) {
+			return errors.Errorf("idle timeout and max session time of route `%s` must not be negative", name)
+		}
+	}
+	for name, limits := range options.RoleLimits {
+		if _, err := parseRole(name); err != nil {
+			return err
+		}
+		if (limits.IdleTimeout != nil && *limits.IdleTimeout < 0) || (limits.MaxSessionTime != nil && *limits.MaxSessionTime < 0) {
+			return errors.Errorf("idle timeout and max session time of role `%s` must not be negative", name)
+		}
+	}
 	return nil
 }
 
+// RouteOptions overrides Options for clients connecting under an additional path.
+// A route named "ops" serves the same terminal at /ops/ (under the random URL if enabled).
+// Nil fields inherit the global value.
+type RouteOptions struct {
+	EnableRecording *bool   `hcl:"enable_recording"`
+	IdleTimeout     *int    `hcl:"idle_timeout"`
+	MaxSessionTime  *int    `hcl:"max_session_time"`
+	Encoding        *string `hcl:"encoding"`
+}
+
+// RoleOptions overrides the time limits of Options and RouteOptions for connections
+// of users with a role, such as "viewer". Nil fields inherit the value of the route.
+type RoleOptions struct {
+	IdleTimeout    *int `hcl:"idle_timeout"`
+	MaxSessionTime *int `hcl:"max_session_time"`
+}
+
+// route returns the options of the named route, or nil for the default route.
+func (options *Options) route(name string) *RouteOptions {
+	if name == "" {
+		return nil
+	}
+	return options.Routes[name]
+}
+
+// recording reports whether connections on route are recorded.
+func (options *Options) recording(route *RouteOptions) bool {
+	if route != nil && route.EnableRecording != nil {
+		return *route.EnableRecording
+	}
+	return options.EnableRecording
+}
+
+// encoding returns the character encoding of the command on route,
+// unless the client has requested one with the encoding parameter.
+func (options *Options) encoding(route *RouteOptions, requested string) string {
+	if requested != "" {
+		return requested
+	}
+	if route != nil && route.Encoding != nil {
+		return *route.Encoding
+	}
+	return options.Encoding
+}
+
+// idleTimeout returns how long connections of users with r on route may send no input, 0 for no limit.
+func (options *Options) idleTimeout(route *RouteOptions, r role) time.Duration {
+	if limits := options.RoleLimits[r.String()]; limits != nil && limits.IdleTimeout != nil {
+		return time.Duration(*limits.IdleTimeout) * time.Second
+	}
+	if route != nil && route.IdleTimeout != nil {
+		return time.Duration(*route.IdleTimeout) * time.Second
+	}
+	return time.Duration(options.IdleTimeout) * time.Second
+}
+
+// maxSessionTime returns how long connections of users with r on route may last, 0 for no limit.
+func (options *Options) maxSessionTime(route *RouteOptions, r role) time.Duration {
+	if limits := options.RoleLimits[r.String()]; limits != nil && limits.MaxSessionTime != nil {
+		return time.Duration(*limits.MaxSessionTime) * time.Second
+	}
+	if route != nil && route.MaxSessionTime != nil {
+		return time.Duration(*route.MaxSessionTime) * time.Second
+	}
+	return time.Duration(options.MaxSessionTime) * time.Second
+}
+
 type HtermPrefernces struct {
 	AltGrMode                     *string                      `hcl:"alt_gr_mode" json:"alt-gr-mode,omitempty"`
 	AltBackspaceIsMetaBackspace   bool                         `hcl:"alt_backspace_is_meta_backspace" json:"alt-backspace-is-meta-backspace,omitempty"`
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// trustedProxies are the networks of reverse proxies whose forwarded headers are honored.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a list of CIDRs and addresses, such as 10.0.0.0/8,127.0.0.1.
+func parseTrustedProxies(spec string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, item := range splitList(spec) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy `%s`, must be an IP address or a CIDR", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, errors.Errorf("invalid trusted proxy `%s`, must be an IP address or a CIDR", item)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// trusts reports whether address is one of the proxies.
+func (proxies trustedProxies) trusts(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the address of the peer of a request, which may be a proxy.
+func remoteIP(r *http.Request) string {
+	// RemoteAddr is in format "IP:port", so we need to extract just the IP
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr // Return as-is if parsing fails
+	}
+	return host
+}
+
+// clientIP returns the real client IP of a request.
+// Proxy headers are only honored when the request comes from a trusted proxy.
+func (server *Server) clientIP(r *http.Request) string {
+	remote := remoteIP(r)
+	if !server.trustedProxies.trusts(remote) {
+		return remote
+	}
+
+	// X-Forwarded-For can contain multiple IPs: "client, proxy1, proxy2",
+	// each appended by the proxy that received the request from it.
+	// Going from the right, the first hop not added by a trusted proxy is the client,
+	// as anything to its left could have been sent by the client.
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) > 0 {
+		client := remote
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			client = hop
+			if !server.trustedProxies.trusts(hop) {
+				break
+			}
+		}
+		return client
+	}
+
+	// X-Real-IP (used by nginx and others) and CF-Connecting-IP (Cloudflare) tell only the client
+	for _, name := range []string{"X-Real-IP", "CF-Connecting-IP"} {
+		if value := strings.TrimSpace(r.Header.Get(name)); net.ParseIP(value) != nil {
+			return value
+		}
+	}
+	return remote
+}
+
+// proxyUser returns the user authenticated by a trusted proxy in Options.TrustedUserHeader.
+func (server *Server) proxyUser(r *http.Request) (string, bool) {
+	if server.options.TrustedUserHeader == "" {
+		return "", false
+	}
+	user := strings.TrimSpace(r.Header.Get(server.options.TrustedUserHeader))
+	if user == "" || !server.trustedProxies.trusts(remoteIP(r)) {
+		return "", false
+	}
+	return user, true
+}
+
+// wrapProxyUser accepts the users authenticated by trusted proxies, and passes
+// other requests to fallback, or rejects them when no other authentication is enabled.
+func (server *Server) wrapProxyUser(handler http.Handler, fallback http.Handler) http.Handler {
+	otherAuth := server.login != nil || server.options.EnableBasicAuth
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := server.proxyUser(r); ok {
+			handler.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), user, nil)))
+			return
+		}
+		if otherAuth {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		log.Printf("Request of %s to %s rejected, not authenticated by a trusted proxy", server.clientIP(r), r.URL.Path)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
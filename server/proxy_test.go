@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 127.0.0.1,::1,")
+	if err != nil {
+		t.Fatalf("Unexpected error from parseTrustedProxies(): %s", err)
+	}
+	for address, trusted := range map[string]bool{
+		"10.1.2.3":  true,
+		"127.0.0.1": true,
+		"127.0.0.2": false,
+		"::1":       true,
+		"11.0.0.1":  false,
+		"invalid":   false,
+	} {
+		if proxies.trusts(address) != trusted {
+			t.Errorf("Unexpected result of trusts(%s): %v", address, !trusted)
+		}
+	}
+
+	for _, spec := range []string{"10.0.0.0/33", "localhost", "1.2.3"} {
+		if _, err := parseTrustedProxies(spec); err == nil {
+			t.Errorf("Expected an error from parseTrustedProxies(%s)", spec)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, _ := parseTrustedProxies("10.0.0.0/8")
+	server := &Server{options: &Options{}, trustedProxies: proxies}
+
+	for _, c := range []struct {
+		name     string
+		remote   string
+		headers  map[string]string
+		expected string
+	}{
+		{"direct", "1.2.3.4:1234", nil, "1.2.3.4"},
+		{"spoofed XFF", "1.2.3.4:1234", map[string]string{"X-Forwarded-For": "6.6.6.6"}, "1.2.3.4"},
+		{"spoofed X-Real-IP", "1.2.3.4:1234", map[string]string{"X-Real-IP": "6.6.6.6"}, "1.2.3.4"},
+		{"spoofed CF-Connecting-IP", "1.2.3.4:1234", map[string]string{"CF-Connecting-IP": "6.6.6.6"}, "1.2.3.4"},
+		{"proxied", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "1.2.3.4"},
+		{"right-most untrusted hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.0.0.2"}, "1.2.3.4"},
+		{"all hops trusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"invalid hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"invalid only hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "garbage"}, "10.0.0.1"},
+		{"X-Real-IP", "10.0.0.1:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "1.2.3.4"},
+		{"CF-Connecting-IP", "10.0.0.1:1234", map[string]string{"CF-Connecting-IP": "1.2.3.4"}, "1.2.3.4"},
+		{"invalid X-Real-IP", "10.0.0.1:1234", map[string]string{"X-Real-IP": "garbage"}, "10.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		for name, value := range c.headers {
+			r.Header.Set(name, value)
+		}
+		if ip := server.clientIP(r); ip != c.expected {
+			t.Errorf("%s: unexpected client IP: %s", c.name, ip)
+		}
+	}
+}
+
+func TestWrapProxyUser(t *testing.T) {
+	proxies, _ := parseTrustedProxies("10.0.0.0/8")
+	server := &Server{
+		options:        &Options{TrustedProxies: "10.0.0.0/8", TrustedUserHeader: "X-Forwarded-User"},
+		trustedProxies: proxies,
+	}
+	handler := server.wrapAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(userFromContext(r.Context())))
+	}))
+
+	for _, c := range []struct {
+		name   string
+		remote string
+		user   string
+		status int
+	}{
+		{"trusted proxy", "10.0.0.1:1234", "alice", http.StatusOK},
+		{"untrusted peer", "1.2.3.4:1234", "alice", http.StatusUnauthorized},
+		{"no user", "10.0.0.1:1234", "", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.user != "" {
+			r.Header.Set("X-Forwarded-User", c.user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s: unexpected status: %d", c.name, w.Code)
+		}
+		if c.status == http.StatusOK && w.Body.String() != c.user {
+			t.Errorf("%s: unexpected user: %s", c.name, w.Body.String())
+		}
+	}
+
+	// requests of untrusted peers fall back to Basic Authentication when it's enabled
+	server.options.EnableBasicAuth = true
+	server.options.Credential = "bob:secret"
+	handler = server.wrapAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(userFromContext(r.Context())))
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "1.2.3.4:1234"
+	r.Header.Set("X-Forwarded-User", "alice")
+	r.SetBasicAuth("bob", "secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "bob" {
+		t.Errorf("Unexpected response of Basic Authentication: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/pkg/asciicast"
+	"github.com/yudai/gotty/pkg/homedir"
+)
+
+// recordingQueueSize is the number of events buffered for each recording
+// before events are discarded to keep the terminal responsive.
+const recordingQueueSize = 4096
+
+// startRecording creates an asciicast file named after the connection ID
+// in the recording directory.
+func (server *Server) startRecording(connID, clientIP, sessionName string, slave Slave) (*asciicast.Writer, string, error) {
+	dir := homedir.Expand(server.options.RecordingDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, "", errors.Wrapf(err, "failed to create recording directory `%s`", dir)
+	}
+
+	// IPv6 addresses contain colons, which are not welcome in file names
+	fileName := strings.NewReplacer(":", "_", "/", "_").Replace(connID) + ".cast"
+	path := filepath.Join(dir, fileName)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to create recording file `%s`", path)
+	}
+
+	header := asciicast.Header{
+		Width:        80,
+		Height:       24,
+		Command:      recordingCommand(slave.WindowTitleVariables()),
+		Env:          map[string]string{"TERM": "xterm"},
+		RemoteAddr:   clientIP,
+		SessionName:  sessionName,
+		ConnectionID: connID,
+	}
+	if server.options.Width > 0 {
+		header.Width = server.options.Width
+	}
+	if server.options.Height > 0 {
+		header.Height = server.options.Height
+	}
+
+	writer, err := asciicast.NewWriter(file, header, recordingQueueSize)
+	if err != nil {
+		file.Close()
+		return nil, "", err
+	}
+
+	return writer, path, nil
+}
+
+// stopRecording closes the recording of a connection, reporting the events
+// discarded because the recording file could not keep up with the terminal.
+func (server *Server) stopRecording(connID string, recorder *asciicast.Writer, path string) {
+	if err := recorder.Close(); err != nil {
+		log.Printf("Failed to write recording of connection %s to %s: %s", connID, path, err)
+	}
+	if dropped := recorder.Dropped(); dropped > 0 {
+		log.Printf("Recording of connection %s to %s is missing %d events, writing it could not keep up", connID, path, dropped)
+	}
+}
+
+// recordingCommand builds a command line from the title variables of a slave.
+func recordingCommand(vars map[string]interface{}) string {
+	command, _ := vars["command"].(string)
+	argv, _ := vars["argv"].([]string)
+	return strings.TrimSpace(command + " " + strings.Join(argv, " "))
+}
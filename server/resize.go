@@ -0,0 +1,196 @@
+package server
+
+import (
+	"log"
+	"sync"
+
+	"github.com/yudai/gotty/webtty"
+)
+
+// policies choosing the size of a terminal seen by several connections
+const (
+	resizeSmallest = "smallest"
+	resizeLargest  = "largest"
+	resizeOwner    = "owner"
+	resizeWriter   = "writer"
+)
+
+// resizeArbiters chooses one size for the connections of a group,
+// which see the same terminal, from the sizes they report.
+type resizeArbiters struct {
+	policy        string
+	mutex         sync.Mutex
+	groups        map[string]*resizeGroup
+	writeControls *writeControls
+}
+
+type resizeGroup struct {
+	key     string
+	members []*resizeMember // in the order of joining, the first one is the owner
+	latest  *resizeMember   // the last member which has reported its size
+	columns int
+	rows    int
+
+	announcer announcer
+}
+
+type resizeMember struct {
+	connID  string
+	tty     *webtty.WebTTY
+	group   *resizeGroup
+	columns int // reported by the client
+	rows    int
+	applied bool // the size of the group has been applied to the member
+}
+
+func newResizeArbiters(policy string, writeControls *writeControls) *resizeArbiters {
+	return &resizeArbiters{
+		policy:        policy,
+		groups:        make(map[string]*resizeGroup),
+		writeControls: writeControls,
+	}
+}
+
+// join adds a connection to the group identified by key,
+// which is the same as the group of the write control.
+func (ras *resizeArbiters) join(key string, connID string, tty *webtty.WebTTY) *resizeMember {
+	ras.mutex.Lock()
+	group, ok := ras.groups[key]
+	if !ok {
+		group = &resizeGroup{key: key}
+		ras.groups[key] = group
+	}
+	member := &resizeMember{
+		connID: connID,
+		tty:    tty,
+		group:  group,
+	}
+	group.members = append(group.members, member)
+	ras.update(group)
+	return member
+}
+
+// leave removes a connection, which may change the size of the others.
+func (ras *resizeArbiters) leave(member *resizeMember) {
+	ras.mutex.Lock()
+	group := member.group
+	group.members = removeResizeMember(group.members, member)
+	if group.latest == member {
+		group.latest = nil
+	}
+	if len(group.members) == 0 {
+		delete(ras.groups, group.key)
+		ras.mutex.Unlock()
+		return
+	}
+	ras.update(group)
+}
+
+// resize records the size reported by a connection.
+func (ras *resizeArbiters) resize(member *resizeMember, columns int, rows int) {
+	ras.mutex.Lock()
+	member.columns, member.rows = columns, rows
+	member.group.latest = member
+	ras.update(member.group)
+}
+
+// writerChanged reconsiders the size of a group when its write control has moved,
+// for the writer policy.
+func (ras *resizeArbiters) writerChanged(key string) {
+	if ras.policy != resizeWriter {
+		return
+	}
+	ras.mutex.Lock()
+	group, ok := ras.groups[key]
+	if !ok {
+		ras.mutex.Unlock()
+		return
+	}
+	ras.update(group)
+}
+
+// update chooses the size of the group and applies it to the members.
+// It must be called with the lock held, which is released.
+// Like writeControls.update, the resizes, which can block on
+// a slow client, are done by the announcer of the group after releasing the lock,
+// which keeps them in order within the group.
+func (ras *resizeArbiters) update(group *resizeGroup) {
+	columns, rows := ras.choose(group)
+	changed := columns != group.columns || rows != group.rows
+	group.columns, group.rows = columns, rows
+
+	var resizes []func()
+	if columns > 0 && rows > 0 {
+		for _, member := range group.members {
+			if changed || !member.applied {
+				member.applied = true
+				resizes = append(resizes, func() {
+					if err := member.tty.SetTerminalSize(columns, rows); err != nil {
+						log.Printf("Failed to resize terminal of %s: %v", member.connID, err)
+					}
+				})
+			}
+		}
+	}
+	flush := group.announcer.push(resizes...)
+	ras.mutex.Unlock()
+
+	if flush {
+		group.announcer.flush()
+	}
+}
+
+// choose returns the size of the group by the policy,
+// falling back to the latest reported size.
+func (ras *resizeArbiters) choose(group *resizeGroup) (columns int, rows int) {
+	var reported []*resizeMember
+	for _, member := range group.members {
+		if member.columns > 0 && member.rows > 0 {
+			reported = append(reported, member)
+		}
+	}
+	if len(reported) == 0 {
+		return group.columns, group.rows
+	}
+
+	var chosen *resizeMember
+	switch ras.policy {
+	case resizeSmallest, resizeLargest:
+		columns, rows = reported[0].columns, reported[0].rows
+		for _, member := range reported[1:] {
+			if ras.policy == resizeSmallest {
+				columns, rows = min(columns, member.columns), min(rows, member.rows)
+			} else {
+				columns, rows = max(columns, member.columns), max(rows, member.rows)
+			}
+		}
+		return columns, rows
+	case resizeOwner:
+		chosen = group.members[0]
+	case resizeWriter:
+		holder := ras.writeControls.holder(group.key)
+		for _, member := range group.members {
+			if member.connID == holder {
+				chosen = member
+			}
+		}
+	}
+
+	if chosen == nil || chosen.columns == 0 || chosen.rows == 0 {
+		chosen = group.latest
+	}
+	if chosen == nil {
+		chosen = reported[len(reported)-1]
+	}
+	return chosen.columns, chosen.rows
+}
+
+func removeResizeMember(members []*resizeMember, target *resizeMember) []*resizeMember {
+	result := members[:0]
+	for _, member := range members {
+		if member != target {
+			result = append(result, member)
+		}
+	}
+	return result
+}
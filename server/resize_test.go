@@ -0,0 +1,19 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestResizeStalledGroup(t *testing.T) {
+	ras := newResizeArbiters(resizeSmallest, nil)
+	stalled := newStalledMaster()
+	defer close(stalled.release)
+
+	go ras.resize(ras.join("stalled", "1", newTestTTY(t, stalled)), 80, 24)
+	<-stalled.writing
+
+	tty := newTestTTY(t, discardMaster{})
+	if !within(func() { ras.resize(ras.join("other", "2", tty), 120, 40) }) {
+		t.Fatalf("A stalled client blocks resizing another group")
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/pkg/htpasswd"
+)
+
+// role tells what a user is allowed to do. Each role can do what the lower ones can.
+type role int
+
+const (
+	// roleViewer sees terminals without writing to them.
+	roleViewer role = iota
+	// roleOperator writes to terminals and executes commands with the REST API.
+	roleOperator
+	// roleAdmin destroys sessions and kicks and controls connections of others.
+	roleAdmin
+)
+
+func parseRole(name string) (role, error) {
+	switch name {
+	case "viewer":
+		return roleViewer, nil
+	case "operator":
+		return roleOperator, nil
+	case "admin":
+		return roleAdmin, nil
+	default:
+		return roleViewer, errors.Errorf("unknown role `%s`, must be one of viewer, operator or admin", name)
+	}
+}
+
+func (r role) String() string {
+	switch r {
+	case roleOperator:
+		return "operator"
+	case roleAdmin:
+		return "admin"
+	default:
+		return "viewer"
+	}
+}
+
+// roles maps users, and groups of a group file, to their roles.
+type roles struct {
+	users       map[string]role
+	groups      map[string]role
+	defaultRole role
+
+	groupFile        *htpasswd.Groups // nil unless a group file is given
+	groupFileChecked atomic.Int64     // when the group file was last checked for changes, in Unix nanoseconds
+}
+
+// parseRoles parses a list of roles in the form of alice=admin,@ops=operator,
+// where names starting with @ are groups.
+// Users given no role get defaultName, which defaults to admin without any roles
+// so that authenticated users can do everything as before, and to viewer with them.
+func parseRoles(spec string, defaultName string) (*roles, error) {
+	rs := &roles{
+		users:  make(map[string]role),
+		groups: make(map[string]role),
+	}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, roleName, ok := strings.Cut(item, "=")
+		if !ok || name == "" || name == "@" {
+			return nil, errors.Errorf("invalid role `%s`, must be in the form of user=role or @group=role", item)
+		}
+		r, err := parseRole(roleName)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(name, "@") {
+			rs.groups[name[1:]] = r
+		} else {
+			rs.users[name] = r
+		}
+	}
+
+	switch {
+	case defaultName != "":
+		r, err := parseRole(defaultName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid default role")
+		}
+		rs.defaultRole = r
+	case len(rs.users) == 0 && len(rs.groups) == 0:
+		rs.defaultRole = roleAdmin
+	default:
+		rs.defaultRole = roleViewer
+	}
+	return rs, nil
+}
+
+// of returns the role of user, who is in groups given by its login and in the ones
+// of the group file. A role given to the user wins over the ones of its groups,
+// and the highest role of the groups wins over the others.
+func (rs *roles) of(user string, groups []string) role {
+	if r, ok := rs.users[user]; ok {
+		return r
+	}
+	if rs.groupFile != nil && user != "" {
+		rs.reloadGroups()
+		groups = append(groups[:len(groups):len(groups)], rs.groupFile.Of(user)...)
+	}
+
+	found := false
+	highest := roleViewer
+	for _, group := range groups {
+		if r, ok := rs.groups[group]; ok {
+			found = true
+			highest = max(highest, r)
+		}
+	}
+	if !found {
+		return rs.defaultRole
+	}
+	return highest
+}
+
+// reloadGroups reloads the group file when it has been modified,
+// checking it at most once a second.
+func (rs *roles) reloadGroups() {
+	if !due(&rs.groupFileChecked, time.Second) {
+		return
+	}
+
+	reloaded, err := rs.groupFile.ReloadIfModified()
+	if err != nil {
+		log.Printf("Failed to reload group file, keeping the groups loaded before: %s", err)
+		return
+	}
+	if reloaded {
+		log.Printf("Reloaded group file `%s`", rs.groupFile.Path())
+	}
+}
+
+// due reports whether interval has passed since the time stored in checked,
+// and stores the current time if so. Only one of concurrent callers gets true.
+func due(checked *atomic.Int64, interval time.Duration) bool {
+	now := time.Now().UnixNano()
+	last := checked.Load()
+	return now-last >= int64(interval) && checked.CompareAndSwap(last, now)
+}
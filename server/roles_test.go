@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yudai/gotty/utils"
+)
+
+func TestParseRoles(t *testing.T) {
+	for _, c := range []struct {
+		spec, defaultName string
+		expected          role
+	}{
+		{"", "", roleAdmin},
+		{"alice=admin", "", roleViewer},
+		{"@ops=operator", "", roleViewer},
+		{"alice=admin", "operator", roleOperator},
+		{"", "viewer", roleViewer},
+	} {
+		rs, err := parseRoles(c.spec, c.defaultName)
+		if err != nil {
+			t.Fatalf("Unexpected error from parseRoles(%s, %s): %s", c.spec, c.defaultName, err)
+		}
+		if rs.defaultRole != c.expected {
+			t.Errorf("Unexpected default role of parseRoles(%s, %s): %s", c.spec, c.defaultName, rs.defaultRole)
+		}
+	}
+
+	for _, c := range []struct{ spec, defaultName string }{
+		{"alice", ""},
+		{"alice=root", ""},
+		{"=admin", ""},
+		{"@=admin", ""},
+		{"alice=admin", "root"},
+	} {
+		if _, err := parseRoles(c.spec, c.defaultName); err == nil {
+			t.Errorf("Expected an error from parseRoles(%s, %s)", c.spec, c.defaultName)
+		}
+	}
+}
+
+func TestRolesOf(t *testing.T) {
+	rs, err := parseRoles("alice=viewer, bob=admin, @ops=operator, @admins=admin, @guests=viewer", "")
+	if err != nil {
+		t.Fatalf("Unexpected error from parseRoles(): %s", err)
+	}
+
+	for _, c := range []struct {
+		user     string
+		groups   []string
+		expected role
+	}{
+		// a role given to the user wins over the ones of its groups
+		{"alice", []string{"admins"}, roleViewer},
+		{"bob", nil, roleAdmin},
+		// the highest role of the groups wins
+		{"carol", []string{"guests", "ops"}, roleOperator},
+		{"carol", []string{"ops", "admins", "guests"}, roleAdmin},
+		// users given none get the default role
+		{"carol", []string{"unknown"}, roleViewer},
+		{"", nil, roleViewer},
+	} {
+		if r := rs.of(c.user, c.groups); r != c.expected {
+			t.Errorf("Unexpected role of %s in %v: %s", c.user, c.groups, r)
+		}
+	}
+}
+
+type nullFactory struct{}
+
+func (factory *nullFactory) Name() string {
+	return "null"
+}
+
+func (factory *nullFactory) New(params map[string][]string) (Slave, error) {
+	return nil, nil
+}
+
+func TestRoleGating(t *testing.T) {
+	options := &Options{}
+	if err := utils.ApplyDefaultValues(options); err != nil {
+		t.Fatalf("Unexpected error from ApplyDefaultValues(): %s", err)
+	}
+	// users are given by a trusted proxy, httptest requests come from 192.0.2.1
+	options.TrustedProxies = "192.0.2.0/24"
+	options.TrustedUserHeader = "X-Forwarded-User"
+	options.Roles = "alice=viewer,bob=operator,carol=admin"
+
+	server, err := New(&nullFactory{}, options)
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := server.setupHandlers(ctx, cancel, "/", newCounter(time.Duration(0)))
+
+	for _, c := range []struct {
+		path      string
+		forbidden []string
+	}{
+		{"/api/exec", []string{"alice"}},
+		{"/api/sessions", nil},
+		{"/api/sessions/destroy", []string{"alice", "bob"}},
+		{"/api/connections", nil},
+		{"/api/connections/history", nil},
+		{"/api/connections/kick", []string{"alice", "bob"}},
+		{"/api/connections/control", []string{"alice", "bob"}},
+		{"/api/connections/notice", []string{"alice", "bob"}},
+	} {
+		for _, user := range []string{"alice", "bob", "carol"} {
+			r := httptest.NewRequest("POST", c.path, nil)
+			r.Header.Set("X-Forwarded-User", user)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			expected := false
+			for _, forbidden := range c.forbidden {
+				expected = expected || forbidden == user
+			}
+			if (w.Code == http.StatusForbidden) != expected {
+				t.Errorf("Unexpected status of %s for %s: %d", c.path, user, w.Code)
+			}
+		}
+	}
+}
+
+func TestRoleLimits(t *testing.T) {
+	hour, zero, minute := 3600, 0, 60
+	options := &Options{}
+	utils.ApplyDefaultValues(options)
+	options.IdleTimeout = 600
+	options.Routes = map[string]*RouteOptions{"ops": {IdleTimeout: &minute, MaxSessionTime: &minute}}
+	options.RoleLimits = map[string]*RoleOptions{
+		"viewer": {MaxSessionTime: &hour},
+		"admin":  {IdleTimeout: &zero},
+	}
+	if err := options.Validate(); err != nil {
+		t.Fatalf("Unexpected error from Validate(): %s", err)
+	}
+
+	route := options.route("ops")
+	for _, c := range []struct {
+		route          *RouteOptions
+		r              role
+		idle, duration time.Duration
+	}{
+		{nil, roleOperator, 600 * time.Second, 0},
+		{route, roleOperator, time.Minute, time.Minute},
+		{nil, roleViewer, 600 * time.Second, time.Hour},
+		{route, roleViewer, time.Minute, time.Hour},
+		{route, roleAdmin, 0, time.Minute},
+	} {
+		if idle := options.idleTimeout(c.route, c.r); idle != c.idle {
+			t.Errorf("Unexpected idle timeout of %s: %s", c.r, idle)
+		}
+		if duration := options.maxSessionTime(c.route, c.r); duration != c.duration {
+			t.Errorf("Unexpected max session time of %s: %s", c.r, duration)
+		}
+	}
+
+	options.RoleLimits["root"] = &RoleOptions{}
+	if err := options.Validate(); err == nil {
+		t.Errorf("Expected an error from Validate() with an unknown role")
+	}
+}
@@ -2,11 +2,14 @@ package server
 
 import (
 	"context"
+
+	"github.com/yudai/gotty/pkg/audit"
 )
 
 // RunOptions holds a set of configurations for Server.Run().
 type RunOptions struct {
 	gracefullCtx context.Context
+	auditSink    audit.Sink
 }
 
 // RunOption is an option of Server.Run().
@@ -19,3 +22,12 @@ func WithGracefullContext(ctx context.Context) RunOption {
 		options.gracefullCtx = ctx
 	}
 }
+
+// WithAuditSink logs the input of clients into sink
+// instead of the audit file given by Options.
+// The Write of sink must not block, see audit.Queue.
+func WithAuditSink(sink audit.Sink) RunOption {
+	return func(options *RunOptions) {
+		options.auditSink = sink
+	}
+}
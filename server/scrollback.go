@@ -0,0 +1,70 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yudai/gotty/webtty"
+)
+
+// maxScrollbacks limits the number of sessions whose scrollback is kept.
+const maxScrollbacks = 100
+
+// scrollbacks keeps the recent output of each named session, so that
+// clients reconnecting to or joining a session see its recent context.
+type scrollbacks struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]*scrollbackEntry
+}
+
+type scrollbackEntry struct {
+	scrollback *webtty.Scrollback
+	lastUsed   time.Time
+}
+
+func newScrollbacks(size int) *scrollbacks {
+	return &scrollbacks{
+		size:    size,
+		entries: make(map[string]*scrollbackEntry),
+	}
+}
+
+// get returns the scrollback of the session, creating it if necessary.
+// The least recently used scrollback is discarded when there are too many.
+func (sbs *scrollbacks) get(sessionName string) *webtty.Scrollback {
+	sbs.mutex.Lock()
+	defer sbs.mutex.Unlock()
+
+	entry, ok := sbs.entries[sessionName]
+	if !ok {
+		if len(sbs.entries) >= maxScrollbacks {
+			sbs.evict()
+		}
+		entry = &scrollbackEntry{scrollback: webtty.NewScrollback(sbs.size)}
+		sbs.entries[sessionName] = entry
+	}
+	entry.lastUsed = time.Now()
+
+	return entry.scrollback
+}
+
+// remove discards the scrollback of a session, typically when it's destroyed.
+func (sbs *scrollbacks) remove(sessionName string) {
+	sbs.mutex.Lock()
+	defer sbs.mutex.Unlock()
+
+	delete(sbs.entries, sessionName)
+}
+
+func (sbs *scrollbacks) evict() {
+	var oldest string
+	var oldestTime time.Time
+	for name, entry := range sbs.entries {
+		if oldestTime.IsZero() || entry.lastUsed.Before(oldestTime) {
+			oldest = name
+			oldestTime = entry.lastUsed
+		}
+	}
+	delete(sbs.entries, oldest)
+}
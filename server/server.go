@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"regexp"
+	"sync/atomic"
 	noesctmpl "text/template"
 	"time"
 
@@ -18,7 +19,10 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 
+	"github.com/yudai/gotty/pkg/audit"
 	"github.com/yudai/gotty/pkg/homedir"
+	"github.com/yudai/gotty/pkg/htpasswd"
+	"github.com/yudai/gotty/pkg/oidclogin"
 	"github.com/yudai/gotty/pkg/randomstring"
 	"github.com/yudai/gotty/webtty"
 )
@@ -32,6 +36,20 @@ type Server struct {
 	indexTemplate *template.Template
 	titleTemplate *noesctmpl.Template
 	connections   *ConnectionTracker
+	scrollbacks   *scrollbacks
+	sharedSlaves  *sharedSlaves
+	writeControls *writeControls
+	resizes       *resizeArbiters
+	detachables   *detachableSessions // nil unless detaching is enabled
+	auditSink     audit.Sink
+
+	roles              *roles
+	trustedProxies     trustedProxies
+	login              *oidclogin.Login // nil unless OpenID Connect is enabled
+	loginPath          string
+	authTokens         *authTokens
+	credentials        *htpasswd.File // nil unless a credential file is given
+	credentialsChecked atomic.Int64   // when the credential file was last checked for changes, in Unix nanoseconds
 }
 
 // New creates a new instance of Server.
@@ -58,6 +76,41 @@ func New(factory Factory, options *Options) (*Server, error) {
 		return nil, errors.Wrapf(err, "failed to parse window title format `%s`", options.TitleFormat)
 	}
 
+	var credentials *htpasswd.File
+	if options.CredentialFile != "" {
+		credentials, err = htpasswd.Load(homedir.Expand(options.CredentialFile))
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded %d users from credential file `%s`", credentials.Len(), credentials.Path())
+	}
+
+	roles, err := parseRoles(options.Roles, options.DefaultRole)
+	if err != nil {
+		return nil, err
+	}
+	if options.GroupFile != "" {
+		roles.groupFile, err = htpasswd.LoadGroups(homedir.Expand(options.GroupFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	authTokens, err := newAuthTokens(options.AuthTokenSecret, time.Duration(options.AuthTokenLifetime)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	proxies, err := parseTrustedProxies(options.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	login, err := newLogin(options)
+	if err != nil {
+		return nil, err
+	}
+
 	var originChekcer func(r *http.Request) bool
 	if options.WSOrigin != "" {
 		matcher, err := regexp.Compile(options.WSOrigin)
@@ -69,19 +122,44 @@ func New(factory Factory, options *Options) (*Server, error) {
 		}
 	}
 
+	connections := NewConnectionTracker()
+	writeControls := newWriteControls(connections)
+	resizes := newResizeArbiters(options.ResizePolicy, writeControls)
+	writeControls.changed = resizes.writerChanged
+
+	var detachables *detachableSessions
+	if options.DetachGracePeriod > 0 {
+		detachables = newDetachableSessions(
+			time.Duration(options.DetachGracePeriod)*time.Second,
+			options.MaxDetachedSessions,
+			options.DetachBufferSize,
+		)
+	}
+
 	return &Server{
 		factory: factory,
 		options: options,
 
 		upgrader: &websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			Subprotocols:    webtty.Protocols,
-			CheckOrigin:     originChekcer,
+			ReadBufferSize:    options.WSReadBufferSize,
+			WriteBufferSize:   options.WSWriteBufferSize,
+			Subprotocols:      webtty.Protocols,
+			CheckOrigin:       originChekcer,
+			EnableCompression: options.EnableCompression,
 		},
-		indexTemplate: indexTemplate,
-		titleTemplate: titleTemplate,
-		connections:   NewConnectionTracker(),
+		indexTemplate:  indexTemplate,
+		titleTemplate:  titleTemplate,
+		connections:    connections,
+		scrollbacks:    newScrollbacks(options.ScrollbackSize),
+		sharedSlaves:   newSharedSlaves(options.ScrollbackSize),
+		writeControls:  writeControls,
+		resizes:        resizes,
+		detachables:    detachables,
+		roles:          roles,
+		trustedProxies: proxies,
+		login:          login,
+		authTokens:     authTokens,
+		credentials:    credentials,
 	}, nil
 }
 
@@ -108,9 +186,28 @@ func (server *Server) Run(ctx context.Context, options ...RunOption) error {
 		return errors.Wrapf(err, "failed to setup an HTTP server")
 	}
 
+	server.auditSink = opts.auditSink
+	if server.auditSink == nil && server.options.EnableAudit {
+		auditPath := homedir.Expand(server.options.AuditFile)
+		auditFile, err := audit.NewRotatingFile(auditPath, int64(server.options.AuditMaxSize), server.options.AuditMaxBackups)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open audit log")
+		}
+		auditQueue := audit.NewQueue(auditFile, auditQueueSize)
+		defer closeAudit(auditQueue, auditPath)
+		server.auditSink = auditQueue
+		log.Printf("Logging input of clients into %s", auditPath)
+	}
+
 	if server.options.PermitWrite {
 		log.Printf("Permitting clients to write input to the PTY.")
 	}
+	if server.options.EnableSharing {
+		log.Printf("Sharing processes between clients with the same share key, writers: %s", server.options.ShareWriters)
+	}
+	if server.detachables != nil {
+		log.Printf("Keeping processes of dropped clients for %d seconds", server.options.DetachGracePeriod)
+	}
 	if server.options.Once {
 		log.Printf("Once option is provided, accepting only one client")
 	}
@@ -156,6 +253,7 @@ func (server *Server) Run(ctx context.Context, options ...RunOption) error {
 	go func() {
 		select {
 		case <-opts.gracefullCtx.Done():
+			server.connections.NotifyAll(shutdownNotice)
 			srv.Shutdown(context.Background())
 		case <-cctx.Done():
 		}
@@ -178,6 +276,9 @@ func (server *Server) Run(ctx context.Context, options ...RunOption) error {
 		log.Printf("Waiting for %d connections to be closed", conn)
 	}
 	counter.wait()
+	if server.detachables != nil {
+		server.detachables.closeAll()
+	}
 
 	return err
 }
@@ -187,66 +288,83 @@ func (server *Server) setupHandlers(ctx context.Context, cancel context.CancelFu
 		&assetfs.AssetFS{Asset: Asset, AssetDir: AssetDir, Prefix: "static"},
 	)
 
-	var siteMux = http.NewServeMux()
-	siteMux.HandleFunc(pathPrefix, server.handleIndex)
-	siteMux.Handle(pathPrefix+"js/", http.StripPrefix(pathPrefix, staticFileHandler))
-	siteMux.Handle(pathPrefix+"favicon.png", http.StripPrefix(pathPrefix, staticFileHandler))
-	siteMux.Handle(pathPrefix+"css/", http.StripPrefix(pathPrefix, staticFileHandler))
+	// each route serves the same terminal page under its own path
+	sitePrefixes := []string{pathPrefix}
+	for name := range server.options.Routes {
+		sitePrefixes = append(sitePrefixes, pathPrefix+name+"/")
+	}
 
-	siteMux.HandleFunc(pathPrefix+"auth_token.js", server.handleAuthToken)
-	siteMux.HandleFunc(pathPrefix+"config.js", server.handleConfig)
+	var siteMux = http.NewServeMux()
+	for _, sitePrefix := range sitePrefixes {
+		siteMux.HandleFunc(sitePrefix, server.handleIndex)
+		siteMux.Handle(sitePrefix+"js/", http.StripPrefix(sitePrefix, staticFileHandler))
+		siteMux.Handle(sitePrefix+"favicon.png", http.StripPrefix(sitePrefix, staticFileHandler))
+		siteMux.Handle(sitePrefix+"css/", http.StripPrefix(sitePrefix, staticFileHandler))
+
+		siteMux.HandleFunc(sitePrefix+"auth_token.json", server.handleAuthToken)
+		siteMux.HandleFunc(sitePrefix+"config.js", server.handleConfig)
+	}
 	siteMux.HandleFunc(pathPrefix+"sessions", server.handleSessionsPage)
 
 	siteHandler := http.Handler(siteMux)
 
 	if server.options.EnableBasicAuth {
 		log.Printf("Using Basic Authentication")
-		siteHandler = server.wrapBasicAuth(siteHandler, server.options.Credential)
 	}
+	if server.login != nil {
+		log.Printf("Using OpenID Connect login with %s", server.options.OIDCIssuer)
+	}
+	server.loginPath = pathPrefix + "login"
 
+	siteHandler = server.wrapAuth(siteHandler)
 	withGz := gziphandler.GzipHandler(server.wrapHeaders(siteHandler))
 	siteHandler = server.wrapLogger(withGz)
 
 	wsMux := http.NewServeMux()
 	wsMux.Handle("/", siteHandler)
-	wsMux.HandleFunc(pathPrefix+"ws", server.generateHandleWS(ctx, cancel, counter))
+	wsHandler := server.generateHandleWS(ctx, cancel, counter)
+	wsMux.HandleFunc(pathPrefix+"ws", wsHandler)
+	for name := range server.options.Routes {
+		wsMux.Handle(pathPrefix+name+"/ws", server.wrapRoute(wsHandler, name))
+		log.Printf("Route enabled at: %s%s/", pathPrefix, name)
+	}
 
-	// Add REST API endpoint for command execution
-	apiHandler := http.Handler(http.HandlerFunc(server.handleAPIExec))
-	if server.options.EnableBasicAuth {
-		apiHandler = server.wrapBasicAuth(apiHandler, server.options.Credential)
+	if server.login != nil {
+		wsMux.Handle(server.loginPath, server.wrapLogger(http.HandlerFunc(server.login.HandleLogin)))
+		wsMux.Handle(pathPrefix+"logout", server.wrapLogger(http.HandlerFunc(server.login.HandleLogout)))
+		log.Printf("Login enabled at: %slogin, logout at: %slogout", pathPrefix, pathPrefix)
 	}
-	wsMux.Handle(pathPrefix+"api/exec", server.wrapLogger(apiHandler))
+
+	// Add REST API endpoint for command execution
+	wsMux.Handle(pathPrefix+"api/exec", server.wrapAPI(server.handleAPIExec, roleOperator))
 	log.Printf("REST API enabled at: %sapi/exec", pathPrefix)
 
 	// Add REST API endpoints for session management
-	sessionListHandler := http.Handler(http.HandlerFunc(server.handleSessionList))
-	sessionDestroyHandler := http.Handler(http.HandlerFunc(server.handleSessionDestroy))
-	connectionsListHandler := http.Handler(http.HandlerFunc(server.handleConnectionsList))
-	connectionsHistoryHandler := http.Handler(http.HandlerFunc(server.handleConnectionsHistory))
-	connectionsKickHandler := http.Handler(http.HandlerFunc(server.handleConnectionKick))
-	if server.options.EnableBasicAuth {
-		sessionListHandler = server.wrapBasicAuth(sessionListHandler, server.options.Credential)
-		sessionDestroyHandler = server.wrapBasicAuth(sessionDestroyHandler, server.options.Credential)
-		connectionsListHandler = server.wrapBasicAuth(connectionsListHandler, server.options.Credential)
-		connectionsHistoryHandler = server.wrapBasicAuth(connectionsHistoryHandler, server.options.Credential)
-		connectionsKickHandler = server.wrapBasicAuth(connectionsKickHandler, server.options.Credential)
-	}
-	wsMux.Handle(pathPrefix+"api/sessions", server.wrapLogger(sessionListHandler))
-	wsMux.Handle(pathPrefix+"api/sessions/destroy", server.wrapLogger(sessionDestroyHandler))
-	wsMux.Handle(pathPrefix+"api/connections", server.wrapLogger(connectionsListHandler))
-	wsMux.Handle(pathPrefix+"api/connections/history", server.wrapLogger(connectionsHistoryHandler))
-	wsMux.Handle(pathPrefix+"api/connections/kick", server.wrapLogger(connectionsKickHandler))
+	wsMux.Handle(pathPrefix+"api/sessions", server.wrapAPI(server.handleSessionList, roleViewer))
+	wsMux.Handle(pathPrefix+"api/sessions/destroy", server.wrapAPI(server.handleSessionDestroy, roleAdmin))
+	wsMux.Handle(pathPrefix+"api/connections", server.wrapAPI(server.handleConnectionsList, roleViewer))
+	wsMux.Handle(pathPrefix+"api/connections/history", server.wrapAPI(server.handleConnectionsHistory, roleViewer))
+	wsMux.Handle(pathPrefix+"api/connections/kick", server.wrapAPI(server.handleConnectionKick, roleAdmin))
+	wsMux.Handle(pathPrefix+"api/connections/control", server.wrapAPI(server.handleConnectionControl, roleAdmin))
+	wsMux.Handle(pathPrefix+"api/connections/notice", server.wrapAPI(server.handleConnectionNotice, roleAdmin))
 	log.Printf("Session API enabled at: %sapi/sessions", pathPrefix)
 	log.Printf("Connections API enabled at: %sapi/connections", pathPrefix)
 	log.Printf("Connection History API enabled at: %sapi/connections/history", pathPrefix)
 	log.Printf("Connection Kick API enabled at: %sapi/connections/kick", pathPrefix)
+	log.Printf("Write Control API enabled at: %sapi/connections/control", pathPrefix)
+	log.Printf("Connection Notice API enabled at: %sapi/connections/notice", pathPrefix)
 
 	siteHandler = http.Handler(wsMux)
 
 	return siteHandler
 }
 
+// wrapAPI wraps a handler of the REST API with logging, which tells the authenticated user,
+// authentication and the check of the minimum role.
+func (server *Server) wrapAPI(handler http.HandlerFunc, minimum role) http.Handler {
+	return server.wrapLogger(server.wrapAuth(server.wrapRole(handler, minimum)))
+}
+
 func (server *Server) setupHTTPServer(handler http.Handler) (*http.Server, error) {
 	srv := &http.Server{
 		Handler: handler,
@@ -9,6 +9,8 @@ import (
 	"os/exec"
 	"strings"
 	"time"
+
+	"github.com/yudai/gotty/webtty"
 )
 
 // SessionInfo represents information about a tmux session
@@ -23,8 +25,9 @@ type SessionInfo struct {
 
 // SessionListResponse represents the response for listing sessions
 type SessionListResponse struct {
-	Sessions []SessionInfo `json:"sessions"`
-	Count    int           `json:"count"`
+	Sessions []SessionInfo         `json:"sessions"`
+	Count    int                   `json:"count"`
+	Detached []DetachedSessionInfo `json:"detached,omitempty"` // processes kept for dropped clients
 }
 
 // SessionActionResponse represents the response for session actions
@@ -41,7 +44,7 @@ func (server *Server) handleSessionList(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	log.Printf("Session list request from %s", getClientIP(r))
+	log.Printf("Session list request from %s", server.clientIP(r))
 
 	// Execute tmux list-sessions command via SSH
 	cmd := exec.Command("ssh",
@@ -59,6 +62,7 @@ func (server *Server) handleSessionList(w http.ResponseWriter, r *http.Request)
 		response := SessionListResponse{
 			Sessions: []SessionInfo{},
 			Count:    0,
+			Detached: server.detachedSessions(),
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
@@ -72,6 +76,7 @@ func (server *Server) handleSessionList(w http.ResponseWriter, r *http.Request)
 		response := SessionListResponse{
 			Sessions: []SessionInfo{},
 			Count:    0,
+			Detached: server.detachedSessions(),
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
@@ -119,6 +124,7 @@ func (server *Server) handleSessionList(w http.ResponseWriter, r *http.Request)
 	response := SessionListResponse{
 		Sessions: sessions,
 		Count:    len(sessions),
+		Detached: server.detachedSessions(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -127,6 +133,14 @@ func (server *Server) handleSessionList(w http.ResponseWriter, r *http.Request)
 	log.Printf("Session list completed: %d sessions found", len(sessions))
 }
 
+// detachedSessions returns the processes kept for dropped clients, nil unless detaching is enabled.
+func (server *Server) detachedSessions() []DetachedSessionInfo {
+	if server.detachables == nil {
+		return nil
+	}
+	return server.detachables.list()
+}
+
 // handleSessionDestroy handles DELETE requests to destroy a tmux session
 func (server *Server) handleSessionDestroy(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
@@ -141,7 +155,7 @@ func (server *Server) handleSessionDestroy(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	log.Printf("Session destroy request from %s: %s", getClientIP(r), sessionName)
+	log.Printf("Session destroy request from %s: %s", server.clientIP(r), sessionName)
 
 	// Execute tmux kill-session command via SSH
 	cmd := exec.Command("ssh",
@@ -181,6 +195,8 @@ func (server *Server) handleSessionDestroy(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	server.scrollbacks.remove(sessionName)
+
 	response.Success = true
 	response.Message = fmt.Sprintf("Session '%s' destroyed successfully", sessionName)
 
@@ -290,7 +306,7 @@ func (server *Server) handleConnectionKick(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	log.Printf("Connection kick request from %s: %s", getClientIP(r), connID)
+	log.Printf("Connection kick request from %s: %s", server.clientIP(r), connID)
 
 	// Kick the connection
 	err := server.connections.Kick(connID)
@@ -317,6 +333,124 @@ func (server *Server) handleConnectionKick(w http.ResponseWriter, r *http.Reques
 	log.Printf("Connection kicked successfully: %s", connID)
 }
 
+// handleConnectionControl handles POST requests to force the write control
+// of a terminal to a connection
+func (server *Server) handleConnectionControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Get connection ID from query parameter
+	connID := r.URL.Query().Get("id")
+	if connID == "" {
+		http.Error(w, "Connection ID is required", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Write control request from %s: %s", server.clientIP(r), connID)
+
+	if !server.options.PermitWrite {
+		response := SessionActionResponse{
+			Success: false,
+			Message: "Writing to terminals is not permitted",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if connRole, ok := server.connections.roleOf(connID); ok && connRole < roleOperator {
+		response := SessionActionResponse{
+			Success: false,
+			Message: fmt.Sprintf("Connection '%s' is of a viewer, who cannot write", connID),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	err := server.writeControls.assign(connID)
+	if err != nil {
+		response := SessionActionResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to assign write control: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		log.Printf("Write control assignment failed: %v", err)
+		return
+	}
+
+	response := SessionActionResponse{
+		Success: true,
+		Message: fmt.Sprintf("Write control assigned to connection '%s'", connID),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleConnectionNotice handles POST requests to show a notice to a user,
+// or to all users when no connection ID is given
+func (server *Server) handleConnectionNotice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Kind      string `json:"kind"`
+		Message   string `json:"message"`
+		Reconnect *bool  `json:"reconnect"` // clients reconnect after the notice unless told otherwise
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Message == "" {
+		http.Error(w, "A JSON body with a message is required", http.StatusBadRequest)
+		return
+	}
+	notice := webtty.NoticeMessage{
+		Kind:      request.Kind,
+		Message:   request.Message,
+		Reconnect: request.Reconnect == nil || *request.Reconnect,
+	}
+	if notice.Kind == "" {
+		notice.Kind = noticeMessage
+	}
+
+	connID := r.URL.Query().Get("id")
+	log.Printf("Connection notice request from %s: %q (connection: %s)", server.clientIP(r), notice.Message, connID)
+
+	var response SessionActionResponse
+	if connID != "" {
+		if !server.connections.Notify(connID, notice) {
+			response = SessionActionResponse{
+				Success: false,
+				Message: fmt.Sprintf("Connection '%s' not found", connID),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		response = SessionActionResponse{
+			Success: true,
+			Message: fmt.Sprintf("Notice sent to connection '%s'", connID),
+		}
+	} else {
+		num := server.connections.NotifyAll(notice)
+		response = SessionActionResponse{
+			Success: true,
+			Message: fmt.Sprintf("Notice sent to %d connections", num),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 // Helper function to parse window names from tmux output
 // Returns a map of session_name -> first_window_name
 func parseWindowNames(output string) map[string]string {
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"io"
+	"sync"
+
+	"github.com/yudai/gotty/webtty"
+)
+
+// sharedSlaveChunks is the number of output chunks buffered for each client.
+const sharedSlaveChunks = 64
+
+// sharedSlaveReset resets the terminal of a client before it's resynchronized.
+var sharedSlaveReset = []byte("\x1bc")
+
+// sharedSlaves holds the slaves shared by connections with the same share key.
+type sharedSlaves struct {
+	mutex          sync.Mutex
+	slaves         map[string]*sharedSlave
+	scrollbackSize int
+}
+
+// sharedSlave runs a single slave for several connections
+// and broadcasts its output to all of them.
+// The slave lives until it exits or the last client detaches.
+type sharedSlave struct {
+	registry   *sharedSlaves
+	key        string
+	slave      Slave
+	scrollback *webtty.Scrollback
+
+	mutex   sync.Mutex
+	clients map[*sharedSlaveClient]struct{}
+	ended   chan struct{} // closed when the slave output ends
+}
+
+// sharedSlaveClient is the Slave given to each connection attached to a sharedSlave.
+type sharedSlaveClient struct {
+	shared  *sharedSlave
+	chunks  chan []byte
+	pending []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSharedSlaves(scrollbackSize int) *sharedSlaves {
+	return &sharedSlaves{
+		slaves:         make(map[string]*sharedSlave),
+		scrollbackSize: scrollbackSize,
+	}
+}
+
+// attach returns a client of the slave shared under key, starting the slave
+// with create when there is none. owner is true for the client that started it.
+// The client starts by reading the recent output of the slave.
+func (sss *sharedSlaves) attach(key string, create func() (Slave, error)) (client *sharedSlaveClient, owner bool, err error) {
+	sss.mutex.Lock()
+	defer sss.mutex.Unlock()
+
+	shared, ok := sss.slaves[key]
+	if !ok {
+		slave, err := create()
+		if err != nil {
+			return nil, false, err
+		}
+		shared = &sharedSlave{
+			registry:   sss,
+			key:        key,
+			slave:      slave,
+			scrollback: webtty.NewScrollback(sss.scrollbackSize),
+			clients:    make(map[*sharedSlaveClient]struct{}),
+			ended:      make(chan struct{}),
+		}
+		sss.slaves[key] = shared
+		go shared.run()
+	}
+
+	client = &sharedSlaveClient{
+		shared: shared,
+		chunks: make(chan []byte, sharedSlaveChunks),
+		done:   make(chan struct{}),
+	}
+
+	shared.mutex.Lock()
+	client.pending = shared.scrollback.Bytes()
+	shared.clients[client] = struct{}{}
+	shared.mutex.Unlock()
+
+	return client, !ok, nil
+}
+
+// detach removes client and closes the slave when it was the last one.
+func (sss *sharedSlaves) detach(client *sharedSlaveClient) error {
+	shared := client.shared
+
+	sss.mutex.Lock()
+	shared.mutex.Lock()
+	delete(shared.clients, client)
+	remaining := len(shared.clients)
+	shared.mutex.Unlock()
+
+	if remaining > 0 {
+		sss.mutex.Unlock()
+		return nil
+	}
+	if sss.slaves[shared.key] == shared {
+		delete(sss.slaves, shared.key)
+	}
+	sss.mutex.Unlock()
+
+	// closing can take a while, don't block other connections meanwhile
+	return shared.slave.Close()
+}
+
+// run reads the slave and hands each chunk to every client.
+func (shared *sharedSlave) run() {
+	defer func() {
+		close(shared.ended)
+
+		// let a new connection start a fresh slave
+		shared.registry.mutex.Lock()
+		if shared.registry.slaves[shared.key] == shared {
+			delete(shared.registry.slaves, shared.key)
+		}
+		shared.registry.mutex.Unlock()
+	}()
+
+	buffer := make([]byte, 1024)
+	for {
+		n, err := shared.slave.Read(buffer)
+		if err != nil {
+			return
+		}
+		chunk := make([]byte, n)
+		copy(chunk, buffer[:n])
+
+		shared.mutex.Lock()
+		shared.scrollback.Append(shared, chunk)
+		clients := make([]*sharedSlaveClient, 0, len(shared.clients))
+		for client := range shared.clients {
+			clients = append(clients, client)
+		}
+		shared.mutex.Unlock()
+
+		// a slow client never holds up the slave and the other clients
+		var resync []byte
+		for _, client := range clients {
+			select {
+			case client.chunks <- chunk:
+				continue
+			default:
+			}
+			if resync == nil {
+				resync = append(append([]byte{}, sharedSlaveReset...), shared.scrollback.Bytes()...)
+			}
+			client.resync(resync)
+		}
+	}
+}
+
+// resync replaces the chunks queued for client, which has fallen behind, with data.
+// Only run sends to the chunks, so that data always fits once they are drained.
+func (client *sharedSlaveClient) resync(data []byte) {
+	for len(client.chunks) > 0 {
+		select {
+		case <-client.chunks:
+		default:
+		}
+	}
+	client.chunks <- data
+}
+
+func (client *sharedSlaveClient) Read(p []byte) (n int, err error) {
+	for len(client.pending) == 0 {
+		select {
+		case client.pending = <-client.chunks:
+		case <-client.done:
+			return 0, io.EOF
+		case <-client.shared.ended:
+			// deliver chunks sent before the end
+			select {
+			case client.pending = <-client.chunks:
+			default:
+				return 0, io.EOF
+			}
+		}
+	}
+
+	n = copy(p, client.pending)
+	client.pending = client.pending[n:]
+	return n, nil
+}
+
+func (client *sharedSlaveClient) Write(p []byte) (n int, err error) {
+	return client.shared.slave.Write(p)
+}
+
+func (client *sharedSlaveClient) WindowTitleVariables() map[string]interface{} {
+	return client.shared.slave.WindowTitleVariables()
+}
+
+func (client *sharedSlaveClient) ResizeTerminal(columns int, rows int) error {
+	return client.shared.slave.ResizeTerminal(columns, rows)
+}
+
+func (client *sharedSlaveClient) Secret() bool {
+	if reporter, ok := client.shared.slave.(webtty.SecretReporter); ok {
+		return reporter.Secret()
+	}
+	return false
+}
+
+// Close detaches the client, the shared slave is closed with its last client.
+func (client *sharedSlaveClient) Close() (err error) {
+	client.closeOnce.Do(func() {
+		close(client.done)
+		err = client.shared.registry.detach(client)
+	})
+	return err
+}
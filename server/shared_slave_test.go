@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// pipeSlave is a Slave whose output is written to a pipe by the test.
+type pipeSlave struct {
+	*io.PipeReader
+}
+
+func (slave *pipeSlave) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (slave *pipeSlave) WindowTitleVariables() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func (slave *pipeSlave) ResizeTerminal(columns int, rows int) error {
+	return nil
+}
+
+func TestSharedSlaveStalledClient(t *testing.T) {
+	reader, writer := io.Pipe()
+	sss := newSharedSlaves(1 << 16)
+	create := func() (Slave, error) { return &pipeSlave{reader}, nil }
+
+	live, _, err := sss.attach("key", create)
+	if err != nil {
+		t.Fatalf("Unexpected error from attach(): %s", err)
+	}
+	stalled, _, err := sss.attach("key", create)
+	if err != nil {
+		t.Fatalf("Unexpected error from attach(): %s", err)
+	}
+
+	var expected bytes.Buffer
+	for i := 0; i < 4*sharedSlaveChunks; i++ {
+		fmt.Fprintf(&expected, "line %d\r\n", i)
+	}
+
+	// the live client reads each line before the next one is written,
+	// while the stalled client doesn't read at all
+	written := make(chan error)
+	go func() {
+		for i := 0; i < 4*sharedSlaveChunks; i++ {
+			line := fmt.Sprintf("line %d\r\n", i)
+			io.WriteString(writer, line)
+			received := make([]byte, len(line))
+			if _, err := io.ReadFull(live, received); err != nil {
+				written <- err
+				return
+			}
+			if string(received) != line {
+				written <- fmt.Errorf("received %q instead of %q", received, line)
+				return
+			}
+		}
+		writer.Close()
+		written <- nil
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("Unexpected output of the live client: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The stalled client blocked the slave")
+	}
+
+	// the stalled client is resynchronized with the scrollback
+	data, _ := ioutil.ReadAll(stalled)
+	if !bytes.HasPrefix(data, sharedSlaveReset) || !bytes.HasSuffix(data, expected.Bytes()) {
+		t.Fatalf("Unexpected output of the stalled client: %q", data)
+	}
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// transferTarget is where the files of a connection are uploaded to and downloaded from.
+type transferTarget interface {
+	// create starts writing a new file in the working directory.
+	// Existing files are not overwritten.
+	create(ctx context.Context, name string) (uploadFile, error)
+	// open starts reading a file in the working directory, and returns its size.
+	// Names leaving the working directory are rejected.
+	open(ctx context.Context, name string) (io.ReadCloser, int64, error)
+}
+
+// localName cleans the name of a file to download, which has to be
+// a relative path staying in the working directory.
+func localName(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", errors.Errorf("invalid file name `%s`, must be relative to the working directory", name)
+	}
+	cleaned := filepath.Clean(name)
+	if !filepath.IsLocal(cleaned) {
+		return "", errors.Errorf("invalid file name `%s`, must stay in the working directory", name)
+	}
+	return cleaned, nil
+}
+
+// uploadFile is a file being uploaded.
+type uploadFile interface {
+	io.Writer
+	// commit finishes the file.
+	commit() error
+	// abort removes the file. It can be called more than once.
+	abort()
+}
+
+// newTransferTarget returns the target of a connection to slave.
+// With Options.FileTransferSSH, sessions of tmux-wrapper.sh live on the SSH host,
+// other slaves are local processes.
+func newTransferTarget(options *Options, sessionName string, slave Slave) transferTarget {
+	if options.FileTransferSSH && sessionName != "" {
+		return &sshTarget{session: sessionName}
+	}
+
+	pid, _ := slave.WindowTitleVariables()["pid"].(int)
+	return &localTarget{pid: pid}
+}
+
+// localTarget transfers files in the working directory of a local process.
+type localTarget struct {
+	pid int
+}
+
+func (target *localTarget) dir() (string, error) {
+	if target.pid == 0 {
+		return "", errors.New("working directory of the session is unknown")
+	}
+	dir, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", target.pid))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to find the working directory of the session")
+	}
+	return dir, nil
+}
+
+func (target *localTarget) create(ctx context.Context, name string) (uploadFile, error) {
+	dir, err := target.dir()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create file")
+	}
+	return &localUpload{File: file}, nil
+}
+
+func (target *localTarget) open(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	path, err := localName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	dir, err := target.dir()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// symbolic links leaving the directory are not followed either
+	file, err := os.OpenInRoot(dir, path)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to open file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, errors.Wrapf(err, "failed to open file")
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, 0, errors.Errorf("%s is not a regular file", name)
+	}
+	return file, info.Size(), nil
+}
+
+// localUpload is an uploadFile created by localTarget.
+type localUpload struct {
+	*os.File
+	aborted bool
+}
+
+func (upload *localUpload) commit() error {
+	err := upload.File.Close()
+	if err != nil {
+		os.Remove(upload.File.Name())
+		return errors.Wrapf(err, "failed to write file")
+	}
+	return nil
+}
+
+func (upload *localUpload) abort() {
+	if upload.aborted {
+		return
+	}
+	upload.aborted = true
+	upload.File.Close()
+	os.Remove(upload.File.Name())
+}
+
+// sshTarget transfers files in the current directory of the active pane
+// of a tmux session on the SSH host, see tmux-wrapper.sh.
+type sshTarget struct {
+	session string
+}
+
+// command runs script on the SSH host in the directory of the session.
+func (target *sshTarget) command(ctx context.Context, script string) *exec.Cmd {
+	cd := fmt.Sprintf(
+		`cd "$(tmux display-message -p -t %s '#{pane_current_path}')" && `,
+		shellQuote("="+target.session+":"),
+	)
+	return exec.CommandContext(ctx, "ssh",
+		"-q",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "ConnectTimeout=5",
+		fmt.Sprintf("%s@host.docker.internal", getSSHUser()),
+		cd+script,
+	)
+}
+
+func (target *sshTarget) create(ctx context.Context, name string) (uploadFile, error) {
+	// the file is written under a temporary name so that an aborted upload can be removed
+	temp := fmt.Sprintf(".%s.%d.part", name, time.Now().UnixNano())
+	script := fmt.Sprintf(
+		`if [ -e %[1]s ]; then printf '%%s already exists\n' %[1]s >&2; exit 1; fi; cat > %[2]s && mv %[2]s %[1]s`,
+		shellQuote(name), shellQuote(temp),
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := target.command(ctx, script)
+	upload := &sshUpload{target: target, temp: temp, cmd: cmd, cancel: cancel}
+	cmd.Stderr = &upload.stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, errors.Wrapf(err, "failed to create file")
+	}
+	upload.stdin = stdin
+	err = cmd.Start()
+	if err != nil {
+		cancel()
+		return nil, errors.Wrapf(err, "failed to start ssh")
+	}
+	return upload, nil
+}
+
+func (target *sshTarget) open(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	path, err := localName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	script := fmt.Sprintf(
+		`if [ ! -f %[1]s ]; then printf '%%s is not a regular file\n' %[2]s >&2; exit 1; fi; wc -c < %[1]s && exec cat < %[1]s`,
+		shellQuote("./"+path), shellQuote(path),
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := target.command(ctx, script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, 0, errors.Wrapf(err, "failed to open file")
+	}
+	err = cmd.Start()
+	if err != nil {
+		cancel()
+		return nil, 0, errors.Wrapf(err, "failed to start ssh")
+	}
+
+	download := &sshDownload{Reader: bufio.NewReader(stdout), cmd: cmd, cancel: cancel}
+	line, err := download.ReadString('\n')
+	if err != nil {
+		cancel()
+		cmd.Wait()
+		return nil, 0, sshError(stderr.String(), err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+	if err != nil {
+		download.Close()
+		return nil, 0, errors.Wrapf(err, "failed to get file size")
+	}
+	return download, size, nil
+}
+
+// sshUpload is an uploadFile created by sshTarget.
+type sshUpload struct {
+	target  *sshTarget
+	temp    string
+	cmd     *exec.Cmd
+	cancel  context.CancelFunc
+	stdin   io.WriteCloser
+	stderr  bytes.Buffer
+	done    bool
+	aborted bool
+}
+
+func (upload *sshUpload) Write(p []byte) (int, error) {
+	n, err := upload.stdin.Write(p)
+	if err != nil {
+		// the command has failed, tell why
+		return n, upload.wait(err)
+	}
+	return n, nil
+}
+
+func (upload *sshUpload) commit() error {
+	upload.stdin.Close()
+	return upload.wait(nil)
+}
+
+func (upload *sshUpload) abort() {
+	if upload.aborted {
+		return
+	}
+	upload.aborted = true
+	upload.cancel()
+	upload.wait(nil)
+
+	rm := upload.target.command(context.Background(), "rm -f "+shellQuote(upload.temp))
+	rm.Run()
+}
+
+func (upload *sshUpload) wait(cause error) error {
+	if !upload.done {
+		upload.done = true
+		err := upload.cmd.Wait()
+		upload.cancel()
+		if err != nil {
+			cause = err
+		}
+	}
+	if cause == nil {
+		return nil
+	}
+	return sshError(upload.stderr.String(), cause)
+}
+
+// sshDownload is the content of a file read by sshTarget.
+type sshDownload struct {
+	*bufio.Reader
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+}
+
+func (download *sshDownload) Close() error {
+	download.cancel()
+	download.cmd.Wait()
+	return nil
+}
+
+// sshError prefers the message of the remote command to err.
+func sshError(stderr string, err error) error {
+	if message := strings.TrimSpace(stderr); message != "" {
+		return errors.New(message)
+	}
+	return errors.Wrapf(err, "ssh failed")
+}
+
+// shellQuote quotes s as a single word for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestNewTransferTarget(t *testing.T) {
+	slave := &pipeSlave{}
+	for _, c := range []struct {
+		ssh         bool
+		sessionName string
+		remote      bool
+	}{
+		{false, "", false},
+		// the session parameter is chosen by the client
+		{false, "work", false},
+		{true, "", false},
+		{true, "work", true},
+	} {
+		target := newTransferTarget(&Options{FileTransferSSH: c.ssh}, c.sessionName, slave)
+		if _, remote := target.(*sshTarget); remote != c.remote {
+			t.Errorf("Unexpected target with SSH %v and session `%s`: %T", c.ssh, c.sessionName, target)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// countingConn counts the bytes passing through a connection on the wire,
+// which are compressed when permessage-deflate is in use.
+type countingConn struct {
+	net.Conn
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+func (cc *countingConn) Read(p []byte) (n int, err error) {
+	n, err = cc.Conn.Read(p)
+	cc.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (cc *countingConn) Write(p []byte) (n int, err error) {
+	n, err = cc.Conn.Write(p)
+	cc.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// countingResponseWriter wraps the connection hijacked by a WebSocket upgrader with a countingConn.
+type countingResponseWriter struct {
+	http.ResponseWriter
+
+	conn *countingConn
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = &countingConn{Conn: conn}
+	return w.conn, rw, nil
+}
+
+// offersDeflate reports whether the client offers the permessage-deflate extension.
+func offersDeflate(r *http.Request) bool {
+	for _, header := range r.Header["Sec-Websocket-Extensions"] {
+		for _, extension := range strings.Split(header, ",") {
+			name := strings.TrimSpace(strings.SplitN(extension, ";", 2)[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"log"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/webtty"
+)
+
+// writeControls makes sure only one connection of a group,
+// which sees the same terminal, writes to it at a time.
+type writeControls struct {
+	mutex       sync.Mutex
+	groups      map[string]*writeControlGroup
+	members     map[string]*writeControlMember // by connection ID
+	connections *ConnectionTracker
+
+	// changed is called with the key of a group after its write control has been updated
+	changed func(key string)
+}
+
+type writeControlGroup struct {
+	key       string
+	holder    *writeControlMember
+	members   []*writeControlMember
+	requests  []*writeControlMember
+	announcer announcer
+}
+
+type writeControlMember struct {
+	connID   string
+	tty      *webtty.WebTTY
+	group    *writeControlGroup
+	eligible bool // permitted to hold the write control
+}
+
+func newWriteControls(connections *ConnectionTracker) *writeControls {
+	return &writeControls{
+		groups:      make(map[string]*writeControlGroup),
+		members:     make(map[string]*writeControlMember),
+		connections: connections,
+	}
+}
+
+// join adds a connection to the group identified by key.
+// An eligible connection gets the write control when nobody holds it.
+func (wcs *writeControls) join(key string, connID string, tty *webtty.WebTTY, eligible bool) *writeControlMember {
+	wcs.mutex.Lock()
+	group, ok := wcs.groups[key]
+	if !ok {
+		group = &writeControlGroup{key: key}
+		wcs.groups[key] = group
+	}
+	member := &writeControlMember{
+		connID:   connID,
+		tty:      tty,
+		group:    group,
+		eligible: eligible,
+	}
+	group.members = append(group.members, member)
+	wcs.members[connID] = member
+	if group.holder == nil && eligible {
+		group.holder = member
+	}
+	wcs.update(group)
+	return member
+}
+
+// leave removes a connection and hands its write control to the first requester.
+func (wcs *writeControls) leave(member *writeControlMember) {
+	wcs.mutex.Lock()
+	group := member.group
+	group.members = removeMember(group.members, member)
+	group.requests = removeMember(group.requests, member)
+	delete(wcs.members, member.connID)
+	if len(group.members) == 0 {
+		delete(wcs.groups, group.key)
+		wcs.mutex.Unlock()
+		return
+	}
+	if group.holder == member {
+		group.holder = nil
+		wcs.handOver(group)
+	}
+	wcs.update(group)
+}
+
+// handle processes a request (request is true) or a release of the write control.
+func (wcs *writeControls) handle(member *writeControlMember, request bool) {
+	if request {
+		wcs.request(member)
+	} else {
+		wcs.release(member)
+	}
+}
+
+// request gives the write control to the member when nobody holds it,
+// otherwise queues the request and lets the holder know.
+func (wcs *writeControls) request(member *writeControlMember) {
+	wcs.mutex.Lock()
+	group := member.group
+	if !member.eligible || group.holder == member {
+		wcs.mutex.Unlock()
+		return
+	}
+	if group.holder == nil {
+		group.holder = member
+	} else if !containsMember(group.requests, member) {
+		group.requests = append(group.requests, member)
+	}
+	wcs.update(group)
+}
+
+// release hands the write control of the member to the first requester,
+// or withdraws its pending request.
+func (wcs *writeControls) release(member *writeControlMember) {
+	wcs.mutex.Lock()
+	group := member.group
+	group.requests = removeMember(group.requests, member)
+	if group.holder == member {
+		group.holder = nil
+		wcs.handOver(group)
+	}
+	wcs.update(group)
+}
+
+// holder returns the connection ID holding the write control of the group, if any.
+func (wcs *writeControls) holder(key string) string {
+	wcs.mutex.Lock()
+	defer wcs.mutex.Unlock()
+
+	group, ok := wcs.groups[key]
+	if !ok || group.holder == nil {
+		return ""
+	}
+	return group.holder.connID
+}
+
+// assign forcibly gives the write control to a connection, revoking it from the holder.
+func (wcs *writeControls) assign(connID string) error {
+	wcs.mutex.Lock()
+	member, ok := wcs.members[connID]
+	if !ok {
+		wcs.mutex.Unlock()
+		return errors.Errorf("connection `%s` not found", connID)
+	}
+	group := member.group
+	group.requests = removeMember(group.requests, member)
+	group.holder = member
+	log.Printf("Write control of %s assigned to %s", group.key, connID)
+	wcs.update(group)
+	return nil
+}
+
+func (wcs *writeControls) handOver(group *writeControlGroup) {
+	if len(group.requests) > 0 {
+		group.holder = group.requests[0]
+		group.requests = group.requests[1:]
+	}
+}
+
+// update applies the write control of the group to its members and announces it.
+// It must be called with the lock held, which is released.
+// The permissions are changed with the lock held so that two members never
+// write at the same time, while the announcements, which can block on
+// a slow client, are sent by the announcer of the group after releasing it.
+func (wcs *writeControls) update(group *writeControlGroup) {
+	holder := ""
+	if group.holder != nil {
+		holder = group.holder.connID
+	}
+	requests := make([]string, 0, len(group.requests))
+	for _, member := range group.requests {
+		requests = append(requests, member.connID)
+	}
+
+	announcements := make([]func(), 0, len(group.members))
+	for _, member := range group.members {
+		writable := group.holder == member
+		member.tty.SetPermitWrite(writable)
+		wcs.connections.SetWritable(member.connID, writable)
+		status := webtty.WriteControlStatus{
+			Writable: writable,
+			Holder:   holder,
+			Requests: requests,
+		}
+		announcements = append(announcements, func() {
+			if err := member.tty.SendWriteControl(status); err != nil {
+				log.Printf("Failed to announce write control to %s: %v", member.connID, err)
+			}
+		})
+	}
+	flush := group.announcer.push(announcements...)
+	wcs.mutex.Unlock()
+
+	if flush {
+		group.announcer.flush()
+	}
+
+	// without any lock held, as the callee may ask for the holder
+	if wcs.changed != nil {
+		wcs.changed(group.key)
+	}
+}
+
+func removeMember(members []*writeControlMember, target *writeControlMember) []*writeControlMember {
+	result := members[:0]
+	for _, member := range members {
+		if member != target {
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+func containsMember(members []*writeControlMember, target *writeControlMember) bool {
+	for _, member := range members {
+		if member == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/yudai/gotty/webtty"
+)
+
+// stalledMaster is a Master which never takes what is written to it.
+type stalledMaster struct {
+	writing chan struct{} // receives once a write has started
+	release chan struct{}
+}
+
+func newStalledMaster() *stalledMaster {
+	return &stalledMaster{writing: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (master *stalledMaster) Read(p []byte) (int, error) {
+	<-master.release
+	return 0, io.EOF
+}
+
+func (master *stalledMaster) Write(p []byte) (int, error) {
+	select {
+	case master.writing <- struct{}{}:
+	default:
+	}
+	<-master.release
+	return len(p), nil
+}
+
+// discardMaster is a Master which takes everything written to it.
+type discardMaster struct{}
+
+func (discardMaster) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (discardMaster) Write(p []byte) (int, error) {
+	return ioutil.Discard.Write(p)
+}
+
+func newTestTTY(t *testing.T, master webtty.Master) *webtty.WebTTY {
+	reader, _ := io.Pipe()
+	tty, err := webtty.New(master, &pipeSlave{reader}, webtty.WithCapabilities(webtty.CapabilitiesMessage{
+		Version:  webtty.ProtocolVersion,
+		Features: []string{webtty.FeatureWriteControl, webtty.FeatureTerminalSize},
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+	return tty
+}
+
+// within returns whether f returns within a second.
+func within(f func()) bool {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestWriteControlStalledGroup(t *testing.T) {
+	wcs := newWriteControls(NewConnectionTracker())
+	stalled := newStalledMaster()
+	defer close(stalled.release)
+
+	go wcs.join("stalled", "1", newTestTTY(t, stalled), true)
+	<-stalled.writing
+
+	var member *writeControlMember
+	if !within(func() { member = wcs.join("other", "2", newTestTTY(t, discardMaster{}), true) }) {
+		t.Fatalf("A stalled client blocks joining another group")
+	}
+	if holder := wcs.holder("other"); holder != "2" {
+		t.Fatalf("Unexpected holder of the write control: %q", holder)
+	}
+	if !within(func() { wcs.leave(member) }) {
+		t.Fatalf("A stalled client blocks leaving another group")
+	}
+}
@@ -1,33 +1,167 @@
 package server
 
 import (
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/webtty"
 )
 
+// errHeartbeatTimeout is returned for connections closed
+// because the client stopped answering heartbeats.
+var errHeartbeatTimeout = errors.New("heartbeat timeout")
+
 type wsWrapper struct {
 	*websocket.Conn
+
+	wire               *countingConn // nil when the connection was not counted
+	compressed         bool          // permessage-deflate has been negotiated
+	compressionMinSize int           // messages smaller than this are not compressed
+
+	// deadline of reads and writes extended by activity of the client, 0 for no deadline
+	timeout  time.Duration
+	timedOut atomic.Bool
+
+	pingSent atomic.Int64 // unix time in nanoseconds of the last heartbeat ping
+	rtt      atomic.Int64 // in nanoseconds
 }
 
 func (wsw *wsWrapper) Write(p []byte) (n int, err error) {
-	writer, err := wsw.Conn.NextWriter(websocket.TextMessage)
+	if wsw.timeout > 0 {
+		wsw.Conn.SetWriteDeadline(time.Now().Add(wsw.timeout))
+	}
+	if wsw.compressed {
+		wsw.Conn.EnableWriteCompression(len(p) >= wsw.compressionMinSize)
+	}
+	writer, err := wsw.Conn.NextWriter(wsw.messageType())
 	if err != nil {
-		return 0, err
+		return 0, wsw.checkTimeout(err)
 	}
 	defer writer.Close()
-	return writer.Write(p)
+	n, err = writer.Write(p)
+	return n, wsw.checkTimeout(err)
 }
 
 func (wsw *wsWrapper) Read(p []byte) (n int, err error) {
 	for {
 		msgType, reader, err := wsw.Conn.NextReader()
 		if err != nil {
-			return 0, err
+			return 0, wsw.checkTimeout(err)
 		}
+		wsw.extendReadDeadline()
 
-		if msgType != websocket.TextMessage {
+		if msgType != websocket.TextMessage && msgType != websocket.BinaryMessage {
 			continue
 		}
 
-		return reader.Read(p)
+		// read the whole message as long as it fits in p
+		for n < len(p) {
+			var m int
+			m, err = reader.Read(p[n:])
+			n += m
+			if err == io.EOF {
+				return n, nil
+			}
+			if err != nil {
+				return n, wsw.checkTimeout(err)
+			}
+		}
+		return n, nil
+	}
+}
+
+// startHeartbeat pings the client every interval, and closes the connection
+// when the client has sent nothing, including pongs, for tolerance more intervals.
+// Each ping carries the time it was sent, so that its pong gives the round trip time.
+// The returned function stops the heartbeat.
+func (wsw *wsWrapper) startHeartbeat(interval time.Duration, tolerance int) (stop func()) {
+	wsw.timeout = interval * time.Duration(tolerance+1)
+	wsw.extendReadDeadline()
+	wsw.Conn.SetPongHandler(func(data string) error {
+		wsw.extendReadDeadline()
+		wsw.handlePong(data)
+		return nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				now := time.Now()
+				wsw.pingSent.Store(now.UnixNano())
+				payload := []byte(strconv.FormatInt(now.UnixNano(), 10))
+				err := wsw.Conn.WriteControl(websocket.PingMessage, payload, now.Add(interval))
+				if err != nil {
+					wsw.checkTimeout(err)
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// handlePong measures the round trip time with the pong of the last ping.
+// Pongs of other pings and unsolicited ones are ignored.
+func (wsw *wsWrapper) handlePong(data string) {
+	sent, err := strconv.ParseInt(data, 10, 64)
+	if err != nil || sent == 0 || sent != wsw.pingSent.Load() {
+		return
+	}
+	wsw.rtt.Store(int64(time.Since(time.Unix(0, sent))))
+}
+
+// roundTripTime returns the round trip time of the last heartbeat, 0 if unknown.
+func (wsw *wsWrapper) roundTripTime() time.Duration {
+	return time.Duration(wsw.rtt.Load())
+}
+
+// heartbeatTimedOut reports whether the connection has failed by a missed heartbeat.
+func (wsw *wsWrapper) heartbeatTimedOut() bool {
+	return wsw.timedOut.Load()
+}
+
+func (wsw *wsWrapper) extendReadDeadline() {
+	if wsw.timeout > 0 {
+		wsw.Conn.SetReadDeadline(time.Now().Add(wsw.timeout))
+	}
+}
+
+func (wsw *wsWrapper) checkTimeout(err error) error {
+	if netErr, ok := errors.Cause(err).(net.Error); ok && netErr.Timeout() {
+		wsw.timedOut.Store(true)
+	}
+	return err
+}
+
+// wireBytes returns the bytes received and sent on the wire.
+func (wsw *wsWrapper) wireBytes() (in int64, out int64) {
+	if wsw.wire == nil {
+		return 0, 0
+	}
+	return wsw.wire.bytesIn.Load(), wsw.wire.bytesOut.Load()
+}
+
+// binary reports whether the client negotiated webtty.ProtocolBinary.
+func (wsw *wsWrapper) binary() bool {
+	return wsw.Conn.Subprotocol() == webtty.ProtocolBinary
+}
+
+func (wsw *wsWrapper) messageType() int {
+	if wsw.binary() {
+		return websocket.BinaryMessage
 	}
+	return websocket.TextMessage
 }
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHeartbeatRoundTripTime(t *testing.T) {
+	measured := make(chan time.Duration, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		wsw := &wsWrapper{Conn: conn}
+		stop := wsw.startHeartbeat(10*time.Millisecond, 2)
+		defer stop()
+
+		// an unsolicited pong doesn't set the round trip time
+		conn.SetPongHandler(func(data string) error {
+			wsw.handlePong("1")
+			wsw.handlePong(data)
+			return nil
+		})
+
+		// pongs are handled while reading
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				if _, err := wsw.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+
+		for i := 0; i < 100; i++ {
+			if rtt := wsw.roundTripTime(); rtt > 0 {
+				measured <- rtt
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		measured <- 0
+	}))
+	defer server.Close()
+
+	// the client answers pings with their payload while reading
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Dial(): %s", err)
+	}
+	defer client.Close()
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if rtt := <-measured; rtt <= 0 || rtt > time.Second {
+		t.Fatalf("Unexpected round trip time: %s", rtt)
+	}
+}
@@ -0,0 +1,25 @@
+package webtty
+
+// Auditor receives the input written to the slave by a WebTTY,
+// for example to keep an audit log of what was typed.
+// Methods are called from the relaying goroutine, so they must not block.
+type Auditor interface {
+	// AuditInput is called with each input before it is written to the slave.
+	// secret tells whether the slave reads a secret such as a password,
+	// see SecretReporter.
+	AuditInput(data []byte, secret bool)
+}
+
+// SecretReporter is implemented by slaves able to tell whether they read a secret,
+// which terminals do with the echo turned off in canonical mode.
+// Slaves not implementing it are assumed to read no secrets.
+type SecretReporter interface {
+	Secret() bool
+}
+
+func (wt *WebTTY) slaveSecret() bool {
+	if reporter, ok := wt.slave.(SecretReporter); ok {
+		return reporter.Secret()
+	}
+	return false
+}
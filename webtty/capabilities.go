@@ -0,0 +1,106 @@
+package webtty
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// ProtocolVersion is the version of the protocol implemented by this package.
+// Masters sending no version are assumed to support LegacyFeatures.
+const ProtocolVersion = 1
+
+// Features which a master and a WebTTY negotiate.
+// A WebTTY doesn't send the optional messages of a feature the master lacks.
+const (
+	// Binary frames, see ProtocolBinary. Chosen by the WebSocket subprotocol.
+	FeatureBinary = "binary"
+	// Compression of WebSocket messages. Chosen by the WebSocket extensions.
+	FeatureCompression = "compression"
+	// Notice messages
+	FeatureNotice = "notice"
+	// WriteControl messages and the requests for the write control
+	FeatureWriteControl = "write_control"
+	// TerminalSize messages
+	FeatureTerminalSize = "terminal_size"
+	// FileTransfer messages and requests
+	FeatureFileTransfer = "file_transfer"
+	// ZMODEM transfers started in the terminal, over FileTransfer messages
+	FeatureZmodem = "zmodem"
+	// Session messages, which resume the slave after the connection drops
+	FeatureSession = "session"
+)
+
+// LegacyFeatures are the features which existed before protocol versions,
+// assumed for masters sending no version. Features added since then,
+// which a master has to offer, don't belong here.
+var LegacyFeatures = []string{
+	FeatureBinary,
+	FeatureCompression,
+	FeatureNotice,
+	FeatureWriteControl,
+	FeatureTerminalSize,
+	FeatureFileTransfer,
+	FeatureZmodem,
+	FeatureSession,
+}
+
+// CapabilitiesMessage is sent to the master with a Capabilities message
+// to tell the features chosen for the connection.
+type CapabilitiesMessage struct {
+	// Version is the protocol version used for the connection,
+	// the lower one of the master and the WebTTY.
+	Version int `json:"version"`
+	// Features are the features both the master and the WebTTY support.
+	Features []string `json:"features"`
+}
+
+// Negotiate chooses the capabilities of a connection with a master,
+// which has sent its version and features, from the supported features.
+func Negotiate(version int, offered []string, supported []string) CapabilitiesMessage {
+	capabilities := CapabilitiesMessage{
+		Version:  min(version, ProtocolVersion),
+		Features: []string{},
+	}
+	for _, feature := range supported {
+		for _, offer := range offered {
+			if offer == feature {
+				capabilities.Features = append(capabilities.Features, feature)
+				break
+			}
+		}
+	}
+	return capabilities
+}
+
+// Has reports whether feature has been chosen.
+func (capabilities CapabilitiesMessage) Has(feature string) bool {
+	for _, chosen := range capabilities.Features {
+		if chosen == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// masterSupports reports whether the master supports feature.
+// Masters which haven't negotiated support LegacyFeatures.
+func (wt *WebTTY) masterSupports(feature string) bool {
+	if wt.capabilities == nil {
+		return CapabilitiesMessage{Features: LegacyFeatures}.Has(feature)
+	}
+	return wt.capabilities.Has(feature)
+}
+
+func (wt *WebTTY) sendCapabilities() error {
+	payload, err := json.Marshal(wt.capabilities)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal capabilities")
+	}
+	err = wt.masterWrite(append([]byte{Capabilities}, payload...))
+	if err != nil {
+		return errors.Wrapf(err, "failed to send capabilities")
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package webtty
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// LookupEncoding returns the character encoding called name, such as shift_jis or latin1,
+// by the names browsers know. It returns nil for UTF-8, which needs no transcoding.
+func LookupEncoding(name string) (encoding.Encoding, error) {
+	if name == "" {
+		return nil, nil
+	}
+	enc, err := htmlindex.Get(strings.ToLower(name))
+	if err != nil {
+		return nil, errors.Errorf("unknown encoding `%s`", name)
+	}
+	if enc == unicode.UTF8 {
+		return nil, nil
+	}
+	return enc, nil
+}
+
+// transcoder converts a stream arriving in pieces.
+// Incomplete characters at the end of a piece are kept until the next piece.
+type transcoder struct {
+	mutex       sync.Mutex
+	transformer transform.Transformer
+	pending     []byte
+}
+
+func newTranscoder(transformer transform.Transformer) *transcoder {
+	return &transcoder{transformer: transformer}
+}
+
+// convert returns the converted data, which may lack the last bytes of data
+// until they are completed by the next call.
+func (tc *transcoder) convert(data []byte) []byte {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	src := data
+	if len(tc.pending) > 0 {
+		src = append(tc.pending, data...)
+		tc.pending = nil
+	}
+
+	dst := make([]byte, len(src)*3+16)
+	var converted []byte
+	for len(src) > 0 {
+		nDst, nSrc, err := tc.transformer.Transform(dst, src, false)
+		converted = append(converted, dst[:nDst]...)
+		src = src[nSrc:]
+
+		switch err {
+		case nil:
+		case transform.ErrShortDst:
+			if nDst == 0 && nSrc == 0 {
+				dst = make([]byte, len(dst)*2)
+			}
+		case transform.ErrShortSrc:
+			tc.pending = append([]byte(nil), src...)
+			return converted
+		default:
+			// transformers replace invalid characters, skip one they still cannot handle
+			tc.transformer.Reset()
+			_, size := utf8.DecodeRune(src)
+			src = src[size:]
+		}
+	}
+	return converted
+}
@@ -0,0 +1,48 @@
+package webtty
+
+import (
+	"testing"
+
+	"golang.org/x/text/encoding"
+)
+
+func TestTranscoderSplitCharacters(t *testing.T) {
+	enc, err := LookupEncoding("Shift_JIS")
+	if err != nil {
+		t.Fatalf("Unexpected error from LookupEncoding(): %s", err)
+	}
+
+	// output of the slave split in the middle of 日
+	decoder := newTranscoder(enc.NewDecoder())
+	if converted := decoder.convert([]byte("a\x93")); string(converted) != "a" {
+		t.Fatalf("Unexpected output converted: %q", converted)
+	}
+	if converted := decoder.convert([]byte("\xfa\x96\x7b")); string(converted) != "日本" {
+		t.Fatalf("Unexpected output converted: %q", converted)
+	}
+
+	// input of the master split in the middle of 日, which is e6 97 a5
+	encoder := newTranscoder(encoding.ReplaceUnsupported(enc.NewEncoder()))
+	if converted := encoder.convert([]byte("a\xe6\x97")); string(converted) != "a" {
+		t.Fatalf("Unexpected input converted: %q", converted)
+	}
+	if converted := encoder.convert([]byte("\xa5本")); string(converted) != "\x93\xfa\x96\x7b" {
+		t.Fatalf("Unexpected input converted: %q", converted)
+	}
+}
+
+func TestTranscoderKeepsRestAfterError(t *testing.T) {
+	enc, err := LookupEncoding("Shift_JIS")
+	if err != nil {
+		t.Fatalf("Unexpected error from LookupEncoding(): %s", err)
+	}
+
+	// the encoder fails on characters Shift_JIS doesn't have
+	encoder := newTranscoder(enc.NewEncoder())
+	if converted := encoder.convert([]byte("a😀b日")); string(converted) != "ab\x93\xfa" {
+		t.Fatalf("Unexpected input converted: %q", converted)
+	}
+	if converted := encoder.convert([]byte("c")); string(converted) != "c" {
+		t.Fatalf("Unexpected input converted: %q", converted)
+	}
+}
@@ -10,4 +10,8 @@ var (
 
 	// ErrSlaveClosed is returned when the slave connection is closed.
 	ErrMasterClosed = errors.New("master closed")
+
+	// ErrOutputQueueFull is returned when the master cannot keep up with
+	// the slave output under OutputQueueDisconnect.
+	ErrOutputQueueFull = errors.New("output queue full")
 )
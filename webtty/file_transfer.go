@@ -0,0 +1,114 @@
+package webtty
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FileTransferChunkSize is the maximum number of file bytes carried by a single message.
+// Masters must not send larger chunks.
+const FileTransferChunkSize = 32 * 1024
+
+// fileTransferBufferSize is enough to read a FileTransfer message
+// carrying a base64 encoded chunk.
+const fileTransferBufferSize = 64 * 1024
+
+// Actions of FileTransferRequest sent by the master.
+const (
+	// TransferUploadStart begins an upload of Name with Size bytes.
+	TransferUploadStart = "upload_start"
+	// TransferUploadChunk carries the next Data of an upload.
+	TransferUploadChunk = "upload_chunk"
+	// TransferUploadEnd finishes an upload.
+	TransferUploadEnd = "upload_end"
+	// TransferDownload asks for the content of Name.
+	TransferDownload = "download"
+	// TransferCancel aborts a running upload or download.
+	TransferCancel = "cancel"
+)
+
+// Actions of FileTransferEvent sent to the master.
+const (
+	// TransferProgress tells how many bytes of an upload have been stored.
+	TransferProgress = "progress"
+	// TransferData carries the next Data of a download.
+	TransferData = "data"
+	// TransferComplete tells that a transfer has finished successfully.
+	TransferComplete = "complete"
+	// TransferError tells that a transfer has failed with Error.
+	TransferError = "error"
+	// TransferCanceled tells that a transfer has been aborted.
+	TransferCanceled = "canceled"
+	// TransferDownloadStart tells that sz has started sending Name with Size bytes,
+	// whose content follows in TransferData events.
+	TransferDownloadStart = "download_start"
+	// TransferUploadRequest tells that rz is waiting for a file.
+	// The master answers with an upload using the same ID, or cancels it.
+	TransferUploadRequest = "upload_request"
+)
+
+// FileTransferRequest is the payload of a FileTransfer message from the master.
+// ID is chosen by the master to tell concurrent transfers apart.
+type FileTransferRequest struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+// FileTransferEvent is the payload of a FileTransfer message to the master.
+type FileTransferEvent struct {
+	ID          string `json:"id"`
+	Action      string `json:"action"`
+	Name        string `json:"name,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Transferred int64  `json:"transferred,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// FileTransferHandler is called with each request of the master.
+// It is called from the goroutine reading the master, so long running work,
+// such as streaming a download, has to be done in another goroutine.
+type FileTransferHandler func(request *FileTransferRequest)
+
+// SendFileTransfer sends an event of a file transfer to the master.
+func (wt *WebTTY) SendFileTransfer(event *FileTransferEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal file transfer event")
+	}
+	err = wt.masterWrite(append([]byte{FileTransfer}, payload...))
+	if err != nil {
+		return errors.Wrapf(err, "failed to send file transfer event")
+	}
+
+	return nil
+}
+
+func (wt *WebTTY) handleFileTransfer(payload []byte) error {
+	var request FileTransferRequest
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		return errors.Wrapf(err, "received malformed data for file transfer")
+	}
+
+	if wt.zmodem != nil && strings.HasPrefix(request.ID, zmodemIDPrefix) {
+		return wt.zmodem.handle(&request)
+	}
+
+	if wt.fileTransferHandler == nil {
+		return wt.SendFileTransfer(&FileTransferEvent{
+			ID:     request.ID,
+			Action: TransferError,
+			Name:   request.Name,
+			Error:  "file transfer is disabled",
+		})
+	}
+
+	wt.fileTransferHandler(&request)
+	return nil
+}
@@ -1,8 +1,17 @@
 package webtty
 
-// Protocols defines the name of this protocol,
-// which is supposed to be used to the subprotocol of Websockt streams.
-var Protocols = []string{"webtty"}
+const (
+	// ProtocolBinary sends every message as a binary frame and carries
+	// terminal output and input as raw bytes without base64 encoding.
+	ProtocolBinary = "webtty.binary"
+	// ProtocolText is the legacy protocol, which sends every message as a text frame
+	// and base64-encodes terminal output.
+	ProtocolText = "webtty"
+)
+
+// Protocols defines the names of this protocol in the order of preference,
+// which are supposed to be used to the subprotocol of Websockt streams.
+var Protocols = []string{ProtocolBinary, ProtocolText}
 
 const (
 	// Unknown message type, maybe sent by a bug
@@ -13,6 +22,16 @@ const (
 	Ping = '2'
 	// Notify that the browser size has been changed
 	ResizeTerminal = '3'
+	// Ask the server to stop sending output until ResumeOutput
+	PauseOutput = '4'
+	// Ask the server to continue sending output
+	ResumeOutput = '5'
+	// Ask for the permission to write to the terminal
+	RequestWriteControl = '6'
+	// Give up the permission to write to the terminal
+	ReleaseWriteControl = '7'
+	// Upload, download or cancel a file, see FileTransferRequest
+	RequestFileTransfer = '8'
 )
 
 const (
@@ -28,4 +47,18 @@ const (
 	SetPreferences = '4'
 	// Make terminal to reconnect
 	SetReconnect = '5'
+	// Notify that output has been discarded and the terminal should be cleared
+	ResyncTerminal = '6'
+	// Announce who can write to the terminal
+	WriteControl = '7'
+	// Show a notice to the user, typically before the server closes the connection
+	Notice = '8'
+	// Report progress or data of a file transfer, see FileTransferEvent
+	FileTransfer = '9'
+	// Announce the size chosen for a terminal shared by masters, see TerminalSizeMessage
+	TerminalSize = 'A'
+	// Tell the token resuming the slave after the connection drops, see SessionMessage
+	Session = 'B'
+	// Tell the features chosen for the connection, see CapabilitiesMessage
+	Capabilities = 'C'
 )
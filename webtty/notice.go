@@ -0,0 +1,36 @@
+package webtty
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// NoticeMessage is sent to the master with a Notice message
+// to tell the user why something happened to the connection.
+type NoticeMessage struct {
+	// Kind is a machine readable category of the notice, e.g. "kicked".
+	Kind string `json:"kind"`
+	// Message is a human readable text shown to the user.
+	Message string `json:"message"`
+	// Reconnect tells whether the master should reconnect once the connection is closed.
+	Reconnect bool `json:"reconnect"`
+}
+
+// SendNotice shows a notice to the user of the master.
+func (wt *WebTTY) SendNotice(notice NoticeMessage) error {
+	if !wt.masterSupports(FeatureNotice) {
+		return nil
+	}
+
+	payload, err := json.Marshal(notice)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal notice")
+	}
+	err = wt.masterWrite(append([]byte{Notice}, payload...))
+	if err != nil {
+		return errors.Wrapf(err, "failed to send notice")
+	}
+
+	return nil
+}
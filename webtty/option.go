@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 
 	"github.com/pkg/errors"
+	"golang.org/x/text/encoding"
 )
 
 // Option is an option for WebTTY.
 type Option func(*WebTTY) error
 
 // WithPermitWrite sets a WebTTY to accept input from slaves.
+// The permission can be changed later with SetPermitWrite.
 func WithPermitWrite() Option {
 	return func(wt *WebTTY) error {
 		wt.permitWrite = true
@@ -17,6 +19,15 @@ func WithPermitWrite() Option {
 	}
 }
 
+// WithBinaryProtocol makes a WebTTY to send output to the master as raw bytes
+// instead of base64 encoded text. Use this when the master negotiated ProtocolBinary.
+func WithBinaryProtocol() Option {
+	return func(wt *WebTTY) error {
+		wt.binary = true
+		return nil
+	}
+}
+
 // WithFixedColumns sets a fixed width to TTY master.
 func WithFixedColumns(columns int) Option {
 	return func(wt *WebTTY) error {
@@ -49,6 +60,120 @@ func WithReconnect(timeInSeconds int) Option {
 	}
 }
 
+// WithOutputQueue sets the maximum number of bytes queued for the master
+// and the policy applied when the master cannot keep up.
+func WithOutputQueue(size int, policy OutputQueuePolicy) Option {
+	return func(wt *WebTTY) error {
+		wt.outputQueueSize = size
+		wt.outputQueuePolicy = policy
+		return nil
+	}
+}
+
+// WithRecorder sets a Recorder which receives the output and resize events of the session.
+func WithRecorder(recorder Recorder) Option {
+	return func(wt *WebTTY) error {
+		wt.recorder = recorder
+		return nil
+	}
+}
+
+// WithAuditor sets an Auditor which receives the input written to the slave.
+func WithAuditor(auditor Auditor) Option {
+	return func(wt *WebTTY) error {
+		wt.auditor = auditor
+		return nil
+	}
+}
+
+// WithScrollback sets a Scrollback whose content is sent to the master
+// right after the initializing messages, and which records the slave output.
+func WithScrollback(scrollback *Scrollback) Option {
+	return func(wt *WebTTY) error {
+		wt.scrollback = scrollback
+		return nil
+	}
+}
+
+// WithWriteControlHandler sets a function called when the master
+// requests or releases the write control.
+func WithWriteControlHandler(handler WriteControlHandler) Option {
+	return func(wt *WebTTY) error {
+		wt.writeControlHandler = handler
+		return nil
+	}
+}
+
+// WithFileTransferHandler sets a function handling the file transfers requested by the master.
+// Without it, file transfers are refused.
+func WithFileTransferHandler(handler FileTransferHandler) Option {
+	return func(wt *WebTTY) error {
+		wt.fileTransferHandler = handler
+		return nil
+	}
+}
+
+// WithZmodem makes a WebTTY run the transfers of rz and sz, or trz and tsz, started in the slave,
+// exchanging the files with the master as file transfer events.
+// upload and download permit rz and trz, and sz and tsz respectively,
+// and maxSize limits the size of files when it's positive.
+func WithZmodem(upload, download bool, maxSize int64) Option {
+	return func(wt *WebTTY) error {
+		wt.zmodem = &zmodemBridge{upload: upload, download: download, maxSize: maxSize}
+		return nil
+	}
+}
+
+// WithResizeHandler sets a function deciding the size of the slave
+// when the master reports its size. See SetTerminalSize.
+func WithResizeHandler(handler ResizeHandler) Option {
+	return func(wt *WebTTY) error {
+		wt.resizeHandler = handler
+		return nil
+	}
+}
+
+// WithStartHandler sets a function called when the master is ready for
+// the messages which follow the initializing ones. See StartHandler.
+func WithStartHandler(handler StartHandler) Option {
+	return func(wt *WebTTY) error {
+		wt.startHandler = handler
+		return nil
+	}
+}
+
+// WithSession sends session to the master before any output,
+// so that it can resume the slave later.
+func WithSession(session SessionMessage) Option {
+	return func(wt *WebTTY) error {
+		wt.session = &session
+		return nil
+	}
+}
+
+// WithCapabilities sets the capabilities negotiated with the master,
+// which are sent to it before anything else. See Negotiate.
+func WithCapabilities(capabilities CapabilitiesMessage) Option {
+	return func(wt *WebTTY) error {
+		wt.capabilities = &capabilities
+		return nil
+	}
+}
+
+// WithEncoding makes WebTTY convert the output of the slave from enc to UTF-8,
+// and the input of the master from UTF-8 to enc. A nil enc means UTF-8.
+// See LookupEncoding.
+func WithEncoding(enc encoding.Encoding) Option {
+	return func(wt *WebTTY) error {
+		if enc == nil {
+			return nil
+		}
+		wt.outputTranscoder = newTranscoder(enc.NewDecoder())
+		wt.inputTranscoder = newTranscoder(encoding.ReplaceUnsupported(enc.NewEncoder()))
+		return nil
+	}
+}
+
 // WithMasterPreferences sets an optional configuration of master.
 func WithMasterPreferences(preferences interface{}) Option {
 	return func(wt *WebTTY) error {
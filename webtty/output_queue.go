@@ -0,0 +1,163 @@
+package webtty
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// OutputQueuePolicy decides what a WebTTY does when the output queue
+// to the master is full, typically because the client is too slow.
+type OutputQueuePolicy int
+
+const (
+	// OutputQueueBlock stops reading from the slave until the master catches up.
+	OutputQueueBlock OutputQueuePolicy = iota
+	// OutputQueueDropOldest discards the oldest queued output and
+	// asks the master to resynchronize its screen.
+	OutputQueueDropOldest
+	// OutputQueueDisconnect closes the connection with ErrOutputQueueFull.
+	OutputQueueDisconnect
+)
+
+// DefaultOutputQueueSize is the default maximum number of bytes queued for a master.
+const DefaultOutputQueueSize = 1024 * 1024
+
+var outputQueuePolicyNames = map[string]OutputQueuePolicy{
+	"block":      OutputQueueBlock,
+	"drop":       OutputQueueDropOldest,
+	"disconnect": OutputQueueDisconnect,
+}
+
+// ParseOutputQueuePolicy returns the policy named by name,
+// which is one of "block", "drop" and "disconnect".
+func ParseOutputQueuePolicy(name string) (OutputQueuePolicy, error) {
+	policy, ok := outputQueuePolicyNames[name]
+	if !ok {
+		return OutputQueueBlock, errors.Errorf("unknown output queue policy `%s`", name)
+	}
+	return policy, nil
+}
+
+// outputQueue is a byte bounded FIFO of output chunks
+// between the slave reader and the master writer.
+type outputQueue struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte
+	size   int
+	limit  int
+	policy OutputQueuePolicy
+
+	paused   bool
+	dropped  int
+	finished bool
+	closed   bool
+}
+
+func newOutputQueue(limit int, policy OutputQueuePolicy) *outputQueue {
+	queue := &outputQueue{
+		limit:  limit,
+		policy: policy,
+	}
+	queue.cond = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+// push appends a copy of data to the queue, applying the policy when the queue is full.
+// A chunk larger than the limit is accepted when the queue is empty.
+func (queue *outputQueue) push(data []byte) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	switch queue.policy {
+	case OutputQueueBlock:
+		for queue.full(len(data)) && !queue.closed {
+			queue.cond.Wait()
+		}
+	case OutputQueueDropOldest:
+		for queue.full(len(data)) {
+			queue.dropped += len(queue.chunks[0])
+			queue.size -= len(queue.chunks[0])
+			queue.chunks[0] = nil
+			queue.chunks = queue.chunks[1:]
+		}
+	case OutputQueueDisconnect:
+		if queue.full(len(data)) {
+			return ErrOutputQueueFull
+		}
+	}
+
+	if queue.closed {
+		return ErrMasterClosed
+	}
+
+	chunk := make([]byte, len(data))
+	copy(chunk, data)
+	queue.chunks = append(queue.chunks, chunk)
+	queue.size += len(chunk)
+	queue.cond.Broadcast()
+
+	return nil
+}
+
+// pop blocks until a chunk is available and the queue is not paused.
+// dropped is the number of bytes discarded since the last call.
+// ok is false once the queue is closed, or finished and drained.
+func (queue *outputQueue) pop() (chunk []byte, dropped int, ok bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for !queue.closed {
+		if len(queue.chunks) == 0 && queue.finished {
+			return nil, 0, false
+		}
+		if len(queue.chunks) > 0 && !queue.paused {
+			break
+		}
+		queue.cond.Wait()
+	}
+	if queue.closed {
+		return nil, 0, false
+	}
+
+	chunk = queue.chunks[0]
+	queue.chunks[0] = nil
+	queue.chunks = queue.chunks[1:]
+	queue.size -= len(chunk)
+	dropped = queue.dropped
+	queue.dropped = 0
+	queue.cond.Broadcast()
+
+	return chunk, dropped, true
+}
+
+func (queue *outputQueue) setPaused(paused bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.paused = paused
+	queue.cond.Broadcast()
+}
+
+// finish tells the queue that no more chunks will be pushed.
+// Queued chunks are still returned by pop.
+func (queue *outputQueue) finish() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.finished = true
+	queue.cond.Broadcast()
+}
+
+func (queue *outputQueue) close() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.closed = true
+	queue.cond.Broadcast()
+}
+
+func (queue *outputQueue) full(incoming int) bool {
+	return queue.size > 0 && queue.size+incoming > queue.limit
+}
@@ -0,0 +1,52 @@
+package webtty
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOutputQueueDropOldest(t *testing.T) {
+	queue := newOutputQueue(8, OutputQueueDropOldest)
+
+	for _, chunk := range []string{"aaaa", "bbbb", "cccc"} {
+		if err := queue.push([]byte(chunk)); err != nil {
+			t.Fatalf("Unexpected error from push(): %s", err)
+		}
+	}
+
+	chunk, dropped, ok := queue.pop()
+	if !ok {
+		t.Fatalf("Unexpected close of the queue")
+	}
+	if dropped != 4 {
+		t.Fatalf("Unexpected number of dropped bytes: %d", dropped)
+	}
+	if !bytes.Equal(chunk, []byte("bbbb")) {
+		t.Fatalf("Unexpected chunk: `%s`", chunk)
+	}
+}
+
+func TestOutputQueueDisconnect(t *testing.T) {
+	queue := newOutputQueue(8, OutputQueueDisconnect)
+
+	if err := queue.push([]byte("aaaaaaaa")); err != nil {
+		t.Fatalf("Unexpected error from push(): %s", err)
+	}
+	if err := queue.push([]byte("b")); err != ErrOutputQueueFull {
+		t.Fatalf("Unexpected error from push(): %v", err)
+	}
+}
+
+func TestOutputQueueFinish(t *testing.T) {
+	queue := newOutputQueue(8, OutputQueueBlock)
+
+	queue.push([]byte("aaaa"))
+	queue.finish()
+
+	if chunk, _, ok := queue.pop(); !ok || !bytes.Equal(chunk, []byte("aaaa")) {
+		t.Fatalf("Unexpected result from pop(): `%s`, %v", chunk, ok)
+	}
+	if _, _, ok := queue.pop(); ok {
+		t.Fatalf("Expected the finished queue to be drained")
+	}
+}
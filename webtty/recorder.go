@@ -0,0 +1,11 @@
+package webtty
+
+// Recorder receives a copy of the terminal traffic relayed by a WebTTY,
+// for example to write it into a session recording.
+// Methods are called from the relaying goroutines, so they must not block.
+type Recorder interface {
+	// WriteOutput is called with each chunk read from the slave.
+	WriteOutput(data []byte)
+	// WriteResize is called when the slave is resized.
+	WriteResize(columns int, rows int)
+}
@@ -0,0 +1,64 @@
+package webtty
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// TerminalSizeMessage is sent to the master with a TerminalSize message
+// when the size of the slave differs from what the master may have reported,
+// so that the master can letterbox the terminal.
+type TerminalSizeMessage struct {
+	Columns int `json:"columns"`
+	Rows    int `json:"rows"`
+}
+
+// ResizeHandler is called with the size reported by the master instead of
+// resizing the slave, typically to choose a size for several masters sharing the slave.
+type ResizeHandler func(columns int, rows int)
+
+// MasterSize returns the last terminal size reported by the master,
+// or zeros if it has reported nothing yet.
+func (wt *WebTTY) MasterSize() (columns int, rows int) {
+	wt.sizeMutex.Lock()
+	defer wt.sizeMutex.Unlock()
+
+	return wt.lastColumns, wt.lastRows
+}
+
+// SetTerminalSize resizes the slave unless it has the size already,
+// and announces the size to the master.
+func (wt *WebTTY) SetTerminalSize(columns int, rows int) error {
+	wt.sizeMutex.Lock()
+	changed := wt.slaveColumns != columns || wt.slaveRows != rows
+	wt.sizeMutex.Unlock()
+	if changed {
+		wt.resizeSlave(columns, rows)
+	}
+	if !wt.masterSupports(FeatureTerminalSize) {
+		return nil
+	}
+
+	payload, err := json.Marshal(TerminalSizeMessage{Columns: columns, Rows: rows})
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal terminal size")
+	}
+	err = wt.masterWrite(append([]byte{TerminalSize}, payload...))
+	if err != nil {
+		return errors.Wrapf(err, "failed to send terminal size")
+	}
+
+	return nil
+}
+
+func (wt *WebTTY) resizeSlave(columns int, rows int) {
+	wt.sizeMutex.Lock()
+	wt.slaveColumns, wt.slaveRows = columns, rows
+	wt.sizeMutex.Unlock()
+
+	wt.slave.ResizeTerminal(columns, rows)
+	if wt.recorder != nil {
+		wt.recorder.WriteResize(columns, rows)
+	}
+}
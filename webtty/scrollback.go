@@ -0,0 +1,109 @@
+package webtty
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Scrollback is a ring buffer keeping the most recent output of a slave,
+// which is replayed to masters joining later.
+// Only one owner at a time appends to a Scrollback, so that several
+// masters relaying the same terminal don't record its output twice.
+type Scrollback struct {
+	mutex   sync.Mutex
+	buffer  []byte
+	start   int // index of the oldest byte in buffer
+	length  int
+	wrapped bool // true once old output has been overwritten
+
+	owner interface{}
+}
+
+// NewScrollback creates a Scrollback holding up to size bytes.
+func NewScrollback(size int) *Scrollback {
+	return &Scrollback{
+		buffer: make([]byte, size),
+	}
+}
+
+// Append records data when owner is the current owner.
+// The first caller becomes the owner until it calls Release.
+func (sb *Scrollback) Append(owner interface{}, data []byte) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	if sb.owner == nil {
+		sb.owner = owner
+	}
+	if sb.owner != owner || len(sb.buffer) == 0 {
+		return
+	}
+
+	size := len(sb.buffer)
+	if len(data) > size {
+		data = data[len(data)-size:]
+		sb.wrapped = true
+	}
+
+	end := (sb.start + sb.length) % size
+	n := copy(sb.buffer[end:], data)
+	copy(sb.buffer, data[n:])
+
+	sb.length += len(data)
+	if sb.length > size {
+		sb.start = (sb.start + sb.length - size) % size
+		sb.length = size
+		sb.wrapped = true
+	}
+}
+
+// Release gives up the ownership so that another caller of Append can take it.
+func (sb *Scrollback) Release(owner interface{}) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	if sb.owner == owner {
+		sb.owner = nil
+	}
+}
+
+// Bytes returns a copy of the recorded output.
+// When older output has been overwritten, the result starts at a safe boundary,
+// either an escape character or the beginning of a line, so that the replay
+// doesn't begin in the middle of an escape sequence or a multibyte character.
+func (sb *Scrollback) Bytes() []byte {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	data := make([]byte, sb.length)
+	n := copy(data, sb.buffer[sb.start:])
+	copy(data[n:], sb.buffer)
+
+	if !sb.wrapped {
+		return data
+	}
+	return data[safeBoundary(data):]
+}
+
+// safeBoundary returns the first index in data from which the stream
+// can be interpreted without the preceding bytes.
+func safeBoundary(data []byte) int {
+	esc := bytes.IndexByte(data, 0x1b)
+	newline := bytes.IndexByte(data, '\n')
+	if newline >= 0 {
+		newline++
+	}
+
+	switch {
+	case esc < 0 && newline < 0:
+		return len(data)
+	case esc < 0:
+		return newline
+	case newline < 0:
+		return esc
+	case esc < newline:
+		return esc
+	default:
+		return newline
+	}
+}
@@ -0,0 +1,52 @@
+package webtty
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestScrollbackKeepsRecentOutput(t *testing.T) {
+	sb := NewScrollback(8)
+
+	sb.Append(t, []byte("abc"))
+	if data := sb.Bytes(); !bytes.Equal(data, []byte("abc")) {
+		t.Fatalf("Unexpected scrollback: `%q`", data)
+	}
+
+	sb.Append(t, []byte("\x1b[1mdef"))
+	if data := sb.Bytes(); !bytes.Equal(data, []byte("\x1b[1mdef")) {
+		t.Fatalf("Unexpected scrollback: `%q`", data)
+	}
+}
+
+func TestScrollbackSafeBoundary(t *testing.T) {
+	sb := NewScrollback(8)
+
+	// the oldest retained bytes are in the middle of an escape sequence
+	sb.Append(t, []byte("\x1b[31mab\ncd"))
+	if data := sb.Bytes(); !bytes.Equal(data, []byte("cd")) {
+		t.Fatalf("Unexpected scrollback: `%q`", data)
+	}
+
+	sb.Append(t, []byte("\x1b[0mxy"))
+	if data := sb.Bytes(); !bytes.Equal(data, []byte("\x1b[0mxy")) {
+		t.Fatalf("Unexpected scrollback: `%q`", data)
+	}
+}
+
+func TestScrollbackOwner(t *testing.T) {
+	sb := NewScrollback(8)
+	first, second := new(int), new(int)
+
+	sb.Append(first, []byte("a"))
+	sb.Append(second, []byte("b"))
+	if data := sb.Bytes(); !bytes.Equal(data, []byte("a")) {
+		t.Fatalf("Unexpected scrollback: `%q`", data)
+	}
+
+	sb.Release(first)
+	sb.Append(second, []byte("b"))
+	if data := sb.Bytes(); !bytes.Equal(data, []byte("ab")) {
+		t.Fatalf("Unexpected scrollback: `%q`", data)
+	}
+}
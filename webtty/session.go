@@ -0,0 +1,38 @@
+package webtty
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// SessionMessage is sent to the master with a Session message to tell
+// how to resume the slave after the connection drops.
+type SessionMessage struct {
+	// Token resumes the slave when given by the next connection,
+	// empty once the slave has ended and cannot be resumed.
+	Token string `json:"token,omitempty"`
+	// Resumed is true when the connection has resumed a detached slave,
+	// whose recent output is sent again.
+	Resumed bool `json:"resumed"`
+	// GracePeriod is the number of seconds the slave is kept after the connection drops.
+	GracePeriod int `json:"grace_period,omitempty"`
+}
+
+// SendSession tells the master how to resume the slave.
+func (wt *WebTTY) SendSession(session SessionMessage) error {
+	if !wt.masterSupports(FeatureSession) {
+		return nil
+	}
+
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal session")
+	}
+	err = wt.masterWrite(append([]byte{Session}, payload...))
+	if err != nil {
+		return errors.Wrapf(err, "failed to send session")
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package webtty
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PingMessage is the optional payload of a Ping message.
+// An empty payload is still accepted from older masters.
+type PingMessage struct {
+	// Timestamp is a time of the master in milliseconds, which is echoed back with the Pong message.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// PongMessage is the payload of a Pong message replying a PingMessage.
+type PongMessage struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Stats are the traffic counters of a WebTTY.
+type Stats struct {
+	// BytesIn and MessagesIn count what was received from the master.
+	BytesIn    int64
+	MessagesIn int64
+	// BytesOut and MessagesOut count what was sent to the master.
+	BytesOut    int64
+	MessagesOut int64
+	// UnknownMessages counts the messages of unknown types from the master, which are ignored.
+	UnknownMessages int64
+	// LastInput is when the master sent the last input.
+	LastInput time.Time
+}
+
+// Stats returns the current traffic counters.
+func (wt *WebTTY) Stats() Stats {
+	return Stats{
+		BytesIn:         wt.bytesIn.Load(),
+		MessagesIn:      wt.messagesIn.Load(),
+		BytesOut:        wt.bytesOut.Load(),
+		MessagesOut:     wt.messagesOut.Load(),
+		UnknownMessages: wt.unknownIn.Load(),
+		LastInput:       wt.LastInput(),
+	}
+}
+
+func (wt *WebTTY) handlePing(payload []byte) error {
+	if len(payload) == 0 {
+		err := wt.masterWrite([]byte{Pong})
+		if err != nil {
+			return errors.Wrapf(err, "failed to return Pong message to master")
+		}
+		return nil
+	}
+
+	// malformed pings are ignored like unknown messages
+	var ping PingMessage
+	if json.Unmarshal(payload, &ping) != nil {
+		return nil
+	}
+
+	pong, err := json.Marshal(PongMessage{Timestamp: ping.Timestamp})
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal pong")
+	}
+	err = wt.masterWrite(append([]byte{Pong}, pong...))
+	if err != nil {
+		return errors.Wrapf(err, "failed to return Pong message to master")
+	}
+	return nil
+}
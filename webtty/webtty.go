@@ -5,6 +5,8 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -19,14 +21,56 @@ type WebTTY struct {
 	slave Slave
 
 	windowTitle []byte
-	permitWrite bool
+	binary      bool
 	columns     int
 	rows        int
 	reconnect   int // in seconds
 	masterPrefs []byte
-
-	bufferSize int
-	writeMutex sync.Mutex
+	session     *SessionMessage
+
+	// features negotiated with the master, nil if it has sent no protocol version
+	capabilities *CapabilitiesMessage
+
+	outputQueueSize   int
+	outputQueuePolicy OutputQueuePolicy
+	outputQueue       *outputQueue
+
+	recorder   Recorder
+	auditor    Auditor
+	scrollback *Scrollback
+
+	// convert the output of the slave to UTF-8 and the input back, nil for UTF-8 slaves
+	outputTranscoder *transcoder
+	inputTranscoder  *transcoder
+
+	permitMutex         sync.RWMutex
+	permitWrite         bool
+	writeControlHandler WriteControlHandler
+	fileTransferHandler FileTransferHandler
+	resizeHandler       ResizeHandler
+	startHandler        StartHandler
+	zmodem              *zmodemBridge
+
+	// last terminal size reported by the master, and the size of the slave
+	sizeMutex    sync.Mutex
+	lastColumns  int
+	lastRows     int
+	slaveColumns int
+	slaveRows    int
+
+	// unix time in nanoseconds of the last input from the master
+	lastInput atomic.Int64
+
+	// traffic counters, see Stats
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	messagesIn  atomic.Int64
+	messagesOut atomic.Int64
+	unknownIn   atomic.Int64
+
+	bufferSize       int
+	masterBufferSize int // large enough for the biggest message from the master
+	writeMutex       sync.Mutex
 }
 
 // New creates a new instance of WebTTY.
@@ -42,6 +86,9 @@ func New(masterConn Master, slave Slave, options ...Option) (*WebTTY, error) {
 		columns:     0,
 		rows:        0,
 
+		outputQueueSize:   DefaultOutputQueueSize,
+		outputQueuePolicy: OutputQueueBlock,
+
 		bufferSize: 1024,
 	}
 
@@ -49,9 +96,23 @@ func New(masterConn Master, slave Slave, options ...Option) (*WebTTY, error) {
 		option(wt)
 	}
 
+	wt.masterBufferSize = wt.bufferSize
+	if wt.fileTransferHandler != nil || wt.zmodem != nil {
+		wt.masterBufferSize = fileTransferBufferSize
+	}
+	if wt.zmodem != nil {
+		wt.zmodem.wt = wt
+	}
+
+	wt.outputQueue = newOutputQueue(wt.outputQueueSize, wt.outputQueuePolicy)
+
 	return wt, nil
 }
 
+// StartHandler is called by Run once the master has received the initializing messages,
+// before any output or input is exchanged.
+type StartHandler func()
+
 // Run starts the main process of the WebTTY.
 // This method blocks until the context is canceled.
 // Note that the master and slave are left intact even
@@ -63,19 +124,69 @@ func (wt *WebTTY) Run(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrapf(err, "failed to send initializing message")
 	}
+	if wt.startHandler != nil {
+		wt.startHandler()
+	}
 
-	errs := make(chan error, 2)
+	if wt.scrollback != nil {
+		defer wt.scrollback.Release(wt)
+		if data := wt.scrollback.Bytes(); len(data) > 0 {
+			err = wt.handleSlaveReadEvent(data)
+			if err != nil {
+				return errors.Wrapf(err, "failed to send scrollback")
+			}
+		}
+	}
+
+	defer wt.outputQueue.close()
+	if wt.zmodem != nil {
+		defer wt.zmodem.close()
+	}
+
+	errs := make(chan error, 3)
 
 	go func() {
-		errs <- func() error {
+		err := func() error {
 			buffer := make([]byte, wt.bufferSize)
 			for {
 				n, err := wt.slave.Read(buffer)
 				if err != nil {
+					// the writer reports ErrSlaveClosed after flushing queued output
+					wt.outputQueue.finish()
+					return nil
+				}
+
+				if wt.zmodem != nil {
+					err = wt.zmodem.filter(buffer[:n])
+				} else {
+					err = wt.writeOutput(buffer[:n])
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}()
+		if err != nil {
+			errs <- err
+		}
+	}()
+
+	go func() {
+		errs <- func() error {
+			for {
+				data, dropped, ok := wt.outputQueue.pop()
+				if !ok {
 					return ErrSlaveClosed
 				}
 
-				err = wt.handleSlaveReadEvent(buffer[:n])
+				if dropped > 0 {
+					err := wt.handleOutputDropped(dropped)
+					if err != nil {
+						return err
+					}
+				}
+
+				err := wt.handleSlaveReadEvent(data)
 				if err != nil {
 					return err
 				}
@@ -85,12 +196,14 @@ func (wt *WebTTY) Run(ctx context.Context) error {
 
 	go func() {
 		errs <- func() error {
-			buffer := make([]byte, wt.bufferSize)
+			buffer := make([]byte, wt.masterBufferSize)
 			for {
 				n, err := wt.masterConn.Read(buffer)
 				if err != nil {
 					return ErrMasterClosed
 				}
+				wt.messagesIn.Add(1)
+				wt.bytesIn.Add(int64(n))
 
 				err = wt.handleMasterReadEvent(buffer[:n])
 				if err != nil {
@@ -110,6 +223,14 @@ func (wt *WebTTY) Run(ctx context.Context) error {
 }
 
 func (wt *WebTTY) sendInitializeMessage() error {
+	// the master learns the features first to understand what follows
+	if wt.capabilities != nil {
+		err := wt.sendCapabilities()
+		if err != nil {
+			return err
+		}
+	}
+
 	err := wt.masterWrite(append([]byte{SetWindowTitle}, wt.windowTitle...))
 	if err != nil {
 		return errors.Wrapf(err, "failed to send window title")
@@ -130,12 +251,45 @@ func (wt *WebTTY) sendInitializeMessage() error {
 		}
 	}
 
+	if wt.session != nil {
+		err := wt.SendSession(*wt.session)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// writeOutput passes output of the slave to the recorder, the scrollback and the master.
+func (wt *WebTTY) writeOutput(data []byte) error {
+	if wt.outputTranscoder != nil {
+		data = wt.outputTranscoder.convert(data)
+		if len(data) == 0 {
+			return nil
+		}
+	}
+
+	if wt.recorder != nil {
+		wt.recorder.WriteOutput(data)
+	}
+	if wt.scrollback != nil {
+		wt.scrollback.Append(wt, data)
+	}
+
+	return wt.outputQueue.push(data)
+}
+
 func (wt *WebTTY) handleSlaveReadEvent(data []byte) error {
-	safeMessage := base64.StdEncoding.EncodeToString(data)
-	err := wt.masterWrite(append([]byte{Output}, []byte(safeMessage)...))
+	var message []byte
+	if wt.binary {
+		message = append([]byte{Output}, data...)
+	} else {
+		safeMessage := base64.StdEncoding.EncodeToString(data)
+		message = append([]byte{Output}, []byte(safeMessage)...)
+	}
+
+	err := wt.masterWrite(message)
 	if err != nil {
 		return errors.Wrapf(err, "failed to send message to master")
 	}
@@ -143,6 +297,37 @@ func (wt *WebTTY) handleSlaveReadEvent(data []byte) error {
 	return nil
 }
 
+// handleOutputDropped tells the master to clear its screen and
+// nudges the slave to redraw by toggling the terminal size.
+func (wt *WebTTY) handleOutputDropped(dropped int) error {
+	payload, _ := json.Marshal(dropped)
+	err := wt.masterWrite(append([]byte{ResyncTerminal}, payload...))
+	if err != nil {
+		return errors.Wrapf(err, "failed to send resync message to master")
+	}
+
+	wt.sizeMutex.Lock()
+	columns, rows := wt.slaveColumns, wt.slaveRows
+	wt.sizeMutex.Unlock()
+
+	if columns > 0 && rows > 1 {
+		wt.slave.ResizeTerminal(columns, rows-1)
+		wt.slave.ResizeTerminal(columns, rows)
+	}
+
+	return nil
+}
+
+// LastInput returns when the master sent the last input it's permitted to write,
+// or the zero time if it has sent nothing yet.
+func (wt *WebTTY) LastInput() time.Time {
+	lastInput := wt.lastInput.Load()
+	if lastInput == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastInput)
+}
+
 func (wt *WebTTY) masterWrite(data []byte) error {
 	wt.writeMutex.Lock()
 	defer wt.writeMutex.Unlock()
@@ -151,6 +336,8 @@ func (wt *WebTTY) masterWrite(data []byte) error {
 	if err != nil {
 		return errors.Wrapf(err, "failed to write to master")
 	}
+	wt.messagesOut.Add(1)
+	wt.bytesOut.Add(int64(len(data)))
 
 	return nil
 }
@@ -162,25 +349,61 @@ func (wt *WebTTY) handleMasterReadEvent(data []byte) error {
 
 	switch data[0] {
 	case Input:
-		if !wt.permitWrite {
+		// input discarded doesn't keep the master from being idle
+		if !wt.PermitWrite() {
 			return nil
 		}
+		wt.lastInput.Store(time.Now().UnixNano())
 
 		if len(data) <= 1 {
 			return nil
 		}
 
-		_, err := wt.slave.Write(data[1:])
+		if wt.zmodem != nil && wt.zmodem.intercept(data[1:]) {
+			return nil
+		}
+
+		if wt.auditor != nil {
+			wt.auditor.AuditInput(data[1:], wt.slaveSecret())
+		}
+
+		input := data[1:]
+		if wt.inputTranscoder != nil {
+			input = wt.inputTranscoder.convert(input)
+		}
+		_, err := wt.slave.Write(input)
 		if err != nil {
 			return errors.Wrapf(err, "failed to write received data to slave")
 		}
 
 	case Ping:
-		err := wt.masterWrite([]byte{Pong})
+		err := wt.handlePing(data[1:])
+		if err != nil {
+			return err
+		}
+
+	case RequestFileTransfer:
+		err := wt.handleFileTransfer(data[1:])
 		if err != nil {
-			return errors.Wrapf(err, "failed to return Pong message to master")
+			return err
 		}
 
+	case RequestWriteControl:
+		if wt.writeControlHandler != nil {
+			wt.writeControlHandler(true)
+		}
+
+	case ReleaseWriteControl:
+		if wt.writeControlHandler != nil {
+			wt.writeControlHandler(false)
+		}
+
+	case PauseOutput:
+		wt.outputQueue.setPaused(true)
+
+	case ResumeOutput:
+		wt.outputQueue.setPaused(false)
+
 	case ResizeTerminal:
 		if wt.columns != 0 && wt.rows != 0 {
 			break
@@ -205,9 +428,18 @@ func (wt *WebTTY) handleMasterReadEvent(data []byte) error {
 			columns = int(args.Columns)
 		}
 
-		wt.slave.ResizeTerminal(columns, rows)
+		wt.sizeMutex.Lock()
+		wt.lastColumns, wt.lastRows = columns, rows
+		wt.sizeMutex.Unlock()
+
+		if wt.resizeHandler != nil {
+			wt.resizeHandler(columns, rows)
+			break
+		}
+		wt.resizeSlave(columns, rows)
 	default:
-		return errors.Errorf("unknown message type `%c`", data[0])
+		// a newer master may send messages unknown to us, don't let them end the connection
+		wt.unknownIn.Add(1)
 	}
 
 	return nil
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"io"
 	"sync"
 	"testing"
@@ -14,6 +15,55 @@ type pipePair struct {
 	*io.PipeWriter
 }
 
+type pipeSlave struct {
+	pipePair
+}
+
+func (ps pipeSlave) WindowTitleVariables() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func (ps pipeSlave) ResizeTerminal(columns int, rows int) error {
+	return nil
+}
+
+// newPipeSlave returns a slave, a writer to feed the slave output
+// and a reader to receive input written to the slave.
+func newPipeSlave() (pipeSlave, *io.PipeWriter, *io.PipeReader) {
+	outReader, outWriter := io.Pipe() // out from slave
+	inReader, inWriter := io.Pipe()   // in to slave
+	return pipeSlave{pipePair{outReader, inWriter}}, outWriter, inReader
+}
+
+func runWebTTY(t *testing.T, dt *WebTTY) (context.CancelFunc, *sync.WaitGroup) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := dt.Run(ctx)
+		if err != nil && err != context.Canceled {
+			t.Errorf("Unexpected error from Run(): %s", err)
+		}
+	}()
+	return cancel, &wg
+}
+
+// readSkippingTitle reads the next message from the master
+// after the initial SetWindowTitle message.
+func readSkippingTitle(t *testing.T, r io.Reader, buf []byte) int {
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error from Read(): %s", err)
+		}
+		if n > 0 && buf[0] == SetWindowTitle {
+			continue
+		}
+		return n
+	}
+}
+
 func TestWriteFromPTY(t *testing.T) {
 	connInPipeReader, connInPipeWriter := io.Pipe() // in to conn
 	connOutPipeReader, _ := io.Pipe()               // out from conn
@@ -22,36 +72,19 @@ func TestWriteFromPTY(t *testing.T) {
 		connOutPipeReader,
 		connInPipeWriter,
 	}
-	dt, err := New(conn)
+	slave, slaveOut, _ := newPipeSlave()
+	dt, err := New(conn, slave)
 	if err != nil {
 		t.Fatalf("Unexpected error from New(): %s", err)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		wg.Done()
-		err := dt.Run(ctx)
-		if err != nil {
-			t.Fatalf("Unexpected error from Run(): %s", err)
-		}
-	}()
+	cancel, wg := runWebTTY(t, dt)
 
 	message := []byte("foobar")
-	n, err := dt.TTY().Write(message)
-	if err != nil {
-		t.Fatalf("Unexpected error from Write(): %s", err)
-	}
-	if n != len(message) {
-		t.Fatalf("Write() accepted `%d` for message `%s`", n, message)
-	}
+	go slaveOut.Write(message)
 
 	buf := make([]byte, 1024)
-	n, err = connInPipeReader.Read(buf)
-	if err != nil {
-		t.Fatalf("Unexpected error from Read(): %s", err)
-	}
+	n := readSkippingTitle(t, connInPipeReader, buf)
 	if buf[0] != Output {
 		t.Fatalf("Unexpected message type `%c`", buf[0])
 	}
@@ -68,7 +101,39 @@ func TestWriteFromPTY(t *testing.T) {
 	wg.Wait()
 }
 
-func TestWriteFromConn(t *testing.T) {
+func TestWriteFromPTYBinary(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe() // in to conn
+	connOutPipeReader, _ := io.Pipe()               // out from conn
+
+	conn := pipePair{
+		connOutPipeReader,
+		connInPipeWriter,
+	}
+	slave, slaveOut, _ := newPipeSlave()
+	dt, err := New(conn, slave, WithBinaryProtocol())
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	cancel, wg := runWebTTY(t, dt)
+
+	message := []byte("foo\x00\xffbar")
+	go slaveOut.Write(message)
+
+	buf := make([]byte, 1024)
+	n := readSkippingTitle(t, connInPipeReader, buf)
+	if buf[0] != Output {
+		t.Fatalf("Unexpected message type `%c`", buf[0])
+	}
+	if !bytes.Equal(buf[1:n], message) {
+		t.Fatalf("Unexpected message received: `%q`", buf[1:n])
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestEncoding(t *testing.T) {
 	connInPipeReader, connInPipeWriter := io.Pipe()   // in to conn
 	connOutPipeReader, connOutPipeWriter := io.Pipe() // out from conn
 
@@ -76,23 +141,61 @@ func TestWriteFromConn(t *testing.T) {
 		connOutPipeReader,
 		connInPipeWriter,
 	}
-
-	dt, err := New(conn)
+	encoding, err := LookupEncoding("Shift_JIS")
+	if err != nil {
+		t.Fatalf("Unexpected error from LookupEncoding(): %s", err)
+	}
+	slave, slaveOut, slaveIn := newPipeSlave()
+	dt, err := New(conn, slave, WithBinaryProtocol(), WithPermitWrite(), WithEncoding(encoding))
 	if err != nil {
 		t.Fatalf("Unexpected error from New(): %s", err)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	var wg sync.WaitGroup
-	wg.Add(1)
+	cancel, wg := runWebTTY(t, dt)
+
+	// a character split across reads of the slave
+	sjis := []byte("\x93\xfa\x96\x7b")
 	go func() {
-		wg.Done()
-		err := dt.Run(ctx)
-		if err != nil {
-			t.Fatalf("Unexpected error from Run(): %s", err)
-		}
+		slaveOut.Write(sjis[:1])
+		slaveOut.Write(sjis[1:])
 	}()
 
+	buf := make([]byte, 1024)
+	n := readSkippingTitle(t, connInPipeReader, buf)
+	if string(buf[:n]) != "1日本" {
+		t.Fatalf("Unexpected message received: `%q`", buf[:n])
+	}
+
+	go connOutPipeWriter.Write([]byte("1日本"))
+	n, _ = slaveIn.Read(buf)
+	if !bytes.Equal(buf[:n], sjis) {
+		t.Fatalf("Unexpected input received: `%q`", buf[:n])
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestWriteFromConn(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe()   // in to conn
+	connOutPipeReader, connOutPipeWriter := io.Pipe() // out from conn
+
+	conn := pipePair{
+		connOutPipeReader,
+		connInPipeWriter,
+	}
+
+	slave, _, slaveIn := newPipeSlave()
+	dt, err := New(conn, slave, WithPermitWrite())
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	// drain the initial window title
+	go connInPipeReader.Read(make([]byte, 1024))
+
+	cancel, wg := runWebTTY(t, dt)
+
 	var (
 		message []byte
 		n       int
@@ -100,7 +203,7 @@ func TestWriteFromConn(t *testing.T) {
 	readBuf := make([]byte, 1024)
 
 	// input
-	message = []byte("0hello\n") // line buffered canonical mode
+	message = []byte("1hello\n") // line buffered canonical mode
 	n, err = connOutPipeWriter.Write(message)
 	if err != nil {
 		t.Fatalf("Unexpected error from Write(): %s", err)
@@ -109,7 +212,7 @@ func TestWriteFromConn(t *testing.T) {
 		t.Fatalf("Write() accepted `%d` for message `%s`", n, message)
 	}
 
-	n, err = dt.TTY().Read(readBuf)
+	n, err = slaveIn.Read(readBuf)
 	if err != nil {
 		t.Fatalf("Unexpected error from Write(): %s", err)
 	}
@@ -118,22 +221,331 @@ func TestWriteFromConn(t *testing.T) {
 	}
 
 	// ping
-	message = []byte("1\n") // line buffered canonical mode
-	n, err = connOutPipeWriter.Write(message)
-	if n != len(message) {
-		t.Fatalf("Write() accepted `%d` for message `%s`", n, message)
+	message = []byte("2") // line buffered canonical mode
+	go connOutPipeWriter.Write(message)
+
+	n = readSkippingTitle(t, connInPipeReader, readBuf)
+	if !bytes.Equal(readBuf[:n], []byte{'2'}) {
+		t.Fatalf("Unexpected message received: `%s`", readBuf[:n])
 	}
 
-	n, err = connInPipeReader.Read(readBuf)
-	if err != nil {
-		t.Fatalf("Unexpected error from Read(): %s", err)
+	// ping with a timestamp
+	message = []byte(`2{"timestamp":1700000000000}`)
+	go connOutPipeWriter.Write(message)
+
+	n = readSkippingTitle(t, connInPipeReader, readBuf)
+	if !bytes.Equal(readBuf[:n], message) {
+		t.Fatalf("Unexpected message received: `%s`", readBuf[:n])
 	}
-	if !bytes.Equal(readBuf[:n], []byte{'1'}) {
+
+	// a malformed ping is ignored, the next one is answered
+	go func() {
+		connOutPipeWriter.Write([]byte("2{"))
+		connOutPipeWriter.Write([]byte("2"))
+	}()
+
+	n = readSkippingTitle(t, connInPipeReader, readBuf)
+	if !bytes.Equal(readBuf[:n], []byte{'2'}) {
 		t.Fatalf("Unexpected message received: `%s`", readBuf[:n])
 	}
 
+	stats := dt.Stats()
+	if stats.MessagesIn != 5 || stats.BytesIn != int64(len("1hello\n")+len("2")+len(message)+len("2{")+len("2")) {
+		t.Errorf("Unexpected input counters: %+v", stats)
+	}
+	if stats.LastInput.IsZero() {
+		t.Errorf("Last input is not recorded")
+	}
+
 	// TODO: resize
 
 	cancel()
 	wg.Wait()
 }
+
+func TestResizeHandler(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe()   // in to conn
+	connOutPipeReader, connOutPipeWriter := io.Pipe() // out from conn
+
+	conn := pipePair{
+		connOutPipeReader,
+		connInPipeWriter,
+	}
+
+	sizes := make(chan [2]int, 1)
+	slave, _, _ := newPipeSlave()
+	dt, err := New(conn, slave, WithResizeHandler(func(columns int, rows int) {
+		sizes <- [2]int{columns, rows}
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	cancel, wg := runWebTTY(t, dt)
+
+	// the initial window title
+	readBuf := make([]byte, 1024)
+	connInPipeReader.Read(readBuf)
+
+	go connOutPipeWriter.Write([]byte(`3{"columns":120,"rows":40}`))
+	if size := <-sizes; size != [2]int{120, 40} {
+		t.Fatalf("Unexpected size given to the handler: %v", size)
+	}
+	if columns, rows := dt.MasterSize(); columns != 120 || rows != 40 {
+		t.Fatalf("Unexpected master size: %dx%d", columns, rows)
+	}
+
+	go dt.SetTerminalSize(80, 24)
+	n, _ := connInPipeReader.Read(readBuf)
+	if string(readBuf[:n]) != `A{"columns":80,"rows":24}` {
+		t.Fatalf("Unexpected message received: `%s`", readBuf[:n])
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestStartHandler(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe() // in to conn
+	connOutPipeReader, _ := io.Pipe()               // out from conn
+
+	conn := pipePair{
+		connOutPipeReader,
+		connInPipeWriter,
+	}
+
+	slave, slaveOutWriter, _ := newPipeSlave()
+	var dt *WebTTY
+	dt, err := New(conn, slave, WithCapabilities(CapabilitiesMessage{
+		Version:  ProtocolVersion,
+		Features: []string{FeatureWriteControl},
+	}), WithStartHandler(func() {
+		dt.SendWriteControl(WriteControlStatus{Writable: true})
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	cancel, wg := runWebTTY(t, dt)
+	go slaveOutWriter.Write([]byte("foo"))
+
+	// the status sent by the handler follows the initializing messages and precedes the output
+	readBuf := make([]byte, 1024)
+	expected := []string{
+		`C{"version":1,"features":["write_control"]}`,
+		string(SetWindowTitle),
+		`7{"writable":true}`,
+		string(Output) + base64.StdEncoding.EncodeToString([]byte("foo")),
+	}
+	for _, message := range expected {
+		n, _ := connInPipeReader.Read(readBuf)
+		if string(readBuf[:n]) != message {
+			t.Fatalf("Unexpected message received: `%s`, expected `%s`", readBuf[:n], message)
+		}
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestReadOnlyInput(t *testing.T) {
+	slave, _, _ := newPipeSlave()
+	dt, err := New(pipePair{}, slave)
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	// discarded input doesn't count as activity
+	if err := dt.handleMasterReadEvent([]byte("1hello")); err != nil {
+		t.Fatalf("Unexpected error from handleMasterReadEvent(): %s", err)
+	}
+	if !dt.LastInput().IsZero() {
+		t.Fatalf("Unexpected last input of a read-only master: %s", dt.LastInput())
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	capabilities := Negotiate(5, []string{FeatureNotice, "future", FeatureBinary}, []string{FeatureBinary, FeatureNotice, FeatureSession})
+	if capabilities.Version != ProtocolVersion {
+		t.Fatalf("Unexpected version: %d", capabilities.Version)
+	}
+	if len(capabilities.Features) != 2 || !capabilities.Has(FeatureBinary) || !capabilities.Has(FeatureNotice) {
+		t.Fatalf("Unexpected features: %v", capabilities.Features)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe()   // in to conn
+	connOutPipeReader, connOutPipeWriter := io.Pipe() // out from conn
+
+	conn := pipePair{
+		connOutPipeReader,
+		connInPipeWriter,
+	}
+
+	slave, _, slaveInReader := newPipeSlave()
+	dt, err := New(conn, slave, WithPermitWrite(), WithCapabilities(CapabilitiesMessage{
+		Version:  ProtocolVersion,
+		Features: []string{FeatureNotice},
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	cancel, wg := runWebTTY(t, dt)
+
+	// the capabilities come before the window title
+	readBuf := make([]byte, 1024)
+	n, _ := connInPipeReader.Read(readBuf)
+	if string(readBuf[:n]) != `C{"version":1,"features":["notice"]}` {
+		t.Fatalf("Unexpected message received: `%s`", readBuf[:n])
+	}
+	connInPipeReader.Read(readBuf)
+
+	// not sent to a master lacking the feature
+	if err := dt.SendWriteControl(WriteControlStatus{Writable: true}); err != nil {
+		t.Fatalf("Unexpected error from SendWriteControl(): %s", err)
+	}
+
+	// an unknown message is ignored
+	connOutPipeWriter.Write([]byte("Zfuture"))
+	go connOutPipeWriter.Write([]byte("1foo"))
+	n, _ = slaveInReader.Read(readBuf)
+	if string(readBuf[:n]) != "foo" {
+		t.Fatalf("Unexpected input received: `%s`", readBuf[:n])
+	}
+	if unknown := dt.Stats().UnknownMessages; unknown != 1 {
+		t.Fatalf("Unexpected number of unknown messages: %d", unknown)
+	}
+
+	go dt.SendNotice(NoticeMessage{Kind: "test", Message: "hello"})
+	n, _ = connInPipeReader.Read(readBuf)
+	if readBuf[0] != Notice {
+		t.Fatalf("Unexpected message received: `%s`", readBuf[:n])
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestLegacyMaster(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe() // in to conn
+	connOutPipeReader, _ := io.Pipe()               // out from conn
+
+	conn := pipePair{
+		connOutPipeReader,
+		connInPipeWriter,
+	}
+
+	// a master sending no version gets no Capabilities message
+	slave, _, _ := newPipeSlave()
+	dt, err := New(conn, slave)
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	for _, feature := range LegacyFeatures {
+		if !dt.masterSupports(feature) {
+			t.Errorf("A master sending no version lacks %s", feature)
+		}
+	}
+	if dt.masterSupports("future") {
+		t.Errorf("A master sending no version supports a feature added since then")
+	}
+
+	cancel, wg := runWebTTY(t, dt)
+
+	readBuf := make([]byte, 1024)
+	n, _ := connInPipeReader.Read(readBuf)
+	if readBuf[0] != SetWindowTitle {
+		t.Fatalf("Unexpected message received: `%s`", readBuf[:n])
+	}
+
+	go dt.SendNotice(NoticeMessage{Kind: "test", Message: "hello"})
+	n, _ = connInPipeReader.Read(readBuf)
+	if readBuf[0] != Notice {
+		t.Fatalf("Unexpected message received: `%s`", readBuf[:n])
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestFileTransfer(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe()   // in to conn
+	connOutPipeReader, connOutPipeWriter := io.Pipe() // out from conn
+
+	conn := pipePair{
+		connOutPipeReader,
+		connInPipeWriter,
+	}
+
+	requests := make(chan *FileTransferRequest, 1)
+	slave, _, _ := newPipeSlave()
+	dt, err := New(conn, slave, WithFileTransferHandler(func(request *FileTransferRequest) {
+		requests <- request
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	cancel, wg := runWebTTY(t, dt)
+
+	// the initial window title
+	readBuf := make([]byte, 1024)
+	connInPipeReader.Read(readBuf)
+
+	// a full chunk is larger than the usual read buffer
+	chunk := bytes.Repeat([]byte{0xff}, FileTransferChunkSize)
+	payload, _ := json.Marshal(FileTransferRequest{ID: "1", Action: TransferUploadChunk, Data: chunk})
+	go connOutPipeWriter.Write(append([]byte{RequestFileTransfer}, payload...))
+
+	request := <-requests
+	if request.ID != "1" || request.Action != TransferUploadChunk || !bytes.Equal(request.Data, chunk) {
+		t.Fatalf("Unexpected request received: `%s` `%s` with %d bytes", request.ID, request.Action, len(request.Data))
+	}
+
+	go dt.SendFileTransfer(&FileTransferEvent{ID: "1", Action: TransferProgress, Size: 100, Transferred: 50})
+
+	n := readSkippingTitle(t, connInPipeReader, readBuf)
+	expected := `9{"id":"1","action":"progress","size":100,"transferred":50}`
+	if string(readBuf[:n]) != expected {
+		t.Fatalf("Unexpected message received: `%s`", readBuf[:n])
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestFileTransferDisabled(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe()   // in to conn
+	connOutPipeReader, connOutPipeWriter := io.Pipe() // out from conn
+
+	conn := pipePair{
+		connOutPipeReader,
+		connInPipeWriter,
+	}
+
+	slave, _, _ := newPipeSlave()
+	dt, err := New(conn, slave)
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	cancel, wg := runWebTTY(t, dt)
+
+	// the initial window title
+	readBuf := make([]byte, 1024)
+	connInPipeReader.Read(readBuf)
+
+	go connOutPipeWriter.Write([]byte(`8{"id":"1","action":"download","name":"foo"}`))
+
+	n := readSkippingTitle(t, connInPipeReader, readBuf)
+	expected := `9{"id":"1","action":"error","name":"foo","error":"file transfer is disabled"}`
+	if string(readBuf[:n]) != expected {
+		t.Fatalf("Unexpected message received: `%s`", readBuf[:n])
+	}
+
+	cancel()
+	wg.Wait()
+}
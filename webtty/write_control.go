@@ -0,0 +1,56 @@
+package webtty
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// WriteControlStatus is sent to the master with a WriteControl message
+// whenever the write control of its terminal changes hands.
+type WriteControlStatus struct {
+	// Writable tells whether the receiving master can write to the slave.
+	Writable bool `json:"writable"`
+	// Holder identifies the master currently holding the write control, if any.
+	Holder string `json:"holder,omitempty"`
+	// Requests lists masters waiting for the write control in order.
+	Requests []string `json:"requests,omitempty"`
+}
+
+// WriteControlHandler is called when the master requests (request is true)
+// or releases (request is false) the write control.
+type WriteControlHandler func(request bool)
+
+// PermitWrite reports whether input from the master currently reaches the slave.
+func (wt *WebTTY) PermitWrite() bool {
+	wt.permitMutex.RLock()
+	defer wt.permitMutex.RUnlock()
+
+	return wt.permitWrite
+}
+
+// SetPermitWrite changes whether input from the master reaches the slave.
+func (wt *WebTTY) SetPermitWrite(permit bool) {
+	wt.permitMutex.Lock()
+	defer wt.permitMutex.Unlock()
+
+	wt.permitWrite = permit
+}
+
+// SendWriteControl announces the write control status to the master.
+func (wt *WebTTY) SendWriteControl(status WriteControlStatus) error {
+	if !wt.masterSupports(FeatureWriteControl) {
+		return nil
+	}
+
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal write control status")
+	}
+	err = wt.masterWrite(append([]byte{WriteControl}, payload...))
+	if err != nil {
+		return errors.Wrapf(err, "failed to send write control status")
+	}
+
+	return nil
+}
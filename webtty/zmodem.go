@@ -0,0 +1,603 @@
+package webtty
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/pkg/zmodem"
+)
+
+// zmodemIDPrefix starts the IDs of the file transfers run by ZMODEM sessions,
+// so that the requests of the master are routed to the session.
+const zmodemIDPrefix = "zmodem-"
+
+const (
+	// zmodemWaitTimeout is how long a session waits for the master to answer.
+	zmodemWaitTimeout = 2 * time.Minute
+	// zmodemRequestQueueSize is the number of requests of the master queued for a session,
+	// more than the chunks sent ahead by the master.
+	zmodemRequestQueueSize = 16
+)
+
+var errTransferCanceled = errors.New("transfer canceled")
+
+// zmodemBridge watches the output of the slave for rz and sz, or trz and tsz of trzsz,
+// and exchanges their files with the master while they run.
+// The output is passed to the master with outputMutex, which keeps it in order
+// but is taken before mutex, so that the input of the master is handled
+// while the output waits for a paused or slow master.
+type zmodemBridge struct {
+	wt       *WebTTY
+	upload   bool
+	download bool
+	maxSize  int64
+
+	outputMutex sync.Mutex
+
+	mutex    sync.Mutex
+	detector zmodem.Detector
+	session  *zmodemSession // the running session, if any
+	lastID   int
+	closed   bool
+}
+
+// filter passes output of the slave to the master,
+// unless it belongs to a ZMODEM session.
+func (b *zmodemBridge) filter(data []byte) error {
+	b.outputMutex.Lock()
+	defer b.outputMutex.Unlock()
+
+	output, refusal := b.scan(data)
+	if refusal != "" {
+		b.refuse(refusal)
+	}
+	if len(output) == 0 {
+		return nil
+	}
+	return b.wt.writeOutput(output)
+}
+
+// scan starts a session when data starts one and returns the output
+// to pass to the master, or why the session has been refused.
+func (b *zmodemBridge) scan(data []byte) (output []byte, refusal string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.session != nil {
+		b.session.port.feed(data)
+		return nil, ""
+	}
+	if b.closed {
+		return data, ""
+	}
+
+	kind, offset, start := b.detector.Scan(data)
+	if kind == zmodem.KindNone || !b.wt.PermitWrite() {
+		return data, ""
+	}
+
+	switch {
+	case kind == zmodem.KindReceive && !b.download:
+		return data, "downloading files with sz is not permitted"
+	case kind == zmodem.KindSend && !b.upload:
+		return data, "uploading files with rz is not permitted"
+	default:
+		b.start(kind, append(start, data[offset:]...))
+		return data[:offset], ""
+	}
+}
+
+// intercept takes the input of the master while a session runs,
+// canceling the session with Ctrl-C.
+func (b *zmodemBridge) intercept(input []byte) bool {
+	b.mutex.Lock()
+	session := b.session
+	b.mutex.Unlock()
+
+	if session == nil {
+		return false
+	}
+	if bytes.IndexByte(input, 0x03) >= 0 {
+		session.cancel()
+	}
+	return true
+}
+
+// handle routes a request of the master to the running session.
+func (b *zmodemBridge) handle(request *FileTransferRequest) error {
+	b.mutex.Lock()
+	session := b.session
+	b.mutex.Unlock()
+
+	if session == nil {
+		if request.Action == TransferCancel {
+			return nil
+		}
+		return b.wt.SendFileTransfer(&FileTransferEvent{
+			ID:     request.ID,
+			Action: TransferError,
+			Name:   request.Name,
+			Error:  "no ZMODEM transfer is running",
+		})
+	}
+	session.request(request)
+	return nil
+}
+
+// close cancels the running session and stops detecting new ones.
+func (b *zmodemBridge) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	if b.session != nil {
+		b.session.cancel()
+	}
+}
+
+func (b *zmodemBridge) start(kind zmodem.Kind, data []byte) {
+	stop := make(chan struct{})
+	session := &zmodemSession{
+		bridge:   b,
+		kind:     kind,
+		port:     newZmodemPort(b.wt.slave, stop),
+		requests: make(chan *FileTransferRequest, zmodemRequestQueueSize),
+		stop:     stop,
+	}
+	session.port.feed(data)
+	b.session = session
+
+	go session.run()
+}
+
+// end returns the terminal to the output of the slave after a session,
+// with the output following the session when it has finished cleanly.
+func (b *zmodemBridge) end(session *zmodemSession, keepRest bool) {
+	b.outputMutex.Lock()
+	defer b.outputMutex.Unlock()
+
+	b.mutex.Lock()
+	b.session = nil
+	b.detector.Reset()
+	rest := session.port.close()
+	b.mutex.Unlock()
+
+	if keepRest && len(rest) > 0 {
+		b.wt.writeOutput(rest)
+	}
+}
+
+func (b *zmodemBridge) nextID() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastID++
+	return fmt.Sprintf("%s%d", zmodemIDPrefix, b.lastID)
+}
+
+// refuse aborts rz or sz when its direction is not permitted.
+func (b *zmodemBridge) refuse(reason string) {
+	zmodem.Abort(b.wt.slave)
+	b.wt.SendNotice(NoticeMessage{Kind: "zmodem", Message: reason})
+}
+
+// zmodemSession runs rz or sz, or trz or tsz, until it finishes.
+type zmodemSession struct {
+	bridge      *zmodemBridge
+	kind        zmodem.Kind
+	port        *zmodemPort
+	requests    chan *FileTransferRequest
+	downloading atomic.Bool // the requests of the master only cancel the session
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (s *zmodemSession) run() {
+	download := &zmodemDownload{session: s}
+	upload := &zmodemUpload{session: s}
+	protocol := "ZMODEM"
+
+	var err error
+	switch s.kind {
+	case zmodem.KindReceive:
+		s.downloading.Store(true)
+		err = zmodem.Receive(s.port, download)
+	case zmodem.KindSend:
+		err = zmodem.Send(s.port, upload)
+	case zmodem.KindTrzsz:
+		protocol = "trzsz"
+		err = s.runTrzsz(download, upload)
+	}
+
+	if err != nil {
+		upload.abort(err)
+		// trz and tsz have been told about the failure by the session
+		if s.kind != zmodem.KindTrzsz {
+			zmodem.Abort(s.port)
+		}
+		if !s.stopped() {
+			s.bridge.wt.SendNotice(NoticeMessage{Kind: "zmodem", Message: protocol + " transfer failed: " + err.Error()})
+		}
+	}
+	s.bridge.end(s, err == nil)
+}
+
+// runTrzsz runs the transfer of trz or tsz, which is declined
+// when its direction is not permitted.
+func (s *zmodemSession) runTrzsz(download *zmodemDownload, upload *zmodemUpload) error {
+	trzsz, err := zmodem.StartTrzsz(s.port)
+	if err != nil {
+		return err
+	}
+
+	b := s.bridge
+	switch {
+	case trzsz.Mode == zmodem.TrzszDirectory:
+		b.wt.SendNotice(NoticeMessage{Kind: "zmodem", Message: "transferring directories with trz is not supported"})
+		return trzsz.Decline()
+	case trzsz.Mode == zmodem.TrzszReceive && !b.download:
+		b.wt.SendNotice(NoticeMessage{Kind: "zmodem", Message: "downloading files with tsz is not permitted"})
+		return trzsz.Decline()
+	case trzsz.Mode == zmodem.TrzszSend && !b.upload:
+		b.wt.SendNotice(NoticeMessage{Kind: "zmodem", Message: "uploading files with trz is not permitted"})
+		return trzsz.Decline()
+	case trzsz.Mode == zmodem.TrzszReceive:
+		s.downloading.Store(true)
+		return trzsz.Receive(download)
+	default:
+		return trzsz.Send(upload)
+	}
+}
+
+// request passes a request of the master to the session.
+// The requests of sz and tsz only cancel it, rz and trz read them for the content of files.
+func (s *zmodemSession) request(request *FileTransferRequest) {
+	if s.downloading.Load() {
+		if request.Action == TransferCancel {
+			s.cancel()
+		}
+		return
+	}
+
+	select {
+	case s.requests <- request:
+	default:
+		// the master has sent more than it was asked for
+		s.cancel()
+	}
+}
+
+// wait returns the next request of the master.
+func (s *zmodemSession) wait() (*FileTransferRequest, error) {
+	timer := time.NewTimer(zmodemWaitTimeout)
+	defer timer.Stop()
+
+	select {
+	case request := <-s.requests:
+		return request, nil
+	case <-s.stop:
+		return nil, errTransferCanceled
+	case <-timer.C:
+		return nil, errors.New("timed out waiting for the browser")
+	}
+}
+
+func (s *zmodemSession) cancel() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func (s *zmodemSession) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *zmodemSession) event(event *FileTransferEvent) {
+	s.bridge.wt.SendFileTransfer(event)
+}
+
+// finish reports the end of the transfer of a file to the master.
+func (s *zmodemSession) finish(id string, name string, err error) {
+	event := &FileTransferEvent{ID: id, Action: TransferComplete, Name: name}
+	switch {
+	case err == nil:
+	case err == errTransferCanceled || err == zmodem.ErrCanceled:
+		event.Action = TransferCanceled
+	case err == zmodem.ErrSkipped:
+		event.Action, event.Error = TransferError, "refused by rz, the file may exist already"
+	default:
+		event.Action, event.Error = TransferError, err.Error()
+	}
+	s.event(event)
+}
+
+// zmodemDownload passes the files sent by sz to the master.
+type zmodemDownload struct {
+	session     *zmodemSession
+	id          string
+	info        zmodem.FileInfo
+	buffer      []byte
+	transferred int64
+}
+
+func (d *zmodemDownload) Offer(info zmodem.FileInfo) (io.Writer, error) {
+	s := d.session
+	id := s.bridge.nextID()
+	if maxSize := s.bridge.maxSize; maxSize > 0 && info.Size > maxSize {
+		s.event(&FileTransferEvent{ID: id, Action: TransferError, Name: info.Name, Error: "file is too large"})
+		return nil, errors.New("file is too large")
+	}
+
+	d.id, d.info, d.buffer, d.transferred = id, info, d.buffer[:0], 0
+	s.event(&FileTransferEvent{ID: id, Action: TransferDownloadStart, Name: info.Name, Size: max(info.Size, 0)})
+	return d, nil
+}
+
+func (d *zmodemDownload) Write(p []byte) (int, error) {
+	d.transferred += int64(len(p))
+	if maxSize := d.session.bridge.maxSize; maxSize > 0 && d.transferred > maxSize {
+		return 0, errors.New("file is too large")
+	}
+
+	d.buffer = append(d.buffer, p...)
+	for len(d.buffer) >= FileTransferChunkSize {
+		d.send(d.buffer[:FileTransferChunkSize])
+		d.buffer = append(d.buffer[:0], d.buffer[FileTransferChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (d *zmodemDownload) Done(info zmodem.FileInfo, err error) {
+	if err == nil && len(d.buffer) > 0 {
+		d.send(d.buffer)
+		d.buffer = d.buffer[:0]
+	}
+	d.session.finish(d.id, info.Name, err)
+}
+
+func (d *zmodemDownload) send(data []byte) {
+	d.session.event(&FileTransferEvent{
+		ID:          d.id,
+		Action:      TransferData,
+		Name:        d.info.Name,
+		Size:        max(d.info.Size, 0),
+		Transferred: d.transferred - int64(len(d.buffer)) + int64(len(data)),
+		Data:        data,
+	})
+}
+
+// zmodemUpload gives rz or trz the files uploaded by the master.
+// rz reads each file before asking for the next one,
+// while trz has to know all of them before reading any.
+type zmodemUpload struct {
+	session *zmodemSession
+	files   []*zmodemUploadFile // given to rz or trz and not done yet
+}
+
+// Next asks the master for a file, which ends the session when canceled.
+func (u *zmodemUpload) Next() (zmodem.FileInfo, io.Reader, error) {
+	s := u.session
+	id := s.bridge.nextID()
+	s.event(&FileTransferEvent{ID: id, Action: TransferUploadRequest})
+
+	for {
+		request, err := s.wait()
+		if err != nil {
+			return zmodem.FileInfo{}, nil, err
+		}
+		if request.ID != id {
+			continue
+		}
+
+		switch request.Action {
+		case TransferCancel:
+			return zmodem.FileInfo{}, nil, io.EOF
+
+		case TransferUploadStart:
+			name := path.Base(strings.ReplaceAll(request.Name, "\\", "/"))
+			if maxSize := s.bridge.maxSize; maxSize > 0 && request.Size > maxSize {
+				s.event(&FileTransferEvent{ID: id, Action: TransferError, Name: name, Error: "file is too large"})
+				id = s.bridge.nextID()
+				s.event(&FileTransferEvent{ID: id, Action: TransferUploadRequest})
+				continue
+			}
+
+			file := &zmodemUploadFile{upload: u, id: id, name: name, size: request.Size}
+			u.files = append(u.files, file)
+			info := zmodem.FileInfo{Name: name, Size: request.Size, ModTime: time.Now(), Mode: 0644}
+			return info, file, nil
+		}
+	}
+}
+
+func (u *zmodemUpload) Done(info zmodem.FileInfo, err error) {
+	file := u.files[0]
+	u.files = u.files[1:]
+	u.session.finish(file.id, info.Name, err)
+}
+
+// abort reports the files which have not been done when the session has failed.
+func (u *zmodemUpload) abort(err error) {
+	for _, file := range u.files {
+		u.session.finish(file.id, file.name, err)
+	}
+	u.files = nil
+}
+
+// owns tells whether id is of a file given to rz or trz.
+func (u *zmodemUpload) owns(id string) bool {
+	for _, file := range u.files {
+		if file.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// zmodemUploadFile reads a file uploaded by the master.
+type zmodemUploadFile struct {
+	upload      *zmodemUpload
+	id          string
+	name        string
+	size        int64
+	transferred int64
+	chunk       []byte
+	started     bool
+	ended       bool
+}
+
+// Read returns the chunks of the master, reporting progress
+// before the first one and after each one so that the master sends more.
+func (f *zmodemUploadFile) Read(p []byte) (int, error) {
+	s := f.upload.session
+	if !f.started {
+		f.started = true
+		s.event(&FileTransferEvent{ID: f.id, Action: TransferProgress, Name: f.name, Size: f.size})
+	}
+
+	for len(f.chunk) == 0 {
+		if f.ended {
+			return 0, io.EOF
+		}
+
+		request, err := s.wait()
+		if err != nil {
+			return 0, err
+		}
+		if request.ID != f.id {
+			// canceling any of the files given to trz cancels the session
+			if request.Action == TransferCancel && f.upload.owns(request.ID) {
+				return 0, errTransferCanceled
+			}
+			continue
+		}
+
+		switch request.Action {
+		case TransferUploadChunk:
+			f.transferred += int64(len(request.Data))
+			if f.transferred > f.size {
+				return 0, errors.New("received more data than the file size")
+			}
+			f.chunk = request.Data
+		case TransferUploadEnd:
+			f.ended = true
+		case TransferCancel:
+			return 0, errTransferCanceled
+		}
+	}
+
+	n := copy(p, f.chunk)
+	f.chunk = f.chunk[n:]
+	if len(f.chunk) == 0 {
+		s.event(&FileTransferEvent{ID: f.id, Action: TransferProgress, Name: f.name, Size: f.size, Transferred: f.transferred})
+	}
+	return n, nil
+}
+
+// zmodemPort connects a session to the slave.
+// The bridge feeds the output of the slave while the session reads it.
+type zmodemPort struct {
+	slave Slave
+	stop  <-chan struct{}
+
+	mutex  sync.Mutex
+	buffer []byte
+	pos    int
+	closed bool
+	signal chan struct{}
+}
+
+func newZmodemPort(slave Slave, stop <-chan struct{}) *zmodemPort {
+	return &zmodemPort{
+		slave:  slave,
+		stop:   stop,
+		signal: make(chan struct{}, 1),
+	}
+}
+
+func (p *zmodemPort) feed(data []byte) {
+	p.mutex.Lock()
+	// keep the last byte read for UnreadByte
+	if p.pos > 1 {
+		p.buffer = append(p.buffer[:0], p.buffer[p.pos-1:]...)
+		p.pos = 1
+	}
+	p.buffer = append(p.buffer, data...)
+	p.mutex.Unlock()
+
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (p *zmodemPort) ReadByteTimeout(timeout time.Duration) (byte, error) {
+	var expired <-chan time.Time
+	for {
+		p.mutex.Lock()
+		if p.pos < len(p.buffer) {
+			c := p.buffer[p.pos]
+			p.pos++
+			p.mutex.Unlock()
+			return c, nil
+		}
+		closed := p.closed
+		p.mutex.Unlock()
+
+		if closed {
+			return 0, io.EOF
+		}
+		if timeout <= 0 {
+			return 0, zmodem.ErrTimeout
+		}
+		if expired == nil {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		select {
+		case <-p.signal:
+		case <-expired:
+			return 0, zmodem.ErrTimeout
+		case <-p.stop:
+			return 0, errTransferCanceled
+		}
+	}
+}
+
+func (p *zmodemPort) UnreadByte() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.pos == 0 {
+		return errors.New("no byte to unread")
+	}
+	p.pos--
+	return nil
+}
+
+func (p *zmodemPort) Write(data []byte) (int, error) {
+	return p.slave.Write(data)
+}
+
+// close stops the port and returns the output which has not been read.
+func (p *zmodemPort) close() []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+	return append([]byte{}, p.buffer[p.pos:]...)
+}
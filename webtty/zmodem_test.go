@@ -0,0 +1,386 @@
+package webtty
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yudai/gotty/pkg/zmodem"
+)
+
+// programPort is the end of sz running in the slave.
+type programPort struct {
+	in     chan byte
+	out    io.Writer
+	last   byte
+	unread bool
+}
+
+func newProgramPort(in io.Reader, out io.Writer) *programPort {
+	port := &programPort{in: make(chan byte, 1<<16), out: out}
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, err := in.Read(buffer)
+			if err != nil {
+				return
+			}
+			for _, c := range buffer[:n] {
+				port.in <- c
+			}
+		}
+	}()
+	return port
+}
+
+func (p *programPort) ReadByteTimeout(timeout time.Duration) (byte, error) {
+	if p.unread {
+		p.unread = false
+		return p.last, nil
+	}
+	select {
+	case p.last = <-p.in:
+		return p.last, nil
+	case <-time.After(timeout):
+		return 0, zmodem.ErrTimeout
+	}
+}
+
+func (p *programPort) UnreadByte() error {
+	p.unread = true
+	return nil
+}
+
+func (p *programPort) Write(data []byte) (int, error) {
+	return p.out.Write(data)
+}
+
+type programFiles struct {
+	content []byte
+	done    error
+	sent    bool
+}
+
+func (f *programFiles) Next() (zmodem.FileInfo, io.Reader, error) {
+	if f.sent {
+		return zmodem.FileInfo{}, nil, io.EOF
+	}
+	f.sent = true
+	return zmodem.FileInfo{Name: "foo.bin", Size: int64(len(f.content))}, bytes.NewReader(f.content), nil
+}
+
+func (f *programFiles) Done(info zmodem.FileInfo, err error) {
+	f.done = err
+}
+
+func TestZmodemDownload(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe() // in to conn
+	connOutPipeReader, _ := io.Pipe()               // out from conn
+
+	conn := pipePair{
+		connOutPipeReader,
+		connInPipeWriter,
+	}
+
+	slave, slaveOut, slaveIn := newPipeSlave()
+	dt, err := New(conn, slave, WithPermitWrite(), WithBinaryProtocol(), WithZmodem(true, true, 0))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	cancel, wg := runWebTTY(t, dt)
+
+	content := make([]byte, 40000)
+	rand.New(rand.NewSource(1)).Read(content)
+	files := &programFiles{content: content}
+	go func() {
+		// sz starts with ZRQINIT
+		slaveOut.Write([]byte("rz\r**\x18B00000000000000\r\x8a\x11"))
+		zmodem.Send(newProgramPort(slaveIn, slaveOut), files)
+		slaveOut.Write([]byte("$ "))
+	}()
+
+	var (
+		output   []byte
+		received []byte
+		events   []string
+	)
+	buf := make([]byte, 128*1024)
+	for !bytes.HasSuffix(output, []byte("$ ")) {
+		n := readSkippingTitle(t, connInPipeReader, buf)
+		switch buf[0] {
+		case Output:
+			output = append(output, buf[1:n]...)
+		case FileTransfer:
+			var event FileTransferEvent
+			if err := json.Unmarshal(buf[1:n], &event); err != nil {
+				t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+			}
+			if event.ID != "zmodem-1" || event.Name != "foo.bin" {
+				t.Fatalf("Unexpected event: %+v", event)
+			}
+			events = append(events, event.Action)
+			received = append(received, event.Data...)
+		}
+	}
+
+	if string(output) != "rz\r$ " {
+		t.Fatalf("Unexpected output: %q", output)
+	}
+	expected := []string{TransferDownloadStart, TransferData, TransferData, TransferComplete}
+	if len(events) != len(expected) {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("Unexpected events: %v", events)
+		}
+	}
+	if !bytes.Equal(received, content) || files.done != nil {
+		t.Fatalf("Unexpected content received: %d bytes, %v", len(received), files.done)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+type programReceiver struct {
+	content bytes.Buffer
+	info    zmodem.FileInfo
+	done    error
+}
+
+func (r *programReceiver) Offer(info zmodem.FileInfo) (io.Writer, error) {
+	r.info = info
+	return &r.content, nil
+}
+
+func (r *programReceiver) Done(info zmodem.FileInfo, err error) {
+	r.done = err
+}
+
+func TestZmodemUpload(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe()   // in to conn
+	connOutPipeReader, connOutPipeWriter := io.Pipe() // out from conn
+
+	conn := pipePair{
+		connOutPipeReader,
+		connInPipeWriter,
+	}
+
+	slave, slaveOut, slaveIn := newPipeSlave()
+	dt, err := New(conn, slave, WithPermitWrite(), WithBinaryProtocol(), WithZmodem(true, true, 0))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	cancel, wg := runWebTTY(t, dt)
+
+	content := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(content)
+	receiver := &programReceiver{}
+	go func() {
+		// rz starts with ZRINIT
+		slaveOut.Write([]byte("rz\r**\x18B0100000023be50\r\x8a\x11"))
+		zmodem.Receive(newProgramPort(slaveIn, slaveOut), receiver)
+		slaveOut.Write([]byte("$ "))
+	}()
+
+	requests := make(chan FileTransferRequest, 16)
+	go func() {
+		for request := range requests {
+			payload, _ := json.Marshal(request)
+			connOutPipeWriter.Write(append([]byte{RequestFileTransfer}, payload...))
+		}
+	}()
+	defer close(requests)
+
+	// the master uploads a file in chunks, each one once the previous one has been acknowledged
+	var (
+		output   []byte
+		events   []string
+		sent     int
+		uploadID string
+	)
+	buf := make([]byte, 128*1024)
+	for !bytes.HasSuffix(output, []byte("$ ")) {
+		n := readSkippingTitle(t, connInPipeReader, buf)
+		switch buf[0] {
+		case Output:
+			output = append(output, buf[1:n]...)
+		case FileTransfer:
+			var event FileTransferEvent
+			if err := json.Unmarshal(buf[1:n], &event); err != nil {
+				t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+			}
+			events = append(events, event.Action)
+
+			switch {
+			case event.Action == TransferUploadRequest && uploadID == "":
+				uploadID = event.ID
+				requests <- FileTransferRequest{ID: event.ID, Action: TransferUploadStart, Name: "foo.bin", Size: int64(len(content))}
+			case event.Action == TransferUploadRequest:
+				requests <- FileTransferRequest{ID: event.ID, Action: TransferCancel}
+			case event.Action == TransferProgress && sent < len(content):
+				chunk := content[sent:min(sent+1000, len(content))]
+				sent += len(chunk)
+				requests <- FileTransferRequest{ID: event.ID, Action: TransferUploadChunk, Data: chunk}
+			case event.Action == TransferProgress && int(event.Transferred) == len(content):
+				requests <- FileTransferRequest{ID: event.ID, Action: TransferUploadEnd}
+			}
+		}
+	}
+
+	if events[len(events)-2] != TransferComplete {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+	if !bytes.Equal(receiver.content.Bytes(), content) || receiver.info.Name != "foo.bin" || receiver.done != nil {
+		t.Fatalf("Unexpected content received by rz: %d bytes, %v", receiver.content.Len(), receiver.done)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestTrzszNotPermitted(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe() // in to conn
+	connOutPipeReader, _ := io.Pipe()               // out from conn
+
+	conn := pipePair{
+		connOutPipeReader,
+		connInPipeWriter,
+	}
+
+	slave, slaveOut, slaveIn := newPipeSlave()
+	dt, err := New(conn, slave, WithPermitWrite(), WithBinaryProtocol(), WithZmodem(false, true, 0))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	cancel, wg := runWebTTY(t, dt)
+
+	go slaveOut.Write([]byte("$ trz\r\n\x1b7\x07::TRZSZ:TRANSFER:R:1.1.6:1234\r\n"))
+
+	// trz is told that the transfer has been declined
+	answer := make(chan string)
+	go func() {
+		in := make([]byte, 1024)
+		n, _ := slaveIn.Read(in)
+		answer <- string(in[:n])
+	}()
+
+	buf := make([]byte, 1024)
+	for {
+		n := readSkippingTitle(t, connInPipeReader, buf)
+		if buf[0] == Notice {
+			if !bytes.Contains(buf[1:n], []byte("uploading files with trz is not permitted")) {
+				t.Fatalf("Unexpected notice: %s", buf[1:n])
+			}
+			break
+		}
+	}
+	if line := <-answer; !strings.HasPrefix(line, "#ACT:") || !strings.HasSuffix(line, "\n") {
+		t.Fatalf("Unexpected answer to trz: %q", line)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestZmodemPausedOutput(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe()   // in to conn
+	connOutPipeReader, connOutPipeWriter := io.Pipe() // out from conn
+
+	conn := pipePair{
+		connOutPipeReader,
+		connInPipeWriter,
+	}
+
+	slave, slaveOut, slaveIn := newPipeSlave()
+	dt, err := New(conn, slave, WithPermitWrite(), WithBinaryProtocol(), WithZmodem(true, true, 0), WithOutputQueue(8, OutputQueueBlock))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	cancel, wg := runWebTTY(t, dt)
+
+	messages := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := connInPipeReader.Read(buf)
+			if err != nil {
+				return
+			}
+			messages <- append([]byte{}, buf[:n]...)
+		}
+	}()
+
+	input := make(chan string)
+	go func() {
+		in := make([]byte, 1024)
+		for {
+			n, err := slaveIn.Read(in)
+			if err != nil {
+				return
+			}
+			input <- string(in[:n])
+		}
+	}()
+	receiveInput := func(expected string) {
+		select {
+		case in := <-input:
+			if in != expected {
+				t.Fatalf("Unexpected input received by the slave: %q", in)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("The input of the master was blocked by the paused output")
+		}
+	}
+
+	// the input is handled after the pause
+	connOutPipeWriter.Write([]byte{PauseOutput})
+	connOutPipeWriter.Write([]byte{Input, 'a'})
+	receiveInput("a")
+
+	// the second line waits for the paused master
+	written := make(chan struct{})
+	go func() {
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(slaveOut, "line %d\r\n", i)
+			if i == 1 {
+				close(written)
+			}
+		}
+	}()
+	<-written
+	// let the output reach the full queue
+	time.Sleep(100 * time.Millisecond)
+
+	connOutPipeWriter.Write([]byte{Input, 'b'})
+	receiveInput("b")
+	connOutPipeWriter.Write([]byte{ResumeOutput})
+
+	var output []byte
+	for !bytes.HasSuffix(output, []byte("line 3\r\n")) {
+		select {
+		case message := <-messages:
+			if message[0] == Output {
+				output = append(output, message[1:]...)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Unexpected output after resuming: %q", output)
+		}
+	}
+	if string(output) != "line 0\r\nline 1\r\nline 2\r\nline 3\r\n" {
+		t.Fatalf("Unexpected output after resuming: %q", output)
+	}
+
+	cancel()
+	wg.Wait()
+}